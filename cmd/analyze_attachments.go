@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/quotedprintable"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	attachmentAnalysisConnectionsLimit = 5
+	attachmentAnalysisFetchBatchSize   = 500
+)
+
+// attachmentPart is an attachment of a single message, as described by the message's body structure.
+type attachmentPart struct {
+	uid      uint32
+	path     []int
+	filename string
+	encoding string
+	size     uint32
+}
+
+// duplicateAttachment is a group of attachments sharing the same (decoded) content.
+type duplicateAttachment struct {
+	hash     string
+	filename string
+	size     int64
+	uids     []uint32
+}
+
+// wastedBytes returns the number of bytes used by all copies of the attachment beyond the first one.
+func (d *duplicateAttachment) wastedBytes() int64 {
+	return d.size * int64(len(d.uids)-1)
+}
+
+func runAnalyzeAttachments(args []string) int {
+	fs := flag.NewFlagSet("analyze-attachments", flag.ContinueOnError)
+	mailbox := fs.String("mailbox", "", "Mailbox to scan for attachments (defaults to $ATTACHMENTS_MAILBOX, or to all messages)")
+	minSize := fs.Uint("min-size", 100*1024, "Ignore attachments smaller than this many (encoded) bytes (defaults to $ATTACHMENTS_MIN_SIZE)")
+	minCount := fs.Int("min-count", 2, "Only report attachments appearing on at least this many messages (defaults to $ATTACHMENTS_MIN_COUNT)")
+	top := fs.Int("top", 50, "Number of duplicate attachments to report (0 for all; defaults to $ATTACHMENTS_TOP)")
+	if !parseFlags(fs, args, map[string]string{"mailbox": "ATTACHMENTS_MAILBOX", "min-size": "ATTACHMENTS_MIN_SIZE", "min-count": "ATTACHMENTS_MIN_COUNT", "top": "ATTACHMENTS_TOP"}) {
+		return exitUsage
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	sourceGmail, err := newGmailFromEnv("SOURCE", 1, attachmentAnalysisConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(sourceGmail)
+	if *mailbox == "" {
+		*mailbox = sourceGmail.DefaultMailbox()
+	}
+
+	duplicates, err := findDuplicateAttachments(ctx, sourceGmail, *mailbox, uint32(*minSize), max(2, *minCount))
+	if err != nil {
+		slog.Error("Attachment analysis failed", "err", err)
+		return exitCodeOf(err)
+	}
+
+	var totalWasted int64
+	for _, d := range duplicates {
+		totalWasted += d.wastedBytes()
+	}
+	if *top > 0 && len(duplicates) > *top {
+		duplicates = duplicates[:*top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SHA256\tFILENAME\tSIZE\tMESSAGES\tWASTED")
+	for _, d := range duplicates {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", d.hash[:16], d.filename, d.size, len(d.uids), d.wastedBytes())
+	}
+	_ = w.Flush()
+	fmt.Printf("\nTotal wasted bytes: %d\n", totalWasted)
+	return exitOK
+}
+
+// findDuplicateAttachments scans the given mailbox for attachments whose content appears on multiple messages, and
+// returns them sorted by wasted bytes (descending). To avoid downloading every attachment in the account, only
+// attachments whose encoded size collides with that of enough other attachments are downloaded and hashed.
+func findDuplicateAttachments(ctx context.Context, g *gcp.Gmail, mailbox string, minSize uint32, minCount int) ([]*duplicateAttachment, error) {
+	// Collect candidate attachments from body structures, grouped by encoded size
+	candidates := make(map[uint32][]*attachmentPart)
+	opts := gcp.IterateOptions{
+		Items:    []imap.FetchItem{imap.FetchBodyStructure},
+		PageSize: attachmentAnalysisFetchBatchSize,
+		Matched: func(n int) {
+			slog.Info("Scanning message structures", "mailbox", mailbox, "messages", n)
+		},
+	}
+	for msg, err := range g.Iterate(ctx, mailbox, opts) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch body structures: %w", err)
+		} else if msg.BodyStructure == nil {
+			continue
+		}
+		msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+			if len(part.Parts) > 0 || part.Size < minSize {
+				return true
+			}
+			filename, _ := part.Filename()
+			if filename == "" && !strings.EqualFold(part.Disposition, "attachment") {
+				return true
+			}
+			candidates[part.Size] = append(candidates[part.Size], &attachmentPart{
+				uid:      msg.Uid,
+				path:     slices.Clone(path),
+				filename: filename,
+				encoding: part.Encoding,
+				size:     part.Size,
+			})
+			return true
+		})
+	}
+
+	// Hash attachments that share their size with enough other attachments
+	groups := make(map[string]*duplicateAttachment)
+	for _, parts := range candidates {
+		if len(parts) < minCount {
+			continue
+		}
+		for _, part := range parts {
+			hash, size, err := hashAttachment(ctx, g, mailbox, part)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash attachment '%s' of message '%d': %w", part.filename, part.uid, err)
+			}
+			group, ok := groups[hash]
+			if !ok {
+				group = &duplicateAttachment{hash: hash, filename: part.filename, size: size}
+				groups[hash] = group
+			}
+			if !slices.Contains(group.uids, part.uid) {
+				group.uids = append(group.uids, part.uid)
+			}
+		}
+	}
+
+	var duplicates []*duplicateAttachment
+	for _, group := range groups {
+		if len(group.uids) >= minCount {
+			duplicates = append(duplicates, group)
+		}
+	}
+	slices.SortFunc(duplicates, func(a, b *duplicateAttachment) int {
+		return cmp.Compare(b.wastedBytes(), a.wastedBytes())
+	})
+	return duplicates, nil
+}
+
+// hashAttachment downloads the given attachment, and returns the SHA-256 and size of its decoded content.
+func hashAttachment(ctx context.Context, g *gcp.Gmail, mailbox string, part *attachmentPart) (string, int64, error) {
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: part.path}, Peek: true}
+	msg, err := g.FetchMessageByUID(ctx, mailbox, part.uid, section.FetchItem())
+	if err != nil {
+		return "", 0, err
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return "", 0, fmt.Errorf("server did not provide attachment content")
+	}
+
+	var r io.Reader = literal
+	switch strings.ToLower(part.encoding) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decode attachment content: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/backup"
+	"github.com/arikkfir-org/gmail-organizer/internal/compress"
+)
+
+const backupConnectionsLimit = 2
+
+func runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	bucket := fs.String("bucket", "", "Bucket to back up into (defaults to $BACKUP_BUCKET)")
+	prefix := fs.String("prefix", "", "Object name prefix in the bucket (defaults to $BACKUP_PREFIX, or the source account username)")
+	mailbox := fs.String("mailbox", "", "Mailbox to back up (defaults to all messages)")
+	full := fs.Bool("full", false, "Back up all messages, rather than only those added since the previous backup")
+	if !parseFlags(fs, args, map[string]string{"bucket": "BACKUP_BUCKET", "prefix": "BACKUP_PREFIX"}) {
+		return exitUsage
+	} else if *bucket == "" {
+		slog.Error("The -bucket flag (or BACKUP_BUCKET environment variable) is required")
+		return exitUsage
+	}
+	account := os.Getenv("SOURCE_ACCOUNT_USERNAME")
+	if *prefix == "" {
+		*prefix = account
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	sourceGmail, err := newGmailFromEnv("SOURCE", 1, backupConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(sourceGmail)
+	if *mailbox == "" {
+		*mailbox = sourceGmail.DefaultMailbox()
+	}
+
+	b, err := openBackupStorage(ctx, *bucket)
+	if err != nil {
+		slog.Error("Failed to open backup bucket", "err", err, "bucket", *bucket)
+		return exitCodeOf(err)
+	}
+	defer b.Close()
+
+	manifest, err := backup.Backup(ctx, sourceGmail, b, *prefix, account, *mailbox, *full)
+	if err != nil {
+		slog.Error("Backup failed", "err", err)
+		return exitCodeOf(err)
+	}
+	summary.Count("messages", uint64(len(manifest.Entries)))
+	slog.Info("Backup completed",
+		"mailbox", manifest.Mailbox,
+		"incremental", manifest.Incremental,
+		"messages", len(manifest.Entries),
+		"uidValidity", manifest.UIDValidity,
+		"lastUID", manifest.LastUID,
+		"storedBytes", b.Stats().Compressed(),
+		"compressionRatio", fmt.Sprintf("%.2f", b.Stats().Ratio()))
+	return exitOK
+}
+
+// openBackupStorage opens the given bucket in the backup storage selected by the BACKUP_STORAGE environment variable
+// (see openBackupBucket). Objects are compressed with the algorithm given by BACKUP_COMPRESSION ("none", "gzip" or
+// "zstd"), and decompressed transparently regardless of it. If BACKUP_ENCRYPTION_KEY (a base64-encoded AES-256 key) or
+// BACKUP_ENCRYPTION_KMS_KEY (a Cloud KMS key resource name) is set, objects are also encrypted on the client side.
+func openBackupStorage(ctx context.Context, bucket string) (*backup.CompressedStorage, error) {
+	algorithm, err := compress.ParseAlgorithm(os.Getenv("BACKUP_COMPRESSION"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BACKUP_COMPRESSION: %w", err)
+	}
+	s, err := openEncryptedBackupStorage(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return backup.NewCompressedStorage(s, algorithm), nil
+}
+
+// openEncryptedBackupStorage opens the given bucket (see openBackupBucket), encrypting its objects if configured to.
+func openEncryptedBackupStorage(ctx context.Context, bucket string) (backup.Storage, error) {
+	key, kmsKey := os.Getenv("BACKUP_ENCRYPTION_KEY"), os.Getenv("BACKUP_ENCRYPTION_KMS_KEY")
+	if key != "" && kmsKey != "" {
+		return nil, fmt.Errorf("only one of BACKUP_ENCRYPTION_KEY and BACKUP_ENCRYPTION_KMS_KEY may be set")
+	}
+
+	s, err := openBackupBucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	var encrypted backup.Storage
+	switch {
+	case key != "":
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(key); err != nil {
+			err = fmt.Errorf("invalid BACKUP_ENCRYPTION_KEY: %w", err)
+		} else {
+			encrypted, err = backup.NewKeyEncryptedStorage(s, b)
+		}
+	case kmsKey != "":
+		var wrapper *backup.CloudKMSKeyWrapper
+		if wrapper, err = backup.NewCloudKMSKeyWrapper(ctx, kmsKey); err == nil {
+			if encrypted, err = backup.NewWrappedKeyEncryptedStorage(ctx, s, wrapper); err != nil {
+				_ = wrapper.Close()
+			}
+		}
+	default:
+		return s, nil
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// openBackupBucket opens the given bucket in the backup storage selected by the BACKUP_STORAGE environment variable:
+// "gcs" (the default) for Google Cloud Storage, or "s3" for an S3-compatible store configured by the BACKUP_S3_*
+// environment variables.
+func openBackupBucket(ctx context.Context, bucket string) (backup.Storage, error) {
+	switch storage := os.Getenv("BACKUP_STORAGE"); storage {
+	case "", "gcs":
+		return backup.NewGCSBucket(ctx, bucket)
+	case "s3":
+		endpoint := os.Getenv("BACKUP_S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "s3.amazonaws.com"
+		}
+		return backup.NewS3Bucket(backup.S3Config{
+			Endpoint:        endpoint,
+			Region:          os.Getenv("BACKUP_S3_REGION"),
+			AccessKeyID:     os.Getenv("BACKUP_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("BACKUP_S3_SECRET_ACCESS_KEY"),
+			Insecure:        lookupEnvBool("BACKUP_S3_INSECURE", false),
+			PathStyle:       lookupEnvBool("BACKUP_S3_PATH_STYLE", false),
+		}, bucket)
+	default:
+		return nil, fmt.Errorf("unknown backup storage '%s' (expected 'gcs' or 's3')", storage)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	cleanupConnectionsLimit = 2
+	cleanupBatchSize        = 500
+	cleanupPreviewSize      = 20
+
+	cleanupActionDelete  = "delete"
+	cleanupActionArchive = "archive"
+)
+
+func runCleanup(args []string) int {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	query := fs.String("query", "", "Clean up messages matching this Gmail search query (e.g. 'category:promotions older_than:1y'; defaults to $CLEANUP_QUERY)")
+	rulesPath := fs.String("rules", "", "Clean up messages matching the conditions of any of the rules in this YAML rules file (their actions are ignored; defaults to $CLEANUP_RULES_PATH)")
+	mailbox := fs.String("mailbox", "", "Mailbox to search with -query (defaults to $CLEANUP_MAILBOX, or to all messages)")
+	account := fs.String("account", "source", "Account to clean up: 'source' or 'target' (configured by the corresponding environment variables; defaults to $CLEANUP_ACCOUNT)")
+	action := fs.String("action", cleanupActionDelete, "What to do with matching messages: 'delete' (flag as deleted & expunge) or 'archive' (defaults to $CLEANUP_ACTION)")
+	maxDelete := fs.Int("max-delete", 1000, "Refuse to clean up more than this many messages (defaults to $CLEANUP_MAX_DELETE)")
+	confirm := fs.String("confirm", "", "Confirmation token printed by a preview run; without it, only a preview is shown")
+	if !parseFlags(fs, args, map[string]string{"query": "CLEANUP_QUERY", "rules": "CLEANUP_RULES_PATH", "mailbox": "CLEANUP_MAILBOX", "account": "CLEANUP_ACCOUNT", "action": "CLEANUP_ACTION", "max-delete": "CLEANUP_MAX_DELETE"}) {
+		return exitUsage
+	} else if (*query == "") == (*rulesPath == "") {
+		slog.Error("Exactly one of the -query and -rules flags is required")
+		return exitUsage
+	} else if *action != cleanupActionDelete && *action != cleanupActionArchive {
+		slog.Error("The -action flag must be 'delete' or 'archive'", "action", *action)
+		return exitUsage
+	} else if *account != "source" && *account != "target" {
+		slog.Error("The -account flag must be 'source' or 'target'", "account", *account)
+		return exitUsage
+	} else if *maxDelete < 1 {
+		slog.Error("The -max-delete flag must be positive", "maxDelete", *maxDelete)
+		return exitUsage
+	}
+
+	var rules []rule
+	if *rulesPath != "" {
+		f, err := loadRules(*rulesPath)
+		if err != nil {
+			slog.Error("Failed to load rules", "err", err)
+			return exitCodeOf(err)
+		}
+		rules = f.Rules
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	g, err := newGmailFromEnv(strings.ToUpper(*account), 1, cleanupConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create Gmail connection", "err", err, "account", *account)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(g)
+	if *action == cleanupActionArchive && !g.GmailExtensions() {
+		slog.Error("Archiving requires Gmail extensions")
+		return exitFailure
+	}
+	if *mailbox == "" {
+		*mailbox = g.DefaultMailbox()
+	}
+
+	// Find matching messages, by mailbox
+	matches := make(map[string][]uint32)
+	if *query != "" {
+		uids, err := findMessagesToExport(ctx, g, *mailbox, *query, imap.NewSearchCriteria())
+		if err != nil {
+			slog.Error("Failed to find matching messages", "err", err)
+			return exitCodeOf(err)
+		}
+		matches[*mailbox] = uids
+	}
+	// Since the confirmation token covers the matching messages, rule ages are evaluated at day granularity, so that
+	// a confirmed run matches the same messages as its preview (IMAP date searches ignore the time of day anyway)
+	now := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, r := range rules {
+		uids, err := findMessagesToExport(ctx, g, r.Mailbox, r.Match.Query, r.Match.criteria(now))
+		if err != nil {
+			slog.Error("Failed to find messages matching rule", "err", err, "rule", r.Name)
+			return exitCodeOf(err)
+		}
+		matches[r.Mailbox] = append(matches[r.Mailbox], uids...)
+	}
+	total := 0
+	for name, uids := range matches {
+		slices.Sort(uids)
+		matches[name] = slices.Compact(uids)
+		total += len(matches[name])
+	}
+	token := cleanupToken(*account, *action, matches)
+
+	if *confirm == "" {
+		if err := previewCleanup(ctx, g, matches); err != nil {
+			slog.Error("Failed to preview messages", "err", err)
+			return exitCodeOf(err)
+		}
+		fmt.Printf("\n%d messages would be %sd", total, *action)
+		if total > *maxDelete {
+			fmt.Printf(", which exceeds the -max-delete limit of %d\n", *maxDelete)
+			return exitFailure
+		} else if total > 0 {
+			fmt.Printf("; to proceed, re-run with: -confirm %s\n", token)
+		} else {
+			fmt.Println()
+		}
+		return exitOK
+	} else if *confirm != token {
+		slog.Error("Confirmation token does not match the messages to clean up; the matching messages may have changed since the preview, run it again", "messages", total)
+		return exitFailure
+	} else if total > *maxDelete {
+		slog.Error("Refusing to clean up more messages than the -max-delete limit", "messages", total, "maxDelete", *maxDelete)
+		return exitFailure
+	}
+
+	cleaned := 0
+	for _, name := range slices.Sorted(maps.Keys(matches)) {
+		for chunk := range slices.Chunk(matches[name], cleanupBatchSize) {
+			if *action == cleanupActionDelete {
+				err = g.DeleteByUID(ctx, name, chunk)
+			} else {
+				err = g.WithSession(ctx, name, func(sess *gcp.Session) error {
+					return sess.Store(chunk, "-"+gcp.GmailLabelsExt+".SILENT", []any{`\Inbox`})
+				})
+			}
+			if err != nil {
+				slog.Error("Failed to clean up messages", "err", err, "mailbox", name, "cleaned", cleaned, "total", total)
+				return exitCodeOf(err)
+			}
+			cleaned += len(chunk)
+			slog.Info("Cleaned up messages", "action", *action, "mailbox", name, "cleaned", cleaned, "total", total)
+		}
+	}
+	summary.Count(*action+"d", uint64(cleaned))
+	slog.Info("Cleanup completed", "action", *action, "messages", cleaned)
+	return exitOK
+}
+
+// cleanupToken returns a short token identifying the given action on the given messages, so that a cleanup can only
+// be confirmed for exactly the messages shown by its preview.
+func cleanupToken(account, action string, matches map[string][]uint32) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n%s\n", account, action)
+	for _, name := range slices.Sorted(maps.Keys(matches)) {
+		_, _ = fmt.Fprintf(h, "%s\n", name)
+		for _, uid := range matches[name] {
+			_ = binary.Write(h, binary.BigEndian, uid)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// previewCleanup prints the number of matching messages in each mailbox, along with a sample of them.
+func previewCleanup(ctx context.Context, g *gcp.Gmail, matches map[string][]uint32) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, name := range slices.Sorted(maps.Keys(matches)) {
+		uids := matches[name]
+		_, _ = fmt.Fprintf(w, "%s: %d messages\n", name, len(uids))
+		if len(uids) == 0 {
+			continue
+		}
+		// Show the most recent messages
+		sample := uids[max(0, len(uids)-cleanupPreviewSize):]
+		messages, err := g.FetchByUIDs(ctx, name, sample, imap.FetchEnvelope)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(w, "  DATE\tFROM\tSUBJECT")
+		for _, msg := range messages {
+			if msg.Envelope == nil {
+				continue
+			}
+			from := ""
+			if len(msg.Envelope.From) > 0 {
+				from = msg.Envelope.From[0].Address()
+			}
+			_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", msg.Envelope.Date.Format("2006-01-02"), from, msg.Envelope.Subject)
+		}
+		if len(uids) > len(sample) {
+			_, _ = fmt.Fprintf(w, "  ... and %d more\n", len(uids)-len(sample))
+		}
+	}
+	return w.Flush()
+}
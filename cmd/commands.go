@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// command is a subcommand of the binary. Commands parse their own flags (see parseFlags), since flags fall back to
+// environment variables, so Cobra only dispatches to them, and provides help & shell completion.
+type command struct {
+	name    string
+	summary string
+	// subcommands are the names of the command's own subcommands, for shell completion.
+	subcommands []string
+	run         func(args []string) int
+	// noSummary skips emitting a run summary (e.g. for informational commands).
+	noSummary bool
+}
+
+// commands are the subcommands of the binary, in the order they are listed in the help.
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "migrate", summary: "Migrate all messages from the source account to the target account (the default)", run: runJob},
+		{name: "serve", summary: "Serve a REST API for starting, monitoring & pausing migrations between any accounts", run: runServe},
+		{name: "orchestrate", summary: "Migrate many account pairs listed in a file, a few at a time", run: runOrchestrate},
+		{name: "diff", summary: "Compare the labels & messages of the source and target accounts", run: runDiff},
+		{name: "mappings", summary: "Preview the target label of every source label & keyword", subcommands: []string{"preview"}, run: runMappings},
+		{name: "sync-labels", summary: "Create the source account's labels in the target account", run: runSyncLabels},
+		{name: "mirror", summary: "Keep the target account in sync with the source account, continuously", run: runMirror},
+		{name: "export", summary: "Export messages of the source account to an mbox file, Maildir directory or JMAP account", run: runExport},
+		{name: "import", summary: "Import an mbox file, Maildir directory, .eml files, POP3 mailbox or JMAP account into the target account", run: runImport},
+		{name: "backup", summary: "Back up messages of the source account to a bucket, incrementally", run: runBackup},
+		{name: "restore", summary: "Restore backed up messages into the target account", run: runRestore},
+		{name: "labels", summary: "Explore the labels of an account", subcommands: []string{"list"}, run: runLabels},
+		{name: "message", summary: "Show, export or import a single message", subcommands: []string{"show", "export", "import"}, run: runMessage},
+		{name: "search", summary: "Search the messages of an account", run: runSearch},
+		{name: "rules", summary: "Label, archive, mark read or delete messages of an account by rules", subcommands: []string{"apply", "test", "stats", "export-filters"}, run: runRules},
+		{name: "cleanup", summary: "Delete or archive messages matching a query or rules, with confirmation", run: runCleanup},
+		{name: "labels-cleanup", summary: "Delete empty labels and merge near-duplicate ones, with confirmation", run: runLabelsCleanup},
+		{name: "analyze-attachments", summary: "Find attachments duplicated across messages of the source account", run: runAnalyzeAttachments},
+		{name: "offload-attachments", summary: "Move attachments to a bucket, optionally replacing them with links", run: runOffloadAttachments},
+		{name: "support-bundle", summary: "Collect configuration & logs for troubleshooting", run: runSupportBundle},
+		{name: "version", summary: "Print the version", run: runVersion, noSummary: true},
+	}
+}
+
+// defaultCommand runs when the binary is executed without a command (e.g. as a Cloud Run job without arguments), or
+// with flags only.
+const defaultCommand = "migrate"
+
+// newRootCommand returns the root command of the binary, with a subcommand for every command, as well as Cobra's
+// "help" and "completion" commands. The exit code of the command that ran is stored in the given variable.
+func newRootCommand(exitCode *int) *cobra.Command {
+	cobra.EnableCommandSorting = false // listed in the order of the commands table
+	root := &cobra.Command{
+		Use:   "gmail-organizer [command] [flags]",
+		Short: "Migrate, back up & organize Gmail accounts",
+		Long: "Migrate, back up & organize Gmail accounts.\n\n" +
+			"Most settings are read from environment variables (e.g. SOURCE_ACCOUNT_USERNAME & TARGET_ACCOUNT_USERNAME); see the README.\n" +
+			"Without a command, '" + defaultCommand + "' runs, with the given flags.",
+		Args:               cobra.ArbitraryArgs,
+		DisableFlagParsing: true,
+		SilenceErrors:      true,
+		SilenceUsage:       true,
+	}
+	for _, c := range commands {
+		sub := &cobra.Command{
+			Use:                c.name,
+			Short:              c.summary,
+			ValidArgs:          c.subcommands,
+			Args:               cobra.ArbitraryArgs,
+			DisableFlagParsing: true,
+			Run:                func(_ *cobra.Command, args []string) { *exitCode = c.execute(args) },
+		}
+		sub.SetHelpFunc(func(*cobra.Command, []string) { c.help() })
+		root.AddCommand(sub)
+		if c.name == defaultCommand {
+			root.Run = func(cmd *cobra.Command, args []string) {
+				if len(args) > 0 && slices.Contains([]string{"-h", "-help", "--help"}, args[0]) {
+					_ = cmd.Help()
+					return
+				} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+					fmt.Fprintf(os.Stderr, "Unknown command '%s' (run 'help' for the list of commands)\n", args[0])
+					*exitCode = exitUsage
+					return
+				}
+				*exitCode = c.execute(args)
+			}
+		}
+	}
+	return root
+}
+
+// execute runs the command with the given arguments, and emits the summary of the run, unless the command is not a
+// run (see noSummary) or its arguments are invalid. Returns the exit code of the command.
+func (c *command) execute(args []string) int {
+	if c.noSummary {
+		return c.run(args)
+	}
+	started := time.Now()
+	exitCode := c.run(args)
+	if exitCode != exitUsage {
+		summary.emit(c.name, started, exitCode)
+	}
+	return exitCode
+}
+
+// help prints the summary of the command, and its flags; or, for commands with subcommands, how to print theirs.
+func (c *command) help() {
+	fmt.Printf("%s: %s\n\n", c.name, c.summary)
+	if len(c.subcommands) > 0 {
+		fmt.Printf("Run '%s %s <subcommand> -h' for the flags of a subcommand: %s\n", os.Args[0], c.name, strings.Join(c.subcommands, ", "))
+		return
+	}
+	// Commands print their flags on -h (as a usage error)
+	c.run([]string{"-h"})
+}
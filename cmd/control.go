@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// controlAbortDrainTimeout bounds the time an abort waits for in-flight messages to finish migrating.
+const controlAbortDrainTimeout = 5 * time.Minute
+
+// errRunAborted is the cause of runs aborted through the control API.
+var errRunAborted = errors.New("run aborted through the control API")
+
+// runControl lets operators pause a long migration (e.g. during business hours), resume it, or abort it gracefully.
+// While paused, workers finish migrating their in-flight messages but take no new ones, and collection stops sending
+// search & fetch commands, so the accounts are left alone. A nil runControl is valid, and never pauses.
+type runControl struct {
+	mu       sync.Mutex
+	paused   bool
+	resumed  chan struct{} // closed when the run is resumed (while paused)
+	inFlight int
+	changed  chan struct{} // closed (and replaced) whenever in-flight messages finish
+}
+
+// newRunControl creates a run control, initially running.
+func newRunControl() *runControl {
+	return &runControl{changed: make(chan struct{})}
+}
+
+// Wait waits until the run is not paused.
+func (c *runControl) Wait(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	resumed, paused := c.resumed, c.paused
+	c.mu.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause pauses the run. Returns false if it was already paused.
+func (c *runControl) Pause() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return false
+	}
+	c.paused, c.resumed = true, make(chan struct{})
+	return true
+}
+
+// Resume resumes the run. Returns false if it was not paused.
+func (c *runControl) Resume() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return false
+	}
+	c.paused = false
+	close(c.resumed)
+	return true
+}
+
+// Begin waits until the run is not paused, and then counts a message as in flight until End is called.
+func (c *runControl) Begin(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	for {
+		if err := c.Wait(ctx); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		if !c.paused {
+			c.inFlight++
+			c.mu.Unlock()
+			return nil
+		}
+		// Paused again while waking up
+		c.mu.Unlock()
+	}
+}
+
+// End marks a message counted by Begin as no longer in flight.
+func (c *runControl) End() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Drain waits until no messages are in flight.
+func (c *runControl) Drain(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		inFlight, changed := c.inFlight, c.changed
+		c.mu.Unlock()
+		if inFlight == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// state returns "paused" if the run is paused, and otherwise "running", along with the number of in-flight messages.
+func (c *runControl) state() (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return "paused", c.inFlight
+	}
+	return "running", c.inFlight
+}
+
+// serveControl serves the control API and the run's dashboard on the given address (e.g. ":8081") until the given
+// context is done. If a token is given, requests must carry it as a bearer token, or (for browsers) as the password of
+// HTTP basic authentication, with any username. Aborting the run pauses it, waits for in-flight messages
+// to finish, and then cancels the run with errRunAborted through the given function, so the run saves its state
+// (e.g. target UIDs and the failure ledger) as if it was interrupted. Cross-site POST requests (e.g. forms of other
+// sites posting to the dashboard) are rejected.
+//
+//	POST /pause   pause the run, letting in-flight messages finish
+//	POST /resume  resume a paused run
+//	POST /abort   abort the run gracefully
+//	GET  /status  the run's state and progress, as JSON
+//	GET  /        the dashboard: the run's progress, per-label progress, and failed messages (see serveDashboard)
+//	POST /failures/{id}/retry  retry a failed message in the background
+func (j *WorkerJob) serveControl(ctx context.Context, addr, token string, abort context.CancelCauseFunc) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           j.controlHandler(ctx, token, abort),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving control API & dashboard", "addr", addr, "authenticated", token != "")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve control API: %w", err)
+	}
+	return nil
+}
+
+// controlHandler handles the requests of the control API (see serveControl).
+func (j *WorkerJob) controlHandler(ctx context.Context, token string, abort context.CancelCauseFunc) http.Handler {
+	c := j.control
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		if c.Pause() {
+			slog.Info("Pausing migration through the control API; in-flight messages will finish first", "remote", r.RemoteAddr)
+		}
+		j.writeControlStatus(w)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		if c.Resume() {
+			slog.Info("Resuming migration through the control API", "remote", r.RemoteAddr)
+		}
+		j.writeControlStatus(w)
+	})
+	mux.HandleFunc("POST /abort", func(w http.ResponseWriter, r *http.Request) {
+		slog.Warn("Aborting migration through the control API, once in-flight messages finish", "remote", r.RemoteAddr)
+		c.Pause()
+		go func() {
+			drainCtx, cancel := context.WithTimeout(ctx, controlAbortDrainTimeout)
+			defer cancel()
+			if err := c.Drain(drainCtx); err != nil {
+				slog.Warn("In-flight messages did not finish before aborting", "err", err)
+			}
+			abort(errRunAborted)
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		j.writeControlStatus(w)
+	})
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) {
+		j.serveDashboard(ctx, w)
+	})
+	mux.HandleFunc("POST /failures/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		j.handleRetry(ctx, w, r)
+	})
+
+	// The dashboard posts retries with the browser's basic authentication, so cross-site posts are rejected to keep other
+	// sites from making the browser control the run
+	handler := http.NewCrossOriginProtection().Handler(mux)
+	if token != "" {
+		protected := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, password, basic := r.BasicAuth()
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 &&
+				(!basic || subtle.ConstantTimeCompare([]byte(password), []byte(token)) != 1) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="gmail-organizer"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			protected.ServeHTTP(w, r)
+		})
+	}
+	return handler
+}
+
+// writeControlStatus writes the run's state and progress as JSON.
+func (j *WorkerJob) writeControlStatus(w http.ResponseWriter) {
+	state, inFlight := j.control.state()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"state":    state,
+		"inFlight": inFlight,
+		"done":     j.processed.Load(),
+		"total":    j.total(),
+		"status":   j.status().String(),
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlHandlerRejectsCrossSitePosts(t *testing.T) {
+	tests := map[string]struct {
+		header     map[string]string
+		wantStatus int
+	}{
+		"same-origin":          {header: map[string]string{"Sec-Fetch-Site": "same-origin"}, wantStatus: http.StatusAccepted},
+		"non-browser":          {wantStatus: http.StatusAccepted},
+		"cross-site":           {header: map[string]string{"Sec-Fetch-Site": "cross-site"}, wantStatus: http.StatusForbidden},
+		"cross-origin":         {header: map[string]string{"Origin": "https://attacker.example.com"}, wantStatus: http.StatusForbidden},
+		"unauthenticated":      {header: map[string]string{"Authorization": ""}, wantStatus: http.StatusUnauthorized},
+		"basic-authentication": {header: map[string]string{"Authorization": "Basic dXNlcjpzZWNyZXQ="}, wantStatus: http.StatusAccepted},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			j := &WorkerJob{control: newRunControl()}
+			aborted := make(chan struct{})
+			handler := j.controlHandler(t.Context(), "secret", func(error) { close(aborted) })
+
+			r := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "http://127.0.0.1:8081/abort", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("POST /abort returned %d, want %d", w.Code, tt.wantStatus)
+			}
+			if state, _ := j.control.state(); (state == "paused") != (tt.wantStatus == http.StatusAccepted) {
+				t.Errorf("run state after POST /abort returning %d = %s", w.Code, state)
+			}
+			if tt.wantStatus == http.StatusAccepted {
+				<-aborted
+			}
+		})
+	}
+}
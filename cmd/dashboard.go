@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/audit"
+	"github.com/arikkfir-org/gmail-organizer/internal/ledger"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// dashboardRefreshSeconds is how often the dashboard page reloads itself.
+const dashboardRefreshSeconds = 10
+
+// runFailure is a message that failed to migrate, and was skipped by the error policy.
+type runFailure struct {
+	ID        int
+	Time      time.Time
+	Mailbox   string
+	SourceUID uint32
+	MessageID string
+	Error     string
+	TraceID   string
+	Retrying  bool
+	stage     string // the stage the failure was attributed to (see errorPolicy.Handle)
+	request   *migrationRequest
+}
+
+// runFailures lists the messages of a run that failed to migrate, so they can be reviewed & retried from the
+// dashboard while the run is still going. A nil runFailures is valid, and lists nothing.
+type runFailures struct {
+	mu       sync.Mutex
+	next     int
+	failures []*runFailure
+}
+
+func newRunFailures() *runFailures {
+	return &runFailures{}
+}
+
+// Add lists the given request as failed at the given stage with the given error.
+func (f *runFailures) Add(r *migrationRequest, stage string, err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	f.failures = append(f.failures, &runFailure{
+		ID:        f.next,
+		Time:      time.Now().UTC(),
+		Mailbox:   r.sourceMailbox,
+		SourceUID: r.sourceGmailUID,
+		MessageID: r.messageID,
+		Error:     err.Error(),
+		TraceID:   traceIDOf(r.migratedBy),
+		stage:     stage,
+		request:   r,
+	})
+}
+
+// List returns copies of the listed failures, oldest first.
+func (f *runFailures) List() []runFailure {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := make([]runFailure, len(f.failures))
+	for i, failure := range f.failures {
+		list[i] = *failure
+	}
+	return list
+}
+
+// startRetry marks the failure of the given ID as being retried, and returns its request along with the stage it was
+// attributed to. Returns nil if there is no such failure, or if it's already being retried.
+func (f *runFailures) startRetry(id int) (*migrationRequest, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, failure := range f.failures {
+		if failure.ID == id && !failure.Retrying {
+			failure.Retrying = true
+			return failure.request, failure.stage
+		}
+	}
+	return nil, ""
+}
+
+// endRetry removes the failure of the given ID if its retry succeeded, and otherwise records the retry's error.
+func (f *runFailures) endRetry(id int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, failure := range f.failures {
+		if failure.ID == id {
+			if err == nil {
+				f.failures = append(f.failures[:i], f.failures[i+1:]...)
+			} else {
+				failure.Retrying, failure.Time, failure.Error, failure.TraceID = false, time.Now().UTC(), err.Error(), traceIDOf(failure.request.migratedBy)
+			}
+			return
+		}
+	}
+}
+
+// traceIDOf returns the ID of the trace of the given span, or "" if it has none.
+func traceIDOf(sc trace.SpanContext) string {
+	if sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// retryFailure migrates the message of the given failure again, like a worker would (honoring pauses and the memory
+// watermark). If it succeeds this time, the failure is removed from the list of failures, and settled with the error
+// policy, so it no longer fails the run, and is recorded as resolved in the failure ledger.
+func (j *WorkerJob) retryFailure(ctx context.Context, id int) {
+	r, stage := j.failures.startRetry(id)
+	if r == nil {
+		return
+	}
+
+	err := func() error {
+		if err := j.control.Begin(ctx); err != nil {
+			return err
+		}
+		defer j.control.End()
+		inMemory := int64(r.size)
+		if r.size > j.spoolThreshold {
+			inMemory = int64(min(int(r.size), j.bodyChunkSize))
+		}
+		if err := j.memory.Acquire(ctx, inMemory); err != nil {
+			return err
+		}
+		defer j.memory.Release(inMemory)
+
+		started := time.Now()
+		record := audit.Record{SourceMailbox: r.sourceMailbox, SourceUID: r.sourceGmailUID, MessageID: r.messageID, Bytes: r.size, DryRun: j.dryRun}
+		migrationErr := j.migrateMessage(ctx, r, &record)
+		record.DurationMS = time.Since(started).Milliseconds()
+		if migrationErr != nil {
+			record.Outcome, record.Error = audit.OutcomeFailed, migrationErr.Error()
+		}
+		if err := j.audit.Record(record); err != nil {
+			slog.Warn("Failed to record retried message in audit log", "err", err, "messageID", r.messageID)
+		}
+		return migrationErr
+	}()
+	if err != nil {
+		slog.Warn("Retried message failed to migrate again", "err", err, "messageID", r.messageID, "sourceUID", r.sourceGmailUID)
+	} else {
+		slog.Info("Retried message migrated", "messageID", r.messageID, "sourceUID", r.sourceGmailUID)
+		j.errors.Settle(stage, ledger.Entry{SourceUID: r.sourceGmailUID, MessageID: r.messageID})
+	}
+	j.failures.endRetry(id, err)
+}
+
+// dashboardMailbox is the progress of a single source mailbox, as shown by the dashboard.
+type dashboardMailbox struct {
+	Name      string
+	Matched   uint64
+	Collected uint64
+	Done      uint64
+	Failed    int
+	Percent   float64
+}
+
+// dashboardPage is the data rendered by the dashboard.
+type dashboardPage struct {
+	Refresh   int
+	Time      time.Time
+	State     string
+	InFlight  int
+	Status    *runStatus
+	Percent   float64
+	TraceURL  string
+	Mailboxes []dashboardMailbox
+	Failures  []dashboardFailure
+}
+
+// dashboardFailure is a failure as shown by the dashboard, with a link to its trace (if configured).
+type dashboardFailure struct {
+	runFailure
+	TraceURL string
+}
+
+// traceURL returns the link to the given trace, by the CONTROL_TRACE_URL template (e.g.
+// "https://console.cloud.google.com/traces/list?tid={traceID}"), or "" if not configured.
+func (j *WorkerJob) traceURL(traceID string) string {
+	if j.controlTraceURL == "" || traceID == "" {
+		return ""
+	}
+	return strings.ReplaceAll(j.controlTraceURL, "{traceID}", traceID)
+}
+
+// serveDashboard renders the dashboard of the run: its progress, the progress of each source mailbox, and the list of
+// failed messages, each with a button to retry it.
+func (j *WorkerJob) serveDashboard(ctx context.Context, w http.ResponseWriter) {
+	state, inFlight := j.control.state()
+	s := j.status()
+	page := &dashboardPage{
+		Refresh:  dashboardRefreshSeconds,
+		Time:     time.Now().UTC(),
+		State:    state,
+		InFlight: inFlight,
+		Status:   s,
+		TraceURL: j.traceURL(traceIDOf(trace.SpanContextFromContext(ctx))),
+	}
+	if s.total > 0 {
+		page.Percent = float64(s.done) / float64(s.total) * 100
+	}
+
+	failures := j.failures.List()
+	failedByMailbox := make(map[string]int)
+	for _, f := range failures {
+		failedByMailbox[f.Mailbox]++
+		page.Failures = append(page.Failures, dashboardFailure{runFailure: f, TraceURL: j.traceURL(f.TraceID)})
+	}
+	for _, mailbox := range j.sourceMailboxes {
+		p := j.progress[mailbox]
+		m := dashboardMailbox{Name: mailbox, Matched: p.matched.Load(), Collected: p.collected.Load(), Done: p.done.Load(), Failed: failedByMailbox[mailbox]}
+		if total := max(m.Matched, m.Collected); total > 0 {
+			m.Percent = min(float64(m.Done)/float64(total)*100, 100)
+		}
+		page.Mailboxes = append(page.Mailboxes, m)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		slog.Warn("Failed to render dashboard", "err", err)
+	}
+}
+
+// handleRetry retries the failure given by the request's path in the background, and redirects back to the dashboard.
+func (j *WorkerJob) handleRetry(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid failure ID: %s", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Retrying failed message through the dashboard", "failure", id, "remote", r.RemoteAddr)
+	go j.retryFailure(ctx, id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Migration {{printf "%.1f" .Percent}}%</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.number { text-align: right; }
+progress { width: 200px; }
+</style>
+</head>
+<body>
+<h1>Migration</h1>
+<p>
+<progress max="100" value="{{.Percent}}"></progress>
+{{.Status.String}}
+</p>
+<p>
+State: {{.State}} ({{.InFlight}} messages in flight){{if .TraceURL}} &middot; <a href="{{.TraceURL}}">Trace</a>{{end}}
+&middot; updated {{.Time.Format "15:04:05 MST"}}
+</p>
+<h2>Labels</h2>
+<table>
+<tr><th>Label</th><th>Progress</th><th>Matched</th><th>Collected</th><th>Done</th><th>Failed</th></tr>
+{{- range .Mailboxes}}
+<tr>
+<td>{{.Name}}</td>
+<td><progress max="100" value="{{.Percent}}"></progress> {{printf "%.1f" .Percent}}%</td>
+<td class="number">{{.Matched}}</td>
+<td class="number">{{.Collected}}</td>
+<td class="number">{{.Done}}</td>
+<td class="number">{{.Failed}}</td>
+</tr>
+{{- end}}
+</table>
+<h2>Failures</h2>
+{{- if .Failures}}
+<table>
+<tr><th>Time</th><th>Label</th><th>UID</th><th>Message-ID</th><th>Error</th><th></th></tr>
+{{- range .Failures}}
+<tr>
+<td>{{.Time.Format "15:04:05"}}</td>
+<td>{{.Mailbox}}</td>
+<td class="number">{{.SourceUID}}</td>
+<td>{{.MessageID}}</td>
+<td>{{.Error}}{{if .TraceURL}} (<a href="{{.TraceURL}}">trace</a>){{end}}</td>
+<td>{{if .Retrying}}Retrying&hellip;{{else}}<form method="post" action="/failures/{{.ID}}/retry"><button type="submit">Retry</button></form>{{end}}</td>
+</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No failures.</p>
+{{- end}}
+</body>
+</html>
+`))
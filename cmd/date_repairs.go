@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// dateRepair is a migrated message whose invalid internal date (e.g. zero, or before 1971) was replaced.
+type dateRepair struct {
+	SourceUID uint32    `json:"sourceUID"`
+	MessageID string    `json:"messageID"`
+	Original  time.Time `json:"original"`
+	// Repaired is the date the message was appended with, or zero if it was left for the target to assign.
+	Repaired time.Time `json:"repaired,omitzero"`
+	// Header is the header the repaired date was taken from ("Received" or "Date"), if any.
+	Header string `json:"header,omitempty"`
+}
+
+// dateRepairReport lists the messages whose internal dates were repaired during a run, so they can be reviewed apart
+// from the failures of the run.
+type dateRepairReport struct {
+	mu         sync.Mutex
+	Repaired   uint64       `json:"repaired"`
+	Unresolved uint64       `json:"unresolved"`
+	Messages   []dateRepair `json:"messages"`
+}
+
+// Add records the repair of the internal date of a message.
+func (r *dateRepairReport) Add(repair dateRepair) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if repair.Repaired.IsZero() {
+		r.Unresolved++
+	} else {
+		r.Repaired++
+	}
+	r.Messages = append(r.Messages, repair)
+}
+
+// Counts returns the number of messages whose internal dates were repaired, and of those left for the target to assign.
+func (r *dateRepairReport) Counts() (repaired, unresolved uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Repaired, r.Unresolved
+}
+
+// Write writes the report as JSON to the given file path, unless no dates were repaired.
+func (r *dateRepairReport) Write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Messages) == 0 {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode date repair report: %w", err)
+	} else if err := os.WriteFile(path, append(content, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write date repair report to '%s': %w", path, err)
+	}
+	return nil
+}
+
+// writeDateRepairReport logs the number of repaired internal dates, and writes the list of affected messages to the
+// file given by the DATE_REPAIR_REPORT environment variable, if any.
+func (j *WorkerJob) writeDateRepairReport() {
+	repaired, unresolved := j.dateRepairs.Counts()
+	if repaired+unresolved == 0 {
+		return
+	}
+	slog.Warn("Repaired invalid internal dates of messages", "repaired", repaired, "unresolved", unresolved, "report", j.dateRepairReportPath)
+	if j.dateRepairReportPath == "" {
+		return
+	}
+	if err := j.dateRepairs.Write(j.dateRepairReportPath); err != nil {
+		slog.Error("Failed to write date repair report", "err", err)
+	}
+}
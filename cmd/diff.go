@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	labelsync "github.com/arikkfir-org/gmail-organizer/internal/sync"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	diffConnectionsLimit = 2
+
+	// diffExamples is the number of example Message-IDs printed per difference in the textual report.
+	diffExamples = 10
+)
+
+// accountsDiff is a structured comparison of the source & target accounts.
+type accountsDiff struct {
+	Labels   labelsDiff    `json:"labels"`
+	Messages *messagesDiff `json:"messages,omitempty"`
+}
+
+// labelsDiff compares the label structures of the accounts.
+type labelsDiff struct {
+	Create     []string `json:"create"`     // labels a migration would create in the target, parents first
+	Parents    []string `json:"parents"`    // labels in Create that are missing parents, rather than source labels
+	Existing   int      `json:"existing"`   // source labels already in the target
+	TargetOnly []string `json:"targetOnly"` // target labels missing in the source
+}
+
+// messagesDiff compares the message identity (Message-ID) sets of the accounts.
+type messagesDiff struct {
+	Source        int      `json:"source"`
+	Target        int      `json:"target"`
+	Common        int      `json:"common"`
+	Append        []string `json:"append"`                 // source messages a migration would append to the target
+	LabelsDiffer  []string `json:"labelsDiffer,omitempty"` // common messages whose labels differ (Gmail extensions only)
+	TargetOnly    []string `json:"targetOnly"`             // target messages missing in the source
+	WithoutIDs    int      `json:"withoutIds"`             // messages without a Message-ID or Gmail message ID, not compared
+	labelsCompare bool
+}
+
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	labelsOnly := fs.Bool("labels-only", false, "Only compare label structures, not messages (defaults to $DIFF_LABELS_ONLY)")
+	asJSON := fs.Bool("json", false, "Print the complete comparison as JSON, rather than a textual report (defaults to $DIFF_JSON)")
+	if !parseFlags(fs, args, map[string]string{"labels-only": "DIFF_LABELS_ONLY", "json": "DIFF_JSON"}) {
+		return exitUsage
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	// Neither account is ever modified
+	sourcePool, err := newGmailFromEnv("SOURCE", 1, diffConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	source := sourcePool.ReadOnly()
+	defer closeGmail(source)
+
+	targetPool, err := newGmailFromEnv("TARGET", 1, diffConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create target Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	target := targetPool.ReadOnly()
+	defer closeGmail(target)
+
+	diff, err := diffAccounts(ctx, source, target, !*labelsOnly)
+	if err != nil {
+		slog.Error("Failed to compare accounts", "err", err)
+		return exitCodeOf(err)
+	}
+	summary.Count("labelsToCreate", uint64(len(diff.Labels.Create)))
+	if diff.Messages != nil {
+		summary.Count("messagesToAppend", uint64(len(diff.Messages.Append)))
+		summary.Count("messagesOnlyInTarget", uint64(len(diff.Messages.TargetOnly)))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diff); err != nil {
+			slog.Error("Failed to encode comparison", "err", err)
+			return exitCodeOf(err)
+		}
+	} else {
+		diff.print()
+	}
+	if len(diff.Labels.Create) > 0 || (diff.Messages != nil && len(diff.Messages.Append) > 0) {
+		return exitMismatch
+	}
+	return exitOK
+}
+
+// diffAccounts compares the label structures of the given accounts and, if compareMessages is true, their message
+// identity sets. Lock labels are ignored.
+func diffAccounts(ctx context.Context, source, target *gcp.ReadOnlyGmail, compareMessages bool) (*accountsDiff, error) {
+	sourceLabels, err := source.FetchMailboxNames(ctx, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch source labels: %w", err)
+	}
+	targetLabels, err := target.FetchMailboxNames(ctx, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch target labels: %w", err)
+	}
+	planner := &labelsync.MailboxPlanner{Exclude: isLockLabel}
+	plan := planner.Plan(sourceLabels, targetLabels)
+	diff := &accountsDiff{
+		Labels: labelsDiff{Create: plan.Create, Parents: plan.Parents, Existing: plan.Existing, TargetOnly: []string{}},
+	}
+	for _, label := range targetLabels {
+		if !isLockLabel(label) && !slices.Contains(sourceLabels, label) {
+			diff.Labels.TargetOnly = append(diff.Labels.TargetOnly, label)
+		}
+	}
+	slices.Sort(diff.Labels.TargetOnly)
+	if !compareMessages {
+		return diff, nil
+	}
+
+	withLabels := source.GmailExtensions() && target.GmailExtensions()
+	sourceMessages, sourceWithoutIDs, err := collectMessageIdentities(ctx, source, withLabels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect source messages: %w", err)
+	}
+	targetMessages, targetWithoutIDs, err := collectMessageIdentities(ctx, target, withLabels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect target messages: %w", err)
+	}
+
+	messages := &messagesDiff{
+		Source:        len(sourceMessages),
+		Target:        len(targetMessages),
+		Append:        []string{},
+		TargetOnly:    []string{},
+		WithoutIDs:    sourceWithoutIDs + targetWithoutIDs,
+		labelsCompare: withLabels,
+	}
+	for messageID, labels := range sourceMessages {
+		if targetLabels, found := targetMessages[messageID]; !found {
+			messages.Append = append(messages.Append, messageID)
+		} else {
+			messages.Common++
+			if withLabels && !slices.Equal(labels, targetLabels) {
+				messages.LabelsDiffer = append(messages.LabelsDiffer, messageID)
+			}
+		}
+	}
+	for messageID := range targetMessages {
+		if _, found := sourceMessages[messageID]; !found {
+			messages.TargetOnly = append(messages.TargetOnly, messageID)
+		}
+	}
+	slices.Sort(messages.Append)
+	slices.Sort(messages.LabelsDiffer)
+	slices.Sort(messages.TargetOnly)
+	diff.Messages = messages
+	return diff, nil
+}
+
+// collectMessageIdentities returns the Message-IDs of all messages of the given account (synthetic ones for messages
+// without a Message-ID, like the migration job), mapped to their sorted labels if withLabels is true. Also returns
+// the number of messages that have no identity at all.
+func collectMessageIdentities(ctx context.Context, g *gcp.ReadOnlyGmail, withLabels bool) (map[string][]string, int, error) {
+	items := []imap.FetchItem{imap.FetchEnvelope, gcp.GmailMsgIDExt}
+	if withLabels {
+		items = append(items, gcp.GmailLabelsExt)
+	}
+
+	messages := make(map[string][]string)
+	withoutIDs := 0
+	for msg, err := range g.Iterate(ctx, g.DefaultMailbox(), gcp.IterateOptions{Items: items}) {
+		if err != nil {
+			return nil, 0, err
+		}
+		messageID := ""
+		if msg.Envelope != nil {
+			messageID = msg.Envelope.MessageId
+		}
+		if messageID == "" && msg.Envelope != nil {
+			if gmailMessageID, err := gcp.GetGmailMessageID(msg); err == nil {
+				messageID, _ = syntheticMessageID(ctx, g, g.DefaultMailbox(), msg, gmailMessageID)
+			}
+		}
+		if messageID == "" {
+			withoutIDs++
+			continue
+		}
+		var labels []string
+		if withLabels {
+			var err error
+			if labels, err = gcp.GetLabels(msg); err != nil {
+				return nil, 0, fmt.Errorf("failed to get labels of UID '%d': %w", msg.Uid, err)
+			}
+		}
+		messages[messageID] = labels
+	}
+	return messages, withoutIDs, nil
+}
+
+// print prints the comparison as a textual report, with a few examples of each message difference.
+func (d *accountsDiff) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "CHANGE\tLABEL")
+	for _, label := range d.Labels.Create {
+		_, _ = fmt.Fprintf(w, "create\t%s\n", label)
+	}
+	for _, label := range d.Labels.TargetOnly {
+		_, _ = fmt.Fprintf(w, "target-only\t%s\n", label)
+	}
+	_ = w.Flush()
+	fmt.Printf("\n%d labels to create, %d already present, %d only in the target\n", len(d.Labels.Create), d.Labels.Existing, len(d.Labels.TargetOnly))
+
+	m := d.Messages
+	if m == nil {
+		return
+	}
+	fmt.Printf("\n%d source messages, %d target messages, %d in both\n", m.Source, m.Target, m.Common)
+	printExamples := func(description string, messageIDs []string) {
+		fmt.Printf("%d %s\n", len(messageIDs), description)
+		for _, messageID := range messageIDs[:min(len(messageIDs), diffExamples)] {
+			fmt.Printf("  %s\n", messageID)
+		}
+		if len(messageIDs) > diffExamples {
+			fmt.Printf("  ... (use -json for all of them)\n")
+		}
+	}
+	printExamples("messages to append to the target", m.Append)
+	if m.labelsCompare {
+		printExamples("messages in both with different labels", m.LabelsDiffer)
+	}
+	printExamples("messages only in the target", m.TargetOnly)
+	if m.WithoutIDs > 0 {
+		fmt.Printf("%d messages without any identity were not compared\n", m.WithoutIDs)
+	}
+}
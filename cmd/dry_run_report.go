@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/backup"
+)
+
+const (
+	dryRunReportSamplesPerLabel = 5
+	dryRunReportUnlabeled       = "(no labels)"
+
+	dryRunActionAppend = "append"
+	dryRunActionUpdate = "update"
+)
+
+// dryRunLabelSummary summarizes the planned changes for the messages of a single label.
+type dryRunLabelSummary struct {
+	Label    string   `json:"label"`
+	Appends  uint64   `json:"appends"`
+	Updates  uint64   `json:"updates"`
+	Bytes    int64    `json:"bytes"`
+	Subjects []string `json:"sampleSubjects,omitempty"`
+}
+
+// dryRunReport collects the changes a dry run would have made to the target account, so they can be reviewed before
+// running for real. Messages with several labels are counted under each of them, but only once in the totals.
+type dryRunReport struct {
+	mu      sync.Mutex
+	Started time.Time                      `json:"started"`
+	Ended   time.Time                      `json:"ended"`
+	Appends uint64                         `json:"appends"`
+	Updates uint64                         `json:"updates"`
+	Bytes   int64                          `json:"bytes"`
+	labels  map[string]*dryRunLabelSummary // by label
+	Labels  []*dryRunLabelSummary          `json:"labels"`
+	// SanitizedLabels are the names the target would use for labels Gmail rejects, by original name.
+	SanitizedLabels map[string]string `json:"sanitizedLabels,omitempty"`
+}
+
+func newDryRunReport() *dryRunReport {
+	return &dryRunReport{Started: time.Now().UTC(), labels: make(map[string]*dryRunLabelSummary)}
+}
+
+// Add records a planned append or update of a message with the given labels, subject and size (which is only counted
+// for appends, since updates do not upload message bodies).
+func (r *dryRunReport) Add(action string, labels []string, subject string, size int64) {
+	if action != dryRunActionAppend {
+		size = 0
+	}
+	if len(labels) == 0 {
+		labels = []string{dryRunReportUnlabeled}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if action == dryRunActionAppend {
+		r.Appends++
+	} else {
+		r.Updates++
+	}
+	r.Bytes += size
+	for _, label := range labels {
+		s, ok := r.labels[label]
+		if !ok {
+			s = &dryRunLabelSummary{Label: label}
+			r.labels[label] = s
+		}
+		if action == dryRunActionAppend {
+			s.Appends++
+		} else {
+			s.Updates++
+		}
+		s.Bytes += size
+		if len(s.Subjects) < dryRunReportSamplesPerLabel {
+			s.Subjects = append(s.Subjects, subject)
+		}
+	}
+}
+
+// finish marks the end of the run, and sorts the label summaries by the number of planned changes, descending.
+func (r *dryRunReport) finish() {
+	r.Ended = time.Now().UTC()
+	r.Labels = r.Labels[:0]
+	for _, s := range r.labels {
+		r.Labels = append(r.Labels, s)
+	}
+	slices.SortFunc(r.Labels, func(a, b *dryRunLabelSummary) int {
+		return cmp.Or(cmp.Compare(b.Appends+b.Updates, a.Appends+a.Updates), strings.Compare(a.Label, b.Label))
+	})
+}
+
+// Write writes the report to the given destination: a local file path, or a "gs://bucket/object" URL of a GCS object.
+// The report is written as HTML if the destination ends with ".html", and as JSON otherwise.
+func (r *dryRunReport) Write(ctx context.Context, destination string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish()
+
+	var content bytes.Buffer
+	if strings.EqualFold(path.Ext(destination), ".html") {
+		if err := dryRunReportTemplate.Execute(&content, r); err != nil {
+			return fmt.Errorf("failed to render dry-run report: %w", err)
+		}
+	} else {
+		encoder := json.NewEncoder(&content)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(r); err != nil {
+			return fmt.Errorf("failed to encode dry-run report: %w", err)
+		}
+	}
+
+	if location, ok := strings.CutPrefix(destination, "gs://"); ok {
+		bucket, object, found := strings.Cut(location, "/")
+		if !found || bucket == "" || object == "" {
+			return fmt.Errorf("invalid GCS object URL '%s' (expected 'gs://bucket/object')", destination)
+		}
+		b, err := backup.NewGCSBucket(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = b.Close() }()
+		return b.Put(ctx, object, &content)
+	} else if err := os.WriteFile(destination, content.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write dry-run report to '%s': %w", destination, err)
+	}
+	return nil
+}
+
+// LogSummary logs the totals of the report.
+func (r *dryRunReport) LogSummary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slog.Info("Dry-run summary", "appends", r.Appends, "updates", r.Updates, "bytes", r.Bytes, "labels", len(r.labels))
+}
+
+var dryRunReportTemplate = template.Must(template.New("dry-run-report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Dry-run report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.number { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Dry-run report</h1>
+<p>Run from {{.Started.Format "2006-01-02 15:04:05 MST"}} to {{.Ended.Format "2006-01-02 15:04:05 MST"}}.</p>
+<p>{{.Appends}} messages would be appended ({{.Bytes}} bytes), and {{.Updates}} messages would be updated.</p>
+<table>
+<tr><th>Label</th><th>Appends</th><th>Updates</th><th>Bytes</th><th>Sample subjects</th></tr>
+{{- range .Labels}}
+<tr>
+<td>{{.Label}}</td>
+<td class="number">{{.Appends}}</td>
+<td class="number">{{.Updates}}</td>
+<td class="number">{{.Bytes}}</td>
+<td>{{range .Subjects}}{{.}}<br>{{end}}</td>
+</tr>
+{{- end}}
+</table>
+{{- if .SanitizedLabels}}
+<h2>Sanitized labels</h2>
+<p>These labels would be created under different names, since Gmail rejects their original names.</p>
+<table>
+<tr><th>Label</th><th>Target label</th></tr>
+{{- range $label, $sanitized := .SanitizedLabels}}
+<tr><td>{{$label}}</td><td>{{$sanitized}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+// writeDryRunReport logs the summary of the dry-run report, and writes it to the destination given by the
+// DRY_RUN_REPORT environment variable, if any.
+func (j *WorkerJob) writeDryRunReport(ctx context.Context) {
+	j.dryRunReport.mu.Lock()
+	j.dryRunReport.SanitizedLabels = j.labelNames.Renamed()
+	j.dryRunReport.mu.Unlock()
+	j.dryRunReport.LogSummary()
+	if j.dryRunReportPath == "" {
+		return
+	}
+	if err := j.dryRunReport.Write(context.WithoutCancel(ctx), j.dryRunReportPath); err != nil {
+		slog.Error("Failed to write dry-run report", "err", err, "destination", j.dryRunReportPath)
+	} else {
+		slog.Info("Wrote dry-run report", "destination", j.dryRunReportPath)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/config"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+)
+
+// lookupEnvInt returns the value of the given environment variable parsed as a non-negative integer, or the given
+// default value if the variable is not set.
+func lookupEnvInt(name string, defaultValue int) (int, error) {
+	s, found := os.LookupEnv(name)
+	if !found || s == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to parse %s environment variable: %w", errInvalidConfig, name, err)
+	} else if v < 0 {
+		return 0, fmt.Errorf("%w: %s environment variable must not be negative", errInvalidConfig, name)
+	}
+	return v, nil
+}
+
+// lookupEnvDuration returns the value of the given environment variable parsed as a positive duration (e.g. "90s",
+// "1h"), or the given default value if the variable is not set.
+func lookupEnvDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	s, found := os.LookupEnv(name)
+	if !found || s == "" {
+		return defaultValue, nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to parse %s environment variable: %w", errInvalidConfig, name, err)
+	} else if v <= 0 {
+		return 0, fmt.Errorf("%w: %s environment variable must be positive", errInvalidConfig, name)
+	}
+	return v, nil
+}
+
+// lookupEnvBool returns true if the given environment variable is set to a truthy value (e.g. "true", "yes", "1"), or
+// the given default value if the variable is not set.
+func lookupEnvBool(name string, defaultValue bool) bool {
+	s, found := os.LookupEnv(name)
+	if !found || s == "" {
+		return defaultValue
+	}
+	return slices.Contains([]string{"t", "true", "y", "yes", "1", "ok", "on"}, strings.ToLower(s))
+}
+
+// parseFlags parses the given command line arguments into the given flag set, after setting the given flags from their
+// environment variables (see config.Load). Invalid environment variables are logged, while the flag package reports
+// invalid arguments itself. Returns false if either is invalid.
+func parseFlags(fs *flag.FlagSet, args []string, envNames map[string]string) bool {
+	if err := config.Load(fs, args, envNames); err != nil {
+		if errors.Is(err, config.ErrInvalidEnv) {
+			slog.Error("Invalid configuration", "err", err)
+		}
+		return false
+	}
+	return true
+}
+
+// logEffectiveConfig logs the effective values of the given flags (loaded by parseFlags with the given environment
+// variable names) and of the application's environment variables, with secrets redacted.
+func logEffectiveConfig(fs *flag.FlagSet, envNames map[string]string) {
+	slog.Info("Effective configuration", "command", fs.Name(), "flags", config.Effective(fs, envNames), "env", config.Environment(supportBundleEnvNames))
+}
+
+// newGmailFromEnv creates a Gmail connection pool for the account configured by environment variables with the
+// given prefix, e.g. SOURCE_ACCOUNT_USERNAME, SOURCE_ACCOUNT_PASSWORD, SOURCE_MIN_CONNECTIONS,
+// SOURCE_MAX_CONNECTIONS, SOURCE_COMMANDS_PER_MINUTE and SOURCE_BYTES_PER_MINUTE for the "SOURCE" prefix. The given
+// pool sizes are used when the corresponding variables are not set, and the given extra options are applied last.
+// SOURCE_WARM_UP_CONCURRENCY and SOURCE_MIN_READY_CONNECTIONS control how many initial connections are opened at
+// once, and how many must be ready before the pool is returned.
+//
+// The IMAP endpoint can be overridden with SOURCE_IMAP_ADDRESS ("host:port") and SOURCE_IMAP_TLS (defaults to true),
+// e.g. to route through a smart host, or to point at a local fake server; Gmail-specific behavior (labels, Gmail
+// message/thread IDs and mailboxes) can be turned off with SOURCE_GMAIL_EXTENSIONS=false for generic IMAP servers.
+// The target account is simulated when SIMULATE_TARGET_DIR is set (see applySimulation).
+//
+// For chaos testing, SOURCE_FAULT_FAILURE_PERCENT, SOURCE_FAULT_DELAY_PERCENT (with SOURCE_FAULT_MAX_DELAY, defaulting
+// to 5s) and SOURCE_FAULT_DROP_PERCENT inject failures, delays and dropped connections into that percentage of IMAP
+// operations.
+func newGmailFromEnv(prefix string, defaultMinConns, defaultMaxConns int, extraOpts ...gcp.GmailOption) (*gcp.Gmail, error) {
+	return newGmailFromEnvAs(prefix, nil, defaultMinConns, defaultMaxConns, extraOpts...)
+}
+
+// accountCredentials are the credentials of a Gmail account: its address, and an app password.
+type accountCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// newGmailFromEnvAs is like newGmailFromEnv, but connects to the given account (if not nil) rather than the one given
+// by the <prefix>_ACCOUNT_USERNAME & <prefix>_ACCOUNT_PASSWORD environment variables; the pool is still configured by
+// the environment.
+func newGmailFromEnvAs(prefix string, account *accountCredentials, defaultMinConns, defaultMaxConns int, extraOpts ...gcp.GmailOption) (*gcp.Gmail, error) {
+	// The target account may be simulated, in which case its password is not needed
+	var simulated string
+	if prefix == "TARGET" {
+		var err error
+		if simulated, err = simulatedTarget(); err != nil {
+			return nil, err
+		}
+	}
+
+	var username, password string
+	if account != nil {
+		if account.Username == "" || (account.Password == "" && simulated == "") {
+			return nil, fmt.Errorf("%s account requires both a username and a password", strings.ToLower(prefix))
+		}
+		username, password = account.Username, account.Password
+	} else {
+		// Gmail account username
+		username = os.Getenv(prefix + "_ACCOUNT_USERNAME")
+		if username == "" {
+			return nil, fmt.Errorf("%w: %s_ACCOUNT_USERNAME environment variable is required", errInvalidConfig, prefix)
+		}
+
+		// Gmail account password
+		password = os.Getenv(prefix + "_ACCOUNT_PASSWORD")
+		if password == "" && simulated == "" {
+			return nil, fmt.Errorf("%w: %s_ACCOUNT_PASSWORD environment variable is required", errInvalidConfig, prefix)
+		}
+	}
+
+	// Connection pool size
+	minConns, err := lookupEnvInt(prefix+"_MIN_CONNECTIONS", defaultMinConns)
+	if err != nil {
+		return nil, err
+	}
+	maxConns, err := lookupEnvInt(prefix+"_MAX_CONNECTIONS", defaultMaxConns)
+	if err != nil {
+		return nil, err
+	}
+
+	// IMAP rate limits (zero means unlimited)
+	commandsPerMinute, bytesPerMinute, err := rateLimitsFromEnv(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connection pool warm-up; by default, wait for a single connection to make sure the account is reachable
+	warmUpConcurrency, err := lookupEnvInt(prefix+"_WARM_UP_CONCURRENCY", 4)
+	if err != nil {
+		return nil, err
+	}
+	minReadyConns, err := lookupEnvInt(prefix+"_MIN_READY_CONNECTIONS", min(1, minConns))
+	if err != nil {
+		return nil, err
+	}
+
+	// IMAP command latencies are reported per account (e.g. "source.imap.fetch.duration")
+	reporter, err := metrics.NewReporter("gmail")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metrics reporter: %w", err)
+	}
+
+	opts := []gcp.GmailOption{
+		gcp.WithMetrics(reporter, strings.ToLower(prefix)),
+		gcp.WithRateLimits(commandsPerMinute, bytesPerMinute),
+		gcp.WithWarmUp(warmUpConcurrency, minReadyConns),
+		gcp.WithGmailExtensions(lookupEnvBool(prefix+"_GMAIL_EXTENSIONS", true)),
+	}
+	if address := os.Getenv(prefix + "_IMAP_ADDRESS"); address != "" {
+		opts = append(opts, gcp.WithEndpoint(address, lookupEnvBool(prefix+"_IMAP_TLS", true)))
+	}
+	if simulated != "" {
+		opts = append(opts, gcp.WithEndpoint(simulated, false))
+	}
+
+	// Fault injection, for chaos testing
+	var faults gcp.Faults
+	for name, percent := range map[string]*int{"FAILURE": &faults.FailurePercent, "DELAY": &faults.DelayPercent, "DROP": &faults.DropPercent} {
+		if *percent, err = lookupEnvInt(prefix+"_FAULT_"+name+"_PERCENT", 0); err != nil {
+			return nil, err
+		} else if *percent > 100 {
+			return nil, fmt.Errorf("%w: %s_FAULT_%s_PERCENT environment variable must not exceed 100", errInvalidConfig, prefix, name)
+		}
+	}
+	if faults.MaxDelay, err = lookupEnvDuration(prefix+"_FAULT_MAX_DELAY", defaultFaultMaxDelay); err != nil {
+		return nil, err
+	}
+	opts = append(opts, gcp.WithFaultInjection(faults))
+
+	return gcp.NewGmail(username, password, minConns, maxConns, 1*time.Hour, append(opts, extraOpts...)...)
+}
+
+// rateLimitsFromEnv returns the IMAP commands & bytes per minute allowed for the account of the given prefix, as
+// configured by the <prefix>_COMMANDS_PER_MINUTE & <prefix>_BYTES_PER_MINUTE environment variables (zero means
+// unlimited).
+func rateLimitsFromEnv(prefix string) (commandsPerMinute, bytesPerMinute int, err error) {
+	if commandsPerMinute, err = lookupEnvInt(prefix+"_COMMANDS_PER_MINUTE", 0); err != nil {
+		return 0, 0, err
+	}
+	if bytesPerMinute, err = lookupEnvInt(prefix+"_BYTES_PER_MINUTE", 0); err != nil {
+		return 0, 0, err
+	}
+	return commandsPerMinute, bytesPerMinute, nil
+}
+
+// defaultFaultMaxDelay is the default maximum delay injected into IMAP operations, when delays are injected.
+const defaultFaultMaxDelay = 5 * time.Second
+
+// defaultCloseTimeout bounds the time spent closing Gmail connection pools on shutdown; it is well within Cloud Run's
+// default termination grace period of 10 seconds.
+const defaultCloseTimeout = 5 * time.Second
+
+// closeGmail closes the given Gmail connection pools in parallel, within the timeout given by the CLOSE_TIMEOUT
+// environment variable. Failures are logged, since there is nothing else to do about them during shutdown.
+func closeGmail(pools ...interface{ Close(context.Context) error }) {
+	timeout, err := lookupEnvDuration("CLOSE_TIMEOUT", defaultCloseTimeout)
+	if err != nil {
+		slog.Warn("Invalid CLOSE_TIMEOUT, using default", "err", err, "default", defaultCloseTimeout)
+		timeout = defaultCloseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, g := range pools {
+		wg.Go(func() {
+			if err := g.Close(ctx); err != nil {
+				slog.Warn("Failed to close Gmail connection pool cleanly", "err", err)
+			}
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/ledger"
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+)
+
+// Error policies of a run.
+const (
+	errorPolicyStrict   = "strict"
+	errorPolicyContinue = "continue"
+)
+
+// Stages of a run that failures are attributed to.
+const (
+	failureStageCollection = "collection"
+	failureStageMigration  = "migration"
+	failureStageLabels     = "labels"
+)
+
+// errLabelUpdate marks failures to update the labels & flags of messages already present in the target.
+var errLabelUpdate = errors.New("label update failed")
+
+// errorPolicy decides whether a failure of a single unit of work (a message, a mailbox, or a label update) aborts the
+// run. Under the strict policy, every failure aborts the run. Under the continue policy, failures are counted and
+// recorded in the failure ledger, and the run goes on until more than the maximum number of failures occurred (zero
+// means no maximum). Failures that would recur for every unit of work (e.g. authentication failures) and cancellation
+// always abort the run.
+type errorPolicy struct {
+	name        string
+	maxFailures uint64
+	failures    atomic.Uint64
+	ledger      *ledger.Ledger
+	failedUnits *metrics.Counter // by stage
+}
+
+func newErrorPolicy(name string, maxFailures uint64, l *ledger.Ledger, failedUnits *metrics.Counter) (*errorPolicy, error) {
+	if name != errorPolicyStrict && name != errorPolicyContinue {
+		return nil, fmt.Errorf("invalid error policy '%s' (must be '%s' or '%s')", name, errorPolicyStrict, errorPolicyContinue)
+	}
+	return &errorPolicy{name: name, maxFailures: maxFailures, ledger: l, failedUnits: failedUnits}, nil
+}
+
+// Handle returns nil if the given failure at the given stage is tolerated, in which case it is recorded in the
+// failure ledger under the given entry, or an error that should abort the run otherwise.
+func (p *errorPolicy) Handle(ctx context.Context, stage string, entry ledger.Entry, err error) error {
+	if err == nil {
+		return nil
+	} else if p.name == errorPolicyStrict || ctx.Err() != nil {
+		return err
+	} else if class := gcp.ClassifyError(err); class == gcp.ErrorClassAuth || class == gcp.ErrorClassCanceled {
+		return err
+	}
+
+	failures := p.failures.Add(1)
+	p.failedUnits.AddWithReason(ctx, stage, 1)
+	entry.Reason = "failed-" + stage
+	entry.Details = err.Error()
+	if ledgerErr := p.ledger.Record(entry); ledgerErr != nil {
+		slog.Warn("Failed to record failure in ledger", "err", ledgerErr)
+	}
+	if p.maxFailures > 0 && failures > p.maxFailures {
+		return fmt.Errorf("aborting after %d failures (maximum is %d): %w", failures, p.maxFailures, err)
+	}
+	slog.Warn("Continuing after failure", "err", err, "stage", stage, "messageID", entry.MessageID, "failures", failures)
+	return nil
+}
+
+// Settle records that a failure at the given stage, tolerated earlier, was resolved since (e.g. by retrying it from
+// the dashboard): it no longer counts as a failure of the run, and is recorded in the failure ledger as resolved
+// under the given entry, so that it's not acted upon after the run.
+func (p *errorPolicy) Settle(stage string, entry ledger.Entry) {
+	p.failures.Add(^uint64(0))
+	entry.Reason = "resolved-" + stage
+	if err := p.ledger.Record(entry); err != nil {
+		slog.Warn("Failed to record resolved failure in ledger", "err", err)
+	}
+}
+
+// Failures returns the number of failures tolerated so far.
+func (p *errorPolicy) Failures() uint64 {
+	return p.failures.Load()
+}
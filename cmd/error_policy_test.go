@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/ledger"
+)
+
+func TestErrorPolicySettle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.jsonl")
+	l, err := ledger.NewLedger(path)
+	if err != nil {
+		t.Fatalf("NewLedger() failed: %v", err)
+	}
+	p, err := newErrorPolicy(errorPolicyContinue, 0, l, nil)
+	if err != nil {
+		t.Fatalf("newErrorPolicy() failed: %v", err)
+	}
+
+	entry := ledger.Entry{SourceUID: 7, MessageID: "m@example.com"}
+	if err := p.Handle(t.Context(), failureStageMigration, entry, errors.New("boom")); err != nil {
+		t.Fatalf("Handle() returned %v, want the failure tolerated", err)
+	}
+	p.Settle(failureStageMigration, entry)
+	if failures := p.Failures(); failures != 0 {
+		t.Errorf("Failures() after settling = %d, want 0", failures)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read ledger: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"failed-migration"`) || !strings.Contains(lines[1], `"resolved-migration"`) {
+		t.Errorf("ledger = %q, want the failure followed by its resolution", lines)
+	}
+}
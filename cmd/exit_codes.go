@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/config"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+)
+
+// Exit codes of all commands, so wrappers & schedulers can branch on the outcome of a run without parsing its logs.
+// They are documented in the README, and must not change meaning.
+const (
+	exitOK        = 0
+	exitFailure   = 1   // the command failed, for any reason not covered by a more specific code
+	exitUsage     = 2   // invalid command line (unknown command, flag or argument)
+	exitConfig    = 3   // invalid configuration (environment variables or configuration files)
+	exitAuth      = 4   // an account rejected its credentials, or has IMAP access disabled
+	exitPartial   = 5   // the run completed, but some messages failed & were skipped (see the failure ledger)
+	exitQuota     = 6   // an account exhausted its Gmail quota (bandwidth or command limits)
+	exitMismatch  = 7   // verification found differences (e.g. content hash mismatches, or accounts that differ)
+	exitCancelled = 130 // the run was interrupted (e.g. by SIGINT) or aborted, like shells report SIGINT
+)
+
+// errInvalidConfig marks errors of invalid configuration files, so they exit with exitConfig.
+var errInvalidConfig = errors.New("invalid configuration")
+
+// exitCodeOf returns the exit code of a command failing with the given error.
+func exitCodeOf(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, config.ErrInvalidEnv) || errors.Is(err, errInvalidConfig):
+		return exitConfig
+	case errors.Is(err, context.Canceled) || errors.Is(err, errRunAborted):
+		return exitCancelled
+	}
+	switch gcp.ClassifyError(err) {
+	case gcp.ErrorClassAuth:
+		return exitAuth
+	case gcp.ErrorClassQuota:
+		return exitQuota
+	default:
+		return exitFailure
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	exploreConnectionsLimit = 2
+	defaultSearchLimit      = 50
+)
+
+// runLabels runs the "labels" command, whose only subcommand is "list".
+func runLabels(args []string) int {
+	if len(args) == 0 || args[0] != "list" {
+		slog.Error("Usage: labels list [flags]")
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("labels list", flag.ContinueOnError)
+	account := fs.String("account", "source", "Account to explore: 'source' or 'target' (configured by the corresponding environment variables; defaults to $EXPLORE_ACCOUNT)")
+	all := fs.Bool("all", false, "Include system mailboxes (e.g. INBOX, '[Gmail]/Sent Mail'; defaults to $EXPLORE_ALL_MAILBOXES)")
+	counts := fs.Bool("counts", true, "Show the number of messages of each label (one STATUS command per label; defaults to $EXPLORE_COUNTS)")
+	if !parseFlags(fs, args[1:], map[string]string{"account": "EXPLORE_ACCOUNT", "all": "EXPLORE_ALL_MAILBOXES", "counts": "EXPLORE_COUNTS"}) {
+		return exitUsage
+	}
+
+	ctx, cancelCtx, g, ok := openExploredAccount(*account)
+	if !ok {
+		return exitUsage
+	} else if g == nil {
+		return exitFailure
+	}
+	defer cancelCtx()
+	defer closeGmail(g)
+
+	labels, err := g.FetchMailboxNames(ctx, !*all, false)
+	if err != nil {
+		slog.Error("Failed to list labels", "err", err)
+		return exitCodeOf(err)
+	}
+	slices.Sort(labels)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if *counts {
+		_, _ = fmt.Fprintln(w, "LABEL\tMESSAGES")
+	} else {
+		_, _ = fmt.Fprintln(w, "LABEL")
+	}
+	for _, label := range labels {
+		if !*counts {
+			_, _ = fmt.Fprintln(w, label)
+		} else if count, err := g.CountMessages(ctx, label); err != nil {
+			// Unselectable parents have no status
+			_, _ = fmt.Fprintf(w, "%s\t-\n", label)
+		} else {
+			_, _ = fmt.Fprintf(w, "%s\t%d\n", label, count)
+		}
+	}
+	_ = w.Flush()
+	summary.Count("labels", uint64(len(labels)))
+	return exitOK
+}
+
+// runMessage runs the "message" command, whose subcommands are "show", "export" and "import".
+func runMessage(args []string) int {
+	if len(args) > 0 && args[0] == "show" {
+		return runMessageShow(args[1:])
+	} else if len(args) > 0 && args[0] == "export" {
+		return runMessageExport(args[1:])
+	} else if len(args) > 0 && args[0] == "import" {
+		return runMessageImport(args[1:])
+	}
+	slog.Error("Usage: message show|export|import [flags]")
+	return exitUsage
+}
+
+// runMessageShow prints the details of a single message.
+func runMessageShow(args []string) int {
+	fs := flag.NewFlagSet("message show", flag.ContinueOnError)
+	account := fs.String("account", "source", "Account to explore: 'source' or 'target' (configured by the corresponding environment variables; defaults to $EXPLORE_ACCOUNT)")
+	mailbox := fs.String("mailbox", "", "Mailbox of the message (defaults to $EXPLORE_MAILBOX, or to all mail: '[Gmail]/All Mail' for Gmail, 'INBOX' otherwise)")
+	if !parseFlags(fs, args, map[string]string{"account": "EXPLORE_ACCOUNT", "mailbox": "EXPLORE_MAILBOX"}) {
+		return exitUsage
+	} else if fs.NArg() != 1 {
+		slog.Error("Usage: message show [flags] <uid|message-id>")
+		return exitUsage
+	}
+
+	ctx, cancelCtx, g, ok := openExploredAccount(*account)
+	if !ok {
+		return exitUsage
+	} else if g == nil {
+		return exitFailure
+	}
+	defer cancelCtx()
+	defer closeGmail(g)
+	if *mailbox == "" {
+		*mailbox = g.DefaultMailbox()
+	}
+
+	// UIDs are numeric, Message-IDs never are (they always contain an '@')
+	var uid uint32
+	if v, err := strconv.ParseUint(fs.Arg(0), 10, 32); err == nil {
+		uid = uint32(v)
+	} else if uid, err = findMessageUID(ctx, g, *mailbox, fs.Arg(0)); err != nil {
+		slog.Error("Failed to find message", "err", err, "messageID", fs.Arg(0))
+		return exitCodeOf(err)
+	}
+
+	header := &imap.BodySectionName{Peek: true, BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}}
+	items := []imap.FetchItem{
+		header.FetchItem(), imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchBodyStructure,
+		gcp.GmailLabelsExt, gcp.GmailMsgIDExt, gcp.GmailThreadIDExt,
+	}
+	msg, err := g.FetchMessageByUID(ctx, *mailbox, uid, items...)
+	if err != nil {
+		slog.Error("Failed to fetch message", "err", err, "uid", uid)
+		return exitCodeOf(err)
+	} else if msg == nil || msg.Envelope == nil {
+		slog.Error("Message not found", "mailbox", *mailbox, "uid", uid)
+		return exitFailure
+	}
+	if err := printMessage(os.Stdout, *mailbox, msg, msg.GetBody(header), g.GmailExtensions()); err != nil {
+		slog.Error("Failed to print message", "err", err)
+		return exitCodeOf(err)
+	}
+	return exitOK
+}
+
+// runMessageExport writes the raw RFC822 content of a single message to a file, e.g. to reproduce a failed append.
+func runMessageExport(args []string) int {
+	fs := flag.NewFlagSet("message export", flag.ContinueOnError)
+	account := fs.String("account", "source", "Account to explore: 'source' or 'target' (configured by the corresponding environment variables; defaults to $EXPLORE_ACCOUNT)")
+	mailbox := fs.String("mailbox", "", "Mailbox of the message (defaults to $EXPLORE_MAILBOX, or to all mail: '[Gmail]/All Mail' for Gmail, 'INBOX' otherwise)")
+	messageID := fs.String("message-id", "", "Message-ID of the message to export")
+	uidFlag := fs.Uint("uid", 0, "UID of the message to export (instead of -message-id)")
+	output := fs.String("out", "", "Path of the .eml file to write, or '-' for stdout")
+	if !parseFlags(fs, args, map[string]string{"account": "EXPLORE_ACCOUNT", "mailbox": "EXPLORE_MAILBOX"}) {
+		return exitUsage
+	} else if (*messageID == "") == (*uidFlag == 0) {
+		slog.Error("Exactly one of the -message-id and -uid flags is required")
+		return exitUsage
+	} else if *uidFlag > math.MaxUint32 {
+		slog.Error("The -uid flag is out of range", "uid", *uidFlag)
+		return exitUsage
+	} else if *output == "" {
+		slog.Error("The -out flag is required")
+		return exitUsage
+	}
+
+	ctx, cancelCtx, g, ok := openExploredAccount(*account)
+	if !ok {
+		return exitUsage
+	} else if g == nil {
+		return exitFailure
+	}
+	defer cancelCtx()
+	defer closeGmail(g)
+	if *mailbox == "" {
+		*mailbox = g.DefaultMailbox()
+	}
+
+	uid := uint32(*uidFlag)
+	if *messageID != "" {
+		var err error
+		if uid, err = findMessageUID(ctx, g, *mailbox, *messageID); err != nil {
+			slog.Error("Failed to find message", "err", err, "messageID", *messageID)
+			return exitCodeOf(err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			slog.Error("Failed to create output file", "err", err, "path", *output)
+			return exitCodeOf(err)
+		}
+		defer func() { _ = f.Close() }()
+		w = f
+	}
+	n, err := g.DownloadBody(ctx, *mailbox, uid, defaultBodyChunkSize, "", w)
+	if err != nil {
+		slog.Error("Failed to export message", "err", err, "uid", uid)
+		if *output != "-" {
+			_ = os.Remove(*output)
+		}
+		return exitFailure
+	} else if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			slog.Error("Failed to write output file", "err", err, "path", *output)
+			return exitCodeOf(err)
+		}
+	}
+	summary.Count("exportedBytes", uint64(n))
+	slog.Info("Exported message", "mailbox", *mailbox, "uid", uid, "bytes", n, "output", *output)
+	return exitOK
+}
+
+// findMessageUID returns the UID of the message with the given Message-ID in the given mailbox.
+func findMessageUID(ctx context.Context, g *gcp.ReadOnlyGmail, mailbox, messageID string) (uint32, error) {
+	uid, err := g.FindUIDByMessageID(ctx, mailbox, messageID)
+	if err != nil {
+		return 0, err
+	} else if uid == nil {
+		return 0, fmt.Errorf("message not found in '%s'", mailbox)
+	}
+	return *uid, nil
+}
+
+// printMessage prints the given message's identity, flags, labels and sizes, the structure of its parts, and its
+// raw header.
+func printMessage(out io.Writer, mailbox string, msg *imap.Message, header io.Reader, gmailExtensions bool) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Mailbox:\t%s\n", mailbox)
+	_, _ = fmt.Fprintf(w, "UID:\t%d\n", msg.Uid)
+	_, _ = fmt.Fprintf(w, "Message-ID:\t%s\n", msg.Envelope.MessageId)
+	if gmailExtensions {
+		gmailMessageID, _ := gcp.GetGmailMessageID(msg)
+		threadID, _ := gcp.GetThreadID(msg)
+		labels, err := gcp.GetLabels(msg)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(w, "Gmail message ID:\t%d\n", gmailMessageID)
+		_, _ = fmt.Fprintf(w, "Gmail thread ID:\t%d\n", threadID)
+		_, _ = fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(labels, ", "))
+	}
+	_, _ = fmt.Fprintf(w, "Flags:\t%s\n", strings.Join(msg.Flags, ", "))
+	_, _ = fmt.Fprintf(w, "Internal date:\t%s\n", msg.InternalDate.Format(time.RFC3339))
+	_, _ = fmt.Fprintf(w, "Subject:\t%s\n", msg.Envelope.Subject)
+	_, _ = fmt.Fprintf(w, "Size:\t%d bytes\n", msg.Size)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if msg.BodyStructure != nil {
+		_, _ = fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "PART\tTYPE\tENCODING\tSIZE\tFILENAME")
+		msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+			filename, _ := part.Filename()
+			_, _ = fmt.Fprintf(w, "%s\t%s/%s\t%s\t%d\t%s\n", partPath(path), strings.ToLower(part.MIMEType), strings.ToLower(part.MIMESubType), part.Encoding, part.Size, filename)
+			return true
+		})
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if header != nil {
+		_, _ = fmt.Fprintln(out)
+		if _, err := io.Copy(out, header); err != nil {
+			return fmt.Errorf("failed to print header: %w", err)
+		}
+	}
+	return nil
+}
+
+// partPath formats the given body structure path as an IMAP part specifier (e.g. "1.2"), or "-" for the root.
+func partPath(path []int) string {
+	if len(path) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(path))
+	for i, n := range path {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// runSearch runs the "search" command, listing the most recent messages matching a query.
+func runSearch(args []string) int {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	account := fs.String("account", "source", "Account to explore: 'source' or 'target' (configured by the corresponding environment variables; defaults to $EXPLORE_ACCOUNT)")
+	mailbox := fs.String("mailbox", "", "Mailbox to search (defaults to $EXPLORE_MAILBOX, or to all mail: '[Gmail]/All Mail' for Gmail, 'INBOX' otherwise)")
+	limit := fs.Int("limit", defaultSearchLimit, "Maximum number of (most recent) matching messages to list (defaults to $EXPLORE_SEARCH_LIMIT)")
+	if !parseFlags(fs, args, map[string]string{"account": "EXPLORE_ACCOUNT", "mailbox": "EXPLORE_MAILBOX", "limit": "EXPLORE_SEARCH_LIMIT"}) {
+		return exitUsage
+	} else if fs.NArg() == 0 {
+		slog.Error("Usage: search [flags] <query>")
+		return exitUsage
+	} else if *limit < 1 {
+		slog.Error("The -limit flag must be positive", "limit", *limit)
+		return exitUsage
+	}
+	query := strings.Join(fs.Args(), " ")
+
+	ctx, cancelCtx, g, ok := openExploredAccount(*account)
+	if !ok {
+		return exitUsage
+	} else if g == nil {
+		return exitFailure
+	}
+	defer cancelCtx()
+	defer closeGmail(g)
+	if *mailbox == "" {
+		*mailbox = g.DefaultMailbox()
+	}
+
+	uids, err := g.Search(ctx, *mailbox, query)
+	if err != nil {
+		slog.Error("Failed to search", "err", err, "query", query)
+		return exitCodeOf(err)
+	}
+	slices.Sort(uids)
+	matched := len(uids)
+	uids = uids[max(0, len(uids)-*limit):]
+
+	messages, err := g.FetchByUIDs(ctx, *mailbox, uids, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size)
+	if err != nil {
+		slog.Error("Failed to fetch matching messages", "err", err)
+		return exitCodeOf(err)
+	}
+	slices.SortFunc(messages, func(a, b *imap.Message) int { return cmp.Compare(b.Uid, a.Uid) })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "UID\tDATE\tSIZE\tFROM\tSUBJECT\tMESSAGE-ID")
+	for _, msg := range messages {
+		var from string
+		if msg.Envelope != nil && len(msg.Envelope.From) > 0 {
+			from = msg.Envelope.From[0].Address()
+		}
+		var subject, messageID string
+		if msg.Envelope != nil {
+			subject, messageID = msg.Envelope.Subject, msg.Envelope.MessageId
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", msg.Uid, msg.InternalDate.Format(time.DateOnly), msg.Size, from, subject, messageID)
+	}
+	_ = w.Flush()
+	if matched > len(messages) {
+		fmt.Printf("\nShowing the %d most recent of %d matching messages\n", len(messages), matched)
+	}
+	summary.Count("matched", uint64(matched))
+	return exitOK
+}
+
+// openExploredAccount opens a read-only pool for the given account ("source" or "target"), along with a context that
+// cancels on SIGINT and SIGTERM. Returns false if the account is invalid, and a nil pool if it failed to open (both
+// are logged).
+func openExploredAccount(account string) (context.Context, context.CancelFunc, *gcp.ReadOnlyGmail, bool) {
+	if account != "source" && account != "target" {
+		slog.Error("The -account flag must be 'source' or 'target'", "account", account)
+		return nil, nil, nil, false
+	}
+
+	pool, err := newGmailFromEnv(strings.ToUpper(account), 1, exploreConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create Gmail connection", "err", err, "account", account)
+		return nil, nil, nil, true
+	}
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx, cancelCtx, pool.ReadOnly(), true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/archive"
+	"github.com/arikkfir-org/gmail-organizer/internal/compress"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/jmap"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	exportConnectionsLimit = 2
+	exportFetchBatchSize   = 100
+	exportDateFormat       = "2006-01-02"
+)
+
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "mbox", "Archive format: 'mbox' (a single file), 'maildir' (a directory) or 'jmap' (a JMAP account, token in $JMAP_TOKEN); defaults to $EXPORT_FORMAT")
+	output := fs.String("output", "", "Path of the mbox file or Maildir directory, or URL of the JMAP account ('jmaps://host[:port]'), to export into (required; defaults to $EXPORT_OUTPUT)")
+	label := fs.String("label", "", "Only export messages with this label (defaults to $EXPORT_LABEL, or to all messages)")
+	query := fs.String("query", "", "Only export messages matching this Gmail search query (e.g. 'from:alice has:attachment'; defaults to $EXPORT_QUERY)")
+	since := fs.String("since", "", "Only export messages received on or after this date (YYYY-MM-DD; defaults to $EXPORT_SINCE)")
+	before := fs.String("before", "", "Only export messages received before this date (YYYY-MM-DD; defaults to $EXPORT_BEFORE)")
+	compression := fs.String("compress", "none", "Compress the mbox file: 'none', 'gzip' or 'zstd' (mbox format only; defaults to $EXPORT_COMPRESSION)")
+	if !parseFlags(fs, args, map[string]string{"format": "EXPORT_FORMAT", "output": "EXPORT_OUTPUT", "label": "EXPORT_LABEL", "query": "EXPORT_QUERY", "since": "EXPORT_SINCE", "before": "EXPORT_BEFORE", "compress": "EXPORT_COMPRESSION"}) {
+		return exitUsage
+	} else if *output == "" {
+		slog.Error("The -output flag (or EXPORT_OUTPUT environment variable) is required")
+		return exitUsage
+	}
+
+	criteria := imap.NewSearchCriteria()
+	for _, d := range []struct {
+		value  string
+		target *time.Time
+	}{{*since, &criteria.Since}, {*before, &criteria.Before}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.Parse(exportDateFormat, d.value)
+		if err != nil {
+			slog.Error("Invalid date", "err", err, "date", d.value)
+			return exitUsage
+		}
+		*d.target = t
+	}
+
+	algorithm, err := compress.ParseAlgorithm(*compression)
+	if err != nil {
+		slog.Error("Invalid compression", "err", err)
+		return exitUsage
+	}
+
+	var w archive.Writer
+	switch *format {
+	case "mbox":
+		w, err = archive.NewMboxWriter(*output, algorithm)
+	case "maildir", "jmap":
+		if algorithm != compress.None {
+			slog.Error("Compression is only supported for the mbox format")
+			return exitUsage
+		} else if *format == "maildir" {
+			w, err = archive.NewMaildirWriter(*output)
+		} else {
+			w, err = openJMAPTarget(*output)
+		}
+	default:
+		slog.Error("Unknown archive format", "format", *format)
+		return exitUsage
+	}
+	if err != nil {
+		slog.Error("Failed to create archive", "err", err)
+		return exitCodeOf(err)
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	sourceGmail, err := newGmailFromEnv("SOURCE", 1, exportConnectionsLimit)
+	if err != nil {
+		_ = w.Close()
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(sourceGmail)
+	mailbox := *label
+	if mailbox == "" {
+		mailbox = sourceGmail.DefaultMailbox()
+	}
+
+	count, size, err := exportMessages(ctx, sourceGmail, mailbox, *query, criteria, w)
+	if closeErr := w.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close archive: %w", closeErr)
+	}
+	if err != nil {
+		slog.Error("Export failed", "err", err, "exported", count)
+		return exitCodeOf(err)
+	}
+	summary.Count("exported", uint64(count))
+	attrs := []any{"exported", count, "output", *output}
+	if algorithm != compress.None {
+		if info, err := os.Stat(*output); err == nil {
+			stats := &compress.Stats{}
+			stats.Add(size, info.Size())
+			attrs = append(attrs, "compressedBytes", info.Size(), "compressionRatio", fmt.Sprintf("%.2f", stats.Ratio()))
+		}
+	}
+	slog.Info("Export completed", attrs...)
+	return exitOK
+}
+
+// openJMAPTarget opens the JMAP account of the given "jmaps://host[:port]" URL for importing messages into (see
+// jmapSession).
+func openJMAPTarget(target string) (archive.Writer, error) {
+	sessionURL, token, err := jmapSession(target)
+	if err != nil {
+		return nil, err
+	}
+	return jmap.Create(sessionURL, token)
+}
+
+// findMessagesToExport returns the sorted UIDs of the messages in the given mailbox matching the given Gmail search
+// query (if any) and search criteria.
+func findMessagesToExport(ctx context.Context, g *gcp.Gmail, mailbox, query string, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var uids []uint32
+	err := g.WithSession(ctx, mailbox, func(sess *gcp.Session) error {
+		var err error
+		if uids, err = sess.Search(criteria); err != nil {
+			return err
+		} else if query != "" {
+			matching, err := sess.SearchRaw(query)
+			if err != nil {
+				return err
+			}
+			uids = slices.DeleteFunc(uids, func(uid uint32) bool { return !slices.Contains(matching, uid) })
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// exportMessages writes the messages in the given mailbox matching the given Gmail search query (if any) and search
+// criteria to the given archive, preserving their flags, labels and internal dates. Returns the number of messages
+// exported, and their total size.
+func exportMessages(ctx context.Context, g *gcp.Gmail, mailbox, query string, criteria *imap.SearchCriteria, w archive.Writer) (int, int64, error) {
+	uids, err := findMessagesToExport(ctx, g, mailbox, query, criteria)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find messages to export: %w", err)
+	}
+	slog.Info("Exporting messages", "mailbox", mailbox, "messages", len(uids))
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags, imap.FetchInternalDate, gcp.GmailLabelsExt}
+	exported, size := 0, int64(0)
+	for chunk := range slices.Chunk(uids, exportFetchBatchSize) {
+		err := g.FetchByUIDsStream(ctx, mailbox, chunk, items, func(msg *imap.Message) error {
+			literal := msg.GetBody(section)
+			if literal == nil {
+				return fmt.Errorf("server did not provide body of message '%d'", msg.Uid)
+			}
+			raw, err := io.ReadAll(literal)
+			if err != nil {
+				return fmt.Errorf("failed to read body of message '%d': %w", msg.Uid, err)
+			}
+			labels, err := gcp.GetLabels(msg)
+			if err != nil {
+				return err
+			}
+			err = w.Write(&archive.Message{
+				Raw:          raw,
+				Flags:        msg.Flags,
+				Labels:       labels,
+				InternalDate: msg.InternalDate,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write message '%d': %w", msg.Uid, err)
+			}
+			exported++
+			size += int64(len(raw))
+			return nil
+		})
+		if err != nil {
+			return exported, size, err
+		}
+		slog.Info("Exported messages", "exported", exported, "total", len(uids))
+	}
+	return exported, size, nil
+}
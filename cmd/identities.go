@@ -0,0 +1,62 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// identityCache is a small LRU cache of recent decisions on whether a message identity (Message-ID) is present in the
+// target account. Bursts of related messages (e.g. messages of the same thread, or copies of the same message in
+// several mailboxes) would otherwise search the target for identities that were just confirmed. The cache is owned by
+// a single run, so decisions never leak into other runs (which may see a different target state).
+type identityCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type identityCacheEntry struct {
+	identity string
+	present  bool
+}
+
+// newIdentityCache creates a cache holding up to the given number of identities. A zero capacity disables caching.
+func newIdentityCache(capacity int) *identityCache {
+	return &identityCache{capacity: capacity, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// Get returns whether the given identity was last known to be present in the target, and whether it is cached at all.
+func (c *identityCache) Get(identity string) (present bool, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[identity]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*identityCacheEntry).present, true
+	}
+	return false, false
+}
+
+// Put records whether the given identity is present in the target, evicting the least recently used identity if the
+// cache is full.
+func (c *identityCache) Put(identity string, present bool) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[identity]; ok {
+		e.Value.(*identityCacheEntry).present = present
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[identity] = c.order.PushFront(&identityCacheEntry{identity: identity, present: present})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*identityCacheEntry).identity)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/archive"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/jmap"
+	"github.com/arikkfir-org/gmail-organizer/internal/pop3"
+	"github.com/emersion/go-imap"
+)
+
+const defaultImportWorkers = 4
+
+// importStats counts the outcome of importing messages.
+type importStats struct {
+	imported   atomic.Uint64
+	existing   atomic.Uint64
+	duplicates atomic.Uint64
+	chats      atomic.Uint64
+}
+
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	source := fs.String("source", "", "Path of the mbox file, Maildir directory, .eml file or directory of .eml files to import, or URL of a POP3 mailbox ('pop3s://[user@]host[:port]', password in $POP3_PASSWORD) or JMAP account ('jmaps://host[:port]', token in $JMAP_TOKEN) (required; defaults to $IMPORT_SOURCE)")
+	label := fs.String("label", "Imported", "Label to apply to all imported messages (empty for none; defaults to $IMPORT_LABEL)")
+	workers := fs.Int("workers", defaultImportWorkers, "Number of messages to append concurrently (defaults to $IMPORT_WORKERS)")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be imported (defaults to $IMPORT_DRY_RUN)")
+	takeout := fs.Bool("takeout", false, "Source is a Google Takeout MBOX export: restore labels, read & starred state from its X-Gmail-Labels headers (defaults to $IMPORT_TAKEOUT)")
+	if !parseFlags(fs, args, map[string]string{"source": "IMPORT_SOURCE", "label": "IMPORT_LABEL", "workers": "IMPORT_WORKERS", "dry-run": "IMPORT_DRY_RUN", "takeout": "IMPORT_TAKEOUT"}) {
+		return exitUsage
+	} else if *source == "" {
+		slog.Error("The -source flag (or IMPORT_SOURCE environment variable) is required")
+		return exitUsage
+	} else if *workers < 1 {
+		slog.Error("The -workers flag must be positive")
+		return exitUsage
+	}
+
+	r, err := openImportSource(*source)
+	if err != nil {
+		slog.Error("Failed to open archive", "err", err)
+		return exitCodeOf(err)
+	}
+	defer r.Close()
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	targetGmail, err := newGmailFromEnv("TARGET", 1, *workers, gcp.WithDryRun(*dryRun))
+	if err != nil {
+		slog.Error("Failed to create target Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(targetGmail)
+
+	if *label != "" && !*dryRun {
+		if err := targetGmail.CreateMailboxes(ctx, *label); err != nil {
+			slog.Error("Failed to create import label", "err", err, "label", *label)
+			return exitCodeOf(err)
+		}
+	}
+
+	stats := &importStats{}
+	if err := importMessages(ctx, targetGmail, r, *label, *workers, *dryRun, *takeout, stats); err != nil {
+		slog.Error("Import failed", "err", err, "imported", stats.imported.Load(), "existing", stats.existing.Load())
+		return exitCodeOf(err)
+	}
+	summary.Count("imported", stats.imported.Load())
+	summary.Count("existing", stats.existing.Load())
+	summary.Count("duplicates", stats.duplicates.Load())
+	slog.Info("Import completed",
+		"dryRun", *dryRun,
+		"imported", stats.imported.Load(),
+		"existing", stats.existing.Load(),
+		"duplicates", stats.duplicates.Load(),
+		"skippedChats", stats.chats.Load())
+	return exitOK
+}
+
+// openImportSource opens the given source of messages to import: a POP3 mailbox if given as a "pop3s://" (or, for
+// local test servers, "pop3://") URL, a JMAP account if given as a "jmaps://" (or "jmap://") URL, and otherwise a local
+// archive (see archive.Open). The POP3 username is taken from the URL or the POP3_USERNAME environment variable, and the
+// password from the POP3_PASSWORD environment variable. The JMAP bearer token is taken from the JMAP_TOKEN environment
+// variable.
+func openImportSource(source string) (archive.Reader, error) {
+	if strings.HasPrefix(source, "jmap://") || strings.HasPrefix(source, "jmaps://") {
+		return openJMAPSource(source)
+	} else if !strings.HasPrefix(source, "pop3://") && !strings.HasPrefix(source, "pop3s://") {
+		return archive.Open(source)
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid POP3 URL '%s': %w", errInvalidConfig, source, err)
+	}
+	useTLS := u.Scheme == "pop3s"
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), map[bool]string{true: "995", false: "110"}[useTLS])
+	}
+	username := cmp.Or(u.User.Username(), os.Getenv("POP3_USERNAME"))
+	password := os.Getenv("POP3_PASSWORD")
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("%w: POP3 mailboxes require a username (in the URL or POP3_USERNAME) and the POP3_PASSWORD environment variable", errInvalidConfig)
+	}
+	return pop3.Open(address, useTLS, username, password)
+}
+
+// openJMAPSource opens the JMAP account of the given "jmaps://host[:port]" URL for reading (see jmapSession).
+func openJMAPSource(source string) (archive.Reader, error) {
+	sessionURL, token, err := jmapSession(source)
+	if err != nil {
+		return nil, err
+	}
+	return jmap.Open(sessionURL, token)
+}
+
+// jmapSession returns the URL of the session resource of the JMAP account of the given "jmaps://host[:port]" (or, for
+// local test servers, "jmap://") URL, expected at the well-known path (RFC 8620, section 2.2) unless the URL has a path
+// of its own, along with the bearer token from the JMAP_TOKEN environment variable.
+func jmapSession(account string) (string, string, error) {
+	u, err := url.Parse(account)
+	if err != nil || u.Host == "" || (u.Scheme != "jmap" && u.Scheme != "jmaps") {
+		return "", "", fmt.Errorf("%w: invalid JMAP URL '%s'", errInvalidConfig, account)
+	}
+	token := os.Getenv("JMAP_TOKEN")
+	if token == "" {
+		return "", "", fmt.Errorf("%w: JMAP accounts require the JMAP_TOKEN environment variable", errInvalidConfig)
+	}
+	u.Scheme = map[bool]string{true: "https", false: "http"}[u.Scheme == "jmaps"]
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/.well-known/jmap"
+	}
+	return u.String(), token, nil
+}
+
+// contentMessageID returns a synthetic Message-ID for messages that have none, derived from the message content, so
+// that re-importing the same message finds the previously imported copy.
+func contentMessageID(raw []byte) string {
+	return fmt.Sprintf("<%x@gmail-organizer.invalid>", sha256.Sum256(raw))
+}
+
+// importMessages appends all messages read from the given archive to the given account, using the given number of
+// concurrent workers. Messages are identified by their Message-ID: messages already present in the account (e.g. from
+// a previous import) are skipped, which makes re-imports idempotent. Messages of Google Takeout exports have their
+// Takeout labels translated first (see applyTakeoutLabels).
+func importMessages(ctx context.Context, g *gcp.Gmail, r archive.Reader, label string, workers int, dryRun, takeout bool, stats *importStats) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	messagesCh := make(chan *imap.Message, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for msg := range messagesCh {
+				if err := importMessage(ctx, g, msg, dryRun, stats); err != nil {
+					cancel(err)
+				}
+			}
+		})
+	}
+
+	seen := make(map[string]bool)
+	var readErr error
+	for seq := uint32(1); ; seq++ {
+		m, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			readErr = fmt.Errorf("failed to read message %d from archive: %w", seq, err)
+			break
+		} else if takeout && !applyTakeoutLabels(m) {
+			stats.chats.Add(1)
+			continue
+		}
+
+		raw := m.Raw
+		messageID := m.Header("Message-ID")
+		if messageID == "" {
+			messageID = contentMessageID(raw)
+			raw = append([]byte("Message-ID: "+messageID+"\r\n"), raw...)
+		}
+		if seen[messageID] {
+			stats.duplicates.Add(1)
+			continue
+		}
+		seen[messageID] = true
+
+		labels := m.Labels
+		if label != "" && !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+		msg := &imap.Message{
+			Uid:          seq,
+			Flags:        slices.DeleteFunc(slices.Clone(m.Flags), func(f string) bool { return f == imap.RecentFlag }),
+			InternalDate: m.InternalDate,
+			Envelope:     &imap.Envelope{MessageId: messageID},
+			Body:         map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader(raw)},
+		}
+		gcp.SetLabels(msg, labels)
+
+		select {
+		case <-ctx.Done():
+		case messagesCh <- msg:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(messagesCh)
+	wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	} else if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// importMessage appends the given message to the given account, unless a message with the same Message-ID exists.
+func importMessage(ctx context.Context, g *gcp.Gmail, msg *imap.Message, dryRun bool, stats *importStats) error {
+	messageID := msg.Envelope.MessageId
+	if uid, err := g.FindUIDByMessageID(ctx, g.DefaultMailbox(), messageID); err != nil {
+		return fmt.Errorf("failed to search for message '%s': %w", messageID, err)
+	} else if uid != nil {
+		slog.Debug("Message already exists in target account", "messageID", messageID, "targetGmailUID", *uid)
+		stats.existing.Add(1)
+		return nil
+	}
+
+	if dryRun {
+		slog.Info("Importing message", "dryRun", true, "messageID", messageID, "flags", msg.Flags, "internalDate", msg.InternalDate, "items", msg.Items)
+	} else if _, err := g.AppendMessage(ctx, g.DefaultMailbox(), msg); err != nil {
+		return fmt.Errorf("failed to append message '%s': %w", messageID, err)
+	}
+	if n := stats.imported.Add(1); n%100 == 0 {
+		slog.Info("Imported messages", "imported", n)
+	}
+	return nil
+}
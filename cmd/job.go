@@ -1,112 +1,438 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"math"
+	"net/mail"
 	"os"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/arikkfir-org/gmail-organizer/internal/audit"
 	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/ledger"
+	"github.com/arikkfir-org/gmail-organizer/internal/maildate"
 	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+	"github.com/arikkfir-org/gmail-organizer/internal/notifications"
+	"github.com/arikkfir-org/gmail-organizer/internal/progress"
+	"github.com/arikkfir-org/gmail-organizer/internal/spool"
+	"github.com/arikkfir-org/gmail-organizer/internal/state"
 	"github.com/emersion/go-imap"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	messageMigrationConcurrency   = 5000
 	messageMigrationWorkers       = 10
-	sourceGmailConnectionsLimit   = 15
-	targetGmailConnectionsLimit   = 15
+	defaultGmailMinConnections    = 5
+	defaultGmailMaxConnections    = 15
 	messageEnvelopeFetchBatchSize = 500
+
+	defaultMailboxCollectionConcurrency = 4
+	defaultLargeMessageThreshold        = 10 * 1024 * 1024
+	defaultLargeMessageWorkers          = 2
+	defaultSpoolThreshold               = 10 * 1024 * 1024
+	defaultBodyChunkSize                = 4 * 1024 * 1024
+	defaultFetchSpoolMaxBytes           = 1024 * 1024 * 1024
+	defaultIdentityCacheSize            = 10000
 )
 
 type migrationRequest struct {
+	sourceMailbox  string
 	sourceGmailUID uint32
 	messageID      string
+	gmailMessageID uint64 // zero if unknown (e.g. on generic IMAP servers)
+	size           uint32
+	targetUID      uint32            // UID of the message in the target, as recorded by a previous run (zero if unknown)
+	targetPresent  *bool             // whether the message was found in the target when dispatched (nil if unknown)
+	collectedBy    trace.SpanContext // span of the collection that dispatched the request, linked from its migration
+	migratedBy     trace.SpanContext // span of the latest migration attempt of the request (set by migrateMessage)
 }
 
 type WorkerJob struct {
-	sourceGmail        *gcp.Gmail
-	targetGmail        *gcp.Gmail
-	reporter           *metrics.Reporter
-	maxEmailsToProcess uint64
-	jsonLogging        bool
-	dryRun             bool
-	messagesCh         chan *migrationRequest
-}
+	sourceGmail          *gcp.ReadOnlyGmail
+	targetGmail          *gcp.Gmail
+	metrics              *workerMetrics
+	ledger               *ledger.Ledger
+	audit                *audit.Log   // per-message records, separate from operational logs (nil if disabled)
+	labelState           *state.Store // labels seen by the previous run, for rename tracking (nil if disabled)
+	targetUIDs           *state.Store // target UIDs of migrated messages, recorded across runs (nil if disabled)
+	errors               *errorPolicy
+	maxEmailsToProcess   uint64
+	dryRun               bool
+	dryRunReport         *dryRunReport // planned changes of a dry run (nil unless dry-running)
+	dryRunReportPath     string
+	dateRepairs          *dateRepairReport // messages whose invalid internal dates were repaired
+	dateRepairReportPath string
+	verifyContent        bool
+	verifyThreads        bool
+	messagesCh           chan *migrationRequest
+	largeMessagesCh      chan *migrationRequest
+	messagesScheduler    *fairScheduler
+	largeScheduler       *fairScheduler
+	largeThreshold       uint32
+	largeWorkers         int
+	spoolThreshold       uint32
+	spoolDir             string
+	fetchSpool           *spool.Spool // bodies fetched but not yet appended (nil if disabled)
+	bodyChunkSize        int
+	lockTTL              time.Duration
+	forceLock            bool
+	keywords             *keywordMapper
+	identities           *identityCache
+	skips                *skipCounter
+	threads              *threadTracker
+	sourceMailboxes      []string
+	excludedLabels       []string
+	minUIDs              map[string]uint32 // if set, only messages with at least these UIDs are migrated, per mailbox
+	priorityMailboxes    []string
+	priorityRemaining    atomic.Int64 // messages of priority mailboxes not yet migrated, plus one until they're collected
+	skipEmptyLabels      bool
+	maxLabelCreations    int
+	labelNames           *labelSanitizer
+	collectionSlots      chan struct{} // bounds the number of mailboxes collected concurrently
+	progress             map[string]*mailboxProgress
+	events               *progress.Publisher
+	collected            sync.Map
+	collectedCount       atomic.Uint64
 
-func newWorkerJob() (*WorkerJob, error) {
+	notifier             *notifications.Notifier
+	failureRateThreshold float64
+	failureRateNotified  atomic.Bool
+	memory               *memoryWatermark   // bounds message bytes held in memory by workers (nil if unbounded)
+	control              *runControl        // pauses, resumes & aborts the run through the control API (nil if disabled)
+	schedule             *migrationSchedule // speed of the migration by time of day (nil if unrestricted)
+	workers              *workerLimit       // number of workers per lane migrating messages (nil if all of them)
+	failures             *runFailures       // failed messages, listed by the dashboard for retries (nil if disabled)
+	controlAddr          string
+	controlToken         string
+	controlTraceURL      string // link template of traces, for the dashboard
+	tui                  bool   // draw the run's progress on the terminal, rather than logging it
 
-	// Source Gmail account username
-	sourceAccountUsername := os.Getenv("SOURCE_ACCOUNT_USERNAME")
-	if sourceAccountUsername == "" {
-		return nil, fmt.Errorf("SOURCE_ACCOUNT_USERNAME environment variable is required")
-	}
+	statusInterval      time.Duration
+	dailyDownloadBudget int64
+	dailyUploadBudget   int64
+	startedAt           time.Time
+	processed           atomic.Uint64
+	appended            atomic.Uint64
+	updated             atomic.Uint64
+	mismatched          atomic.Uint64 // migrated messages whose content differs from the source (see verifyContentHash)
+	collectionDone      atomic.Bool
+}
 
-	// Source Gmail account password
-	sourceAccountPassword := os.Getenv("SOURCE_ACCOUNT_PASSWORD")
-	if sourceAccountPassword == "" {
-		return nil, fmt.Errorf("SOURCE_ACCOUNT_PASSWORD environment variable is required")
-	}
+// jobPaths are the destinations of a job's state files, logs & reports; empty ones are not kept.
+type jobPaths struct {
+	labelState       string // LABEL_STATE_PATH
+	targetUIDState   string // TARGET_UID_STATE_PATH, which may be the label state file
+	failureLedger    string // FAILURE_LEDGER_PATH
+	auditLog         string // AUDIT_LOG
+	dryRunReport     string // DRY_RUN_REPORT
+	dateRepairReport string // DATE_REPAIR_REPORT
+}
 
-	// Target Gmail account username
-	targetAccountUsername := os.Getenv("TARGET_ACCOUNT_USERNAME")
-	if targetAccountUsername == "" {
-		return nil, fmt.Errorf("TARGET_ACCOUNT_USERNAME environment variable is required")
+// jobPathsFromEnv returns the paths configured by the environment.
+func jobPathsFromEnv() jobPaths {
+	return jobPaths{
+		labelState:       os.Getenv("LABEL_STATE_PATH"),
+		targetUIDState:   os.Getenv("TARGET_UID_STATE_PATH"),
+		failureLedger:    os.Getenv("FAILURE_LEDGER_PATH"),
+		auditLog:         os.Getenv("AUDIT_LOG"),
+		dryRunReport:     os.Getenv("DRY_RUN_REPORT"),
+		dateRepairReport: os.Getenv("DATE_REPAIR_REPORT"),
 	}
+}
 
-	// Target Gmail account password
-	targetAccountPassword := os.Getenv("TARGET_ACCOUNT_PASSWORD")
-	if targetAccountPassword == "" {
-		return nil, fmt.Errorf("TARGET_ACCOUNT_PASSWORD environment variable is required")
-	}
+// newWorkerJob creates a migration job configured by the environment, keeping its state files, logs & reports in the
+// given paths. The source & target accounts are given by the environment too, unless given explicitly (e.g. by the
+// management API of the "serve" command).
+func newWorkerJob(forceLock bool, errorPolicyName string, maxFailures uint64, priorityLabels []string, notifier *notifications.Notifier, source, target *accountCredentials, paths jobPaths) (*WorkerJob, error) {
 
-	// Gmail account password
+	// Maximum number of messages to migrate
 	var maxEmailsToProcess uint64 = math.MaxUint64
 	if s, found := os.LookupEnv("MAX_EMAILS"); found {
 		if v, err := strconv.ParseUint(s, 10, 64); err != nil {
-			return nil, fmt.Errorf("failed to parse MAX_EMAILS environment variable: %w", err)
+			return nil, fmt.Errorf("%w: failed to parse MAX_EMAILS environment variable: %w", errInvalidConfig, err)
 		} else {
 			maxEmailsToProcess = v
 		}
 	}
 
-	sourceGmail, err := gcp.NewGmail(sourceAccountUsername, sourceAccountPassword, sourceGmailConnectionsLimit, 1*time.Hour)
+	// Source mailboxes to migrate messages from (defaults to the source account's mailbox of all messages)
+	sourceMailboxes := parseLabelList(os.Getenv("SOURCE_MAILBOXES"))
+
+	// Labels whose messages are not migrated, as Gmail reports them (e.g. "Receipts" or "\Important"); requires Gmail
+	// extensions in the source account
+	excludedLabels := parseLabelList(os.Getenv("EXCLUDE_LABELS"))
+
+	// Number of source mailboxes to collect messages from concurrently
+	mailboxConcurrency := defaultMailboxCollectionConcurrency
+	if s, found := os.LookupEnv("MAILBOX_COLLECTION_CONCURRENCY"); found {
+		if v, err := strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("%w: failed to parse MAILBOX_COLLECTION_CONCURRENCY environment variable: %w", errInvalidConfig, err)
+		} else if v < 1 {
+			return nil, fmt.Errorf("%w: MAILBOX_COLLECTION_CONCURRENCY environment variable must be positive", errInvalidConfig)
+		} else {
+			mailboxConcurrency = v
+		}
+	}
+
+	// Messages larger than this are migrated by a dedicated, low-concurrency set of workers
+	largeThreshold, err := lookupEnvInt("LARGE_MESSAGE_THRESHOLD", defaultLargeMessageThreshold)
+	if err != nil {
+		return nil, err
+	}
+	largeWorkers, err := lookupEnvInt("LARGE_MESSAGE_WORKERS", defaultLargeMessageWorkers)
+	if err != nil {
+		return nil, err
+	} else if largeWorkers < 1 {
+		return nil, fmt.Errorf("%w: LARGE_MESSAGE_WORKERS environment variable must be positive", errInvalidConfig)
+	}
+
+	// Messages larger than this are downloaded in chunks & spooled to disk before being appended
+	spoolThreshold, err := lookupEnvInt("SPOOL_THRESHOLD", defaultSpoolThreshold)
+	if err != nil {
+		return nil, err
+	}
+	bodyChunkSize, err := lookupEnvInt("BODY_CHUNK_SIZE", defaultBodyChunkSize)
+	if err != nil {
+		return nil, err
+	} else if bodyChunkSize < 1 {
+		return nil, fmt.Errorf("%w: BODY_CHUNK_SIZE environment variable must be positive", errInvalidConfig)
+	}
+	spoolDir := os.Getenv("SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+
+	// Bodies fetched but not yet appended are optionally kept on disk, surviving failed appends & restarts
+	fetchSpoolMaxBytes, err := lookupEnvInt("FETCH_SPOOL_MAX_BYTES", defaultFetchSpoolMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	fetchSpool, err := spool.Open(os.Getenv("FETCH_SPOOL_DIR"), int64(fetchSpoolMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock labels of other runs not refreshed within this period are considered stale
+	lockTTL, err := lookupEnvDuration("LOCK_TTL", defaultLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Interval of run status logs, and the daily bandwidth budgets they report usage against
+	statusInterval, err := lookupEnvDuration("STATUS_INTERVAL", defaultStatusInterval)
+	if err != nil {
+		return nil, err
+	}
+	dailyDownloadBudget, err := lookupEnvInt("DAILY_DOWNLOAD_BUDGET", defaultDailyDownloadBudget)
+	if err != nil {
+		return nil, err
+	}
+	dailyUploadBudget, err := lookupEnvInt("DAILY_UPLOAD_BUDGET", defaultDailyUploadBudget)
+	if err != nil {
+		return nil, err
+	}
+
+	// Translation table for custom keywords (e.g. colored stars) of source messages
+	keywords, err := loadKeywordMapper(os.Getenv("KEYWORD_MAPPINGS_PATH"))
+	if err != nil {
+		return nil, err
+	}
+	maxLabelCreations, err := lookupEnvInt("MAX_LABEL_CREATIONS", defaultMaxLabelCreations)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := loadMigrationSchedule(os.Getenv("SCHEDULE_PATH"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The control API can pause & abort the run, so it requires a token unless it is only reachable locally
+	controlAddr, controlToken := os.Getenv("CONTROL_ADDR"), os.Getenv("CONTROL_TOKEN")
+	if controlAddr != "" && controlToken == "" && !isLoopbackAddr(controlAddr) && !lookupEnvBool("CONTROL_ALLOW_NO_AUTH", false) {
+		return nil, fmt.Errorf("%w: CONTROL_TOKEN is required when serving the control API on other addresses than loopback ones (set CONTROL_ALLOW_NO_AUTH=true to let anyone reaching it pause & abort the run)", errInvalidConfig)
+	} else if controlAddr != "" && controlToken == "" {
+		slog.Warn("CONTROL_TOKEN is not set, so anyone reaching the control API can pause & abort the run", "addr", controlAddr)
+	}
+
+	// Number of recent target presence decisions to cache (zero disables the cache)
+	identityCacheSize, err := lookupEnvInt("IDENTITY_CACHE_SIZE", defaultIdentityCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	failureRateThreshold, err := lookupFailureRateThreshold()
+	if err != nil {
+		return nil, err
+	}
+
+	memory, err := newMemoryWatermarkFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Label rename tracking is only enabled with a file to keep the labels of previous runs in
+	labelState, err := state.Open(paths.labelState)
+	if err != nil {
+		return nil, err
+	}
+
+	// Target UIDs of migrated messages are only recorded with a file to keep them in; it may be the label state file
+	targetUIDs := labelState
+	if paths.targetUIDState != paths.labelState {
+		if targetUIDs, err = state.Open(paths.targetUIDState); err != nil {
+			return nil, err
+		}
+	}
+
+	// Dry runs are enforced by the target pool itself, so no code path can modify the target account; the source
+	// account is never modified, which its read-only pool guarantees regardless of dry runs
+	dryRun := lookupEnvBool("DRY_RUN", false)
+
+	sourcePool, err := newGmailFromEnvAs("SOURCE", source, defaultGmailMinConnections, defaultGmailMaxConnections)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create source Gmail connection: %w", err)
 	}
+	sourceGmail := sourcePool.ReadOnly()
+	if len(sourceMailboxes) == 0 {
+		sourceMailboxes = []string{sourceGmail.DefaultMailbox()}
+	}
+	sourceMailboxes, priorityMailboxes := prioritizeMailboxes(sourceMailboxes, priorityLabels, sourceGmail.GmailExtensions())
+	if len(excludedLabels) > 0 && !sourceGmail.GmailExtensions() {
+		go closeGmail(sourceGmail)
+		return nil, fmt.Errorf("%w: EXCLUDE_LABELS requires Gmail extensions in the source account (list the mailboxes to migrate in SOURCE_MAILBOXES instead)", errInvalidConfig)
+	}
 
-	targetGmail, err := gcp.NewGmail(targetAccountUsername, targetAccountPassword, targetGmailConnectionsLimit, 1*time.Hour)
+	targetGmail, err := newGmailFromEnvAs("TARGET", target, defaultGmailMinConnections, defaultGmailMaxConnections, gcp.WithDryRun(dryRun))
 	if err != nil {
-		go sourceGmail.Close()
+		go closeGmail(sourceGmail)
 		return nil, fmt.Errorf("failed to create target Gmail connection: %w", err)
 	}
 
 	reporter, err := metrics.NewReporter("worker")
 	if err != nil {
-		go sourceGmail.Close()
-		go targetGmail.Close()
+		go closeGmail(sourceGmail, targetGmail)
 		return nil, fmt.Errorf("failed to create metrics reporter: %w", err)
 	}
 
+	failureLedger, err := ledger.NewLedger(paths.failureLedger)
+	if err != nil {
+		go closeGmail(sourceGmail, targetGmail)
+		return nil, fmt.Errorf("failed to create failure ledger: %w", err)
+	}
+
+	auditLog, err := audit.Open(context.Background(), paths.auditLog)
+	if err != nil {
+		go closeGmail(sourceGmail, targetGmail)
+		_ = failureLedger.Close()
+		return nil, fmt.Errorf("failed to create audit log: %w", err)
+	}
+
+	instruments := newWorkerMetrics(reporter)
+	policy, err := newErrorPolicy(errorPolicyName, maxFailures, failureLedger, instruments.failedUnits)
+	if err != nil {
+		go closeGmail(sourceGmail, targetGmail)
+		_ = failureLedger.Close()
+		_ = auditLog.Close()
+		return nil, err
+	}
+
+	var report *dryRunReport
+	if dryRun {
+		report = newDryRunReport()
+	}
+
+	// Lanes are barely buffered, so the fair schedulers decide which mailbox's messages are migrated next
+	messagesCh := make(chan *migrationRequest, messageMigrationWorkers)
+	largeMessagesCh := make(chan *migrationRequest, largeWorkers)
+	progressByMailbox := make(map[string]*mailboxProgress, len(sourceMailboxes))
+	for _, mailbox := range sourceMailboxes {
+		progressByMailbox[mailbox] = &mailboxProgress{}
+	}
+
 	return &WorkerJob{
-		sourceGmail:        sourceGmail,
-		targetGmail:        targetGmail,
-		reporter:           reporter,
-		maxEmailsToProcess: maxEmailsToProcess,
-		jsonLogging:        slices.Contains([]string{"t", "true", "y", "yes", "1", "ok", "on"}, os.Getenv("JSON_LOGGING")),
-		dryRun:             os.Getenv("DRY_RUN") != "" || slices.Contains([]string{"t", "true", "y", "yes", "1", "ok", "on"}, os.Getenv("DRY_RUN")),
-		messagesCh:         make(chan *migrationRequest, messageMigrationConcurrency),
+		sourceGmail:          sourceGmail,
+		targetGmail:          targetGmail,
+		metrics:              instruments,
+		ledger:               failureLedger,
+		audit:                auditLog,
+		labelState:           labelState,
+		targetUIDs:           targetUIDs,
+		errors:               policy,
+		maxEmailsToProcess:   maxEmailsToProcess,
+		dryRun:               dryRun,
+		dryRunReport:         report,
+		dryRunReportPath:     paths.dryRunReport,
+		dateRepairs:          &dateRepairReport{},
+		dateRepairReportPath: paths.dateRepairReport,
+		verifyContent:        lookupEnvBool("VERIFY_CONTENT", false),
+		verifyThreads:        lookupEnvBool("VERIFY_THREADS", false),
+		messagesCh:           messagesCh,
+		largeMessagesCh:      largeMessagesCh,
+		messagesScheduler:    newFairScheduler(sourceMailboxes, priorityMailboxes, messagesCh),
+		largeScheduler:       newFairScheduler(sourceMailboxes, priorityMailboxes, largeMessagesCh),
+		largeThreshold:       uint32(min(largeThreshold, math.MaxUint32)),
+		largeWorkers:         largeWorkers,
+		spoolThreshold:       uint32(min(spoolThreshold, math.MaxUint32)),
+		spoolDir:             spoolDir,
+		fetchSpool:           fetchSpool,
+		bodyChunkSize:        bodyChunkSize,
+		lockTTL:              lockTTL,
+		forceLock:            forceLock,
+		keywords:             keywords,
+		identities:           newIdentityCache(identityCacheSize),
+		skips:                newSkipCounter(instruments.skipped),
+		threads:              newThreadTracker(),
+		sourceMailboxes:      sourceMailboxes,
+		excludedLabels:       excludedLabels,
+		priorityMailboxes:    priorityMailboxes,
+		skipEmptyLabels:      lookupEnvBool("SKIP_EMPTY_LABELS", false),
+		maxLabelCreations:    maxLabelCreations,
+		labelNames:           newLabelSanitizer(),
+		collectionSlots:      make(chan struct{}, mailboxConcurrency),
+		progress:             progressByMailbox,
+		events:               progress.New(),
+
+		notifier:             notifier,
+		failureRateThreshold: failureRateThreshold,
+		memory:               memory,
+		schedule:             schedule,
+		controlAddr:          controlAddr,
+		controlToken:         controlToken,
+		controlTraceURL:      os.Getenv("CONTROL_TRACE_URL"),
+
+		statusInterval:      statusInterval,
+		dailyDownloadBudget: int64(dailyDownloadBudget),
+		dailyUploadBudget:   int64(dailyUploadBudget),
 	}, nil
 }
 
+// Progress returns the publisher of this job's progress events, for embedding applications to subscribe to.
+func (j *WorkerJob) Progress() *progress.Publisher {
+	return j.events
+}
+
 func (j *WorkerJob) Close() {
-	j.sourceGmail.Close()
-	j.targetGmail.Close()
+	closeGmail(j.sourceGmail, j.targetGmail)
+	if err := j.ledger.Close(); err != nil {
+		slog.Warn("Failed to close failure ledger", "err", err)
+	}
+	if err := j.audit.Close(); err != nil {
+		slog.Warn("Failed to close audit log", "err", err)
+	}
 }
 
 func (j *WorkerJob) Run(ctx context.Context) error {
@@ -114,19 +440,81 @@ func (j *WorkerJob) Run(ctx context.Context) error {
 	ctx, span := tr.Start(ctx, "Run")
 	defer span.End()
 
+	// Aborting through the control API cancels the run like an interruption, so its state is saved on the way out
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+
+	// Prevent concurrent runs against the same target account (dry runs do not modify the target)
+	if !j.dryRun {
+		lock, err := acquireLabelLock(ctx, j.targetGmail, j.lockTTL, j.forceLock)
+		if err != nil {
+			return fmt.Errorf("failed to lock target account: %w", err)
+		}
+		defer func() {
+			if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+				slog.Warn("Failed to release target account lock", "err", err)
+			}
+		}()
+	}
+
+	if err := j.validateTargetUIDs(ctx); err != nil {
+		return err
+	}
+	defer j.saveTargetUIDs()
+
+	if j.dryRunReport != nil {
+		defer j.writeDryRunReport(ctx)
+	}
+	defer j.writeDateRepairReport()
+	defer func() {
+		if failures := j.errors.Failures(); failures > 0 {
+			slog.Warn("Some messages failed to migrate; see the failure ledger for details", "failures", failures)
+		}
+	}()
 	if err := j.migrateMailboxes(ctx); err != nil {
 		return fmt.Errorf("failed to migrate mailboxes: %w", err)
 	}
+	defer j.skips.LogSummary()
+
+	j.startedAt = time.Now()
+	statusCtx, stopStatus := context.WithCancel(ctx)
+	defer stopStatus()
+	if j.tui {
+		stopTUI := j.startTUI(statusCtx)
+		defer stopTUI()
+	} else {
+		go j.reportStatus(statusCtx)
+	}
+	go j.reportGauges(statusCtx)
+	go j.saveTargetUIDsPeriodically(statusCtx)
+	if j.controlAddr != "" {
+		j.control, j.failures = newRunControl(), newRunFailures()
+		go func() {
+			if err := j.serveControl(statusCtx, j.controlAddr, j.controlToken, abort); err != nil {
+				slog.Error("Control API failed", "err", err, "addr", j.controlAddr)
+			}
+		}()
+	}
 
+	go j.messagesScheduler.Run(ctx)
+	go j.largeScheduler.Run(ctx)
 	collectionErrorCh := make(chan error, 1)
 	go func() {
 		collectionErrorCh <- j.collectMessagesForMigration(ctx)
 	}()
 
-	migrationErrorCh := make(chan error, messageMigrationWorkers)
+	// Large messages are migrated by their own (smaller) set of workers, so they don't stall the small messages lane;
+	// since each worker holds at most one connection of each pool, this also bounds their share of the connections
+	totalWorkers := messageMigrationWorkers + j.largeWorkers
+	migrationErrorCh := make(chan error, totalWorkers)
 	for i := 0; i < messageMigrationWorkers; i++ {
 		go func(worker int) {
-			migrationErrorCh <- j.migrateMessages(ctx, worker)
+			migrationErrorCh <- j.migrateMessages(ctx, "regular", worker, j.messagesCh)
+		}(i)
+	}
+	for i := 0; i < j.largeWorkers; i++ {
+		go func(worker int) {
+			migrationErrorCh <- j.migrateMessages(ctx, "large", worker, j.largeMessagesCh)
 		}(i)
 	}
 
@@ -134,12 +522,14 @@ func (j *WorkerJob) Run(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return context.Cause(ctx)
 		case err := <-collectionErrorCh:
 			if err != nil {
 				return fmt.Errorf("failed during message collection for migration: %w", err)
 			} else {
+				j.collectionDone.Store(true)
 				slog.Info("Message collection done")
+				j.events.Publish(progress.Event{Kind: progress.KindCollectionDone, Done: j.processed.Load(), Total: j.total()})
 			}
 		case err := <-migrationErrorCh:
 			if err != nil {
@@ -147,7 +537,7 @@ func (j *WorkerJob) Run(ctx context.Context) error {
 			} else {
 				done++
 				slog.Info("Migration worker done", "workersDone", done)
-				if done == messageMigrationWorkers {
+				if done == totalWorkers {
 					return nil
 				}
 			}
@@ -155,34 +545,33 @@ func (j *WorkerJob) Run(ctx context.Context) error {
 	}
 }
 
+// migrateMailboxes recreates the label hierarchy of the source account in the target account, first renaming labels
+// renamed in the source since the previous run (if tracked).
 func (j *WorkerJob) migrateMailboxes(ctx context.Context) error {
 	tr := otel.Tracer("worker")
 	ctx, span := tr.Start(ctx, "migrateMailboxes")
 	defer span.End()
 
-	slog.Info("Fetching source mailbox names")
-	sourceMailboxNames, err := j.sourceGmail.FetchMailboxNames(ctx, true, false)
-	if err != nil {
-		return fmt.Errorf("failed to fetch source mailbox names: %w", err)
-	}
-
-	slog.Info("Fetching target mailbox names")
-	targetMailboxNames, err := j.targetGmail.FetchMailboxNames(ctx, true, false)
-	if err != nil {
-		return fmt.Errorf("failed to fetch target mailbox names: %w", err)
-	}
-	var missingMailboxNames []string
-	for _, targetMailboxName := range targetMailboxNames {
-		if !slices.Contains(sourceMailboxNames, targetMailboxName) {
-			missingMailboxNames = append(missingMailboxNames, targetMailboxName)
+	if j.labelState != nil {
+		slog.Info("Tracking label renames in source account")
+		if err := trackLabelRenames(ctx, j.sourceGmail, j.targetGmail, j.labelState, j.dryRun); err != nil {
+			// Renamed labels are then synced as new labels, leaving the old ones in the target
+			if err := j.errors.Handle(ctx, failureStageLabels, ledger.Entry{}, fmt.Errorf("failed to track label renames: %w", err)); err != nil {
+				return err
+			}
 		}
 	}
 
-	slog.Info("Creating mailboxes in target account")
-	if err := j.targetGmail.CreateMailboxes(ctx, missingMailboxNames...); err != nil {
-		return fmt.Errorf("failed to create mailboxes: %w", err)
+	slog.Info("Syncing label structure to target account", "skipEmpty", j.skipEmptyLabels)
+	if _, err := syncLabelStructure(ctx, j.sourceGmail, j.targetGmail, j.labelNames, j.skipEmptyLabels, j.maxLabelCreations, j.dryRun); err != nil {
+		if errors.Is(err, errLabelExplosion) {
+			return err
+		}
+		// Messages of missing labels will fail to be labeled, and are handled by the error policy then
+		if err := j.errors.Handle(ctx, failureStageLabels, ledger.Entry{}, err); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
@@ -191,104 +580,499 @@ func (j *WorkerJob) collectMessagesForMigration(ctx context.Context) error {
 	ctx, span := tr.Start(ctx, "collectMessagesForMigration")
 	defer span.End()
 
-	// Iterate messages one by one and fetch
-	slog.Info("Fetching messages for migration")
-	allUIDs, err := j.sourceGmail.FindAllUIDs(ctx, gcp.GmailAllMailLabel)
-	if err != nil {
-		return fmt.Errorf("failed to find all UIDs: %w", err)
+	// Collect the priority mailboxes first, so their messages are queued (and migrated) before those of other mailboxes
+	others := slices.DeleteFunc(slices.Clone(j.sourceMailboxes), func(mailbox string) bool {
+		return slices.Contains(j.priorityMailboxes, mailbox)
+	})
+	if len(j.priorityMailboxes) > 0 {
+		j.priorityRemaining.Add(1)
+		slog.Info("Collecting priority labels first", "labels", j.priorityMailboxes)
+		if err := j.collectMailboxes(ctx, j.priorityMailboxes); err != nil {
+			return err
+		}
+		j.priorityMessageDone()
+	}
+	if err := j.collectMailboxes(ctx, others); err != nil {
+		return err
 	}
 
-	slog.Info("Sorting for consistency", "size", len(allUIDs))
-	slices.Sort(allUIDs)
+	j.messagesScheduler.Close()
+	j.largeScheduler.Close()
+	return nil
+}
 
-	if uint64(len(allUIDs)) > j.maxEmailsToProcess {
-		allUIDs = allUIDs[:int(j.maxEmailsToProcess)]
+// collectMailboxes collects messages from the given mailboxes concurrently, bounded by the configured mailbox
+// concurrency; mailboxes whose collection is blocked waiting for their turn in the fair schedulers give up their slot
+// meanwhile.
+func (j *WorkerJob) collectMailboxes(ctx context.Context, mailboxes []string) error {
+	errs := make(chan error, len(mailboxes))
+	var wg sync.WaitGroup
+	for _, mailbox := range mailboxes {
+		wg.Go(func() {
+			j.collectionSlots <- struct{}{}
+			defer func() { <-j.collectionSlots }()
+			err := j.collectMailboxMessagesForMigration(ctx, mailbox)
+			if err != nil {
+				err = fmt.Errorf("failed to collect messages from '%s': %w", mailbox, err)
+			}
+			if err := j.errors.Handle(ctx, failureStageCollection, ledger.Entry{}, err); err != nil {
+				errs <- err
+			}
+		})
 	}
-	slog.Info("Collected message set for migration", "size", len(allUIDs))
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
 
-	// Process in chunks to avoid fetching all UIDs at once
-	chunks := slices.Collect(slices.Chunk(allUIDs, messageEnvelopeFetchBatchSize))
-	for chunkNumber, chunkUIDs := range chunks {
-		slog.Info("Migrating chunk", "chunkIndex", chunkNumber)
-		messages, err := j.sourceGmail.FetchByUIDs(ctx, gcp.GmailAllMailLabel, chunkUIDs, imap.FetchEnvelope)
+func (j *WorkerJob) collectMailboxMessagesForMigration(ctx context.Context, mailbox string) error {
+	tr := otel.Tracer("worker")
+	ctx, span := tr.Start(ctx, fmt.Sprintf("collectMailboxMessagesForMigration(%s)", mailbox), trace.WithAttributes(attribute.String("sourceMailbox", mailbox)))
+	defer span.End()
+
+	// Chat transcripts are not email, and appending them would turn them into email in the target
+	if mailbox == gmailChatsMailbox && j.sourceGmail.GmailExtensions() {
+		n, err := j.sourceGmail.CountMessages(ctx, mailbox)
 		if err != nil {
-			return fmt.Errorf("failed to fetch messages for chunk %d: %w", chunkNumber, err)
+			return fmt.Errorf("failed to count chat messages: %w", err)
+		}
+		j.metrics.sourceEmails.Add(ctx, int64(n))
+		j.skips.Add(ctx, skipReasonChatMessage, uint64(n))
+		slog.Info("Skipping chat messages", "mailbox", mailbox, "messages", n)
+		return nil
+	}
+
+	// Iterate messages page by page, dispatching them for migration in batches
+	slog.Info("Fetching messages for migration", "mailbox", mailbox)
+	opts := gcp.IterateOptions{
+		Items:    []imap.FetchItem{imap.FetchEnvelope, imap.FetchRFC822Size, gcp.GmailMsgIDExt},
+		PageSize: messageEnvelopeFetchBatchSize,
+		Matched: func(n int) {
+			j.progress[mailbox].matched.Store(min(uint64(n), j.maxEmailsToProcess))
+			j.events.Publish(progress.Event{
+				Kind:    progress.KindMailboxMatched,
+				Mailbox: mailbox,
+				Matched: min(uint64(n), j.maxEmailsToProcess),
+				Done:    j.processed.Load(),
+				Total:   j.total(),
+			})
+			if uint64(n) > j.maxEmailsToProcess {
+				j.metrics.sourceEmails.Add(ctx, int64(uint64(n)-j.maxEmailsToProcess))
+				j.skips.Add(ctx, skipReasonOverLimit, uint64(n)-j.maxEmailsToProcess)
+			}
+			slog.Info("Collected message set for migration", "mailbox", mailbox, "size", min(uint64(n), j.maxEmailsToProcess))
+		},
+	}
+	if len(j.excludedLabels) > 0 {
+		opts.Items = append(opts.Items, gcp.GmailLabelsExt)
+	}
+	if j.maxEmailsToProcess < math.MaxInt {
+		opts.Limit = int(j.maxEmailsToProcess)
+	}
+	minUID := j.minUIDs[mailbox]
+	if minUID > 1 {
+		opts.Criteria = imap.NewSearchCriteria()
+		opts.Criteria.Uid = new(imap.SeqSet)
+		opts.Criteria.Uid.AddRange(minUID, 0)
+	}
+
+	var requests []*migrationRequest
+	batchNumber := 0
+	dispatch := func() error {
+		if len(requests) == 0 {
+			return nil
+		}
+		slog.Info("Migrating batch", "mailbox", mailbox, "batchIndex", batchNumber)
+		if err := j.dispatchMigrationRequests(ctx, requests); err != nil {
+			return fmt.Errorf("failed to dispatch messages of batch %d: %w", batchNumber, err)
+		}
+		requests = nil
+		batchNumber++
+		return nil
+	}
+	for msg, err := range j.sourceGmail.Iterate(ctx, mailbox, opts) {
+		if err != nil {
+			return fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		if msg.Uid < minUID {
+			// A UID range always matches the mailbox's last message, even if it's below the range
+			continue
+		}
+		j.metrics.sourceEmails.Inc(ctx)
+		if msg.Envelope == nil {
+			if err := j.errors.Handle(ctx, failureStageCollection, ledger.Entry{SourceUID: msg.Uid}, fmt.Errorf("failed to fetch envelope of UID '%d'", msg.Uid)); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(j.excludedLabels) > 0 {
+			labels, err := gcp.GetLabels(msg)
+			if err != nil {
+				if err := j.errors.Handle(ctx, failureStageCollection, ledger.Entry{SourceUID: msg.Uid}, fmt.Errorf("failed to get labels of UID '%d': %w", msg.Uid, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			if slices.ContainsFunc(labels, func(label string) bool { return slices.Contains(j.excludedLabels, label) }) {
+				j.skips.Add(ctx, skipReasonFilteredByLabel, 1)
+				continue
+			}
+		}
+		gmailMessageID, err := gcp.GetGmailMessageID(msg)
+		if err != nil {
+			if err := j.errors.Handle(ctx, failureStageCollection, ledger.Entry{SourceUID: msg.Uid}, fmt.Errorf("failed to get Gmail message ID of UID '%d': %w", msg.Uid, err)); err != nil {
+				return err
+			}
+			continue
 		}
-		for _, msg := range messages {
-			if msg.Envelope == nil {
-				return fmt.Errorf("failed to fetch envelope of UID '%d'", msg.Uid)
+		messageID := msg.Envelope.MessageId
+		if messageID == "" {
+			// Messages without a Message-ID get a synthetic one, derived from their (stable) Gmail message ID or
+			// content, which is injected as a header when appending, so they can be found in the target on later runs
+			if messageID, err = syntheticMessageID(ctx, j.sourceGmail, mailbox, msg, gmailMessageID); err != nil {
+				if err := j.errors.Handle(ctx, failureStageCollection, ledger.Entry{SourceUID: msg.Uid}, fmt.Errorf("failed to derive a Message-ID for UID '%d': %w", msg.Uid, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			slog.Debug("Using synthetic Message-ID", "sourceGmailUID", msg.Uid, "messageID", messageID)
+			j.metrics.syntheticMessageIDs.Inc(ctx)
+		}
+
+		// The same message appears in every mailbox (label) it belongs to - only migrate it once
+		var identity any = messageID
+		if gmailMessageID != 0 {
+			identity = gmailMessageID
+		}
+		if _, seen := j.collected.LoadOrStore(identity, true); seen {
+			j.skips.Add(ctx, skipReasonDuplicate, 1)
+			continue
+		} else if j.collectedCount.Add(1) > j.maxEmailsToProcess {
+			j.skips.Add(ctx, skipReasonOverLimit, 1)
+			if err := dispatch(); err != nil {
+				return err
+			}
+			slog.Info("Reached maximum number of messages to process", "mailbox", mailbox)
+			return nil
+		}
+
+		j.metrics.messageSize.Record(ctx, int64(msg.Size))
+		j.progress[mailbox].collected.Add(1)
+		if slices.Contains(j.priorityMailboxes, mailbox) {
+			j.priorityRemaining.Add(1)
+		}
+		requests = append(requests, &migrationRequest{
+			sourceMailbox:  mailbox,
+			sourceGmailUID: msg.Uid,
+			messageID:      messageID,
+			gmailMessageID: gmailMessageID,
+			size:           msg.Size,
+			targetUID:      j.targetUIDs.TargetUID(gmailMessageID),
+			collectedBy:    span.SpanContext(),
+		})
+		if len(requests) == messageEnvelopeFetchBatchSize {
+			if err := dispatch(); err != nil {
+				return err
+			}
+		}
+	}
+	return dispatch()
+}
+
+// syntheticMessageIDTextPrefix is the number of bytes of a message's text hashed into its synthetic Message-ID, when it
+// has no Gmail message ID to derive one from.
+const syntheticMessageIDTextPrefix = 1024
+
+// syntheticMessageID returns a stable Message-ID for the given message of the given mailbox, which has none: derived
+// from its Gmail message ID if it has one, or else from its date, senders, subject and a prefix of its text (e.g. for
+// sources without Gmail extensions).
+func syntheticMessageID(ctx context.Context, g *gcp.ReadOnlyGmail, mailbox string, msg *imap.Message, gmailMessageID uint64) (string, error) {
+	if gmailMessageID != 0 {
+		return gcp.SyntheticMessageID(gmailMessageID), nil
+	}
+	text, err := g.FetchTextPrefix(ctx, mailbox, msg.Uid, syntheticMessageIDTextPrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch text of message: %w", err)
+	}
+	return gcp.ContentMessageID(msg.Envelope, text), nil
+}
+
+// dispatchMigrationRequests checks which of the given messages are already present in the target account, with a few
+// batched searches rather than one search per message, and queues the requests for the migration workers in the fair
+// scheduler of their lane. Messages with target UIDs recorded by previous runs are assumed present, and not searched.
+func (j *WorkerJob) dispatchMigrationRequests(ctx context.Context, requests []*migrationRequest) error {
+	if err := j.control.Wait(ctx); err != nil {
+		return err
+	}
+
+	var unknown []*migrationRequest
+	var messageIDs []string
+	for _, r := range requests {
+		if r.targetUID != 0 {
+			present := true
+			r.targetPresent = &present
+		} else if _, cached := j.identities.Get(r.messageID); !cached {
+			unknown = append(unknown, r)
+			messageIDs = append(messageIDs, r.messageID)
+		}
+	}
+	if len(unknown) > 0 {
+		found, err := j.targetGmail.FindUIDsByMessageIDs(ctx, j.targetGmail.DefaultMailbox(), messageIDs)
+		if err != nil {
+			// If tolerated, the workers search for the messages one by one instead
+			if err := j.errors.Handle(ctx, failureStageCollection, ledger.Entry{}, fmt.Errorf("failed to search for messages in target account: %w", err)); err != nil {
+				return err
 			}
-			j.messagesCh <- &migrationRequest{
-				sourceGmailUID: msg.Uid,
-				messageID:      msg.Envelope.MessageId,
+		} else {
+			for _, r := range unknown {
+				_, present := found[r.messageID]
+				r.targetPresent = &present
 			}
 		}
 	}
 
-	close(j.messagesCh)
+	for _, r := range requests {
+		scheduler := j.messagesScheduler
+		if r.size > j.largeThreshold {
+			scheduler = j.largeScheduler
+		}
+		if err := scheduler.Enqueue(ctx, r, j.collectionSlots); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (j *WorkerJob) migrateMessages(ctx context.Context, worker int) error {
+func (j *WorkerJob) migrateMessages(ctx context.Context, lane string, worker int, messagesCh <-chan *migrationRequest) error {
 	tr := otel.Tracer("worker")
-	ctx, span := tr.Start(ctx, fmt.Sprintf("migrateMessages(%d)", worker))
+	ctx, span := tr.Start(ctx, fmt.Sprintf("migrateMessages(%s/%d)", lane, worker))
 	defer span.End()
 
 	ticker := time.NewTicker(10 * time.Second)
 	for {
 		select {
 		case <-ctx.Done():
-			slog.Warn("Worker done due to context being done", "worker", worker)
+			slog.Warn("Worker done due to context being done", "lane", lane, "worker", worker)
 			return ctx.Err()
-		case r, more := <-j.messagesCh:
+		case r, more := <-messagesCh:
 			if !more {
-				slog.Info("Worker done, no more messages (channel closed)", "worker", worker)
+				slog.Info("Worker done, no more messages (channel closed)", "lane", lane, "worker", worker)
 				return nil
 			} else if r == nil {
-				slog.Info("Worker done, no more messages (received nil message)", "worker", worker)
+				slog.Info("Worker done, no more messages (received nil message)", "lane", lane, "worker", worker)
 				return nil
 			} else {
-				slog.Debug("Migrating message", "worker", worker, "more", more, "messageID", r.messageID)
-				if err := j.migrateMessage(ctx, r.sourceGmailUID, r.messageID); err != nil {
-					return fmt.Errorf("failed to migrate message '%s' (%d): %w", r.messageID, r.sourceGmailUID, err)
+				slog.Debug("Migrating message", "lane", lane, "worker", worker, "more", more, "messageID", r.messageID)
+				// Bodies of spooled messages are only held in memory one chunk at a time
+				inMemory := int64(r.size)
+				if r.size > j.spoolThreshold {
+					inMemory = int64(min(int(r.size), j.bodyChunkSize))
+				}
+				if err := j.schedule.Wait(ctx, worker); err != nil {
+					slog.Warn("Worker done due to context being done", "lane", lane, "worker", worker)
+					return err
+				}
+				if err := j.workers.Wait(ctx, worker); err != nil {
+					slog.Warn("Worker done due to context being done", "lane", lane, "worker", worker)
+					return err
+				}
+				if err := j.control.Begin(ctx); err != nil {
+					slog.Warn("Worker done due to context being done", "lane", lane, "worker", worker)
+					return err
+				}
+				if err := j.memory.Acquire(ctx, inMemory); err != nil {
+					j.control.End()
+					slog.Warn("Worker done due to context being done", "lane", lane, "worker", worker)
+					return err
+				}
+				started := time.Now()
+				record := audit.Record{SourceMailbox: r.sourceMailbox, SourceUID: r.sourceGmailUID, MessageID: r.messageID, Bytes: r.size, DryRun: j.dryRun}
+				migrationErr := j.migrateMessage(ctx, r, &record)
+				j.memory.Release(inMemory)
+				j.control.End()
+				record.DurationMS = time.Since(started).Milliseconds()
+				if migrationErr != nil {
+					record.Outcome, record.Error = audit.OutcomeFailed, migrationErr.Error()
+				}
+				if err := j.audit.Record(record); err != nil {
+					return err
+				}
+				if migrationErr != nil {
+					stage := failureStageMigration
+					if errors.Is(migrationErr, errLabelUpdate) {
+						stage = failureStageLabels
+					}
+					migrationErr = fmt.Errorf("failed to migrate message '%s' (%d): %w", r.messageID, r.sourceGmailUID, migrationErr)
+					if err := j.errors.Handle(ctx, stage, ledger.Entry{SourceUID: r.sourceGmailUID, MessageID: r.messageID}, migrationErr); err != nil {
+						return err
+					}
+					j.failures.Add(r, stage, migrationErr)
+				}
+				j.events.Publish(progress.Event{
+					Kind:      progress.KindMessageDone,
+					Mailbox:   r.sourceMailbox,
+					MessageID: r.messageID,
+					SourceUID: r.sourceGmailUID,
+					Err:       migrationErr,
+					Done:      j.processed.Add(1),
+					Total:     j.total(),
+				})
+				j.checkFailureRate(ctx)
+				j.progress[r.sourceMailbox].done.Add(1)
+				if slices.Contains(j.priorityMailboxes, r.sourceMailbox) {
+					j.priorityMessageDone()
 				}
 			}
 			ticker.Reset(10 * time.Second)
 		case <-ticker.C:
-			slog.Info("Worker idle for 10sec...")
+			slog.Info("Worker idle for 10sec...", "lane", lane, "worker", worker)
 		}
 	}
 }
 
-func (j *WorkerJob) migrateMessage(ctx context.Context, sourceGmailUID uint32, messageID string) error {
+// migrateMessage appends the given message to the target account, or updates it if already there, filling in the
+// given audit record with the outcome.
+func (j *WorkerJob) migrateMessage(ctx context.Context, r *migrationRequest, record *audit.Record) error {
 	tr := otel.Tracer("worker")
-	ctx, span := tr.Start(ctx, "migrateMessage")
+	// Each message is traced separately (linked to the run, and to the collection which dispatched it), so sampling
+	// can keep large runs from flooding the trace backend without losing the run's own trace
+	ctx, span := tr.Start(ctx, "migrateMessage",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}, trace.Link{SpanContext: r.collectedBy}),
+		trace.WithAttributes(
+			attribute.String("messageID", r.messageID),
+			attribute.Int64("sourceGmailUID", int64(r.sourceGmailUID)),
+			attribute.String("sourceMailbox", r.sourceMailbox),
+			attribute.Int64("bytes", int64(r.size)),
+		))
 	defer span.End()
+	r.migratedBy = span.SpanContext()
 
-	if uid, err := j.targetGmail.FindUIDByMessageID(ctx, gcp.GmailAllMailLabel, messageID); err != nil {
-		return fmt.Errorf("failed to search for message '%s' in target account: %w", messageID, err)
-	} else if uid == nil {
-		if err := j.appendNewMessageToTargetAccount(ctx, sourceGmailUID); err != nil {
+	// Prefer the cached decision, since it reflects appends made after the request was dispatched
+	sourceMailbox, sourceGmailUID, messageID, size := r.sourceMailbox, r.sourceGmailUID, r.messageID, r.size
+	present, cached := j.identities.Get(messageID)
+	if !cached && r.targetPresent != nil {
+		present = *r.targetPresent
+	} else if !cached {
+		uid, err := j.targetGmail.FindUIDByMessageID(ctx, j.targetGmail.DefaultMailbox(), messageID)
+		if err != nil {
+			return fmt.Errorf("failed to search for message '%s' in target account: %w", messageID, err)
+		}
+		present = uid != nil
+	}
+
+	if present {
+		err := j.updateExistingMessageInTargetAccount(ctx, sourceMailbox, sourceGmailUID, messageID, r.targetUID, record)
+		if errors.Is(err, gcp.ErrMessageNotFound) && r.targetUID != 0 {
+			// The message was deleted from the target since its UID was recorded, so it's appended again
+			slog.Info("Message with recorded target UID is no longer in target account", "messageID", messageID, "targetUID", r.targetUID)
+			j.targetUIDs.SetTargetUID(r.gmailMessageID, 0)
+			present = false
+		} else if err != nil {
+			return fmt.Errorf("failed to update existing message '%s' in target account: %w: %w", messageID, errLabelUpdate, err)
+		} else {
+			record.Outcome = audit.OutcomeUpdated
+
+			// A run may have stopped after appending a spooled body, but before removing it from the spool
+			if err := j.fetchSpool.Remove(messageID); err != nil {
+				slog.Warn("Failed to remove present message from fetch spool", "err", err, "messageID", messageID)
+			}
+		}
+	}
+	if !present {
+		err := j.appendNewMessageToTargetAccount(ctx, sourceMailbox, sourceGmailUID, messageID, size, record)
+		if errors.Is(err, errMessageTooLarge) {
+			record.Outcome, record.Error = audit.OutcomeSkipped, err.Error()
+			return nil
+		} else if err != nil {
 			return fmt.Errorf("failed to append new message '%s' to target account: %w", messageID, err)
 		}
-	} else if err := j.updateExistingMessageInTargetAccount(ctx, sourceGmailUID, messageID); err != nil {
-		return fmt.Errorf("failed to update existing message '%s' in target account: %w", messageID, err)
+		present = !j.dryRun
+		record.Outcome = audit.OutcomeAppended
 	}
+	if record.TargetUID != 0 {
+		j.targetUIDs.SetTargetUID(r.gmailMessageID, record.TargetUID)
+	}
+	j.identities.Put(messageID, present)
 	return nil
 }
 
-func (j *WorkerJob) appendNewMessageToTargetAccount(ctx context.Context, sourceGmailUID uint32) error {
+func (j *WorkerJob) appendNewMessageToTargetAccount(ctx context.Context, sourceMailbox string, sourceGmailUID uint32, messageID string, size uint32, record *audit.Record) error {
 
-	// Fetch message
+	// Fetch message; bodies of large messages are fetched separately, in chunks, to a spool file
+	// Bodies kept in the fetch spool by a previous attempt (possibly of an earlier run) are not downloaded again
 	slog.Debug("Appending new message to target account", "sourceGmailUID", sourceGmailUID)
-	msg, err := j.sourceGmail.FetchMessageByUID(ctx, gcp.GmailAllMailLabel, sourceGmailUID, imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822, gcp.GmailLabelsExt)
+	fromFetchSpool := j.fetchSpool.Has(messageID)
+	spooled := size > j.spoolThreshold
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, gcp.GmailLabelsExt}
+	if j.verifyThreads {
+		items = append(items, gcp.GmailThreadIDExt)
+	}
+	if !spooled && !fromFetchSpool {
+		items = append(items, imap.FetchRFC822)
+	}
+	msg, err := j.sourceGmail.FetchMessageByUID(ctx, sourceMailbox, sourceGmailUID, items...)
 	if err != nil {
-		j.reporter.Increment(ctx, "failed.appended.emails")
+		j.metrics.appendFailures.Inc(ctx)
 		return fmt.Errorf("failed to fetch message '%d' from source account: %w", sourceGmailUID, err)
+	} else if err := j.mapKeywords(ctx, msg, messageID); err != nil {
+		j.metrics.appendFailures.Inc(ctx)
+		return fmt.Errorf("failed to map keywords of message '%d': %w", sourceGmailUID, err)
+	} else if err := j.labelNames.Apply(msg); err != nil {
+		j.metrics.appendFailures.Inc(ctx)
+		return fmt.Errorf("failed to sanitize labels of message '%d': %w", sourceGmailUID, err)
+	} else if err := j.repairInternalDate(ctx, sourceMailbox, msg, messageID); err != nil {
+		j.metrics.appendFailures.Inc(ctx)
+		return fmt.Errorf("failed to repair internal date of message '%d': %w", sourceGmailUID, err)
+	}
+
+	var sourceHash []byte
+	if fromFetchSpool || spooled {
+		spoolBody := j.spoolMessageBody
+		if fromFetchSpool {
+			spoolBody = j.unspoolMessageBody
+		}
+		f, hash, err := spoolBody(ctx, sourceMailbox, msg, messageID)
+		if err != nil {
+			j.metrics.appendFailures.Inc(ctx)
+			return fmt.Errorf("failed to spool body of message '%d' from source account: %w", sourceGmailUID, err)
+		}
+		defer func() {
+			_ = f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				slog.Warn("Failed to remove spool file", "err", err, "path", f.Name())
+			}
+		}()
+		if j.verifyContent {
+			sourceHash = hash
+		}
+	} else if msg.Envelope.MessageId == "" {
+		// Inject the synthetic Message-ID into messages that have none
+		if err := gcp.SetMessageIDHeader(msg, messageID); err != nil {
+			j.metrics.appendFailures.Inc(ctx)
+			return fmt.Errorf("failed to set Message-ID of message '%d': %w", sourceGmailUID, err)
+		}
+	}
+
+	// Hash the source body before appending, so it can be compared with the appended message later on
+	if j.verifyContent && !spooled && !fromFetchSpool {
+		body, err := gcp.GetRawBody(msg)
+		if err != nil {
+			j.metrics.appendFailures.Inc(ctx)
+			return fmt.Errorf("failed to read body of message '%d' from source account: %w", sourceGmailUID, err)
+		}
+		sum := sha256.Sum256(body)
+		sourceHash = sum[:]
+	}
+
+	if !fromFetchSpool && !j.dryRun {
+		j.putFetchSpool(msg, messageID)
 	}
 
 	// Append the message to the target's "[Gmail]/All Mail" folder.
 	// This preserves the flags and the original received date.
+	record.Labels, _ = gcp.GetLabels(msg)
+	record.SenderDomain = senderDomain(msg)
 	if j.dryRun {
 		slog.Info("Appending new message",
 			"dryRun", true,
@@ -298,26 +1082,311 @@ func (j *WorkerJob) appendNewMessageToTargetAccount(ctx context.Context, sourceG
 			"envelope", msg.Envelope,
 			"body", msg.Body,
 			"items", msg.Items)
-	} else if _, err := j.targetGmail.AppendMessage(ctx, gcp.GmailAllMailLabel, msg); err != nil {
-		j.reporter.Increment(ctx, "failed.appended.emails")
-		return fmt.Errorf("failed to append message %d to target: %w", sourceGmailUID, err)
+		labels, _ := gcp.GetLabels(msg) // messages without parsable labels are reported as unlabeled
+		j.dryRunReport.Add(dryRunActionAppend, labels, msg.Envelope.Subject, int64(size))
+	} else {
+		targetGmailUID, err := j.targetGmail.AppendMessage(ctx, j.targetGmail.DefaultMailbox(), msg)
+		if gcp.IsMessageTooLarge(err) {
+			// Retrying cannot help, so the message is skipped rather than failed; it's still recorded in the failure
+			// ledger, and makes the run exit as partial
+			j.skips.Add(ctx, skipReasonTooLarge, 1)
+			if err := j.fetchSpool.Remove(messageID); err != nil {
+				slog.Warn("Failed to remove rejected message from fetch spool", "err", err, "messageID", messageID)
+			}
+			err := j.ledger.Record(ledger.Entry{SourceUID: sourceGmailUID, MessageID: messageID, Reason: skipReasonTooLarge, Details: err.Error()})
+			if err != nil {
+				return fmt.Errorf("failed to record too large message: %w", err)
+			}
+			return fmt.Errorf("target rejected message %d: %w", sourceGmailUID, errMessageTooLarge)
+		} else if err != nil {
+			j.metrics.appendFailures.Inc(ctx)
+			return fmt.Errorf("failed to append message %d to target: %w", sourceGmailUID, err)
+		}
+		record.TargetUID = targetGmailUID
+		if err := j.fetchSpool.Remove(messageID); err != nil {
+			slog.Warn("Failed to remove appended message from fetch spool", "err", err, "messageID", messageID)
+		}
+		if err := j.verifyContentHash(ctx, msg, targetGmailUID, sourceHash); err != nil {
+			return fmt.Errorf("failed to verify content of message %d in target: %w", sourceGmailUID, err)
+		}
+		if j.verifyThreads {
+			j.verifyThread(ctx, msg, targetGmailUID)
+		}
+	}
+	j.metrics.appended.Inc(ctx)
+	j.appended.Add(1)
+
+	return nil
+}
+
+// mapKeywords translates the custom keywords of the given source message according to the keyword mapping table, and
+// records messages carrying keywords the table does not map in the failure ledger, for review.
+func (j *WorkerJob) mapKeywords(ctx context.Context, msg *imap.Message, messageID string) error {
+	result, err := j.keywords.Apply(msg)
+	if err != nil {
+		return err
+	}
+	if len(result.mapped) > 0 {
+		j.metrics.mappedKeywords.Inc(ctx)
+	}
+	if len(result.unknown) > 0 {
+		j.metrics.unknownKeywords.Inc(ctx)
+		slog.Debug("Message has unmapped keywords", "sourceGmailUID", msg.Uid, "keywords", result.unknown, "policy", j.keywords.Unknown)
+		err := j.ledger.Record(ledger.Entry{
+			SourceUID: msg.Uid,
+			MessageID: messageID,
+			Reason:    "unknown-keywords",
+			Details:   fmt.Sprintf("keywords %s handled by policy '%s'", strings.Join(result.unknown, ", "), j.keywords.Unknown),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record unknown keywords: %w", err)
+		}
+	}
+	return nil
+}
+
+// repairInternalDate replaces an implausible (e.g. zero) INTERNALDATE of the given source message with the date of its
+// most recent "Received" header, or else its "Date" header (both parsed leniently). If neither is usable, the date is
+// cleared, so the target assigns the append time rather than a bogus date. Repairs are listed in the date repair
+// report, apart from failures.
+func (j *WorkerJob) repairInternalDate(ctx context.Context, mailbox string, msg *imap.Message, messageID string) error {
+	if maildate.Valid(msg.InternalDate) {
+		return nil
 	}
-	j.reporter.Increment(ctx, "appended.emails")
 
+	section := &imap.BodySectionName{Peek: true, BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"Received", "Date"}}}
+	headerMsg, err := j.sourceGmail.FetchMessageByUID(ctx, mailbox, msg.Uid, section.FetchItem())
+	if err != nil {
+		return fmt.Errorf("failed to fetch date headers: %w", err)
+	}
+	var header mail.Header
+	if literal := headerMsg.GetBody(section); literal != nil {
+		// Header-only sections lack a body, which net/mail tolerates as long as the header is terminated
+		if m, err := mail.ReadMessage(io.MultiReader(literal, strings.NewReader("\r\n"))); err == nil {
+			header = m.Header
+		}
+	}
+
+	repair := dateRepair{SourceUID: msg.Uid, MessageID: messageID, Original: msg.InternalDate}
+	if t, source, ok := maildate.Resolve(header); ok {
+		repair.Repaired, repair.Header = t, source
+		j.metrics.repairedDates.Inc(ctx)
+	} else {
+		// Left for the target to assign (no usable "Received" or "Date" header)
+		j.metrics.unresolvedDates.Inc(ctx)
+	}
+	msg.InternalDate = repair.Repaired
+	slog.Warn("Repaired invalid internal date", "sourceGmailUID", msg.Uid, "messageID", messageID, "original", repair.Original, "repaired", repair.Repaired, "header", repair.Header)
+	j.dateRepairs.Add(repair)
 	return nil
 }
 
-func (j *WorkerJob) updateExistingMessageInTargetAccount(ctx context.Context, sourceGmailUID uint32, messageID string) error {
+// spoolMessageBody downloads the body of the given source message in chunks to a temporary file, and sets it as the
+// message's body, so it can be appended without holding it in memory. If the message has no Message-ID, the given
+// (synthetic) Message-ID is injected as a header. Returns the spool file (which the caller must close & remove), and the
+// SHA-256 of the spooled body.
+func (j *WorkerJob) spoolMessageBody(ctx context.Context, mailbox string, msg *imap.Message, messageID string) (*os.File, []byte, error) {
+	f, err := os.CreateTemp(j.spoolDir, fmt.Sprintf("message-%d-*.eml", msg.Uid))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	syntheticMessageID := ""
+	if msg.Envelope.MessageId == "" {
+		syntheticMessageID = messageID
+	}
+	h := sha256.New()
+	size, err := j.sourceGmail.DownloadBody(ctx, mailbox, msg.Uid, j.bodyChunkSize, syntheticMessageID, io.MultiWriter(f, h))
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, nil, err
+	}
+	slog.Debug("Spooled message body", "sourceGmailUID", msg.Uid, "path", f.Name(), "size", size)
+
+	literal, err := gcp.NewFileLiteral(f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, nil, err
+	}
+	msg.Body = map[*imap.BodySectionName]imap.Literal{{}: literal}
+	if syntheticMessageID != "" {
+		msg.Envelope.MessageId = syntheticMessageID
+	}
+	return f, h.Sum(nil), nil
+}
+
+// senderDomain returns the (lower-cased) domain of the sender of the given message, if known.
+func senderDomain(msg *imap.Message) string {
+	if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+		return ""
+	}
+	return strings.ToLower(msg.Envelope.From[0].HostName)
+}
+
+// unspoolMessageBody sets the body of the given message to its body kept in the fetch spool, decompressed into a spool
+// file, which is returned along with the SHA-256 of the body. Spooled bodies already carry any synthetic Message-ID.
+func (j *WorkerJob) unspoolMessageBody(_ context.Context, _ string, msg *imap.Message, messageID string) (*os.File, []byte, error) {
+	r, err := j.fetchSpool.Open(messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = r.Close() }()
+
+	f, err := os.CreateTemp(j.spoolDir, fmt.Sprintf("message-%d-*.eml", msg.Uid))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, nil, fmt.Errorf("failed to read spooled body: %w", err)
+	}
+	literal, err := gcp.NewFileLiteral(f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, nil, err
+	}
+	slog.Debug("Using message body from fetch spool", "sourceGmailUID", msg.Uid, "messageID", messageID)
+	msg.Body = map[*imap.BodySectionName]imap.Literal{{}: literal}
+	if msg.Envelope.MessageId == "" {
+		msg.Envelope.MessageId = messageID
+	}
+	return f, h.Sum(nil), nil
+}
+
+// putFetchSpool keeps the body of the given message (as it is about to be appended) in the fetch spool, so it need not
+// be downloaded again if appending fails. Failing to spool is not fatal, since the body can always be downloaded again.
+func (j *WorkerJob) putFetchSpool(msg *imap.Message, messageID string) {
+	if j.fetchSpool == nil {
+		return
+	}
+	var r io.Reader
+	if literal, ok := msg.GetBody(&imap.BodySectionName{}).(*gcp.FileLiteral); ok {
+		r = io.NewSectionReader(literal.File, 0, int64(literal.Len()))
+	} else if body, err := gcp.GetRawBody(msg); err != nil {
+		slog.Warn("Failed to spool message body", "err", err, "messageID", messageID)
+		return
+	} else {
+		r = bytes.NewReader(body)
+	}
+	if ok, err := j.fetchSpool.Put(messageID, r); err != nil {
+		slog.Warn("Failed to spool message body", "err", err, "messageID", messageID)
+	} else if !ok {
+		slog.Debug("Fetch spool is full, not spooling message body", "messageID", messageID)
+	}
+}
+
+// verifyContentHash re-fetches the newly-appended target message, and compares the SHA-256 of its body with the given
+// hash of the source message body. Mismatches are recorded in the failure ledger. Does nothing if the source hash is
+// nil (i.e. content verification is disabled).
+func (j *WorkerJob) verifyContentHash(ctx context.Context, sourceMsg *imap.Message, targetGmailUID uint32, sourceHash []byte) error {
+	if sourceHash == nil {
+		return nil
+	}
+
+	targetMsg, err := j.targetGmail.FetchMessageByUID(ctx, j.targetGmail.DefaultMailbox(), targetGmailUID, imap.FetchRFC822)
+	if err != nil {
+		return fmt.Errorf("failed to fetch target message '%d': %w", targetGmailUID, err)
+	}
+	body, err := gcp.GetRawBody(targetMsg)
+	if err != nil {
+		return fmt.Errorf("failed to read body of target message '%d': %w", targetGmailUID, err)
+	}
+	targetHash := sha256.Sum256(body)
+
+	if !bytes.Equal(sourceHash, targetHash[:]) {
+		j.metrics.mismatched.Inc(ctx)
+		j.mismatched.Add(1)
+		slog.Error("Content hash of appended message does not match source message",
+			"messageID", sourceMsg.Envelope.MessageId,
+			"sourceGmailUID", sourceMsg.Uid,
+			"targetGmailUID", targetGmailUID,
+			"sourceHash", hex.EncodeToString(sourceHash),
+			"targetHash", hex.EncodeToString(targetHash[:]))
+		err := j.ledger.Record(ledger.Entry{
+			SourceUID: sourceMsg.Uid,
+			TargetUID: targetGmailUID,
+			MessageID: sourceMsg.Envelope.MessageId,
+			Reason:    "content-hash-mismatch",
+			Details:   fmt.Sprintf("source sha256 %s, target sha256 %s", hex.EncodeToString(sourceHash), hex.EncodeToString(targetHash[:])),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record content hash mismatch: %w", err)
+		}
+	} else {
+		j.metrics.verified.Inc(ctx)
+	}
+	return nil
+}
+
+// verifyThread checks that the newly-appended target message was placed in the same target thread as previously
+// appended messages of its source thread. Thread breakage is reported, but does not fail the migration, since the
+// message itself (including its References/In-Reply-To headers) was migrated intact. Failing to verify is reported the
+// same way, since the message was appended successfully regardless.
+func (j *WorkerJob) verifyThread(ctx context.Context, sourceMsg *imap.Message, targetGmailUID uint32) {
+	sourceThreadID, err := gcp.GetThreadID(sourceMsg)
+	if err != nil {
+		j.metrics.unverifiedThreads.Inc(ctx)
+		slog.Warn("Failed to get thread ID of source message", "err", err, "sourceGmailUID", sourceMsg.Uid)
+		return
+	} else if sourceThreadID == 0 {
+		return
+	}
+
+	targetMsg, err := j.targetGmail.FetchMessageByUID(ctx, j.targetGmail.DefaultMailbox(), targetGmailUID, gcp.GmailThreadIDExt)
+	if err != nil {
+		j.metrics.unverifiedThreads.Inc(ctx)
+		slog.Warn("Failed to fetch thread ID of appended message", "err", err, "targetGmailUID", targetGmailUID)
+		return
+	}
+	targetThreadID, err := gcp.GetThreadID(targetMsg)
+	if err != nil {
+		j.metrics.unverifiedThreads.Inc(ctx)
+		slog.Warn("Failed to get thread ID of appended message", "err", err, "targetGmailUID", targetGmailUID)
+		return
+	}
+
+	if expectedThreadID, ok := j.threads.Track(sourceThreadID, targetThreadID); !ok {
+		j.metrics.brokenThreads.Inc(ctx)
+		slog.Warn("Message was placed in a different thread than other messages of its source thread",
+			"messageID", sourceMsg.Envelope.MessageId,
+			"inReplyTo", sourceMsg.Envelope.InReplyTo,
+			"sourceThreadID", sourceThreadID,
+			"targetThreadID", targetThreadID,
+			"expectedTargetThreadID", expectedThreadID)
+	}
+}
+
+// updateExistingMessageInTargetAccount updates the labels & flags of the given message in the target account, where
+// it is addressed by the given target UID if known (non-zero), or else searched for by its Message-ID.
+func (j *WorkerJob) updateExistingMessageInTargetAccount(ctx context.Context, sourceMailbox string, sourceGmailUID uint32, messageID string, targetUID uint32, record *audit.Record) error {
 
 	// Fetch message
 	slog.Debug("Updating message in target account", "sourceGmailUID", sourceGmailUID, "messageID", messageID)
-	sourceMsg, err := j.sourceGmail.FetchMessageByUID(ctx, gcp.GmailAllMailLabel, sourceGmailUID, imap.FetchFlags, imap.FetchInternalDate, imap.FetchEnvelope, gcp.GmailLabelsExt)
+	sourceMsg, err := j.sourceGmail.FetchMessageByUID(ctx, sourceMailbox, sourceGmailUID, imap.FetchFlags, imap.FetchInternalDate, imap.FetchEnvelope, gcp.GmailLabelsExt)
 	if err != nil {
-		j.reporter.Increment(ctx, "failed.updated.emails")
+		j.metrics.updateFailures.Inc(ctx)
 		return fmt.Errorf("failed to fetch message '%d' from source account: %w", sourceGmailUID, err)
+	} else if err := j.mapKeywords(ctx, sourceMsg, messageID); err != nil {
+		j.metrics.updateFailures.Inc(ctx)
+		return fmt.Errorf("failed to map keywords of message '%d': %w", sourceGmailUID, err)
+	} else if err := j.labelNames.Apply(sourceMsg); err != nil {
+		j.metrics.updateFailures.Inc(ctx)
+		return fmt.Errorf("failed to sanitize labels of message '%d': %w", sourceGmailUID, err)
+	}
+
+	// Messages without a Message-ID were appended with a synthetic one, which is what we'll find them by
+	if sourceMsg.Envelope.MessageId == "" {
+		sourceMsg.Envelope.MessageId = messageID
 	}
 
 	// Update message
+	record.Labels, _ = gcp.GetLabels(sourceMsg)
+	record.SenderDomain = senderDomain(sourceMsg)
 	if j.dryRun {
 		slog.Info("Updating existing message",
 			"dryRun", true,
@@ -327,11 +1396,14 @@ func (j *WorkerJob) updateExistingMessageInTargetAccount(ctx context.Context, so
 			"envelope", sourceMsg.Envelope,
 			"body", sourceMsg.Body,
 			"items", sourceMsg.Items)
-	} else if err := j.targetGmail.UpdateMessage(ctx, gcp.GmailAllMailLabel, sourceMsg); err != nil {
-		j.reporter.Increment(ctx, "failed.updated.emails")
+		labels, _ := gcp.GetLabels(sourceMsg) // messages without parsable labels are reported as unlabeled
+		j.dryRunReport.Add(dryRunActionUpdate, labels, sourceMsg.Envelope.Subject, 0)
+	} else if record.TargetUID, err = j.targetGmail.UpdateMessageAt(ctx, j.targetGmail.DefaultMailbox(), targetUID, sourceMsg); err != nil {
+		j.metrics.updateFailures.Inc(ctx)
 		return fmt.Errorf("failed to update message '%s' in target account: %w", messageID, err)
 	}
-	j.reporter.Increment(ctx, "updated.emails")
+	j.metrics.updated.Inc(ctx)
+	j.updated.Add(1)
 
 	return nil
 }
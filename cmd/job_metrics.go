@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+)
+
+// workerMetrics are the instruments of a migration job, registered once when the job is created.
+type workerMetrics struct {
+	sourceEmails        *metrics.Counter
+	syntheticMessageIDs *metrics.Counter
+	messageSize         *metrics.Histogram
+	appended            *metrics.Counter
+	appendFailures      *metrics.Counter
+	updated             *metrics.Counter
+	updateFailures      *metrics.Counter
+	mappedKeywords      *metrics.Counter
+	unknownKeywords     *metrics.Counter
+	repairedDates       *metrics.Counter
+	unresolvedDates     *metrics.Counter
+	verified            *metrics.Counter
+	mismatched          *metrics.Counter
+	brokenThreads       *metrics.Counter
+	unverifiedThreads   *metrics.Counter
+	skipped             *metrics.Counter // by reason
+	failedUnits         *metrics.Counter // by stage
+	sourcePoolOpen      *metrics.Gauge
+	sourcePoolIdle      *metrics.Gauge
+	targetPoolOpen      *metrics.Gauge
+	targetPoolIdle      *metrics.Gauge
+	regularQueue        *metrics.Gauge
+	largeQueue          *metrics.Gauge
+	inFlightMemory      *metrics.Gauge
+}
+
+func newWorkerMetrics(r *metrics.Reporter) *workerMetrics {
+	return &workerMetrics{
+		sourceEmails:        r.Counter("source.emails"),
+		syntheticMessageIDs: r.Counter("synthetic.message.ids"),
+		messageSize:         r.BytesHistogram("message.size"),
+		appended:            r.Counter("appended.emails"),
+		appendFailures:      r.Counter("failed.appended.emails"),
+		updated:             r.Counter("updated.emails"),
+		updateFailures:      r.Counter("failed.updated.emails"),
+		mappedKeywords:      r.Counter("mapped.keywords"),
+		unknownKeywords:     r.Counter("unknown.keywords"),
+		repairedDates:       r.Counter("repaired.internal.dates"),
+		unresolvedDates:     r.Counter("unresolved.internal.dates"),
+		verified:            r.Counter("verified.emails"),
+		mismatched:          r.Counter("mismatched.emails"),
+		brokenThreads:       r.Counter("broken.threads"),
+		unverifiedThreads:   r.Counter("unverified.threads"),
+		skipped:             r.Counter("skipped.emails"),
+		failedUnits:         r.Counter("failed.units"),
+		sourcePoolOpen:      r.Gauge("source.pool.open"),
+		sourcePoolIdle:      r.Gauge("source.pool.idle"),
+		targetPoolOpen:      r.Gauge("target.pool.open"),
+		targetPoolIdle:      r.Gauge("target.pool.idle"),
+		regularQueue:        r.Gauge("queue.regular"),
+		largeQueue:          r.Gauge("queue.large"),
+		inFlightMemory:      r.Gauge("memory.inflight"),
+	}
+}
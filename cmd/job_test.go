@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/ledger"
+	"github.com/arikkfir-org/gmail-organizer/internal/shadow/imaptest"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	testSourceUsername = "source@example.com"
+	testTargetUsername = "target@example.com"
+)
+
+// testMessage is a message of a fake account.
+type testMessage struct {
+	messageID string
+	labels    []string
+	flags     []string
+	// padding is the number of body bytes added to the message, e.g. to exceed the server's message size limit.
+	padding int
+}
+
+// imapMessage returns the message as appended to (or updated in) an account.
+func (m testMessage) imapMessage() *imap.Message {
+	raw := fmt.Sprintf("From: a@example.com\r\nTo: b@example.com\r\nSubject: %s\r\nMessage-ID: %s\r\nDate: Mon, 1 Jan 2024 00:00:00 +0000\r\n\r\n%s\r\n",
+		m.messageID, m.messageID, strings.Repeat("x", m.padding))
+	msg := &imap.Message{
+		Uid:          1,
+		Flags:        m.flags,
+		InternalDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Envelope:     &imap.Envelope{MessageId: m.messageID},
+		Body:         map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader([]byte(raw))},
+	}
+	gcp.SetLabels(msg, m.labels)
+	return msg
+}
+
+// testAccount returns a pool connected to the given account of the given fake server.
+func testAccount(t *testing.T, srv *imaptest.Server, username string, gmailExtensions bool) *gcp.Gmail {
+	t.Helper()
+	g, err := gcp.NewGmail(username, "password", 0, 1, 10*time.Second, gcp.WithEndpoint(srv.Addr, false), gcp.WithGmailExtensions(gmailExtensions))
+	if err != nil {
+		t.Fatalf("failed to connect to account '%s': %v", username, err)
+	}
+	t.Cleanup(func() { _ = g.Close(context.Background()) })
+	return g
+}
+
+// seed appends the given messages to the given mailbox of the given account.
+func seed(t *testing.T, g *gcp.Gmail, mailbox string, messages ...testMessage) {
+	t.Helper()
+	for _, m := range messages {
+		if _, err := g.AppendMessage(context.Background(), mailbox, m.imapMessage()); err != nil {
+			t.Fatalf("failed to seed message '%s' into '%s': %v", m.messageID, mailbox, err)
+		}
+	}
+}
+
+// targetMessages returns the messages of the target account, by Message-ID, with their labels & flags.
+func targetMessages(t *testing.T, srv *imaptest.Server) map[string]testMessage {
+	t.Helper()
+	ctx := context.Background()
+	g := testAccount(t, srv, testTargetUsername, true)
+	uids, err := g.FindAllUIDs(ctx, gcp.GmailAllMailLabel)
+	if err != nil {
+		t.Fatalf("failed to list target messages: %v", err)
+	}
+	fetched, err := g.FetchByUIDs(ctx, gcp.GmailAllMailLabel, uids, imap.FetchEnvelope, imap.FetchFlags, gcp.GmailLabelsExt)
+	if err != nil {
+		t.Fatalf("failed to fetch target messages: %v", err)
+	}
+	messages := make(map[string]testMessage, len(fetched))
+	for _, msg := range fetched {
+		labels, err := gcp.GetLabels(msg)
+		if err != nil {
+			t.Fatalf("failed to get labels of target message: %v", err)
+		}
+		flags := slices.Sorted(slices.Values(msg.Flags))
+		if _, found := messages[msg.Envelope.MessageId]; found {
+			t.Errorf("target account has message '%s' more than once", msg.Envelope.MessageId)
+		}
+		messages[msg.Envelope.MessageId] = testMessage{messageID: msg.Envelope.MessageId, labels: labels, flags: flags}
+	}
+	return messages
+}
+
+// setMigrateEnv configures migrations from the source to the target account of the given fake server, through the
+// environment like the migrate command is configured, keeping the state of runs in the given directory.
+func setMigrateEnv(t *testing.T, srv *imaptest.Server, stateDir string) {
+	t.Helper()
+	for prefix, username := range map[string]string{"SOURCE": testSourceUsername, "TARGET": testTargetUsername} {
+		t.Setenv(prefix+"_IMAP_ADDRESS", srv.Addr)
+		t.Setenv(prefix+"_IMAP_TLS", "false")
+		t.Setenv(prefix+"_ACCOUNT_USERNAME", username)
+		t.Setenv(prefix+"_ACCOUNT_PASSWORD", "password")
+	}
+	t.Setenv("VERSION_CHECK", "false")
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	t.Setenv("METRICS_EXPORTER", "none")
+	t.Setenv("SIMULATE_TARGET_DIR", "")
+	t.Setenv("LABEL_STATE_PATH", filepath.Join(stateDir, "state.json"))
+	t.Setenv("FAILURE_LEDGER_PATH", filepath.Join(stateDir, "failures.jsonl"))
+	t.Setenv("AUDIT_LOG", filepath.Join(stateDir, "audit.jsonl"))
+}
+
+// migrate runs the migrate command, returning its exit code and the summary of its migration.
+func migrate(t *testing.T) (int, *migrationSummary) {
+	t.Helper()
+	code := runJob(nil)
+	if summary.Migration == nil {
+		t.Fatalf("migrate exited with %d without running a migration", code)
+	}
+	return code, summary.Migration
+}
+
+// checkMigration fails the test unless the given migration ended with the given exit code & counts (skips by reason).
+func checkMigration(t *testing.T, code int, s *migrationSummary, wantCode int, migrated, updated uint64, skipped map[string]uint64) {
+	t.Helper()
+	if code != wantCode {
+		t.Errorf("exit code = %d, want %d", code, wantCode)
+	}
+	if s.Migrated != migrated || s.Updated != updated {
+		t.Errorf("migrated & updated = %d & %d, want %d & %d", s.Migrated, s.Updated, migrated, updated)
+	}
+	if !maps.Equal(s.Skipped, skipped) {
+		t.Errorf("skipped = %v, want %v", s.Skipped, skipped)
+	}
+}
+
+// checkTargetMessages fails the test unless the target account holds exactly the given messages, with their labels &
+// flags.
+func checkTargetMessages(t *testing.T, srv *imaptest.Server, want ...testMessage) {
+	t.Helper()
+	got := targetMessages(t, srv)
+	if len(got) != len(want) {
+		t.Errorf("target account has %d messages, want %d", len(got), len(want))
+	}
+	for _, w := range want {
+		g, found := got[w.messageID]
+		if !found {
+			t.Errorf("message '%s' is missing from target account", w.messageID)
+			continue
+		}
+		if !slices.Equal(g.labels, w.labels) {
+			t.Errorf("labels of message '%s' = %v, want %v", w.messageID, g.labels, w.labels)
+		}
+		if !slices.Equal(g.flags, w.flags) {
+			t.Errorf("flags of message '%s' = %v, want %v", w.messageID, g.flags, w.flags)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	srv := imaptest.NewServer(t)
+	setMigrateEnv(t, srv, t.TempDir())
+	messages := []testMessage{
+		{messageID: "<one@example.com>", labels: []string{"Work/Projects"}, flags: []string{imap.SeenFlag}},
+		{messageID: "<two@example.com>", labels: []string{"Personal"}, flags: []string{imap.FlaggedFlag}},
+		{messageID: "<three@example.com>"},
+	}
+	seed(t, testAccount(t, srv, testSourceUsername, true), gcp.GmailAllMailLabel, messages...)
+
+	code, s := migrate(t)
+	checkMigration(t, code, s, exitOK, 3, 0, nil)
+	checkTargetMessages(t, srv, messages...)
+}
+
+func TestMigrateUpdatesExistingMessages(t *testing.T) {
+	srv := imaptest.NewServer(t)
+	setMigrateEnv(t, srv, t.TempDir())
+	messages := []testMessage{
+		{messageID: "<one@example.com>", labels: []string{"Work/Projects"}},
+		{messageID: "<two@example.com>", labels: []string{"Personal"}, flags: []string{imap.SeenFlag}},
+	}
+	source := testAccount(t, srv, testSourceUsername, true)
+	seed(t, source, gcp.GmailAllMailLabel, messages...)
+	code, s := migrate(t)
+	checkMigration(t, code, s, exitOK, 2, 0, nil)
+
+	// Labels & flags changed in the source account since the first run
+	messages[0].labels, messages[0].flags = []string{"Archive", "Work/Projects"}, []string{imap.SeenFlag}
+	messages[1].labels, messages[1].flags = nil, nil
+	for _, m := range messages {
+		if err := source.UpdateMessage(context.Background(), gcp.GmailAllMailLabel, m.imapMessage()); err != nil {
+			t.Fatalf("failed to update source message '%s': %v", m.messageID, err)
+		}
+	}
+
+	code, s = migrate(t)
+	checkMigration(t, code, s, exitOK, 0, 2, nil)
+	checkTargetMessages(t, srv, messages...)
+}
+
+func TestMigrateDeduplicates(t *testing.T) {
+	srv := imaptest.NewServer(t)
+	setMigrateEnv(t, srv, t.TempDir())
+
+	// Without Gmail extensions, messages are identified by their Message-ID, so the copy of a message in another
+	// mailbox is a duplicate
+	t.Setenv("SOURCE_GMAIL_EXTENSIONS", "false")
+	t.Setenv("SOURCE_MAILBOXES", "INBOX,Work")
+	source := testAccount(t, srv, testSourceUsername, false)
+	if err := source.CreateMailboxes(context.Background(), "Work"); err != nil {
+		t.Fatalf("failed to create source mailbox: %v", err)
+	}
+	present := testMessage{messageID: "<present@example.com>"}
+	copied := testMessage{messageID: "<copied@example.com>"}
+	seed(t, source, "INBOX", present, copied)
+	seed(t, source, "Work", copied)
+
+	// The first message is already present in the target account (e.g. forwarded to it earlier)
+	seed(t, testAccount(t, srv, testTargetUsername, true), gcp.GmailAllMailLabel, present)
+
+	code, s := migrate(t)
+	checkMigration(t, code, s, exitOK, 1, 1, map[string]uint64{skipReasonDuplicate: 1})
+	got := targetMessages(t, srv)
+	if len(got) != 2 {
+		t.Errorf("target account has %d messages, want 2", len(got))
+	}
+}
+
+func TestMigrateSkipsOversizedMessages(t *testing.T) {
+	srv := imaptest.NewServer(t, imaptest.WithMaxMessageSize(4096))
+	stateDir := t.TempDir()
+	setMigrateEnv(t, srv, stateDir)
+	t.Setenv("ERROR_POLICY", errorPolicyContinue)
+	small := testMessage{messageID: "<small@example.com>", labels: []string{"Work"}}
+	big := testMessage{messageID: "<big@example.com>", labels: []string{"Work"}, padding: 8192}
+
+	// The source account is seeded before the server's limit applies to it, like Gmail accounts holding messages larger
+	// than the limit of the target (e.g. of another provider)
+	unlimited := imaptest.NewServer(t)
+	seed(t, testAccount(t, unlimited, testSourceUsername, true), gcp.GmailAllMailLabel, small, big)
+	t.Setenv("SOURCE_IMAP_ADDRESS", unlimited.Addr)
+
+	code, s := migrate(t)
+	checkMigration(t, code, s, exitPartial, 1, 0, map[string]uint64{skipReasonTooLarge: 1})
+	if s.Failed != 0 {
+		t.Errorf("failed = %d, want 0 (too large messages are only skipped)", s.Failed)
+	}
+	checkTargetMessages(t, srv, small)
+
+	f, err := os.Open(filepath.Join(stateDir, "failures.jsonl"))
+	if err != nil {
+		t.Fatalf("failed to open failure ledger: %v", err)
+	}
+	defer f.Close()
+	var failed []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var e ledger.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("failed to parse failure ledger entry: %v", err)
+		}
+		failed = append(failed, e.MessageID)
+	}
+	if !slices.Equal(failed, []string{big.messageID}) {
+		t.Errorf("failure ledger lists %v, want %v", failed, []string{big.messageID})
+	}
+}
+
+func TestMigrateIntoPrefixedNamespace(t *testing.T) {
+	srv := imaptest.NewServer(t, imaptest.WithNamespace("INBOX/"))
+	setMigrateEnv(t, srv, t.TempDir())
+	t.Setenv("TARGET_GMAIL_EXTENSIONS", "false")
+	source := imaptest.NewServer(t)
+	seed(t, testAccount(t, source, testSourceUsername, true), gcp.GmailAllMailLabel, testMessage{messageID: "<one@example.com>", labels: []string{"Work/Projects"}})
+	t.Setenv("SOURCE_IMAP_ADDRESS", source.Addr)
+
+	code, s := migrate(t)
+	checkMigration(t, code, s, exitOK, 1, 0, nil)
+	if _, err := os.Stat(filepath.Join(srv.Dir, testTargetUsername, "INBOX%2FWork%2FProjects")); err != nil {
+		t.Errorf("label was not created in the target's namespace: %v", err)
+	}
+}
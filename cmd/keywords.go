@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+// Policies for keywords that have no mapping.
+const (
+	unknownKeywordKeep  = "keep"
+	unknownKeywordDrop  = "drop"
+	unknownKeywordLabel = "label"
+)
+
+// keywordMapping translates a single source keyword (custom IMAP flag).
+type keywordMapping struct {
+	// Source is the keyword on source messages, e.g. "$Label1" or "$MailFlagBit0" (case-insensitive).
+	Source string `json:"source"`
+	// Flag is the keyword (or system flag, e.g. "\\Flagged") to set on target messages instead.
+	Flag string `json:"flag,omitempty"`
+	// Label is a Gmail label to add to target messages instead.
+	Label string `json:"label,omitempty"`
+	// Drop removes the keyword from target messages.
+	Drop bool `json:"drop,omitempty"`
+}
+
+// keywordMapper translates custom flags & keywords of source messages when migrating them, according to a mapping
+// table loaded from a JSON file. Gmail only exposes a single star over IMAP (as \Flagged or the "\\Starred" label),
+// while other providers & clients represent colored stars and tags as custom keywords (e.g. Apple Mail's
+// "$MailFlagBit0-2" or Thunderbird's "$Label1-5"), which Gmail does not preserve; the table allows translating such
+// keywords into other flags or into labels. Keywords without a mapping are handled by the configured policy.
+type keywordMapper struct {
+	Mappings []keywordMapping `json:"mappings"`
+	// Unknown is the policy for keywords without a mapping: "keep" (the default), "drop" or "label".
+	Unknown string `json:"unknown,omitempty"`
+	// UnknownLabelPrefix is prepended to unknown keywords turned into labels (defaults to "Keywords/").
+	UnknownLabelPrefix string `json:"unknownLabelPrefix,omitempty"`
+}
+
+// keywordMappingResult describes how the keywords of a single message were translated.
+type keywordMappingResult struct {
+	mapped  []string
+	unknown []string
+}
+
+// loadKeywordMapper loads the keyword mapping table from the given JSON file. Returns nil if the path is empty, in
+// which case keywords are migrated as-is.
+func loadKeywordMapper(path string) (*keywordMapper, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read keyword mappings file '%s': %w", errInvalidConfig, path, err)
+	}
+	// Unknown fields are rejected, so that misspelled settings are not silently ignored
+	m := &keywordMapper{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(m); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse keyword mappings file '%s': %w", errInvalidConfig, path, err)
+	}
+	if m.Unknown == "" {
+		m.Unknown = unknownKeywordKeep
+	} else if !slices.Contains([]string{unknownKeywordKeep, unknownKeywordDrop, unknownKeywordLabel}, m.Unknown) {
+		return nil, fmt.Errorf("%w: invalid unknown keywords policy '%s' in '%s'", errInvalidConfig, m.Unknown, path)
+	}
+	if m.UnknownLabelPrefix == "" {
+		m.UnknownLabelPrefix = "Keywords/"
+	}
+	for i, mapping := range m.Mappings {
+		targets := 0
+		for _, set := range []bool{mapping.Flag != "", mapping.Label != "", mapping.Drop} {
+			if set {
+				targets++
+			}
+		}
+		if mapping.Source == "" || targets != 1 {
+			return nil, fmt.Errorf("%w: keyword mapping %d in '%s' must have a source, and exactly one of flag, label or drop", errInvalidConfig, i, path)
+		}
+	}
+	return m, nil
+}
+
+// Apply translates the keywords of the given message in place, according to the mapping table. System flags (e.g.
+// \Seen) are never translated, unless explicitly mapped. Labels are only added if the message was fetched with its
+// Gmail labels. Does nothing if the mapper is nil.
+func (m *keywordMapper) Apply(msg *imap.Message) (*keywordMappingResult, error) {
+	result := &keywordMappingResult{}
+	if m == nil {
+		return result, nil
+	}
+
+	labels, err := gcp.GetLabels(msg)
+	if err != nil {
+		return nil, err
+	}
+	_, hasLabels := msg.Items[gcp.GmailLabelsExt]
+
+	var flags []string
+	for _, flag := range msg.Flags {
+		i := slices.IndexFunc(m.Mappings, func(mapping keywordMapping) bool { return strings.EqualFold(mapping.Source, flag) })
+		switch {
+		case i >= 0:
+			result.mapped = append(result.mapped, flag)
+			if mapping := m.Mappings[i]; mapping.Flag != "" {
+				flags = append(flags, mapping.Flag)
+			} else if mapping.Label != "" {
+				labels = append(labels, mapping.Label)
+			}
+		case strings.HasPrefix(flag, `\`):
+			flags = append(flags, flag)
+		default:
+			result.unknown = append(result.unknown, flag)
+			switch m.Unknown {
+			case unknownKeywordKeep:
+				flags = append(flags, flag)
+			case unknownKeywordLabel:
+				labels = append(labels, m.UnknownLabelPrefix+strings.TrimPrefix(flag, "$"))
+			}
+		}
+	}
+
+	slices.Sort(flags)
+	msg.Flags = slices.Compact(flags)
+	if hasLabels {
+		slices.Sort(labels)
+		gcp.SetLabels(msg, slices.Compact(labels))
+	}
+	return result, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// gmailMaxLabelLength is the maximum length (in characters) of a Gmail label name, including its parents.
+	gmailMaxLabelLength = 225
+
+	// sanitizedLabelHashLength is the number of hex digits of the hash suffix of truncated label names, which keeps
+	// distinct long names distinct.
+	sanitizedLabelHashLength = 8
+
+	// sanitizedLabelReplacement replaces control characters in label names, and empty path segments.
+	sanitizedLabelReplacement = '_'
+)
+
+// sanitizeLabelName returns a name Gmail accepts for the given label name from another provider, or the name itself
+// if Gmail accepts it as-is. Each path segment is trimmed of surrounding whitespace, control characters (e.g. tabs &
+// newlines in folder names of other providers) are replaced, empty segments are replaced, and names longer than Gmail
+// allows are truncated with a hash of the original name appended. The result depends only on the given name, so
+// reruns (and retries) map labels the same way. System labels (e.g. "\\Inbox") are never changed.
+func sanitizeLabelName(name string) string {
+	if strings.HasPrefix(name, `\`) {
+		return name
+	}
+
+	segments := strings.Split(name, gcp.LabelDelimiter)
+	for i, segment := range segments {
+		segment = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return sanitizedLabelReplacement
+			}
+			return r
+		}, strings.TrimSpace(segment))
+		if segment == "" {
+			segment = string(sanitizedLabelReplacement)
+		}
+		segments[i] = segment
+	}
+	sanitized := strings.Join(segments, gcp.LabelDelimiter)
+
+	if utf8.RuneCountInString(sanitized) > gmailMaxLabelLength {
+		sum := sha256.Sum256([]byte(name))
+		suffix := "~" + hex.EncodeToString(sum[:])[:sanitizedLabelHashLength]
+		truncated := []rune(sanitized)[:gmailMaxLabelLength-len(suffix)]
+		sanitized = strings.TrimRightFunc(string(truncated), func(r rune) bool {
+			return unicode.IsSpace(r) || string(r) == gcp.LabelDelimiter
+		}) + suffix
+	}
+	return sanitized
+}
+
+// labelSanitizer sanitizes the label names of a run (see sanitizeLabelName), and records which names were changed, so
+// the mapping can be reviewed in the run's report. A nil labelSanitizer is valid, and sanitizes without recording.
+type labelSanitizer struct {
+	mu      sync.Mutex
+	renamed map[string]string // sanitized names, by original name
+}
+
+func newLabelSanitizer() *labelSanitizer {
+	return &labelSanitizer{renamed: make(map[string]string)}
+}
+
+// Name returns the sanitized name of the given label, recording it if it differs from the original name.
+func (s *labelSanitizer) Name(label string) string {
+	sanitized := sanitizeLabelName(label)
+	if s == nil || sanitized == label {
+		return sanitized
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.renamed[label]; !found {
+		slog.Warn("Label name rejected by Gmail, using a sanitized name", "label", label, "sanitized", sanitized)
+		s.renamed[label] = sanitized
+	}
+	return sanitized
+}
+
+// Names returns the sanitized names of the given labels.
+func (s *labelSanitizer) Names(labels []string) []string {
+	sanitized := make([]string, len(labels))
+	for i, label := range labels {
+		sanitized[i] = s.Name(label)
+	}
+	return sanitized
+}
+
+// Apply sanitizes the Gmail labels of the given message in place. Messages fetched without labels are left as-is.
+func (s *labelSanitizer) Apply(msg *imap.Message) error {
+	if _, hasLabels := msg.Items[gcp.GmailLabelsExt]; !hasLabels {
+		return nil
+	}
+	labels, err := gcp.GetLabels(msg)
+	if err != nil {
+		return err
+	}
+	gcp.SetLabels(msg, s.Names(labels))
+	return nil
+}
+
+// Renamed returns the sanitized names of the labels changed so far, by original name.
+func (s *labelSanitizer) Renamed() map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.renamed)
+}
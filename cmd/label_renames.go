@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/state"
+	"github.com/emersion/go-imap"
+)
+
+// labelRename is a source label renamed since the previous run.
+type labelRename struct {
+	from string
+	to   string
+}
+
+// trackLabelRenames detects source labels renamed since the previous run, and renames them in the target as well, so
+// the target does not end up with both the old and the new label. A label is considered renamed if a label of the
+// previous run disappeared, and a new label has exactly the same (non-empty) set of messages. The current source
+// labels are then recorded in the given store for the next run (unless dry-running).
+func trackLabelRenames(ctx context.Context, source *gcp.ReadOnlyGmail, target *gcp.Gmail, store *state.Store, dryRun bool) error {
+	if !source.GmailExtensions() {
+		slog.Warn("Label rename tracking requires Gmail extensions; skipping")
+		return nil
+	}
+
+	names, err := source.FetchMailboxNames(ctx, true, true)
+	if err != nil {
+		return fmt.Errorf("failed to fetch source labels: %w", err)
+	}
+	current := make(map[string]state.Label, len(names))
+	for _, name := range names {
+		if isLockLabel(name) {
+			continue
+		}
+		if current[name], err = fingerprintLabel(ctx, source, name); err != nil {
+			return err
+		}
+	}
+
+	renames := detectLabelRenames(store.Labels(), current)
+	if len(renames) > 0 {
+		targetNames, err := target.FetchMailboxNames(ctx, true, false)
+		if err != nil {
+			return fmt.Errorf("failed to fetch target labels: %w", err)
+		}
+		for _, r := range renames {
+			// The target has the sanitized names of labels Gmail rejects
+			r.from, r.to = sanitizeLabelName(r.from), sanitizeLabelName(r.to)
+			if !slices.Contains(targetNames, r.from) || slices.Contains(targetNames, r.to) {
+				slog.Debug("Skipping rename of label not in target, or already renamed", "label", r.from, "newName", r.to)
+				continue
+			}
+			slog.Info("Renaming label renamed in source account", "dryRun", dryRun, "label", r.from, "newName", r.to)
+			if err := target.RenameMailbox(ctx, r.from, r.to); err != nil {
+				return err
+			}
+			// Nested labels are renamed along with their parent
+			for i, name := range targetNames {
+				if name == r.from {
+					targetNames[i] = r.to
+				} else if rest, ok := strings.CutPrefix(name, r.from+gcp.LabelDelimiter); ok {
+					targetNames[i] = r.to + gcp.LabelDelimiter + rest
+				}
+			}
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+	return store.SetLabels(current)
+}
+
+// detectLabelRenames returns the labels of the previous run renamed in the current one, parents first. Labels whose
+// set of messages is shared with other labels (e.g. empty labels) are never considered renamed, since it is ambiguous
+// which label they were renamed to.
+func detectLabelRenames(previous, current map[string]state.Label) []labelRename {
+	if len(previous) == 0 {
+		return nil
+	}
+	removed := make(map[string][]string) // by fingerprint
+	for name, label := range previous {
+		if _, ok := current[name]; !ok && label.Messages > 0 {
+			removed[label.Fingerprint] = append(removed[label.Fingerprint], name)
+		}
+	}
+	added := make(map[string][]string) // by fingerprint
+	for name, label := range current {
+		if _, ok := previous[name]; !ok && label.Messages > 0 {
+			added[label.Fingerprint] = append(added[label.Fingerprint], name)
+		}
+	}
+
+	var renames []labelRename
+	for fingerprint, from := range removed {
+		if to := added[fingerprint]; len(from) == 1 && len(to) == 1 {
+			renames = append(renames, labelRename{from: from[0], to: to[0]})
+		}
+	}
+	slices.SortFunc(renames, func(a, b labelRename) int {
+		depth := strings.Count(a.from, gcp.LabelDelimiter) - strings.Count(b.from, gcp.LabelDelimiter)
+		return cmp.Or(depth, strings.Compare(a.from, b.from))
+	})
+	return renames
+}
+
+// fingerprintLabel returns the number of messages in the given source label, and a fingerprint of their (stable)
+// Gmail message IDs.
+func fingerprintLabel(ctx context.Context, source *gcp.ReadOnlyGmail, label string) (state.Label, error) {
+	uids, err := source.FindAllUIDs(ctx, label)
+	if err != nil {
+		return state.Label{}, fmt.Errorf("failed to find messages of '%s': %w", label, err)
+	}
+
+	// Fetches may be retried, so IDs are collected into a set
+	ids := make(map[uint64]bool, len(uids))
+	for chunk := range slices.Chunk(uids, messageEnvelopeFetchBatchSize) {
+		err := source.FetchByUIDsStream(ctx, label, chunk, []imap.FetchItem{gcp.GmailMsgIDExt}, func(msg *imap.Message) error {
+			id, err := gcp.GetGmailMessageID(msg)
+			if err != nil {
+				return err
+			}
+			ids[id] = true
+			return nil
+		})
+		if err != nil {
+			return state.Label{}, fmt.Errorf("failed to fetch message IDs of '%s': %w", label, err)
+		}
+	}
+
+	h := sha256.New()
+	for _, id := range slices.Sorted(maps.Keys(ids)) {
+		_ = binary.Write(h, binary.BigEndian, id)
+	}
+	return state.Label{Messages: uint32(len(ids)), Fingerprint: hex.EncodeToString(h.Sum(nil))[:16]}, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+)
+
+const labelsCleanupConnectionsLimit = 2
+
+// labelMerge moves the messages of a label into a near-duplicate label, and deletes it.
+type labelMerge struct {
+	from     string
+	into     string
+	messages uint32
+}
+
+// labelsCleanupPlan are the changes a labels cleanup makes.
+type labelsCleanupPlan struct {
+	empty   []string
+	merges  []labelMerge
+	skipped []string
+}
+
+// token returns a short token identifying the plan, so that a cleanup can only be confirmed for exactly the changes
+// shown by its preview.
+func (p *labelsCleanupPlan) token(account string) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n", account)
+	for _, label := range p.empty {
+		_, _ = fmt.Fprintf(h, "delete\t%s\n", label)
+	}
+	for _, m := range p.merges {
+		_, _ = fmt.Fprintf(h, "merge\t%s\t%s\t%d\n", m.from, m.into, m.messages)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+func runLabelsCleanup(args []string) int {
+	fs := flag.NewFlagSet("labels-cleanup", flag.ContinueOnError)
+	account := fs.String("account", "source", "Account to clean up: 'source' or 'target' (configured by the corresponding environment variables; defaults to $LABELS_CLEANUP_ACCOUNT)")
+	deleteEmpty := fs.Bool("delete-empty", true, "Delete labels without messages (labels with nested labels are kept; defaults to $LABELS_CLEANUP_DELETE_EMPTY)")
+	mergeDuplicates := fs.Bool("merge-duplicates", true, "Merge labels differing only by case or whitespace into the one with the most messages (defaults to $LABELS_CLEANUP_MERGE_DUPLICATES)")
+	confirm := fs.String("confirm", "", "Confirmation token printed by a preview run; without it, only a preview is shown")
+	if !parseFlags(fs, args, map[string]string{"account": "LABELS_CLEANUP_ACCOUNT", "delete-empty": "LABELS_CLEANUP_DELETE_EMPTY", "merge-duplicates": "LABELS_CLEANUP_MERGE_DUPLICATES"}) {
+		return exitUsage
+	} else if *account != "source" && *account != "target" {
+		slog.Error("The -account flag must be 'source' or 'target'", "account", *account)
+		return exitUsage
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	g, err := newGmailFromEnv(strings.ToUpper(*account), 1, labelsCleanupConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create Gmail connection", "err", err, "account", *account)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(g)
+
+	plan, err := planLabelsCleanup(ctx, g, *deleteEmpty, *mergeDuplicates)
+	if err != nil {
+		slog.Error("Failed to plan labels cleanup", "err", err)
+		return exitCodeOf(err)
+	}
+	token := plan.token(*account)
+
+	if *confirm == "" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "ACTION\tLABEL\tINTO\tMESSAGES")
+		for _, label := range plan.empty {
+			_, _ = fmt.Fprintf(w, "delete\t%s\t\t0\n", label)
+		}
+		for _, m := range plan.merges {
+			_, _ = fmt.Fprintf(w, "merge\t%s\t%s\t%d\n", m.from, m.into, m.messages)
+		}
+		for _, label := range plan.skipped {
+			_, _ = fmt.Fprintf(w, "skip\t%s\t\t\n", label)
+		}
+		_ = w.Flush()
+		if len(plan.empty)+len(plan.merges) > 0 {
+			fmt.Printf("\nTo proceed, re-run with: -confirm %s\n", token)
+		} else {
+			fmt.Println("\nNothing to clean up")
+		}
+		return exitOK
+	} else if *confirm != token {
+		slog.Error("Confirmation token does not match the labels to clean up; the labels may have changed since the preview, run it again")
+		return exitFailure
+	}
+
+	for _, m := range plan.merges {
+		if err := mergeLabel(ctx, g, m); err != nil {
+			slog.Error("Failed to merge label", "err", err, "label", m.from, "into", m.into)
+			return exitCodeOf(err)
+		}
+		slog.Info("Merged label", "label", m.from, "into", m.into, "messages", m.messages)
+	}
+	for _, label := range plan.empty {
+		if err := g.DeleteMailbox(ctx, label); err != nil {
+			slog.Error("Failed to delete empty label", "err", err, "label", label)
+			return exitCodeOf(err)
+		}
+		slog.Info("Deleted empty label", "label", label)
+	}
+	summary.Count("deleted", uint64(len(plan.empty)))
+	summary.Count("merged", uint64(len(plan.merges)))
+	slog.Info("Labels cleanup completed", "deleted", len(plan.empty), "merged", len(plan.merges))
+	return exitOK
+}
+
+// planLabelsCleanup finds the empty labels to delete, and the near-duplicate labels to merge. Labels with nested
+// labels are never deleted or merged, since that would affect their nested labels as well; such duplicates are
+// reported as skipped instead.
+func planLabelsCleanup(ctx context.Context, g *gcp.Gmail, deleteEmpty, mergeDuplicates bool) (*labelsCleanupPlan, error) {
+	labels, err := g.FetchMailboxNames(ctx, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch labels: %w", err)
+	}
+	labels = slices.DeleteFunc(labels, isLockLabel)
+	slices.Sort(labels)
+
+	counts := make(map[string]uint32, len(labels))
+	for _, label := range labels {
+		if counts[label], err = g.CountMessages(ctx, label); err != nil {
+			return nil, err
+		}
+	}
+	hasChildren := func(label string) bool {
+		return slices.ContainsFunc(labels, func(other string) bool {
+			return strings.HasPrefix(other, label+gcp.LabelDelimiter)
+		})
+	}
+
+	plan := &labelsCleanupPlan{}
+	merged := make(map[string]bool)
+	if mergeDuplicates {
+		groups := make(map[string][]string)
+		for _, label := range labels {
+			key := normalizeLabel(label)
+			groups[key] = append(groups[key], label)
+		}
+		for _, key := range slices.Sorted(maps.Keys(groups)) {
+			group := groups[key]
+			if len(group) < 2 {
+				continue
+			}
+			// Keep the label with the most messages (or the first, alphabetically)
+			slices.SortStableFunc(group, func(a, b string) int { return cmp.Compare(counts[b], counts[a]) })
+			into := group[0]
+			for _, label := range group[1:] {
+				if hasChildren(label) {
+					plan.skipped = append(plan.skipped, label)
+					continue
+				}
+				plan.merges = append(plan.merges, labelMerge{from: label, into: into, messages: counts[label]})
+				merged[label] = true
+			}
+		}
+	}
+	if deleteEmpty {
+		for _, label := range labels {
+			if counts[label] == 0 && !merged[label] && !hasChildren(label) {
+				plan.empty = append(plan.empty, label)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// normalizeLabel returns the given label in lower case, with whitespace in each level of its hierarchy collapsed.
+func normalizeLabel(label string) string {
+	segments := strings.Split(label, gcp.LabelDelimiter)
+	for i, segment := range segments {
+		segments[i] = strings.ToLower(strings.Join(strings.Fields(segment), " "))
+	}
+	return strings.Join(segments, gcp.LabelDelimiter)
+}
+
+// mergeLabel moves the messages of a label into another label, and deletes it.
+func mergeLabel(ctx context.Context, g *gcp.Gmail, m labelMerge) error {
+	uids, err := g.FindAllUIDs(ctx, m.from)
+	if err != nil {
+		return fmt.Errorf("failed to find messages of '%s': %w", m.from, err)
+	}
+	for chunk := range slices.Chunk(uids, cleanupBatchSize) {
+		if err := g.MoveMessage(ctx, m.from, chunk, m.into); err != nil {
+			return err
+		}
+	}
+	return g.DeleteMailbox(ctx, m.from)
+}
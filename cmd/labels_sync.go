@@ -0,0 +1,159 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	labelsync "github.com/arikkfir-org/gmail-organizer/internal/sync"
+)
+
+const (
+	labelsSyncConnectionsLimit = 2
+
+	// defaultMaxLabelCreations is the default number of labels a single sync may create before it is considered a
+	// label explosion (e.g. from mis-parsed mailbox names), and aborted.
+	defaultMaxLabelCreations = 1000
+
+	// gmailMaxLabels is (approximately) the maximum number of labels of a Gmail account.
+	gmailMaxLabels = 10000
+
+	// labelExplosionBreakdownSize is the number of top-level labels described by a label explosion error.
+	labelExplosionBreakdownSize = 10
+)
+
+// errLabelExplosion is returned when a sync would create an absurd number of labels. Unlike other label sync
+// failures, it must never be tolerated, since appending messages would then create their labels one by one.
+var errLabelExplosion = errors.New("too many labels to create")
+
+func runSyncLabels(args []string) int {
+	fs := flag.NewFlagSet("sync-labels", flag.ContinueOnError)
+	skipEmpty := fs.Bool("skip-empty", false, "Do not create labels without messages, other than parents of created labels (defaults to $SKIP_EMPTY_LABELS)")
+	dryRun := fs.Bool("dry-run", false, "Only report which labels would be created")
+	maxCreate := fs.Int("max-create", defaultMaxLabelCreations, "Abort without creating any labels if more than this many would be created (0 for no limit; defaults to $MAX_LABEL_CREATIONS)")
+	if !parseFlags(fs, args, map[string]string{"skip-empty": "SKIP_EMPTY_LABELS", "max-create": "MAX_LABEL_CREATIONS"}) {
+		return exitUsage
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	sourcePool, err := newGmailFromEnv("SOURCE", 1, labelsSyncConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	sourceGmail := sourcePool.ReadOnly()
+	defer closeGmail(sourceGmail)
+
+	targetGmail, err := newGmailFromEnv("TARGET", 1, labelsSyncConnectionsLimit, gcp.WithDryRun(*dryRun))
+	if err != nil {
+		slog.Error("Failed to create target Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(targetGmail)
+
+	created, err := syncLabelStructure(ctx, sourceGmail, targetGmail, newLabelSanitizer(), *skipEmpty, *maxCreate, *dryRun)
+	if err != nil {
+		slog.Error("Failed to sync labels", "err", err)
+		return exitCodeOf(err)
+	}
+	summary.Count("created", uint64(len(created)))
+	slog.Info("Labels synced", "dryRun", *dryRun, "created", len(created))
+	return exitOK
+}
+
+// syncLabelStructure creates the labels of the source account that are missing in the target account, including
+// organizational parents without messages of their own (which are not selectable on some servers), so the target
+// has the complete label hierarchy even before any messages are migrated. If skipEmpty is true, labels without
+// messages are not created, unless they are parents of created labels. Labels are created under their sanitized names
+// (see sanitizeLabelName), recorded by the given sanitizer. Lock labels are never synced. If more than
+// maxCreate labels (unless 0) would be created, or the target would exceed Gmail's label limit, no labels are created
+// and errLabelExplosion is returned. Returns the names of the created (or, in a dry run, planned) labels, parents
+// first.
+func syncLabelStructure(ctx context.Context, source *gcp.ReadOnlyGmail, target *gcp.Gmail, names *labelSanitizer, skipEmpty bool, maxCreate int, dryRun bool) ([]string, error) {
+	sourceLabels, err := source.FetchMailboxNames(ctx, true, skipEmpty)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch source labels: %w", err)
+	}
+	targetLabels, err := target.FetchMailboxNames(ctx, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch target labels: %w", err)
+	}
+
+	if skipEmpty {
+		var nonEmpty []string
+		for _, label := range sourceLabels {
+			if slices.Contains(targetLabels, label) {
+				nonEmpty = append(nonEmpty, label)
+			} else if count, err := source.CountMessages(ctx, label); err != nil {
+				return nil, err
+			} else if count > 0 {
+				nonEmpty = append(nonEmpty, label)
+			} else {
+				slog.Debug("Skipping empty label", "label", label)
+			}
+		}
+		sourceLabels = nonEmpty
+	}
+
+	sourceLabels = slices.Compact(slices.Sorted(slices.Values(names.Names(sourceLabels))))
+	planner := &labelsync.MailboxPlanner{
+		Exclude: isLockLabel,
+	}
+	plan := planner.Plan(sourceLabels, targetLabels)
+	slog.Info("Planned label structure sync", "dryRun", dryRun, "create", len(plan.Create), "parents", len(plan.Parents), "existing", plan.Existing)
+	if err := checkLabelExplosion(plan.Create, len(targetLabels), maxCreate); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		for _, label := range plan.Create {
+			slog.Info("Creating label", "dryRun", true, "label", label, "parent", slices.Contains(plan.Parents, label))
+		}
+		return plan.Create, nil
+	}
+	if err := target.CreateMailboxes(ctx, plan.Create...); err != nil {
+		return nil, fmt.Errorf("failed to create labels: %w", err)
+	}
+	return plan.Create, nil
+}
+
+// checkLabelExplosion returns errLabelExplosion if more than maxCreate labels (unless 0) are to be created, or if
+// creating them would exceed Gmail's label limit, describing which top-level labels most of them are nested under.
+func checkLabelExplosion(create []string, existing, maxCreate int) error {
+	var limit string
+	if maxCreate > 0 && len(create) > maxCreate {
+		limit = fmt.Sprintf("more than %d", maxCreate)
+	} else if existing+len(create) > gmailMaxLabels {
+		limit = fmt.Sprintf("the target's %d existing labels plus these exceed Gmail's limit of %d", existing, gmailMaxLabels)
+	} else {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, label := range create {
+		top, _, _ := strings.Cut(label, gcp.LabelDelimiter)
+		counts[top]++
+	}
+	tops := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(tops, func(a, b string) int { return cmp.Or(counts[b]-counts[a], strings.Compare(a, b)) })
+	var breakdown []string
+	for _, top := range tops[:min(len(tops), labelExplosionBreakdownSize)] {
+		breakdown = append(breakdown, fmt.Sprintf("%s (%d)", top, counts[top]))
+	}
+	if len(tops) > labelExplosionBreakdownSize {
+		breakdown = append(breakdown, fmt.Sprintf("%d more top-level labels", len(tops)-labelExplosionBreakdownSize))
+	}
+	return fmt.Errorf("%w: %d labels to create (%s), under %s; check for mis-parsed mailbox names, or raise the limit with MAX_LABEL_CREATIONS", errLabelExplosion, len(create), limit, strings.Join(breakdown, ", "))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// defaultLocalDir is the directory of the files kept by local mode, unless configured otherwise.
+const defaultLocalDir = ".gmail-organizer"
+
+// applyLocalMode configures local mode if enabled by the LOCAL_MODE environment variable: a self-contained mode for
+// running on a laptop with nothing but the accounts' app passwords. Telemetry is not exported (rather than failing to
+// reach a collector), and the label state, target UIDs, failure ledger, audit log & dry-run report are kept in files
+// of the LOCAL_DIR directory, so runs resume & report just like they do in the cloud. Settings configured explicitly
+// are left as is; everything else that depends on GCP (e.g. BigQuery, Cloud Storage & Secret Manager) is only used
+// when configured.
+func applyLocalMode() error {
+	if !lookupEnvBool("LOCAL_MODE", false) {
+		return nil
+	}
+	dir := cmp.Or(os.Getenv("LOCAL_DIR"), defaultLocalDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create local mode directory '%s': %w", dir, err)
+	}
+	defaults := map[string]string{
+		"OTEL_TRACES_EXPORTER":  "none",
+		"METRICS_EXPORTER":      "none",
+		"LABEL_STATE_PATH":      filepath.Join(dir, "state.json"),
+		"TARGET_UID_STATE_PATH": filepath.Join(dir, "state.json"),
+		"FAILURE_LEDGER_PATH":   filepath.Join(dir, "failures.jsonl"),
+		"AUDIT_LOG":             filepath.Join(dir, "audit.jsonl"),
+		"DRY_RUN_REPORT":        filepath.Join(dir, "dry-run-report.json"),
+	}
+	for name, value := range defaults {
+		if _, found := os.LookupEnv(name); !found {
+			if err := os.Setenv(name, value); err != nil {
+				return fmt.Errorf("failed to set %s: %w", name, err)
+			}
+		}
+	}
+	slog.Info("Running in local mode", "dir", dir)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+)
+
+const (
+	// lockLabelPrefix is the prefix of lock labels; they are top-level labels, so releasing a lock leaves no parent
+	// label behind.
+	lockLabelPrefix = "Migration-Lock-"
+	// legacyLockLabelPrefix is the prefix of lock labels of older versions, still recognized so that their stale
+	// locks are removed.
+	legacyLockLabelPrefix = "Migration/Lock-"
+
+	lockLabelTimeFormat = "20060102T150405Z"
+	defaultLockTTL      = time.Hour
+)
+
+// labelLock is an advisory lock on an account, held by the existence of a "Migration-Lock-<timestamp>-<id>" label in
+// it. This is a low-tech way of preventing concurrent runs against the same target account, which works for ad-hoc
+// CLI runs without any infrastructure. The lock is kept fresh by periodically renaming the label to a more recent
+// timestamp; lock labels not refreshed within the lock TTL are considered stale (e.g. left behind by a crashed run).
+type labelLock struct {
+	g       *gcp.Gmail
+	id      string
+	ttl     time.Duration
+	mu      sync.Mutex
+	label   string
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// lockLabelName returns the lock label name for the given lock ID and timestamp.
+func lockLabelName(id string, t time.Time) string {
+	return lockLabelPrefix + t.UTC().Format(lockLabelTimeFormat) + "-" + id
+}
+
+// isLockLabel returns whether the given label is a lock label (of this version or an older one).
+func isLockLabel(name string) bool {
+	return strings.HasPrefix(name, lockLabelPrefix) || strings.HasPrefix(name, legacyLockLabelPrefix)
+}
+
+// parseLockLabel returns the timestamp of the given lock label, and false if it is not a lock label.
+func parseLockLabel(name string) (time.Time, bool) {
+	rest, found := strings.CutPrefix(name, lockLabelPrefix)
+	if !found {
+		if rest, found = strings.CutPrefix(name, legacyLockLabelPrefix); !found {
+			return time.Time{}, false
+		}
+	}
+	timestamp, _, _ := strings.Cut(rest, "-")
+	t, err := time.Parse(lockLabelTimeFormat, timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// acquireLabelLock acquires the advisory lock of the given account. Fails if another fresh lock label exists, unless
+// forced, in which case that label is removed. Stale lock labels are always removed.
+func acquireLabelLock(ctx context.Context, g *gcp.Gmail, ttl time.Duration, force bool) (*labelLock, error) {
+	names, err := g.FetchMailboxNames(ctx, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch mailbox names: %w", err)
+	}
+	for _, name := range names {
+		t, ok := parseLockLabel(name)
+		if !ok {
+			continue
+		}
+		age := time.Since(t)
+		if age < ttl && !force {
+			return nil, fmt.Errorf("account is locked by another run (label '%s', refreshed %s ago); use --force to override", name, age.Round(time.Second))
+		}
+		slog.Warn("Removing existing lock label", "label", name, "age", age.Round(time.Second), "stale", age >= ttl)
+		if err := g.DeleteMailbox(ctx, name); err != nil {
+			return nil, fmt.Errorf("failed to remove lock label '%s': %w", name, err)
+		}
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate lock ID: %w", err)
+	}
+	l := &labelLock{
+		g:       g,
+		id:      hex.EncodeToString(b),
+		ttl:     ttl,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	l.label = lockLabelName(l.id, time.Now())
+	if err := g.CreateMailboxes(ctx, l.label); err != nil {
+		return nil, fmt.Errorf("failed to create lock label '%s': %w", l.label, err)
+	}
+	slog.Info("Acquired account lock", "label", l.label)
+
+	go l.refresh()
+	return l, nil
+}
+
+// refresh periodically renames the lock label to the current time, so other runs see the lock as fresh.
+func (l *labelLock) refresh() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			label := lockLabelName(l.id, time.Now())
+			if err := l.g.RenameMailbox(context.Background(), l.label, label); err != nil {
+				slog.Warn("Failed to refresh account lock", "err", err, "label", l.label)
+			} else {
+				l.label = label
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Release stops refreshing the lock, and removes its label.
+func (l *labelLock) Release(ctx context.Context) error {
+	close(l.done)
+	<-l.stopped
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.g.DeleteMailbox(ctx, l.label); err != nil {
+		return fmt.Errorf("failed to remove lock label '%s': %w", l.label, err)
+	}
+	slog.Info("Released account lock", "label", l.label)
+	return nil
+}
@@ -2,29 +2,22 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/arikkfir-org/gmail-organizer/internal/notifications"
 	"github.com/arikkfir-org/gmail-organizer/internal/otel"
 	"github.com/arikkfir-org/gmail-organizer/internal/util"
 )
 
-func runJob() int {
-	// Create context that cancels on SIGINT and SIGTERM
-	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
-	defer cancelCtx()
-
-	// Create job
-	job, err := newWorkerJob()
-	if err != nil {
-		slog.Error("Failed to initialize job", "err", err)
-		return 1
-	}
-	defer job.Close()
-
-	// Configure logging
+// configureLogging configures the default logger according to the JSON_LOGGING and LOG_LEVEL environment variables.
+func configureLogging() {
 	logLevel := slog.LevelInfo
 	if s, found := os.LookupEnv("LOG_LEVEL"); found {
 		switch strings.ToUpper(s) {
@@ -40,26 +33,103 @@ func runJob() int {
 			logLevel = slog.LevelError
 		}
 	}
-	util.ConfigureLogging(job.jsonLogging, logLevel)
+	util.ConfigureLogging(lookupEnvBool("JSON_LOGGING", false), logLevel)
+}
+
+func runJob(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Run even if the target account is locked by another (possibly crashed) run")
+	errorPolicy := fs.String("error-policy", errorPolicyStrict, "Whether failures of single messages abort the run ('strict') or are recorded & skipped ('continue'); defaults to $ERROR_POLICY")
+	maxFailures := fs.Uint64("max-failures", 0, "With -error-policy=continue, abort the run after this many failures (0 for no limit; defaults to $MAX_FAILURES)")
+	priorityLabels := fs.String("priority-labels", "", "Comma-separated labels to migrate before all others, e.g. 'INBOX,Starred,Important' (defaults to $PRIORITY_LABELS)")
+	tui := fs.Bool("tui", false, "Show live progress in the terminal instead of logging it, if stdout is a terminal (defaults to $TUI)")
+	envNames := map[string]string{"error-policy": "", "max-failures": "", "priority-labels": "", "tui": ""}
+	if !parseFlags(fs, args, envNames) {
+		return exitUsage
+	}
+	logEffectiveConfig(fs, envNames)
+	if *tui && !isTerminal(os.Stdout) {
+		slog.Info("Standard output is not a terminal, logging progress instead of showing it")
+		*tui = false
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	// Warn if this version is outdated or known to be bad
+	go checkVersion(ctx)
+
+	// Create job
+	notifier, err := newNotifierFromEnv()
+	if err != nil {
+		slog.Error("Failed to configure notifications", "err", err)
+		return exitCodeOf(err)
+	}
+	job, err := newWorkerJob(*force, *errorPolicy, *maxFailures, parseLabelList(*priorityLabels), notifier, nil, nil, jobPathsFromEnv())
+	if err != nil {
+		slog.Error("Failed to initialize job", "err", err)
+		notify(ctx, notifier, notifications.Event{Kind: notifications.KindFailed, Source: "migrate", Message: fmt.Sprintf("Failed to initialize job: %s", err)})
+		return exitCodeOf(err)
+	}
+	defer job.Close()
+	job.tui = *tui
 
 	// Initialize OpenTelemetry for tracing and metrics
 	shutdown, err := otel.InitOtelProvider(ctx, "worker")
 	if err != nil {
 		slog.Error("Failed to initialize OTel provider", "err", err)
-		return 1
+		return exitCodeOf(err)
 	}
 	defer shutdown()
 
 	// Run job
-	if err := job.Run(ctx); err != nil {
+	started := time.Now()
+	err = job.Run(ctx)
+	summary.Migration = job.summary()
+	details := map[string]any{
+		"migrated": summary.Migration.Migrated,
+		"updated":  summary.Migration.Updated,
+		"failed":   summary.Migration.Failed,
+		"duration": time.Since(started).Round(time.Second).String(),
+	}
+	if err != nil {
 		slog.Error("Job failed", "err", err)
-		return 1
+		notify(ctx, notifier, notifications.Event{Kind: notifications.KindFailed, Source: "migrate", Message: fmt.Sprintf("Job failed: %s", err), Details: details})
+		return exitCodeOf(err)
 	}
 
-	slog.Info("Job completed successfully")
-	return 0
+	notify(ctx, notifier, notifications.Event{Kind: notifications.KindCompleted, Source: "migrate", Message: "Job completed", Details: details})
+	switch {
+	case summary.Migration.Mismatched > 0:
+		slog.Warn("Job completed, but some migrated messages differ from their source; see the failure ledger", "mismatched", summary.Migration.Mismatched)
+		return exitMismatch
+	case summary.Migration.Failed > 0 || summary.Migration.Skipped[skipReasonTooLarge] > 0:
+		slog.Warn("Job completed, but some messages failed to migrate; see the failure ledger", "failed", summary.Migration.Failed, "tooLarge", summary.Migration.Skipped[skipReasonTooLarge])
+		return exitPartial
+	default:
+		slog.Info("Job completed successfully")
+		return exitOK
+	}
 }
 
 func main() {
-	os.Exit(runJob())
+	configureLogging()
+	// The simulation is applied first, so that local mode's defaults do not override the simulation's state paths
+	if err := applySimulation(); err != nil {
+		slog.Error("Failed to configure target simulation", "err", err)
+		os.Exit(exitConfig)
+	}
+	if err := applyLocalMode(); err != nil {
+		slog.Error("Failed to configure local mode", "err", err)
+		os.Exit(exitConfig)
+	}
+
+	exitCode := exitOK
+	root := newRootCommand(&exitCode)
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	os.Exit(exitCode)
 }
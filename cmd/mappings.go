@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// labelMapping is a single source label or keyword, and the target label a migration maps it to.
+type labelMapping struct {
+	Kind   string `json:"kind"` // "label" or "keyword"
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// labelMappingsPreview lists the target label of every source label & mapped keyword, along with collisions: target
+// labels (case-insensitively, like Gmail) that more than one source label or keyword maps to.
+type labelMappingsPreview struct {
+	Mappings   []labelMapping            `json:"mappings"`
+	Collisions map[string][]labelMapping `json:"collisions"`
+	// UnknownKeywords describes what keywords without a mapping are turned into, if anything.
+	UnknownKeywords string `json:"unknownKeywords,omitempty"`
+}
+
+// runMappings runs the "mappings" command, whose only subcommand is "preview".
+func runMappings(args []string) int {
+	if len(args) == 0 || args[0] != "preview" {
+		slog.Error("Usage: mappings preview [flags]")
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("mappings preview", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the preview as JSON, rather than a table (defaults to $MAPPINGS_JSON)")
+	if !parseFlags(fs, args[1:], map[string]string{"json": "MAPPINGS_JSON"}) {
+		return exitUsage
+	}
+
+	// The keyword mappings are validated before connecting, so a broken file fails fast
+	keywords, err := loadKeywordMapper(os.Getenv("KEYWORD_MAPPINGS_PATH"))
+	if err != nil {
+		slog.Error("Failed to load keyword mappings", "err", err)
+		return exitCodeOf(err)
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	sourcePool, err := newGmailFromEnv("SOURCE", 1, 1)
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	source := sourcePool.ReadOnly()
+	defer closeGmail(source)
+
+	labels, err := source.FetchMailboxNames(ctx, true, false)
+	if err != nil {
+		slog.Error("Failed to fetch source labels", "err", err)
+		return exitCodeOf(err)
+	}
+	preview := previewLabelMappings(labels, keywords)
+	summary.Count("mappings", uint64(len(preview.Mappings)))
+	summary.Count("collisions", uint64(len(preview.Collisions)))
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(preview); err != nil {
+			slog.Error("Failed to encode preview", "err", err)
+			return exitCodeOf(err)
+		}
+	} else {
+		preview.print()
+	}
+	if len(preview.Collisions) > 0 {
+		slog.Error("Some target labels are mapped from more than one source label or keyword", "collisions", len(preview.Collisions))
+		return exitFailure
+	}
+	return exitOK
+}
+
+// previewLabelMappings returns the target label of each of the given source labels (lock labels excluded) and of each
+// keyword the given mapper turns into a label, as a migration would map them. Labels are migrated as-is unless Gmail
+// rejects their names (see sanitizeLabelName), so collisions arise from labels differing only in case (which Gmail
+// treats as the same label, but other providers do not) or in rejected characters, and from keywords mapped to labels
+// that already exist.
+func previewLabelMappings(labels []string, keywords *keywordMapper) *labelMappingsPreview {
+	preview := &labelMappingsPreview{Mappings: []labelMapping{}, Collisions: map[string][]labelMapping{}}
+	slices.Sort(labels)
+	for _, label := range labels {
+		if !isLockLabel(label) {
+			preview.Mappings = append(preview.Mappings, labelMapping{Kind: "label", Source: label, Target: sanitizeLabelName(label)})
+		}
+	}
+	if keywords != nil {
+		for _, m := range keywords.Mappings {
+			if m.Label != "" {
+				preview.Mappings = append(preview.Mappings, labelMapping{Kind: "keyword", Source: m.Source, Target: sanitizeLabelName(m.Label)})
+			}
+		}
+		if keywords.Unknown == unknownKeywordLabel {
+			preview.UnknownKeywords = keywords.UnknownLabelPrefix + "<keyword>"
+		}
+	}
+
+	byTarget := make(map[string][]labelMapping)
+	for _, m := range preview.Mappings {
+		key := strings.ToLower(m.Target)
+		byTarget[key] = append(byTarget[key], m)
+	}
+	for key, mappings := range byTarget {
+		if len(mappings) > 1 {
+			preview.Collisions[key] = mappings
+		}
+	}
+	return preview
+}
+
+// print prints the preview as a table, marking colliding mappings.
+func (p *labelMappingsPreview) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "KIND\tSOURCE\tTARGET\tCOLLISION")
+	for _, m := range p.Mappings {
+		collision := ""
+		if _, found := p.Collisions[strings.ToLower(m.Target)]; found {
+			collision = "yes"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Kind, m.Source, m.Target, collision)
+	}
+	_ = w.Flush()
+	if p.UnknownKeywords != "" {
+		fmt.Printf("\nKeywords without a mapping become labels named '%s'\n", p.UnknownKeywords)
+	}
+	fmt.Printf("\n%d mappings, %d colliding target labels\n", len(p.Mappings), len(p.Collisions))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryLimitWatermarkRatio is the fraction of the container's memory limit that in-flight messages may occupy, by
+// default; the rest is left for buffers, copies of bodies made while migrating them, and the runtime itself.
+const memoryLimitWatermarkRatio = 0.5
+
+// cgroupMemoryLimitFiles hold the container's memory limit, under cgroup v2 and v1 respectively.
+var cgroupMemoryLimitFiles = []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"}
+
+// memoryWatermark bounds the approximate number of message bytes held in memory by workers at once: workers wait
+// before migrating a message that would exceed the watermark, until enough in-flight messages are done. This pauses
+// pulling new work under memory pressure, rather than letting the container be OOM-killed (losing all in-flight work).
+// A nil memoryWatermark is valid, and never waits.
+type memoryWatermark struct {
+	limit    int64
+	mu       sync.Mutex
+	inFlight int64
+	paused   bool
+	changed  chan struct{} // closed (and replaced) whenever in-flight bytes are released
+}
+
+// newMemoryWatermarkFromEnv creates a watermark of MEMORY_WATERMARK bytes if set (0 disables it), or of half of the
+// container's memory limit otherwise. Returns nil if disabled, or if no memory limit is set.
+func newMemoryWatermarkFromEnv() (*memoryWatermark, error) {
+	var limit int64
+	if _, found := os.LookupEnv("MEMORY_WATERMARK"); found {
+		v, err := lookupEnvInt("MEMORY_WATERMARK", 0)
+		if err != nil {
+			return nil, err
+		} else if v < 0 {
+			return nil, fmt.Errorf("%w: MEMORY_WATERMARK environment variable must not be negative", errInvalidConfig)
+		}
+		limit = int64(v)
+	} else if containerLimit := containerMemoryLimit(); containerLimit > 0 {
+		limit = int64(float64(containerLimit) * memoryLimitWatermarkRatio)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	slog.Debug("Limiting in-flight message bytes", "watermark", limit)
+	return &memoryWatermark{limit: limit, changed: make(chan struct{})}, nil
+}
+
+// containerMemoryLimit returns the memory limit of the container this process runs in, or 0 if there is none.
+func containerMemoryLimit() int64 {
+	for _, path := range cgroupMemoryLimitFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s := strings.TrimSpace(string(content))
+		if s == "max" {
+			return 0
+		}
+		// cgroup v1 reports "no limit" as a huge value, rounded down to the page size
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && v > 0 && v < 1<<62 {
+			return v
+		}
+	}
+	return 0
+}
+
+// Acquire waits until the given number of bytes fits under the watermark, and adds them to the in-flight bytes. A
+// message larger than the watermark is let through once nothing else is in flight, so it cannot wait forever.
+func (w *memoryWatermark) Acquire(ctx context.Context, n int64) error {
+	if w == nil {
+		return nil
+	}
+	for {
+		w.mu.Lock()
+		if w.inFlight == 0 || w.inFlight+n <= w.limit {
+			if w.paused {
+				w.paused = false
+				slog.Info("Resuming migration, in-flight messages are back under the memory watermark", "inFlightBytes", w.inFlight, "watermark", w.limit)
+			}
+			w.inFlight += n
+			w.mu.Unlock()
+			return nil
+		}
+		if !w.paused {
+			w.paused = true
+			slog.Info("Pausing migration until in-flight messages drain under the memory watermark", "inFlightBytes", w.inFlight, "watermark", w.limit)
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release removes the given number of bytes (previously acquired) from the in-flight bytes.
+func (w *memoryWatermark) Release(n int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inFlight -= n
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// InFlight returns the number of message bytes currently in flight.
+func (w *memoryWatermark) InFlight() int64 {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.inFlight
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/audit"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/maildate"
+	"github.com/emersion/go-imap"
+)
+
+// runMessageImport appends a single local .eml file to the target account, for manual remediation of messages the
+// migration could not handle. The message goes through the same transformations as migrated messages: keyword
+// mapping, and dating by its headers (a file has no INTERNALDATE). If the target already has the message, its labels
+// and flags are updated instead. The outcome is written to the audit log, if configured.
+func runMessageImport(args []string) int {
+	fs := flag.NewFlagSet("message import", flag.ContinueOnError)
+	labels := fs.String("labels", "", "Comma-separated labels to apply to the message (defaults to $MESSAGE_IMPORT_LABELS)")
+	flags := fs.String("flags", "", "Comma-separated flags & keywords to set on the message (e.g. '\\Seen,\\Flagged'; defaults to $MESSAGE_IMPORT_FLAGS)")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be imported (defaults to $MESSAGE_IMPORT_DRY_RUN)")
+	if !parseFlags(fs, args, map[string]string{"labels": "MESSAGE_IMPORT_LABELS", "flags": "MESSAGE_IMPORT_FLAGS", "dry-run": "MESSAGE_IMPORT_DRY_RUN"}) {
+		return exitUsage
+	} else if fs.NArg() != 1 {
+		slog.Error("Usage: message import [flags] <file.eml>")
+		return exitUsage
+	}
+	path := fs.Arg(0)
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Failed to read message file", "err", err, "path", path)
+		return exitCodeOf(err)
+	}
+	keywords, err := loadKeywordMapper(os.Getenv("KEYWORD_MAPPINGS_PATH"))
+	if err != nil {
+		slog.Error("Failed to load keyword mappings", "err", err)
+		return exitCodeOf(err)
+	}
+	msg, err := parseMessageFile(raw, parseLabelList(*labels), parseLabelList(*flags))
+	if err != nil {
+		slog.Error("Failed to parse message file", "err", err, "path", path)
+		return exitCodeOf(err)
+	} else if result, err := keywords.Apply(msg); err != nil {
+		slog.Error("Failed to map keywords", "err", err)
+		return exitCodeOf(err)
+	} else if len(result.unknown) > 0 {
+		slog.Warn("Message has unmapped keywords", "keywords", result.unknown, "policy", keywords.Unknown)
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	auditLog, err := audit.Open(ctx, os.Getenv("AUDIT_LOG"))
+	if err != nil {
+		slog.Error("Failed to open audit log", "err", err)
+		return exitCodeOf(err)
+	}
+	defer func() {
+		if err := auditLog.Close(); err != nil {
+			slog.Warn("Failed to close audit log", "err", err)
+		}
+	}()
+
+	g, err := newGmailFromEnv("TARGET", 1, 1, gcp.WithDryRun(*dryRun))
+	if err != nil {
+		slog.Error("Failed to create target Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(g)
+
+	started := time.Now()
+	record := audit.Record{SourceMailbox: path, MessageID: msg.Envelope.MessageId, Bytes: uint32(len(raw)), SenderDomain: senderDomain(msg), DryRun: *dryRun}
+	record.Labels, _ = gcp.GetLabels(msg)
+	err = importMessageFile(ctx, g, msg, &record)
+	record.DurationMS = time.Since(started).Milliseconds()
+	if err != nil {
+		record.Outcome, record.Error = audit.OutcomeFailed, err.Error()
+	}
+	if auditErr := auditLog.Record(record); auditErr != nil {
+		slog.Error("Failed to write audit record", "err", auditErr)
+		return exitFailure
+	} else if err != nil {
+		slog.Error("Failed to import message", "err", err, "messageID", msg.Envelope.MessageId)
+		return exitCodeOf(err)
+	}
+	summary.Count(record.Outcome, 1)
+	slog.Info("Imported message", "dryRun", *dryRun, "outcome", record.Outcome, "messageID", msg.Envelope.MessageId, "targetGmailUID", record.TargetUID)
+	return exitOK
+}
+
+// parseMessageFile returns a message to append with the given raw content, labels and flags. Messages without a
+// Message-ID get one derived from their content (like bulk imports), so importing them again finds the same message.
+// The internal date is taken from the "Received" or "Date" headers, or else left for the target to assign.
+func parseMessageFile(raw []byte, labels, flags []string) (*imap.Message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &imap.Envelope{MessageId: m.Header.Get("Message-ID"), Subject: m.Header.Get("Subject")}
+	if envelope.MessageId == "" {
+		envelope.MessageId = contentMessageID(raw)
+		raw = append([]byte("Message-ID: "+envelope.MessageId+"\r\n"), raw...)
+	}
+	if from, err := m.Header.AddressList("From"); err == nil && len(from) > 0 {
+		mailbox, host, _ := strings.Cut(from[0].Address, "@")
+		envelope.From = []*imap.Address{{PersonalName: from[0].Name, MailboxName: mailbox, HostName: host}}
+	}
+	internalDate, _, _ := maildate.Resolve(m.Header)
+
+	msg := &imap.Message{
+		Flags:        flags,
+		InternalDate: internalDate,
+		Envelope:     envelope,
+		Body:         map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader(raw)},
+	}
+	gcp.SetLabels(msg, labels)
+	return msg, nil
+}
+
+// importMessageFile appends the given message to the given account, or updates its labels and flags if the account
+// already has it, filling in the given audit record with the outcome.
+func importMessageFile(ctx context.Context, g *gcp.Gmail, msg *imap.Message, record *audit.Record) error {
+	existing, err := g.FindUIDByMessageID(ctx, g.DefaultMailbox(), msg.Envelope.MessageId)
+	if err != nil {
+		return fmt.Errorf("failed to search for message: %w", err)
+	} else if existing != nil {
+		uid, err := g.UpdateMessageAt(ctx, g.DefaultMailbox(), *existing, msg)
+		if err != nil {
+			return fmt.Errorf("failed to update existing message: %w", err)
+		}
+		record.Outcome, record.TargetUID = audit.OutcomeUpdated, uid
+		return nil
+	}
+
+	uid, err := g.AppendMessage(ctx, g.DefaultMailbox(), msg)
+	if err != nil {
+		return fmt.Errorf("failed to append message: %w", err)
+	}
+	record.Outcome, record.TargetUID = audit.OutcomeAppended, uid
+	return nil
+}
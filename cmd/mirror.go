@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+	"github.com/arikkfir-org/gmail-organizer/internal/notifications"
+	"github.com/arikkfir-org/gmail-organizer/internal/otel"
+)
+
+const (
+	defaultMirrorFreshness         = 15 * time.Minute
+	defaultMirrorReconcileInterval = 24 * time.Hour
+	mirrorFreshnessReportInterval  = time.Minute
+	mirrorRetryDelay               = time.Minute
+)
+
+// mirrorWatermark is the state of a source mailbox as of the last successful mirror cycle.
+type mirrorWatermark struct {
+	uidValidity uint32
+	uidNext     uint32
+}
+
+// mirror keeps the target account within a freshness objective of the source account, for as long as it runs: new
+// source messages are migrated incrementally as they arrive (waiting for them with IMAP IDLE), and the labels & flags
+// of all messages are reconciled periodically by a full migration run.
+type mirror struct {
+	defaultFreshness         time.Duration
+	defaultReconcileInterval time.Duration
+	defaultSchedule          *migrationSchedule // of the SCHEDULE_PATH file (nil if none)
+	configPath               string             // of the tunables file, watched for changes (empty if none)
+
+	mu                sync.Mutex
+	tunables          *mirrorTunables // as last loaded from the configuration file (nil if none)
+	freshness         time.Duration
+	reconcileInterval time.Duration
+	workers           *workerLimit
+	schedule          *migrationSchedule
+	job               *WorkerJob // of the cycle in progress (nil between cycles)
+
+	errorPolicy  string
+	forceLock    bool
+	notifier     *notifications.Notifier
+	freshnessLag *metrics.Gauge
+	source       *gcp.ReadOnlyGmail
+	watermarks   map[string]mirrorWatermark
+	reconciledAt time.Time
+	syncedAt     atomic.Int64 // start time (in Unix nanoseconds) of the last successful cycle
+	breached     bool
+}
+
+func runMirror(args []string) int {
+	fs := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	freshness := fs.Duration("freshness", defaultMirrorFreshness, "Objective for how far behind the source the target may fall (defaults to $MIRROR_FRESHNESS)")
+	reconcileInterval := fs.Duration("reconcile-interval", defaultMirrorReconcileInterval, "Interval of full runs reconciling the labels & flags of all messages (defaults to $MIRROR_RECONCILE_INTERVAL)")
+	errorPolicy := fs.String("error-policy", errorPolicyContinue, "Whether failures of single messages abort a cycle ('strict') or are recorded & skipped ('continue'); defaults to $ERROR_POLICY")
+	force := fs.Bool("force", false, "Run even if the target account is locked by another (possibly crashed) run")
+	configPath := fs.String("config", "", "Path of a JSON file of settings to watch & apply while mirroring, without restarting (defaults to $MIRROR_CONFIG_PATH)")
+	envNames := map[string]string{"freshness": "MIRROR_FRESHNESS", "reconcile-interval": "MIRROR_RECONCILE_INTERVAL", "error-policy": "", "config": "MIRROR_CONFIG_PATH"}
+	if !parseFlags(fs, args, envNames) {
+		return exitUsage
+	} else if *freshness <= 0 || *reconcileInterval <= 0 {
+		slog.Error("The -freshness and -reconcile-interval flags must be positive")
+		return exitUsage
+	}
+	logEffectiveConfig(fs, envNames)
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	notifier, err := newNotifierFromEnv()
+	if err != nil {
+		slog.Error("Failed to configure notifications", "err", err)
+		return exitCodeOf(err)
+	}
+
+	shutdown, err := otel.InitOtelProvider(ctx, "mirror")
+	if err != nil {
+		slog.Error("Failed to initialize OTel provider", "err", err)
+		return exitCodeOf(err)
+	}
+	defer shutdown()
+
+	reporter, err := metrics.NewReporter("mirror")
+	if err != nil {
+		slog.Error("Failed to create metrics reporter", "err", err)
+		return exitCodeOf(err)
+	}
+
+	// Between cycles, the source is only checked for new messages (each cycle's job has pools of its own)
+	sourcePool, err := newGmailFromEnv("SOURCE", 0, 1)
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	source := sourcePool.ReadOnly()
+	defer closeGmail(source)
+
+	m := &mirror{
+		defaultFreshness:         *freshness,
+		defaultReconcileInterval: *reconcileInterval,
+		configPath:               *configPath,
+		freshness:                *freshness,
+		reconcileInterval:        *reconcileInterval,
+		errorPolicy:              *errorPolicy,
+		forceLock:                *force,
+		notifier:                 notifier,
+		freshnessLag:             reporter.Gauge("mirror.freshness"),
+		source:                   source,
+	}
+	if m.configPath != "" {
+		if m.defaultSchedule, err = loadMigrationSchedule(os.Getenv("SCHEDULE_PATH")); err != nil {
+			slog.Error("Failed to load schedule", "err", err)
+			return exitCodeOf(err)
+		}
+		m.workers, m.schedule = newWorkerLimit(), &migrationSchedule{mode: scheduleModeFull}
+		tunables, err := loadMirrorTunables(m.configPath)
+		if err == nil {
+			err = m.apply(tunables)
+		}
+		if err != nil {
+			slog.Error("Failed to load mirror configuration", "err", err)
+			return exitCodeOf(err)
+		}
+		go m.watchConfig(ctx)
+	}
+	m.run(ctx)
+	return exitOK
+}
+
+// objectives returns the freshness objective and the interval of full runs currently in effect.
+func (m *mirror) objectives() (freshness, reconcileInterval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.freshness, m.reconcileInterval
+}
+
+// run mirrors the source account until the given context is done.
+func (m *mirror) run(ctx context.Context) {
+	freshness, reconcileInterval := m.objectives()
+	slog.Info("Mirroring source account", "freshness", freshness, "reconcileInterval", reconcileInterval)
+	go m.reportFreshness(ctx)
+
+	for ctx.Err() == nil {
+		freshness, reconcileInterval := m.objectives()
+		full := m.reconciledAt.IsZero() || time.Since(m.reconciledAt) >= reconcileInterval
+		started := time.Now()
+		if err := m.cycle(ctx, full); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Mirror cycle failed", "err", err, "full", full)
+			notify(ctx, m.notifier, notifications.Event{Kind: notifications.KindFailed, Source: "mirror", Message: fmt.Sprintf("Mirror cycle failed: %s", err)})
+			select {
+			case <-ctx.Done():
+			case <-time.After(mirrorRetryDelay):
+			}
+			continue
+		}
+		m.syncedAt.Store(started.UnixNano())
+		if full {
+			m.reconciledAt = started
+		}
+
+		// Wait for new messages, but not so long that the target falls behind the freshness objective
+		mailbox := m.source.DefaultMailbox()
+		if arrived, err := m.source.WaitForNewMessages(ctx, mailbox, freshness/2); err != nil && ctx.Err() == nil {
+			slog.Warn("Failed to wait for new messages", "err", err, "mailbox", mailbox)
+		} else if arrived {
+			slog.Debug("New messages arrived", "mailbox", mailbox)
+		}
+	}
+}
+
+// cycle migrates the source messages that arrived since the last cycle to the target account, or, if full is true,
+// all source messages, which also reconciles the labels & flags of messages migrated earlier.
+func (m *mirror) cycle(ctx context.Context, full bool) error {
+	mailboxes := parseLabelList(os.Getenv("SOURCE_MAILBOXES"))
+	if len(mailboxes) == 0 {
+		mailboxes = []string{m.source.DefaultMailbox()}
+	}
+
+	// Snapshot the source mailboxes before migrating, so messages arriving meanwhile are picked up by the next cycle
+	watermarks := make(map[string]mirrorWatermark, len(mailboxes))
+	minUIDs := make(map[string]uint32, len(mailboxes))
+	changed := full
+	for _, mailbox := range mailboxes {
+		status, err := m.source.MailboxStatus(ctx, mailbox)
+		if err != nil {
+			return err
+		}
+		watermarks[mailbox] = mirrorWatermark{uidValidity: status.UidValidity, uidNext: status.UidNext}
+		if previous, ok := m.watermarks[mailbox]; ok && previous.uidValidity == status.UidValidity && !full {
+			minUIDs[mailbox] = previous.uidNext
+			changed = changed || status.UidNext != previous.uidNext
+		} else {
+			changed = true
+		}
+	}
+	if !changed {
+		slog.Debug("No new messages in source account")
+		return nil
+	}
+
+	job, err := newWorkerJob(m.forceLock, m.errorPolicy, 0, nil, m.notifier, nil, nil, jobPathsFromEnv())
+	if err != nil {
+		return fmt.Errorf("failed to initialize job: %w", err)
+	}
+	defer job.Close()
+	job.minUIDs = minUIDs
+	if err := m.attach(job); err != nil {
+		return err
+	}
+	defer m.attach(nil)
+
+	slog.Info("Starting mirror cycle", "full", full)
+	if err := job.Run(ctx); err != nil {
+		return err
+	}
+	m.watermarks = watermarks
+	slog.Info("Mirror cycle completed", "full", full, "migrated", job.appended.Load(), "updated", job.updated.Load(), "failed", job.errors.Failures())
+	return nil
+}
+
+// attach makes the given job that of the cycle in progress (or no job, if nil), applying the tunables of the
+// configuration file (if any) to it, so that they're applied to it again whenever they change.
+func (m *mirror) attach(job *WorkerJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job != nil && m.tunables != nil {
+		if err := applyRateLimits(m.tunables, m.source, job); err != nil {
+			return err
+		}
+		job.workers, job.schedule = m.workers, m.schedule
+	}
+	m.job = job
+	return nil
+}
+
+// reportFreshness periodically reports how far behind the source the target is (as the "mirror.freshness" gauge, in
+// seconds), and notifies when the freshness objective is breached, until the given context is done.
+func (m *mirror) reportFreshness(ctx context.Context) {
+	ticker := time.NewTicker(mirrorFreshnessReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			syncedAt := m.syncedAt.Load()
+			if syncedAt == 0 {
+				continue
+			}
+			freshness, _ := m.objectives()
+			lag := time.Since(time.Unix(0, syncedAt))
+			m.freshnessLag.Set(ctx, lag.Seconds())
+			if lag > freshness && !m.breached {
+				m.breached = true
+				slog.Warn("Target account is behind the freshness objective", "lag", lag.Round(time.Second), "freshness", freshness)
+				notify(ctx, m.notifier, notifications.Event{
+					Kind:    notifications.KindThreshold,
+					Source:  "mirror",
+					Message: fmt.Sprintf("Target account is %s behind the source (objective is %s)", lag.Round(time.Second), freshness),
+				})
+			} else if lag <= freshness && m.breached {
+				m.breached = false
+				slog.Info("Target account is back within the freshness objective", "lag", lag.Round(time.Second), "freshness", freshness)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/notifications"
+)
+
+const (
+	defaultNotifySMTPPort        = 587
+	defaultNotifyFailureRate     = 0.01
+	failureThresholdMinProcessed = 100
+	notifyTimeout                = 30 * time.Second
+)
+
+// newNotifierFromEnv creates a notifier for the channels configured by the NOTIFY_* environment variables: a Slack
+// incoming webhook (NOTIFY_SLACK_WEBHOOK_URL), a generic webhook receiving events as JSON (NOTIFY_WEBHOOK_URL), and
+// email (NOTIFY_SMTP_HOST, NOTIFY_SMTP_PORT, NOTIFY_SMTP_USERNAME, NOTIFY_SMTP_PASSWORD, NOTIFY_SMTP_FROM and the
+// comma-separated NOTIFY_SMTP_TO). Returns nil if no channel is configured.
+func newNotifierFromEnv() (*notifications.Notifier, error) {
+	config := notifications.Config{
+		SlackWebhookURL: os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"),
+		WebhookURL:      os.Getenv("NOTIFY_WEBHOOK_URL"),
+	}
+	if host := os.Getenv("NOTIFY_SMTP_HOST"); host != "" {
+		port, err := lookupEnvInt("NOTIFY_SMTP_PORT", defaultNotifySMTPPort)
+		if err != nil {
+			return nil, err
+		}
+		to := parseLabelList(os.Getenv("NOTIFY_SMTP_TO"))
+		if len(to) == 0 {
+			return nil, fmt.Errorf("%w: NOTIFY_SMTP_TO environment variable is required when NOTIFY_SMTP_HOST is set", errInvalidConfig)
+		}
+		from := os.Getenv("NOTIFY_SMTP_FROM")
+		if from == "" {
+			from = os.Getenv("NOTIFY_SMTP_USERNAME")
+		}
+		config.SMTP = &notifications.SMTPConfig{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("NOTIFY_SMTP_USERNAME"),
+			Password: os.Getenv("NOTIFY_SMTP_PASSWORD"),
+			From:     from,
+			To:       to,
+		}
+	}
+	return notifications.New(config), nil
+}
+
+// lookupFailureRateThreshold returns the fraction of failed messages above which a threshold breach is notified, from
+// the NOTIFY_FAILURE_RATE environment variable (defaults to 1%).
+func lookupFailureRateThreshold() (float64, error) {
+	s, found := os.LookupEnv("NOTIFY_FAILURE_RATE")
+	if !found {
+		return defaultNotifyFailureRate, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to parse NOTIFY_FAILURE_RATE environment variable: %w", errInvalidConfig, err)
+	} else if v <= 0 || v > 1 {
+		return 0, fmt.Errorf("%w: NOTIFY_FAILURE_RATE environment variable must be between 0 (exclusive) and 1", errInvalidConfig)
+	}
+	return v, nil
+}
+
+// notify sends the given event, logging failures rather than returning them, since notifications are best-effort.
+func notify(ctx context.Context, n *notifications.Notifier, e notifications.Event) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+	if err := n.Notify(ctx, e); err != nil {
+		slog.Warn("Failed to send notification", "err", err, "kind", e.Kind)
+	}
+}
+
+// checkFailureRate notifies (once per run) when the fraction of failed messages exceeds the configured threshold.
+// Rates are only checked after enough messages were processed to be meaningful.
+func (j *WorkerJob) checkFailureRate(ctx context.Context) {
+	processed := j.processed.Load()
+	if processed < failureThresholdMinProcessed {
+		return
+	}
+	failures := j.errors.Failures()
+	rate := float64(failures) / float64(processed)
+	if rate <= j.failureRateThreshold || !j.failureRateNotified.CompareAndSwap(false, true) {
+		return
+	}
+	slog.Warn("Failure rate threshold exceeded", "failures", failures, "processed", processed, "threshold", j.failureRateThreshold)
+	go notify(ctx, j.notifier, notifications.Event{
+		Kind:    notifications.KindThreshold,
+		Source:  "migrate",
+		Message: fmt.Sprintf("%.1f%% of messages failed to migrate (threshold is %.1f%%)", rate*100, j.failureRateThreshold*100),
+		Details: map[string]any{"failures": failures, "processed": processed},
+	})
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/backup"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/mime"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	offloadConnectionsLimit = 2
+	offloadFetchBatchSize   = 100
+
+	// offloadedHeader marks messages whose attachments were offloaded, so they are not processed again.
+	offloadedHeader = "X-Gmail-Organizer-Offloaded"
+)
+
+// offloadStats counts the outcome of offloading attachments.
+type offloadStats struct {
+	messages    int
+	attachments int
+	bytes       int64
+	replaced    int
+}
+
+func runOffloadAttachments(args []string) int {
+	fs := flag.NewFlagSet("offload-attachments", flag.ContinueOnError)
+	bucket := fs.String("bucket", "", "Bucket to offload attachments into (defaults to $BACKUP_BUCKET)")
+	prefix := fs.String("prefix", "", "Object name prefix in the bucket (defaults to $BACKUP_PREFIX, or the source account username)")
+	linkBase := fs.String("link-base", "", "Base URL of links to offloaded attachments (defaults to the bucket's console or s3:// URL)")
+	mailbox := fs.String("mailbox", "", "Mailbox to scan (defaults to all messages)")
+	query := fs.String("query", "", "Only scan messages matching this Gmail search query (e.g. 'older_than:2y has:attachment')")
+	minSize := fs.Uint("min-size", 5*1024*1024, "Only offload attachments of at least this many (encoded) bytes")
+	replace := fs.Bool("replace", false, "Replace each message with a copy whose offloaded attachments are replaced by links (the original is moved to the trash)")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be offloaded")
+	if !parseFlags(fs, args, map[string]string{"bucket": "BACKUP_BUCKET", "prefix": "BACKUP_PREFIX"}) {
+		return exitUsage
+	} else if *bucket == "" {
+		slog.Error("The -bucket flag (or BACKUP_BUCKET environment variable) is required")
+		return exitUsage
+	}
+	if *prefix == "" {
+		*prefix = os.Getenv("SOURCE_ACCOUNT_USERNAME")
+	}
+	if *linkBase == "" {
+		if os.Getenv("BACKUP_STORAGE") == "s3" {
+			*linkBase = "s3://" + *bucket
+		} else {
+			*linkBase = "https://storage.cloud.google.com/" + *bucket
+		}
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	sourceGmail, err := newGmailFromEnv("SOURCE", 1, offloadConnectionsLimit, gcp.WithDryRun(*dryRun))
+	if err != nil {
+		slog.Error("Failed to create source Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(sourceGmail)
+	if *mailbox == "" {
+		*mailbox = sourceGmail.DefaultMailbox()
+	}
+
+	// Attachments are stored as-is (neither compressed nor encrypted), so their links can be followed
+	s, err := openBackupBucket(ctx, *bucket)
+	if err != nil {
+		slog.Error("Failed to open bucket", "err", err, "bucket", *bucket)
+		return exitCodeOf(err)
+	}
+	defer s.Close()
+
+	o := &attachmentOffloader{
+		g:        sourceGmail,
+		storage:  s,
+		prefix:   *prefix,
+		linkBase: strings.TrimSuffix(*linkBase, "/"),
+		mailbox:  *mailbox,
+		minSize:  uint32(*minSize),
+		replace:  *replace,
+		dryRun:   *dryRun,
+	}
+	if err := o.run(ctx, *query); err != nil {
+		slog.Error("Attachment offloading failed", "err", err, "messages", o.stats.messages, "attachments", o.stats.attachments)
+		return exitCodeOf(err)
+	}
+	summary.Count("messages", uint64(o.stats.messages))
+	summary.Count("attachments", uint64(o.stats.attachments))
+	slog.Info("Attachment offloading completed",
+		"dryRun", *dryRun,
+		"messages", o.stats.messages,
+		"attachments", o.stats.attachments,
+		"bytes", o.stats.bytes,
+		"replacedMessages", o.stats.replaced)
+	return exitOK
+}
+
+// attachmentOffloader extracts large attachments of messages into a bucket, and optionally replaces the messages with
+// copies linking to the extracted attachments instead, to reclaim mailbox quota.
+type attachmentOffloader struct {
+	g        *gcp.Gmail
+	storage  backup.Storage
+	prefix   string
+	linkBase string
+	mailbox  string
+	minSize  uint32
+	replace  bool
+	dryRun   bool
+	stats    offloadStats
+}
+
+func (o *attachmentOffloader) run(ctx context.Context, query string) error {
+	candidates, err := o.findCandidates(ctx, query)
+	if err != nil {
+		return err
+	}
+	slog.Info("Offloading attachments", "mailbox", o.mailbox, "messages", len(candidates))
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, gcp.GmailLabelsExt}
+	for _, uid := range candidates {
+		// Messages are fetched one by one, since only messages with large attachments are candidates
+		msg, err := o.g.FetchMessageByUID(ctx, o.mailbox, uid, items...)
+		if err != nil {
+			return fmt.Errorf("failed to fetch message '%d': %w", uid, err)
+		}
+		raw, err := gcp.GetRawBody(msg)
+		if err != nil {
+			return fmt.Errorf("failed to read message '%d': %w", uid, err)
+		}
+		if err := o.offloadMessage(ctx, msg, raw); err != nil {
+			return fmt.Errorf("failed to offload attachments of message '%d': %w", uid, err)
+		}
+	}
+	return nil
+}
+
+// findCandidates returns the sorted UIDs of the messages in the mailbox (matching the given Gmail search query, if
+// any) that have at least one attachment of the minimum size, according to their body structures.
+func (o *attachmentOffloader) findCandidates(ctx context.Context, query string) ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Larger = o.minSize
+	uids, err := findMessagesToExport(ctx, o.g, o.mailbox, query, criteria)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find messages to scan: %w", err)
+	}
+
+	var candidates []uint32
+	for chunk := range slices.Chunk(uids, offloadFetchBatchSize) {
+		err := o.g.FetchByUIDsStream(ctx, o.mailbox, chunk, []imap.FetchItem{imap.FetchBodyStructure}, func(msg *imap.Message) error {
+			if msg.BodyStructure == nil {
+				return nil
+			}
+			found := false
+			msg.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+				if len(part.Parts) == 0 && part.Size >= o.minSize && len(path) > 0 {
+					found = true
+				}
+				return !found
+			})
+			if found {
+				candidates = append(candidates, msg.Uid)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch body structures: %w", err)
+		}
+	}
+	slices.Sort(candidates)
+	return candidates, nil
+}
+
+// offloadMessage uploads the large attachments of the given message, and replaces the message if configured to.
+func (o *attachmentOffloader) offloadMessage(ctx context.Context, msg *imap.Message, raw []byte) error {
+	root, err := mime.Parse(raw)
+	if err != nil {
+		return err
+	} else if root.Header.Get(offloadedHeader) != "" {
+		slog.Debug("Skipping message with offloaded attachments", "uid", msg.Uid)
+		return nil
+	}
+
+	var replacements []mime.Replacement
+	var walkErr error
+	root.Walk(func(part *mime.Part) {
+		if walkErr != nil || !part.IsAttachment() || len(part.Body(raw)) < int(o.minSize) {
+			return
+		}
+		content, err := part.Decode(raw)
+		if err != nil {
+			walkErr = err
+			return
+		}
+		filename := part.Filename()
+		if filename == "" {
+			filename = "attachment"
+		}
+		link, err := o.upload(ctx, filename, content)
+		if err != nil {
+			walkErr = err
+			return
+		}
+		slog.Info("Offloaded attachment", "dryRun", o.dryRun, "uid", msg.Uid, "filename", filename, "size", len(content), "link", link)
+		replacements = append(replacements, mime.Replacement{
+			Part:    part,
+			Content: mime.Placeholder(filename, part.MediaType(), len(content), link),
+		})
+		o.stats.attachments++
+		o.stats.bytes += int64(len(content))
+	})
+	if walkErr != nil {
+		return walkErr
+	} else if len(replacements) == 0 {
+		return nil
+	}
+	o.stats.messages++
+
+	if !o.replace {
+		return nil
+	} else if msg.Envelope == nil || msg.Envelope.MessageId == "" {
+		slog.Warn("Not replacing message without a Message-ID", "uid", msg.Uid)
+		return nil
+	}
+	stripped := append([]byte(fmt.Sprintf("%s: %d\r\n", offloadedHeader, len(replacements))), mime.Rewrite(raw, replacements...)...)
+	if o.dryRun {
+		slog.Info("Replacing message", "dryRun", true, "uid", msg.Uid, "size", len(raw), "newSize", len(stripped))
+		o.stats.replaced++
+		return nil
+	}
+
+	// The original is trashed first, so that the copy (which shares its Message-ID) is the only one found when applying
+	// labels after appending it; if appending fails, the original can still be restored from the trash
+	copied := &imap.Message{
+		Uid:          msg.Uid,
+		Flags:        slices.DeleteFunc(slices.Clone(msg.Flags), func(f string) bool { return f == imap.RecentFlag }),
+		InternalDate: msg.InternalDate,
+		Envelope:     msg.Envelope,
+		Items:        map[imap.FetchItem]any{gcp.GmailLabelsExt: msg.Items[gcp.GmailLabelsExt]},
+		Body:         map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader(stripped)},
+	}
+	if err := o.g.MoveToTrash(ctx, o.mailbox, []uint32{msg.Uid}); err != nil {
+		return fmt.Errorf("failed to trash original message: %w", err)
+	} else if _, err := o.g.AppendMessage(ctx, o.mailbox, copied); err != nil {
+		slog.Error("Failed to append stripped copy; the original message is in the trash", "uid", msg.Uid, "messageID", msg.Envelope.MessageId)
+		return fmt.Errorf("failed to append stripped copy: %w", err)
+	}
+	o.stats.replaced++
+	return nil
+}
+
+// upload stores the given attachment content in the bucket, keyed by its hash (so identical attachments are stored
+// once), and returns a link to it.
+func (o *attachmentOffloader) upload(ctx context.Context, filename string, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	name := path.Join(o.prefix, "attachments", hex.EncodeToString(sum[:]), path.Base(strings.ReplaceAll(filename, "\\", "/")))
+
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	link := o.linkBase + "/" + strings.Join(segments, "/")
+
+	if o.dryRun {
+		return link, nil
+	} else if exists, err := o.storage.Exists(ctx, name); err != nil {
+		return "", err
+	} else if !exists {
+		if err := o.storage.Put(ctx, name, bytes.NewReader(content)); err != nil {
+			return "", err
+		}
+	}
+	return link, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/config"
+	"github.com/arikkfir-org/gmail-organizer/internal/notifications"
+	"github.com/arikkfir-org/gmail-organizer/internal/otel"
+	"github.com/arikkfir-org/gmail-organizer/internal/secrets"
+)
+
+const (
+	defaultOrchestrationConcurrency = 4
+
+	// defaultSecretCacheTTL is how long passwords accessed through the latest version of their secret are cached,
+	// before being accessed again (e.g. to pick up rotated passwords). Passwords of pinned versions are never accessed
+	// again.
+	defaultSecretCacheTTL = time.Hour
+)
+
+// orchestrationAccount is an account of a pair to migrate. Its password is read from the given environment variable,
+// or accessed in Secret Manager, so the orchestration file itself holds no secrets.
+type orchestrationAccount struct {
+	Username    string `json:"username"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+	// PasswordSecret is the resource name of the secret (version) holding the password, e.g.
+	// "projects/p/secrets/alice/versions/3"; secrets without a version refer to their latest version.
+	PasswordSecret string `json:"passwordSecret,omitempty"`
+}
+
+// orchestrationPair is a source account to migrate into a target account, along with the "migrate" command's flags
+// for that migration.
+type orchestrationPair struct {
+	Name           string               `json:"name"`
+	Tenant         string               `json:"tenant"`
+	Source         orchestrationAccount `json:"source"`
+	Target         orchestrationAccount `json:"target"`
+	Force          bool                 `json:"force"`
+	ErrorPolicy    string               `json:"errorPolicy"`
+	MaxFailures    uint64               `json:"maxFailures"`
+	PriorityLabels []string             `json:"priorityLabels"`
+}
+
+// orchestrationTenant caps the concurrency of the migrations of a tenant (e.g. a Workspace domain), so its own
+// accounts (and their shared quotas) aren't overwhelmed.
+type orchestrationTenant struct {
+	MaxConcurrentRuns int `json:"maxConcurrentRuns"`
+}
+
+// orchestration is a list of account pairs to migrate, with caps on the number of concurrent migrations overall and
+// per tenant, as loaded from the ORCHESTRATION_PATH file, e.g.:
+//
+//	{
+//	  "maxConcurrentRuns": 4,
+//	  "tenants": {"acme.com": {"maxConcurrentRuns": 2}},
+//	  "pairs": [
+//	    {
+//	      "name": "alice",
+//	      "tenant": "acme.com",
+//	      "source": {"username": "alice@gmail.com", "passwordEnv": "ALICE_SOURCE_PASSWORD"},
+//	      "target": {"username": "alice@acme.com", "passwordSecret": "projects/acme/secrets/alice-target"},
+//	      "errorPolicy": "continue"
+//	    }
+//	  ]
+//	}
+//
+// Tenants without caps are capped only by the overall cap.
+type orchestration struct {
+	MaxConcurrentRuns int                            `json:"maxConcurrentRuns"`
+	Tenants           map[string]orchestrationTenant `json:"tenants"`
+	Pairs             []orchestrationPair            `json:"pairs"`
+}
+
+// loadOrchestration loads the orchestration from the given JSON file.
+func loadOrchestration(path string) (*orchestration, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read orchestration file '%s': %w", errInvalidConfig, path, err)
+	}
+	// Unknown fields are rejected, so that misspelled settings are not silently ignored
+	o := &orchestration{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(o); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse orchestration file '%s': %w", errInvalidConfig, path, err)
+	}
+	o.MaxConcurrentRuns = cmp.Or(o.MaxConcurrentRuns, defaultOrchestrationConcurrency)
+	if o.MaxConcurrentRuns < 0 {
+		return nil, fmt.Errorf("%w: maximum concurrent runs in '%s' must not be negative", errInvalidConfig, path)
+	}
+
+	names, targets := make(map[string]bool), make(map[string]bool)
+	for i := range o.Pairs {
+		p := &o.Pairs[i]
+		p.Name = cmp.Or(p.Name, config.MaskEmailAddress(p.Target.Username))
+		switch {
+		case p.Source.Username == "" || p.Target.Username == "":
+			return nil, fmt.Errorf("%w: pair %d in '%s' requires the username of both accounts", errInvalidConfig, i, path)
+		case p.Name == "." || p.Name == ".." || strings.ContainsAny(p.Name, `/\`):
+			// Pairs keep their state files in directories named after them (see pairPaths)
+			return nil, fmt.Errorf("%w: pair name '%s' in '%s' must be usable as a directory name", errInvalidConfig, p.Name, path)
+		case names[p.Name]:
+			return nil, fmt.Errorf("%w: duplicate pair name '%s' in '%s' (pairs are named after their masked target address unless named explicitly)", errInvalidConfig, p.Name, path)
+		case targets[strings.ToLower(p.Target.Username)]:
+			// Runs against the same target would only wait for each other's lock
+			return nil, fmt.Errorf("%w: pair '%s' in '%s' migrates into the target account of another pair", errInvalidConfig, p.Name, path)
+		case p.Tenant != "" && o.Tenants[p.Tenant].MaxConcurrentRuns < 0:
+			return nil, fmt.Errorf("%w: maximum concurrent runs of tenant '%s' in '%s' must not be negative", errInvalidConfig, p.Tenant, path)
+		}
+		for _, a := range []orchestrationAccount{p.Source, p.Target} {
+			if (a.PasswordEnv == "") == (a.PasswordSecret == "") {
+				return nil, fmt.Errorf("%w: account '%s' of pair '%s' in '%s' requires either a password variable or a password secret", errInvalidConfig, config.MaskEmailAddress(a.Username), p.Name, path)
+			} else if a.PasswordSecret != "" {
+				if err := secrets.Validate(a.PasswordSecret); err != nil {
+					return nil, fmt.Errorf("%w: account '%s' of pair '%s' in '%s': %w", errInvalidConfig, config.MaskEmailAddress(a.Username), p.Name, path, err)
+				}
+			}
+		}
+		names[p.Name], targets[strings.ToLower(p.Target.Username)] = true, true
+	}
+	return o, nil
+}
+
+// passwordSecrets returns the secrets holding passwords of the orchestrated accounts.
+func (o *orchestration) passwordSecrets() []string {
+	var names []string
+	for _, p := range o.Pairs {
+		for _, a := range []orchestrationAccount{p.Source, p.Target} {
+			if a.PasswordSecret != "" && !slices.Contains(names, a.PasswordSecret) {
+				names = append(names, a.PasswordSecret)
+			}
+		}
+	}
+	return names
+}
+
+// credentials returns the credentials of the account, reading its password from the environment, or from the given
+// cache of secrets.
+func (a orchestrationAccount) credentials(ctx context.Context, cache *secrets.Cache) (*accountCredentials, error) {
+	if a.PasswordSecret != "" {
+		password, err := cache.Get(ctx, a.PasswordSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get password of '%s': %w", config.MaskEmailAddress(a.Username), err)
+		}
+		return &accountCredentials{Username: a.Username, Password: password}, nil
+	}
+	password := os.Getenv(a.PasswordEnv)
+	if password == "" {
+		return nil, fmt.Errorf("%s environment variable (password of '%s') is required", a.PasswordEnv, config.MaskEmailAddress(a.Username))
+	}
+	return &accountCredentials{Username: a.Username, Password: password}, nil
+}
+
+// orchestratedRun is the migration of a single pair.
+type orchestratedRun struct {
+	pair *orchestrationPair
+
+	mu     sync.Mutex
+	job    *WorkerJob // nil until started
+	state  string
+	err    error
+	status string
+}
+
+// runOrchestrate runs the "orchestrate" command: it migrates every account pair listed in the orchestration file, a
+// few at a time, logging the progress of each pair and waiting for all of them to end. Pairs are isolated from each
+// other: each has connection pools and state files of its own (see pairPaths), and a failing pair does not stop the
+// others.
+func runOrchestrate(args []string) int {
+	fs := flag.NewFlagSet("orchestrate", flag.ContinueOnError)
+	path := fs.String("config", "", "Path of the orchestration file, listing the account pairs to migrate (defaults to $ORCHESTRATION_PATH)")
+	envNames := map[string]string{"config": "ORCHESTRATION_PATH"}
+	if !parseFlags(fs, args, envNames) {
+		return exitUsage
+	} else if *path == "" {
+		slog.Error("Orchestration file is required (-config or ORCHESTRATION_PATH)")
+		return exitUsage
+	}
+	logEffectiveConfig(fs, envNames)
+
+	o, err := loadOrchestration(*path)
+	if err != nil {
+		slog.Error("Failed to load orchestration", "err", err)
+		return exitCodeOf(err)
+	}
+	statusInterval, err := lookupEnvDuration("STATUS_INTERVAL", defaultStatusInterval)
+	if err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		return exitCodeOf(err)
+	}
+	paths := jobPathsFromEnv()
+	if strings.HasPrefix(paths.auditLog, "bq://") {
+		slog.Error("AUDIT_LOG cannot be a BigQuery table when orchestrating, since its records would not tell the pairs apart (use a file or a GCS object, which is kept per pair)")
+		return exitConfig
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	notifier, err := newNotifierFromEnv()
+	if err != nil {
+		slog.Error("Failed to configure notifications", "err", err)
+		return exitCodeOf(err)
+	}
+
+	// Initialize OpenTelemetry for tracing and metrics
+	shutdown, err := otel.InitOtelProvider(ctx, "worker")
+	if err != nil {
+		slog.Error("Failed to initialize OTel provider", "err", err)
+		return exitCodeOf(err)
+	}
+	defer shutdown()
+
+	// Passwords held in Secret Manager are all accessed up front, rather than as each pair starts
+	var secretCache *secrets.Cache
+	if names := o.passwordSecrets(); len(names) > 0 {
+		ttl, err := lookupEnvDuration("SECRET_CACHE_TTL", defaultSecretCacheTTL)
+		if err != nil {
+			slog.Error("Invalid configuration", "err", err)
+			return exitCodeOf(err)
+		}
+		if secretCache, err = secrets.NewCache(ctx, ttl); err != nil {
+			slog.Error("Failed to access Secret Manager", "err", err)
+			return exitCodeOf(err)
+		}
+		defer secretCache.Close()
+		if err := secretCache.Prefetch(ctx, names); err != nil {
+			slog.Error("Failed to access password secrets", "err", err)
+			return exitCodeOf(err)
+		}
+		slog.Info("Accessed password secrets", "secrets", len(names))
+	}
+
+	slots := make(chan struct{}, o.MaxConcurrentRuns)
+	tenantSlots := make(map[string]chan struct{})
+	for name, tenant := range o.Tenants {
+		if tenant.MaxConcurrentRuns > 0 {
+			tenantSlots[name] = make(chan struct{}, tenant.MaxConcurrentRuns)
+		}
+	}
+
+	runs := make([]*orchestratedRun, len(o.Pairs))
+	var wg sync.WaitGroup
+	for i := range o.Pairs {
+		run := &orchestratedRun{pair: &o.Pairs[i], state: "pending"}
+		runs[i] = run
+		wg.Go(func() {
+			// The tenant's slot is taken first, so pairs of a capped tenant don't hold overall slots while waiting
+			for _, ch := range []chan struct{}{tenantSlots[run.pair.Tenant], slots} {
+				if ch == nil {
+					continue
+				}
+				select {
+				case ch <- struct{}{}:
+					defer func() { <-ch }()
+				case <-ctx.Done():
+					run.end(ctx.Err())
+					return
+				}
+			}
+			run.end(run.migrate(ctx, notifier, secretCache, paths))
+		})
+	}
+
+	statusCtx, stopStatus := context.WithCancel(ctx)
+	go logOrchestrationStatus(statusCtx, runs, statusInterval)
+	wg.Wait()
+	stopStatus()
+
+	failed := 0
+	for _, run := range runs {
+		if run.err != nil {
+			failed++
+			slog.Error("Pair failed", "pair", run.pair.Name, "tenant", run.pair.Tenant, "err", run.err)
+		} else {
+			slog.Info("Pair completed", "pair", run.pair.Name, "tenant", run.pair.Tenant)
+		}
+	}
+	summary.Count("pairs", uint64(len(runs)))
+	summary.Count("failedPairs", uint64(failed))
+	if failed > 0 {
+		notify(ctx, notifier, notifications.Event{Kind: notifications.KindFailed, Source: "orchestrate", Message: fmt.Sprintf("%d of %d pairs failed", failed, len(runs))})
+		return exitFailure
+	}
+	notify(ctx, notifier, notifications.Event{Kind: notifications.KindCompleted, Source: "orchestrate", Message: fmt.Sprintf("All %d pairs completed successfully", len(runs))})
+	return exitOK
+}
+
+// migrate migrates the pair, like the "migrate" command would, keeping the pair's state files, logs & reports in the
+// given paths made specific to the pair (see pairPaths).
+func (r *orchestratedRun) migrate(ctx context.Context, notifier *notifications.Notifier, secretCache *secrets.Cache, paths jobPaths) error {
+	source, err := r.pair.Source.credentials(ctx, secretCache)
+	if err != nil {
+		return err
+	}
+	target, err := r.pair.Target.credentials(ctx, secretCache)
+	if err != nil {
+		return err
+	}
+	paths, err = pairPaths(paths, r.pair.Name)
+	if err != nil {
+		return err
+	}
+	slog.Info("Starting pair migration", "pair", r.pair.Name, "tenant", r.pair.Tenant)
+	job, err := newWorkerJob(r.pair.Force, cmp.Or(r.pair.ErrorPolicy, errorPolicyStrict), r.pair.MaxFailures, r.pair.PriorityLabels, notifier, source, target, paths)
+	if err != nil {
+		return fmt.Errorf("failed to initialize job: %w", err)
+	}
+	defer job.Close()
+	// The progress of all pairs is logged together (see logOrchestrationStatus), and a single control API can't serve
+	// them all
+	job.statusInterval, job.controlAddr = 0, ""
+
+	r.mu.Lock()
+	r.job, r.state = job, "running"
+	r.mu.Unlock()
+	return job.Run(ctx)
+}
+
+// pairPaths returns the given paths made specific to the given pair, since pairs migrate concurrently and must not
+// share state files, logs or reports: each is kept in a directory named after the pair, next to where it would be
+// kept otherwise (e.g. "/data/state.json" becomes "/data/alice/state.json", and "gs://bucket/audit.jsonl" becomes
+// "gs://bucket/alice/audit.jsonl"). Local directories are created as needed.
+func pairPaths(paths jobPaths, pair string) (jobPaths, error) {
+	for _, p := range []*string{&paths.labelState, &paths.targetUIDState, &paths.failureLedger, &paths.auditLog, &paths.dryRunReport, &paths.dateRepairReport} {
+		if *p == "" {
+			continue
+		} else if object, ok := strings.CutPrefix(*p, "gs://"); ok {
+			*p = "gs://" + path.Join(path.Dir(object), pair, path.Base(object))
+			continue
+		}
+		dir := filepath.Join(filepath.Dir(*p), pair)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return paths, fmt.Errorf("failed to create directory of pair '%s': %w", pair, err)
+		}
+		*p = filepath.Join(dir, filepath.Base(*p))
+	}
+	return paths, nil
+}
+
+// end records the outcome of the run.
+func (r *orchestratedRun) end(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err, r.state = err, "completed"
+	if err != nil {
+		r.state = "failed"
+	}
+	if r.job != nil {
+		r.status = r.job.status().String()
+	}
+}
+
+// logOrchestrationStatus logs the state & progress of each pair at the given interval, until the given context is
+// done.
+func logOrchestrationStatus(ctx context.Context, runs []*orchestratedRun, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, run := range runs {
+				run.mu.Lock()
+				state, status := run.state, run.status
+				if run.job != nil && state == "running" {
+					status = run.job.status().String()
+				}
+				run.mu.Unlock()
+				slog.Info("Pair status", "pair", run.pair.Name, "tenant", run.pair.Tenant, "state", state, "status", status)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPairPaths(t *testing.T) {
+	dir := t.TempDir()
+	paths := jobPaths{
+		labelState:     filepath.Join(dir, "state.json"),
+		targetUIDState: filepath.Join(dir, "state.json"),
+		auditLog:       "gs://bucket/logs/audit.jsonl",
+	}
+
+	got, err := pairPaths(paths, "alice")
+	if err != nil {
+		t.Fatalf("pairPaths() failed: %v", err)
+	}
+	want := jobPaths{
+		labelState:     filepath.Join(dir, "alice", "state.json"),
+		targetUIDState: filepath.Join(dir, "alice", "state.json"),
+		auditLog:       "gs://bucket/logs/alice/audit.jsonl",
+	}
+	if got != want {
+		t.Errorf("pairPaths() = %+v, want %+v", got, want)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "alice")); err != nil || !info.IsDir() {
+		t.Errorf("directory of pair was not created: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// gmailSystemLabelAliases maps the names of Gmail's system labels as shown in its UI to their IMAP mailboxes.
+var gmailSystemLabelAliases = map[string]string{
+	"inbox":     "INBOX",
+	"starred":   "[Gmail]/Starred",
+	"important": "[Gmail]/Important",
+	"sent":      "[Gmail]/Sent Mail",
+	"drafts":    "[Gmail]/Drafts",
+}
+
+// parseLabelList parses a comma-separated list of labels, ignoring empty entries.
+func parseLabelList(s string) []string {
+	var labels []string
+	for _, label := range strings.Split(s, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// prioritizeMailboxes returns the source mailboxes to migrate, with the given priority labels first (resolving the UI
+// names of Gmail system labels, e.g. "Starred", if Gmail extensions are used), along with the resolved priority
+// mailboxes.
+func prioritizeMailboxes(sourceMailboxes, priorityLabels []string, gmailExtensions bool) (mailboxes, priority []string) {
+	for _, label := range priorityLabels {
+		if mailbox, ok := gmailSystemLabelAliases[strings.ToLower(label)]; ok && gmailExtensions {
+			label = mailbox
+		}
+		if !slices.Contains(priority, label) {
+			priority = append(priority, label)
+		}
+	}
+	mailboxes = slices.Clone(priority)
+	for _, mailbox := range sourceMailboxes {
+		if !slices.Contains(mailboxes, mailbox) {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+	return mailboxes, priority
+}
+
+// priorityMessageDone marks a message of the priority labels (or, once, the end of their collection) as done, and
+// logs when all messages of the priority labels are migrated.
+func (j *WorkerJob) priorityMessageDone() {
+	if j.priorityRemaining.Add(-1) != 0 {
+		return
+	}
+	var done uint64
+	for _, mailbox := range j.priorityMailboxes {
+		done += j.progress[mailbox].done.Load()
+	}
+	slog.Info("Priority labels migrated", "labels", j.priorityMailboxes, "messages", done, "failures", j.errors.Failures())
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/backup"
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+const restoreConnectionsLimit = 2
+
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	bucket := fs.String("bucket", "", "Bucket to restore from (defaults to $BACKUP_BUCKET)")
+	prefix := fs.String("prefix", "", "Object name prefix in the bucket (defaults to $BACKUP_PREFIX, or the source account username)")
+	mailbox := fs.String("mailbox", gcp.GmailAllMailLabel, "Backed up mailbox to restore")
+	manifest := fs.String("manifest", "", "Name of the snapshot manifest object to restore (defaults to the latest snapshot of the mailbox)")
+	label := fs.String("label", "", "Only restore messages with this label")
+	since := fs.String("since", "", "Only restore messages received on or after this date (YYYY-MM-DD)")
+	before := fs.String("before", "", "Only restore messages received before this date (YYYY-MM-DD)")
+	messageIDs := fs.String("message-ids", "", "Only restore messages with these Message-IDs (comma-separated)")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be restored")
+	if !parseFlags(fs, args, map[string]string{"bucket": "BACKUP_BUCKET", "prefix": "BACKUP_PREFIX"}) {
+		return exitUsage
+	} else if *bucket == "" {
+		slog.Error("The -bucket flag (or BACKUP_BUCKET environment variable) is required")
+		return exitUsage
+	}
+	if *prefix == "" {
+		*prefix = os.Getenv("SOURCE_ACCOUNT_USERNAME")
+	}
+
+	filter := &backup.Filter{Label: *label}
+	for _, d := range []struct {
+		value  string
+		target *time.Time
+	}{{*since, &filter.Since}, {*before, &filter.Before}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.Parse(exportDateFormat, d.value)
+		if err != nil {
+			slog.Error("Invalid date", "err", err, "date", d.value)
+			return exitUsage
+		}
+		*d.target = t
+	}
+	if *messageIDs != "" {
+		for _, id := range strings.Split(*messageIDs, ",") {
+			filter.MessageIDs = append(filter.MessageIDs, strings.TrimSpace(id))
+		}
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	b, err := openBackupStorage(ctx, *bucket)
+	if err != nil {
+		slog.Error("Failed to open backup bucket", "err", err, "bucket", *bucket)
+		return exitCodeOf(err)
+	}
+	defer b.Close()
+
+	entries, err := backup.LoadSnapshot(ctx, b, *prefix, *mailbox, *manifest)
+	if err != nil {
+		slog.Error("Failed to load backup snapshot", "err", err)
+		return exitCodeOf(err)
+	}
+	entries = slices.DeleteFunc(entries, func(e backup.Entry) bool { return !filter.Matches(&e) })
+	slog.Info("Restoring messages", "mailbox", *mailbox, "messages", len(entries), "dryRun", *dryRun)
+
+	targetGmail, err := newGmailFromEnv("TARGET", 1, restoreConnectionsLimit, gcp.WithDryRun(*dryRun))
+	if err != nil {
+		slog.Error("Failed to create target Gmail connection", "err", err)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(targetGmail)
+
+	// Create the (non-system) labels of the restored messages, in case the target account lacks them
+	if !*dryRun {
+		var labels []string
+		for _, e := range entries {
+			for _, l := range e.Labels {
+				if !strings.HasPrefix(l, "\\") && !slices.Contains(labels, l) {
+					labels = append(labels, l)
+				}
+			}
+		}
+		if err := targetGmail.CreateMailboxes(ctx, labels...); err != nil {
+			slog.Error("Failed to create labels", "err", err)
+			return exitCodeOf(err)
+		}
+	}
+
+	restored, existing, err := restoreMessages(ctx, targetGmail, b, entries, *dryRun)
+	if err != nil {
+		slog.Error("Restore failed", "err", err, "restored", restored, "existing", existing)
+		return exitCodeOf(err)
+	}
+	summary.Count("restored", uint64(restored))
+	summary.Count("existing", uint64(existing))
+	slog.Info("Restore completed", "dryRun", *dryRun, "restored", restored, "existing", existing)
+	return exitOK
+}
+
+// restoreMessages appends the messages of the given backup entries to the given account, with their labels, flags
+// and internal dates, skipping messages already present in it (so restores can be repeated safely). Returns the
+// number of restored messages, and of messages skipped since they already exist.
+func restoreMessages(ctx context.Context, g *gcp.Gmail, b backup.Storage, entries []backup.Entry, dryRun bool) (int, int, error) {
+	restored, existing := 0, 0
+	for chunk := range slices.Chunk(entries, gcp.MessageIDSearchBatchSize) {
+		var messageIDs []string
+		for _, e := range chunk {
+			if e.MessageID != "" {
+				messageIDs = append(messageIDs, e.MessageID)
+			}
+		}
+		found, err := g.FindUIDsByMessageIDs(ctx, g.DefaultMailbox(), messageIDs)
+		if err != nil {
+			return restored, existing, fmt.Errorf("failed to search for messages in target account: %w", err)
+		}
+
+		for _, e := range chunk {
+			raw, err := backup.ReadMessage(ctx, b, &e)
+			if err != nil {
+				return restored, existing, err
+			}
+
+			// Messages without a Message-ID get a content-derived one, so repeated restores find the restored copy
+			messageID := e.MessageID
+			if messageID == "" {
+				messageID = contentMessageID(raw)
+				raw = append([]byte("Message-ID: "+messageID+"\r\n"), raw...)
+				if uid, err := g.FindUIDByMessageID(ctx, g.DefaultMailbox(), messageID); err != nil {
+					return restored, existing, fmt.Errorf("failed to search for message '%s': %w", messageID, err)
+				} else if uid != nil {
+					found[messageID] = *uid
+				}
+			}
+			if _, ok := found[messageID]; ok {
+				slog.Debug("Message already exists in target account", "messageID", messageID)
+				existing++
+				continue
+			}
+
+			msg := &imap.Message{
+				Uid:          e.UID,
+				Flags:        slices.DeleteFunc(slices.Clone(e.Flags), func(f string) bool { return f == imap.RecentFlag }),
+				InternalDate: e.InternalDate,
+				Envelope:     &imap.Envelope{MessageId: messageID},
+				Body:         map[*imap.BodySectionName]imap.Literal{{}: bytes.NewReader(raw)},
+			}
+			gcp.SetLabels(msg, e.Labels)
+			if dryRun {
+				slog.Info("Restoring message", "dryRun", true, "messageID", messageID, "flags", msg.Flags, "labels", e.Labels, "internalDate", e.InternalDate)
+			} else if _, err := g.AppendMessage(ctx, g.DefaultMailbox(), msg); err != nil {
+				return restored, existing, fmt.Errorf("failed to append message '%s': %w", messageID, err)
+			}
+			restored++
+		}
+		slog.Info("Restored messages", "restored", restored, "existing", existing, "total", len(entries))
+	}
+	return restored, existing, nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/arikkfir-org/gmail-organizer/internal/state"
+	"github.com/emersion/go-imap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	rulesConnectionsLimit = 2
+	rulesBatchSize        = 500
+)
+
+// rulesFile is the YAML file of organization rules, e.g.:
+//
+//	mailbox: INBOX
+//	rules:
+//	  - name: newsletters
+//	    match:
+//	      listId: news.example.com
+//	      olderThan: 7d
+//	    actions:
+//	      labels: [Newsletters]
+//	      archive: true
+//	      markRead: true
+//	  - name: old-promotions
+//	    match:
+//	      query: category:promotions
+//	      olderThan: 90d
+//	    actions:
+//	      delete: true
+//	    ramp:
+//	      maxMessages: 100
+//	      runs: 3
+type rulesFile struct {
+	// Mailbox is the default mailbox that rules are evaluated against (defaults to INBOX).
+	Mailbox string `yaml:"mailbox"`
+	Rules   []rule `yaml:"rules"`
+}
+
+// rule applies its actions to all messages matching all of its conditions.
+type rule struct {
+	Name string `yaml:"name"`
+	// Mailbox overrides the default mailbox for this rule.
+	Mailbox string      `yaml:"mailbox"`
+	Match   ruleMatch   `yaml:"match"`
+	Actions ruleActions `yaml:"actions"`
+	// Ramp limits the number of messages a new deleting or archiving rule acts on in its first runs.
+	Ramp *ruleRamp `yaml:"ramp"`
+}
+
+// ruleMatch are the conditions of a rule; header conditions match substrings, case-insensitively.
+type ruleMatch struct {
+	From    string `yaml:"from"`
+	To      string `yaml:"to"`
+	Subject string `yaml:"subject"`
+	ListID  string `yaml:"listId"`
+	// Query is a Gmail search query (e.g. "has:attachment -is:starred") that messages must match as well.
+	Query string `yaml:"query"`
+	// OlderThan matches messages received more than this long ago, e.g. "36h", "30d" or "2w".
+	OlderThan string `yaml:"olderThan"`
+	// LargerThan matches messages larger than this many bytes.
+	LargerThan uint32 `yaml:"largerThan"`
+
+	olderThan time.Duration
+}
+
+// ruleActions are applied to the messages matching a rule. Deleting is exclusive with the other actions.
+type ruleActions struct {
+	Labels   []string `yaml:"labels"`
+	Archive  bool     `yaml:"archive"`
+	MarkRead bool     `yaml:"markRead"`
+	Delete   bool     `yaml:"delete"`
+}
+
+// ruleRamp limits the blast radius of a badly written destructive rule: during its first Runs runs (that acted on any
+// messages, as recorded in the rules state file), it acts on at most MaxMessages of its matching messages (the oldest
+// ones) per run.
+type ruleRamp struct {
+	MaxMessages int `yaml:"maxMessages"`
+	Runs        int `yaml:"runs"`
+}
+
+// loadRules loads and validates the rules in the given YAML file.
+func loadRules(path string) (*rulesFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read rules file '%s': %w", errInvalidConfig, path, err)
+	}
+	f := &rulesFile{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse rules file '%s': %w", errInvalidConfig, path, err)
+	}
+	if f.Mailbox == "" {
+		f.Mailbox = gcp.InboxMailbox
+	}
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if r.Mailbox == "" {
+			r.Mailbox = f.Mailbox
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%w: invalid rule '%s' in '%s': %w", errInvalidConfig, r.Name, path, err)
+		}
+	}
+	return f, nil
+}
+
+func (r *rule) validate() error {
+	m, a := &r.Match, &r.Actions
+	if m.From == "" && m.To == "" && m.Subject == "" && m.ListID == "" && m.Query == "" && m.OlderThan == "" && m.LargerThan == 0 {
+		// Guard against accidentally applying actions to the whole mailbox
+		return fmt.Errorf("rule has no conditions")
+	}
+	if m.OlderThan != "" {
+		age, err := parseAge(m.OlderThan)
+		if err != nil {
+			return err
+		}
+		m.olderThan = age
+	}
+	if len(a.Labels) == 0 && !a.Archive && !a.MarkRead && !a.Delete {
+		return fmt.Errorf("rule has no actions")
+	} else if a.Delete && (len(a.Labels) > 0 || a.Archive || a.MarkRead) {
+		return fmt.Errorf("deleting messages cannot be combined with other actions")
+	} else if slices.Contains(a.Labels, "") {
+		return fmt.Errorf("empty label")
+	}
+	if r.Ramp != nil {
+		if !a.Delete && !a.Archive {
+			return fmt.Errorf("ramps only apply to rules deleting or archiving messages")
+		} else if r.Ramp.MaxMessages < 1 || r.Ramp.Runs < 1 {
+			return fmt.Errorf("ramp requires positive maxMessages & runs")
+		}
+	}
+	return nil
+}
+
+// parseAge parses a duration that may also be expressed in days ("30d") or weeks ("2w").
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, found := strings.CutSuffix(s, suffix); found {
+			if v, err := strconv.Atoi(n); err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid age '%s'", s)
+			} else {
+				return time.Duration(v) * unit, nil
+			}
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age '%s'", s)
+	}
+	return d, nil
+}
+
+// criteria returns the IMAP search criteria of the rule's conditions (except for its Gmail search query), as of the
+// given time.
+func (m *ruleMatch) criteria(now time.Time) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	for name, value := range map[string]string{"From": m.From, "To": m.To, "Subject": m.Subject, "List-Id": m.ListID} {
+		if value != "" {
+			criteria.Header.Add(name, value)
+		}
+	}
+	if m.olderThan > 0 {
+		criteria.Before = now.Add(-m.olderThan)
+	}
+	criteria.Larger = m.LargerThan
+	// Skip messages flagged as deleted, e.g. trashed by a previous run on a server without Gmail extensions
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	return criteria
+}
+
+// runRules runs a subcommand of "rules"; rules are applied by default (e.g. "rules -rules rules.yaml").
+func runRules(args []string) int {
+	if len(args) > 0 && args[0] == "stats" {
+		return runRulesStats(args[1:])
+	} else if len(args) > 0 && args[0] == "test" {
+		return runRulesTest(args[1:])
+	} else if len(args) > 0 && args[0] == "export-filters" {
+		return runRulesExportFilters(args[1:])
+	} else if len(args) > 0 && args[0] == "apply" {
+		args = args[1:]
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		slog.Error("Usage: rules [apply|test|stats|export-filters] [flags]")
+		return exitUsage
+	}
+	return runRulesApply(args)
+}
+
+// runRulesApply applies the rules to the messages of an account, once or at an interval.
+func runRulesApply(args []string) int {
+	fs := flag.NewFlagSet("rules apply", flag.ContinueOnError)
+	path := fs.String("rules", "", "Path of the YAML rules file (defaults to $RULES_PATH)")
+	account := fs.String("account", "source", "Account to organize: 'source' or 'target' (configured by the corresponding environment variables)")
+	interval := fs.Duration("interval", 0, "Keep running, evaluating the rules at this interval (e.g. '15m'), instead of once")
+	dryRun := fs.Bool("dry-run", false, "Only report which messages each rule matches")
+	statePath := fs.String("state", "", "Path of the JSON file keeping the state & history of rules across runs, e.g. of ramps (defaults to $RULES_STATE_PATH)")
+	if !parseFlags(fs, args, map[string]string{"rules": "RULES_PATH", "state": "RULES_STATE_PATH"}) {
+		return exitUsage
+	} else if *path == "" {
+		slog.Error("The -rules flag (or RULES_PATH environment variable) is required")
+		return exitUsage
+	} else if *account != "source" && *account != "target" {
+		slog.Error("The -account flag must be 'source' or 'target'", "account", *account)
+		return exitUsage
+	} else if *interval < 0 {
+		slog.Error("The -interval flag must not be negative", "interval", *interval)
+		return exitUsage
+	}
+
+	rules, err := loadRules(*path)
+	if err != nil {
+		slog.Error("Failed to load rules", "err", err)
+		return exitCodeOf(err)
+	}
+	for _, r := range rules.Rules {
+		if r.Ramp != nil && *statePath == "" {
+			slog.Error("Rules with a ramp require the -state flag (or RULES_STATE_PATH environment variable)", "rule", r.Name)
+			return exitUsage
+		}
+	}
+	store, err := state.Open(*statePath)
+	if err != nil {
+		slog.Error("Failed to open rules state", "err", err)
+		return exitFailure
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	g, err := newGmailFromEnv(strings.ToUpper(*account), 1, rulesConnectionsLimit, gcp.WithDryRun(*dryRun))
+	if err != nil {
+		slog.Error("Failed to create Gmail connection", "err", err, "account", *account)
+		return exitCodeOf(err)
+	}
+	defer closeGmail(g)
+
+	for _, r := range rules.Rules {
+		if (len(r.Actions.Labels) > 0 || r.Actions.Archive) && !g.GmailExtensions() {
+			slog.Error("Labeling and archiving require Gmail extensions", "rule", r.Name)
+			return exitFailure
+		} else if r.Match.Query != "" && !g.GmailExtensions() {
+			slog.Error("Gmail search queries require Gmail extensions", "rule", r.Name)
+			return exitFailure
+		}
+	}
+
+	for {
+		if err := applyRules(ctx, g, rules.Rules, store, *dryRun); err != nil {
+			slog.Error("Failed to apply rules", "err", err)
+			return exitCodeOf(err)
+		} else if *interval == 0 {
+			return exitOK
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped applying rules")
+			return exitOK
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// applyRules evaluates the given rules, in order, and applies their actions to the matching messages, recording their
+// state in the given store.
+func applyRules(ctx context.Context, g *gcp.Gmail, rules []rule, store *state.Store, dryRun bool) error {
+	now := time.Now()
+	total := 0
+	for _, r := range rules {
+		n, err := applyRule(ctx, g, &r, now, store, dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to apply rule '%s': %w", r.Name, err)
+		}
+		total += n
+	}
+	slog.Info("Applied rules", "dryRun", dryRun, "rules", len(rules), "messages", total)
+	return nil
+}
+
+// applyRule applies the actions of the given rule to the messages matching it (as limited by its ramp), and returns the
+// number of messages it acted on. Unless dry-running, the numbers of matched & acted on messages are recorded in the
+// rule's history.
+func applyRule(ctx context.Context, g *gcp.Gmail, r *rule, now time.Time, store *state.Store, dryRun bool) (int, error) {
+	uids, err := findMessagesToExport(ctx, g, r.Mailbox, r.Match.Query, r.Match.criteria(now))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find matching messages: %w", err)
+	}
+	ruleState := store.Rule(r.Name)
+	run := state.RuleRun{Time: now.UTC(), Matched: len(uids)}
+	if len(uids) == 0 {
+		slog.Debug("Rule matched no messages", "rule", r.Name, "mailbox", r.Mailbox)
+		if dryRun {
+			return 0, nil
+		}
+		ruleState.AddRun(run)
+		if err := store.SetRule(r.Name, ruleState); err != nil {
+			return 0, fmt.Errorf("failed to record rule state: %w", err)
+		}
+		return 0, nil
+	}
+
+	if r.Ramp != nil && ruleState.ActedRuns < r.Ramp.Runs && len(uids) > r.Ramp.MaxMessages {
+		slog.Warn("Rule is ramping up, acting on its oldest matching messages only",
+			"rule", r.Name, "run", ruleState.ActedRuns+1, "rampRuns", r.Ramp.Runs, "matched", len(uids), "limit", r.Ramp.MaxMessages)
+		uids = uids[:r.Ramp.MaxMessages]
+	}
+	slog.Info("Applying rule", "dryRun", dryRun, "rule", r.Name, "mailbox", r.Mailbox, "messages", len(uids))
+	if dryRun {
+		return len(uids), nil
+	}
+
+	if err := applyRuleActions(ctx, g, r, uids); err != nil {
+		return 0, err
+	}
+	run.Acted = len(uids)
+	ruleState.AddRun(run)
+	if err := store.SetRule(r.Name, ruleState); err != nil {
+		return 0, fmt.Errorf("failed to record rule state: %w", err)
+	}
+	return len(uids), nil
+}
+
+// applyRuleActions applies the actions of the given rule to the messages of the given UIDs.
+func applyRuleActions(ctx context.Context, g *gcp.Gmail, r *rule, uids []uint32) error {
+	a := &r.Actions
+	if a.Delete {
+		for chunk := range slices.Chunk(uids, rulesBatchSize) {
+			if err := g.MoveToTrash(ctx, r.Mailbox, chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(a.Labels) > 0 {
+		if err := g.CreateMailboxes(ctx, a.Labels...); err != nil {
+			return fmt.Errorf("failed to create labels: %w", err)
+		}
+	}
+	labels := make([]any, len(a.Labels))
+	for i, label := range a.Labels {
+		labels[i] = label
+	}
+	for chunk := range slices.Chunk(uids, rulesBatchSize) {
+		err := g.WithSession(ctx, r.Mailbox, func(sess *gcp.Session) error {
+			if len(labels) > 0 {
+				if err := sess.Store(chunk, "+"+gcp.GmailLabelsExt+".SILENT", labels); err != nil {
+					return err
+				}
+			}
+			if a.MarkRead {
+				if err := sess.Store(chunk, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.SeenFlag}); err != nil {
+					return err
+				}
+			}
+			if a.Archive {
+				// Archiving in Gmail removes the "Inbox" label; it is done last, since the messages leave the INBOX
+				if err := sess.Store(chunk, "-"+gcp.GmailLabelsExt+".SILENT", []any{`\Inbox`}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
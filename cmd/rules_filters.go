@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// gmailFilter is a native Gmail filter compiled from an organization rule: criteria that Gmail evaluates against
+// incoming messages, and the actions it applies to the matching ones.
+type gmailFilter struct {
+	rule       string
+	from       string
+	to         string
+	subject    string
+	query      string
+	largerThan uint32
+	labels     []string
+	archive    bool
+	markRead   bool
+	trash      bool
+}
+
+// compileFilter compiles the given rule into a Gmail filter, or returns why Gmail filters cannot express it. Filters
+// only apply to messages as they arrive, so rules of other mailboxes than the inbox, or of message age, stay with this
+// tool. Header conditions of filters match whole words rather than substrings, which is close enough for addresses and
+// list IDs.
+func compileFilter(r *rule) (*gmailFilter, error) {
+	if r.Mailbox != gcp.InboxMailbox {
+		return nil, fmt.Errorf("filters only apply to incoming messages, not to messages of mailbox '%s'", r.Mailbox)
+	} else if r.Match.OlderThan != "" {
+		return nil, errors.New("filters apply when messages arrive, so they cannot match messages by age")
+	}
+
+	query := r.Match.Query
+	if r.Match.ListID != "" {
+		query = strings.TrimSpace(fmt.Sprintf("list:(%s) %s", r.Match.ListID, query))
+	}
+	return &gmailFilter{
+		rule:       r.Name,
+		from:       r.Match.From,
+		to:         r.Match.To,
+		subject:    r.Match.Subject,
+		query:      query,
+		largerThan: r.Match.LargerThan,
+		labels:     r.Actions.Labels,
+		archive:    r.Actions.Archive,
+		markRead:   r.Actions.MarkRead,
+		trash:      r.Actions.Delete,
+	}, nil
+}
+
+// filtersFeed is the XML feed of filters that Gmail exports, and imports under "Settings > Filters and Blocked
+// Addresses > Import filters".
+type filtersFeed struct {
+	XMLName xml.Name      `xml:"feed"`
+	NS      string        `xml:"xmlns,attr"`
+	AppsNS  string        `xml:"xmlns:apps,attr"`
+	Title   string        `xml:"title"`
+	Entries []filterEntry `xml:"entry"`
+}
+
+type filterEntry struct {
+	Category struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+	Title      string           `xml:"title"`
+	Content    string           `xml:"content"`
+	Properties []filterProperty `xml:"apps:property"`
+}
+
+type filterProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// writeFiltersFeed writes the given filters as an XML feed that Gmail can import. Gmail filter entries carry a single
+// label each, so filters applying several labels are written as several entries with the same criteria.
+func writeFiltersFeed(w io.Writer, filters []*gmailFilter) error {
+	feed := filtersFeed{NS: "http://www.w3.org/2005/Atom", AppsNS: "http://schemas.google.com/apps/2006", Title: "Mail Filters"}
+	for _, f := range filters {
+		var criteria []filterProperty
+		for name, value := range map[string]string{"from": f.from, "to": f.to, "subject": f.subject, "hasTheWord": f.query} {
+			if value != "" {
+				criteria = append(criteria, filterProperty{Name: name, Value: value})
+			}
+		}
+		slices.SortFunc(criteria, func(a, b filterProperty) int { return strings.Compare(a.Name, b.Name) })
+		if f.largerThan > 0 {
+			criteria = append(criteria,
+				filterProperty{Name: "size", Value: strconv.FormatUint(uint64(f.largerThan), 10)},
+				filterProperty{Name: "sizeOperator", Value: "s_sl"},
+				filterProperty{Name: "sizeUnit", Value: "s_sb"})
+		}
+
+		var actions []filterProperty
+		for name, enabled := range map[string]bool{"shouldArchive": f.archive, "shouldMarkAsRead": f.markRead, "shouldTrash": f.trash} {
+			if enabled {
+				actions = append(actions, filterProperty{Name: name, Value: "true"})
+			}
+		}
+		slices.SortFunc(actions, func(a, b filterProperty) int { return strings.Compare(a.Name, b.Name) })
+
+		labels := f.labels
+		if len(labels) == 0 {
+			labels = []string{""}
+		}
+		for i, label := range labels {
+			entry := filterEntry{Title: "Mail Filter", Content: "Organizer rule " + f.rule}
+			entry.Category.Term = "filter"
+			entry.Properties = slices.Clone(criteria)
+			if label != "" {
+				entry.Properties = append(entry.Properties, filterProperty{Name: "label", Value: label})
+			}
+			if i == 0 {
+				entry.Properties = append(entry.Properties, actions...)
+			}
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return fmt.Errorf("failed to encode filters: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// createFilters creates the given filters in the account of the given Gmail API service, along with the labels they
+// apply. Filters identical to existing ones are skipped, so exporting the same rules again creates nothing. Returns the
+// number of filters created.
+func createFilters(ctx context.Context, svc *gmail.Service, user string, filters []*gmailFilter) (int, error) {
+	labels, err := svc.Users.Labels.List(user).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list labels: %w", err)
+	}
+	labelIDs := make(map[string]string, len(labels.Labels))
+	for _, l := range labels.Labels {
+		labelIDs[l.Name] = l.Id
+	}
+	existing, err := svc.Users.Settings.Filters.List(user).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list filters: %w", err)
+	}
+
+	created := 0
+	for _, f := range filters {
+		filter := &gmail.Filter{
+			Criteria: &gmail.FilterCriteria{From: f.from, To: f.to, Subject: f.subject, Query: f.query},
+			Action:   &gmail.FilterAction{},
+		}
+		if f.largerThan > 0 {
+			filter.Criteria.Size, filter.Criteria.SizeComparison = int64(f.largerThan), "larger"
+		}
+		for _, name := range f.labels {
+			if _, found := labelIDs[name]; !found {
+				l, err := svc.Users.Labels.Create(user, &gmail.Label{Name: name}).Context(ctx).Do()
+				if err != nil {
+					return created, fmt.Errorf("failed to create label '%s' of rule '%s': %w", name, f.rule, err)
+				}
+				labelIDs[name] = l.Id
+			}
+			filter.Action.AddLabelIds = append(filter.Action.AddLabelIds, labelIDs[name])
+		}
+		if f.trash {
+			filter.Action.AddLabelIds = append(filter.Action.AddLabelIds, "TRASH")
+		}
+		if f.archive {
+			filter.Action.RemoveLabelIds = append(filter.Action.RemoveLabelIds, "INBOX")
+		}
+		if f.markRead {
+			filter.Action.RemoveLabelIds = append(filter.Action.RemoveLabelIds, "UNREAD")
+		}
+
+		if slices.ContainsFunc(existing.Filter, func(e *gmail.Filter) bool { return sameFilter(e, filter) }) {
+			slog.Info("Gmail filter of rule already exists", "rule", f.rule)
+			continue
+		}
+		if _, err := svc.Users.Settings.Filters.Create(user, filter).Context(ctx).Do(); err != nil {
+			return created, fmt.Errorf("failed to create filter of rule '%s': %w", f.rule, err)
+		}
+		slog.Info("Created Gmail filter of rule", "rule", f.rule)
+		created++
+	}
+	return created, nil
+}
+
+// sameFilter returns whether the given Gmail filters have the same criteria & actions.
+func sameFilter(a, b *gmail.Filter) bool {
+	if a.Criteria == nil || a.Action == nil {
+		return false
+	}
+	ac, bc := a.Criteria, b.Criteria
+	if ac.From != bc.From || ac.To != bc.To || ac.Subject != bc.Subject || ac.Query != bc.Query || ac.Size != bc.Size || ac.SizeComparison != bc.SizeComparison {
+		return false
+	}
+	sameSet := func(x, y []string) bool {
+		x, y = slices.Clone(x), slices.Clone(y)
+		slices.Sort(x)
+		slices.Sort(y)
+		return slices.Equal(x, y)
+	}
+	return sameSet(a.Action.AddLabelIds, b.Action.AddLabelIds) && sameSet(a.Action.RemoveLabelIds, b.Action.RemoveLabelIds)
+}
+
+// runRulesExportFilters compiles the rules that Gmail filters can express into native Gmail filters, so they keep
+// applying to incoming messages without scheduling this tool; the rest are listed, to keep applying with "rules".
+func runRulesExportFilters(args []string) int {
+	fs := flag.NewFlagSet("rules export-filters", flag.ContinueOnError)
+	path := fs.String("rules", "", "Path of the YAML rules file (defaults to $RULES_PATH)")
+	output := fs.String("output", "-", "Path of the XML file to write the filters to, for importing in Gmail's settings ('-' for standard output)")
+	create := fs.Bool("create", false, "Create the filters through the Gmail API instead of writing them, using Application Default Credentials with the 'gmail.settings.basic' & 'gmail.labels' scopes")
+	user := fs.String("user", "me", "With -create, the account to create filters in ('me' for the authenticated account)")
+	if !parseFlags(fs, args, map[string]string{"rules": "RULES_PATH"}) {
+		return exitUsage
+	} else if *path == "" {
+		slog.Error("The -rules flag (or RULES_PATH environment variable) is required")
+		return exitUsage
+	}
+
+	rules, err := loadRules(*path)
+	if err != nil {
+		slog.Error("Failed to load rules", "err", err)
+		return exitCodeOf(err)
+	}
+	var filters []*gmailFilter
+	for _, r := range rules.Rules {
+		if f, err := compileFilter(&r); err != nil {
+			slog.Warn("Rule cannot be expressed as a Gmail filter, keep applying it with the 'rules' command", "rule", r.Name, "reason", err)
+		} else {
+			filters = append(filters, f)
+		}
+	}
+	slog.Info("Compiled rules into Gmail filters", "rules", len(rules.Rules), "filters", len(filters))
+	if len(filters) == 0 {
+		return exitOK
+	}
+
+	if !*create {
+		w := io.Writer(os.Stdout)
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				slog.Error("Failed to create filters file", "err", err, "path", *output)
+				return exitFailure
+			}
+			defer func() { _ = f.Close() }()
+			w = f
+		}
+		if err := writeFiltersFeed(w, filters); err != nil {
+			slog.Error("Failed to write filters", "err", err)
+			return exitFailure
+		}
+		return exitOK
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	svc, err := gmail.NewService(ctx, option.WithScopes(gmail.GmailSettingsBasicScope, gmail.GmailLabelsScope))
+	if err != nil {
+		slog.Error("Failed to create Gmail API client", "err", err)
+		return exitAuth
+	}
+	created, err := createFilters(ctx, svc, *user, filters)
+	if err != nil {
+		slog.Error("Failed to create Gmail filters", "err", err, "created", created)
+		return exitFailure
+	}
+	slog.Info("Created Gmail filters", "created", created, "existing", len(filters)-created)
+	return exitOK
+}
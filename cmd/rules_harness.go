@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/maildate"
+)
+
+// matchesMessage evaluates the conditions of the rule against a message with the given header & size, as of the given
+// time, without an account. Conditions that cannot be evaluated locally (a Gmail search query, or an age without a
+// usable date) are assumed to match, and returned.
+func (m *ruleMatch) matchesMessage(header mail.Header, size int64, now time.Time) (bool, []string) {
+	// Like IMAP header searches, header conditions match substrings of any of the header's values, case-insensitively
+	for name, value := range map[string]string{"From": m.From, "To": m.To, "Subject": m.Subject, "List-Id": m.ListID} {
+		if value != "" && !slices.ContainsFunc(header[name], func(v string) bool {
+			return strings.Contains(strings.ToLower(v), strings.ToLower(value))
+		}) {
+			return false, nil
+		}
+	}
+	if m.LargerThan > 0 && size <= int64(m.LargerThan) {
+		return false, nil
+	}
+
+	var unevaluated []string
+	if m.olderThan > 0 {
+		if t, _, ok := maildate.Resolve(header); !ok {
+			unevaluated = append(unevaluated, "olderThan (no usable date)")
+		} else if !t.Before(now.Add(-m.olderThan)) {
+			return false, nil
+		}
+	}
+	if m.Query != "" {
+		unevaluated = append(unevaluated, "query (requires Gmail search)")
+	}
+	return true, unevaluated
+}
+
+// String describes the actions, e.g. "label Newsletters, archive, mark read".
+func (a *ruleActions) String() string {
+	var actions []string
+	if a.Delete {
+		actions = append(actions, "delete")
+	}
+	if len(a.Labels) > 0 {
+		actions = append(actions, "label "+strings.Join(a.Labels, " & "))
+	}
+	if a.MarkRead {
+		actions = append(actions, "mark read")
+	}
+	if a.Archive {
+		actions = append(actions, "archive")
+	}
+	return strings.Join(actions, ", ")
+}
+
+// runRulesTest shows which rules match a sample message (an .eml file), or the messages of an account matching a Gmail
+// search query, and which actions they would apply, without modifying anything.
+func runRulesTest(args []string) int {
+	fs := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	path := fs.String("rules", "", "Path of the YAML rules file (defaults to $RULES_PATH)")
+	message := fs.String("message", "", "Path of a sample message (.eml) to evaluate the rules against, without an account")
+	query := fs.String("query", "", "Gmail search query (e.g. 'from:x') of account messages to evaluate the rules against")
+	account := fs.String("account", "source", "With -query, the account to search: 'source' or 'target' (configured by the corresponding environment variables)")
+	if !parseFlags(fs, args, map[string]string{"rules": "RULES_PATH"}) {
+		return exitUsage
+	} else if *path == "" {
+		slog.Error("The -rules flag (or RULES_PATH environment variable) is required")
+		return exitUsage
+	} else if (*message == "") == (*query == "") {
+		slog.Error("Exactly one of the -message and -query flags is required")
+		return exitUsage
+	}
+
+	rules, err := loadRules(*path)
+	if err != nil {
+		slog.Error("Failed to load rules", "err", err)
+		return exitCodeOf(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer func() { _ = w.Flush() }()
+	if *message != "" {
+		return testRulesOnMessage(w, rules.Rules, *message)
+	}
+	return testRulesOnQuery(w, rules.Rules, *account, *query)
+}
+
+// testRulesOnMessage prints which of the given rules match the message in the given .eml file.
+func testRulesOnMessage(w *tabwriter.Writer, rules []rule, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Error("Failed to open message", "err", err, "path", path)
+		return exitFailure
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		slog.Error("Failed to stat message", "err", err, "path", path)
+		return exitFailure
+	}
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		slog.Error("Failed to parse message", "err", err, "path", path)
+		return exitFailure
+	}
+
+	now := time.Now()
+	_, _ = fmt.Fprintln(w, "RULE\tMATCHES\tACTIONS\tNOT EVALUATED")
+	for _, r := range rules {
+		matched, unevaluated := r.Match.matchesMessage(msg.Header, info.Size(), now)
+		actions := "-"
+		if matched {
+			actions = r.Actions.String()
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", r.Name, matched, actions, strings.Join(unevaluated, ", "))
+	}
+	return exitOK
+}
+
+// testRulesOnQuery prints how many of the messages of the given account matching the given Gmail search query each of
+// the given rules matches. The account is accessed read-only.
+func testRulesOnQuery(w *tabwriter.Writer, rules []rule, account, query string) int {
+	if account != "source" && account != "target" {
+		slog.Error("The -account flag must be 'source' or 'target'", "account", account)
+		return exitUsage
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	// The pool refuses any modification once read-only, even of code paths shared with "rules apply"
+	g, err := newGmailFromEnv(strings.ToUpper(account), 1, rulesConnectionsLimit)
+	if err != nil {
+		slog.Error("Failed to create Gmail connection", "err", err, "account", account)
+		return exitCodeOf(err)
+	}
+	g.ReadOnly()
+	defer closeGmail(g)
+
+	now := time.Now()
+	_, _ = fmt.Fprintln(w, "RULE\tMAILBOX\tQUERIED\tMATCHES\tACTIONS")
+	for _, r := range rules {
+		queried, err := g.Search(ctx, r.Mailbox, query)
+		if err != nil {
+			slog.Error("Failed to search messages", "err", err, "mailbox", r.Mailbox, "query", query)
+			return exitCodeOf(err)
+		}
+		matched, err := findMessagesToExport(ctx, g, r.Mailbox, r.Match.Query, r.Match.criteria(now))
+		if err != nil {
+			slog.Error("Failed to find messages matching rule", "err", err, "rule", r.Name)
+			return exitCodeOf(err)
+		}
+		matched = slices.DeleteFunc(matched, func(uid uint32) bool { return !slices.Contains(queried, uid) })
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", r.Name, r.Mailbox, len(queried), len(matched), r.Actions.String())
+	}
+	return exitOK
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/mail"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRuleMatchesMessage(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	header := mail.Header{
+		"From":    {"Example News <news@example.com>"},
+		"To":      {"me@example.org"},
+		"Subject": {"Weekly Digest"},
+		"List-Id": {"<news.example.com>"},
+		"Date":    {"Mon, 13 May 2024 10:00:00 +0000"},
+	}
+	tests := []struct {
+		name        string
+		match       ruleMatch
+		matched     bool
+		unevaluated []string
+	}{
+		{name: "header substrings ignore case", match: ruleMatch{From: "NEWS@example", Subject: "digest"}, matched: true},
+		{name: "list ID", match: ruleMatch{ListID: "news.example.com"}, matched: true},
+		{name: "mismatching header", match: ruleMatch{To: "someone@else"}},
+		{name: "missing header", match: ruleMatch{From: "news", ListID: "other"}},
+		{name: "older than", match: ruleMatch{olderThan: 7 * 24 * time.Hour}, matched: true},
+		{name: "not older than", match: ruleMatch{olderThan: 30 * 24 * time.Hour}},
+		{name: "larger than", match: ruleMatch{LargerThan: 100}, matched: true},
+		{name: "not larger than", match: ruleMatch{LargerThan: 1000}},
+		{name: "query is not evaluated", match: ruleMatch{From: "news", Query: "has:attachment"}, matched: true, unevaluated: []string{"query (requires Gmail search)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, unevaluated := tt.match.matchesMessage(header, 500, now)
+			if matched != tt.matched {
+				t.Errorf("matched = %t, want %t", matched, tt.matched)
+			}
+			if !slices.Equal(unevaluated, tt.unevaluated) {
+				t.Errorf("unevaluated = %v, want %v", unevaluated, tt.unevaluated)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/state"
+)
+
+const (
+	// ruleStoppedRuns is the number of most recent runs a rule that used to match messages must match none in, to be
+	// reported as having stopped matching.
+	ruleStoppedRuns = 3
+	// ruleSpikeFactor is how many times more messages than its average a rule must match in its last run, to be
+	// reported as spiking; spikes of fewer than ruleSpikeMinimum messages are not reported.
+	ruleSpikeFactor  = 3
+	ruleSpikeMinimum = 10
+)
+
+// ruleStats summarize the history of a single organization rule.
+type ruleStats struct {
+	Rule        string    `json:"rule"`
+	Runs        int       `json:"runs"`
+	LastRun     time.Time `json:"lastRun,omitzero"`
+	LastMatched int       `json:"lastMatched"`
+	LastActed   int       `json:"lastActed"`
+	AvgMatched  float64   `json:"avgMatched"`
+	TotalActed  int       `json:"totalActed"`
+	// Warning flags rules that stopped matching, or that suddenly match far more messages than they used to.
+	Warning string `json:"warning,omitempty"`
+}
+
+// newRuleStats summarizes the history of the rule of the given name.
+func newRuleStats(name string, r state.Rule) ruleStats {
+	stats := ruleStats{Rule: name, Runs: len(r.History)}
+	if len(r.History) == 0 {
+		stats.Warning = "never ran"
+		return stats
+	}
+	last := r.History[len(r.History)-1]
+	stats.LastRun, stats.LastMatched, stats.LastActed = last.Time, last.Matched, last.Acted
+	matched := 0
+	for _, run := range r.History {
+		matched += run.Matched
+		stats.TotalActed += run.Acted
+	}
+	stats.AvgMatched = float64(matched) / float64(len(r.History))
+
+	// Anomalies are judged against the runs before the most recent ones
+	if n := len(r.History); n > ruleStoppedRuns {
+		recent, earlier := r.History[n-ruleStoppedRuns:], r.History[:n-ruleStoppedRuns]
+		if !slices.ContainsFunc(recent, func(run state.RuleRun) bool { return run.Matched > 0 }) &&
+			slices.ContainsFunc(earlier, func(run state.RuleRun) bool { return run.Matched > 0 }) {
+			stats.Warning = fmt.Sprintf("stopped matching (none in the last %d runs)", ruleStoppedRuns)
+		}
+	}
+	if n := len(r.History); n > 1 && stats.Warning == "" {
+		earlierMatched := 0
+		for _, run := range r.History[:n-1] {
+			earlierMatched += run.Matched
+		}
+		avg := float64(earlierMatched) / float64(n-1)
+		if last.Matched >= ruleSpikeMinimum && float64(last.Matched) > ruleSpikeFactor*avg {
+			stats.Warning = fmt.Sprintf("spiked (matched %d, average %.1f)", last.Matched, avg)
+		}
+	}
+	return stats
+}
+
+// runRulesStats prints the history of every rule recorded in the rules state file, flagging rules that stopped
+// matching or that suddenly match far more messages than they used to.
+func runRulesStats(args []string) int {
+	fs := flag.NewFlagSet("rules stats", flag.ContinueOnError)
+	statePath := fs.String("state", "", "Path of the JSON file keeping the state & history of rules (defaults to $RULES_STATE_PATH)")
+	path := fs.String("rules", "", "Path of the YAML rules file, to include rules that never ran (defaults to $RULES_PATH)")
+	asJSON := fs.Bool("json", false, "Print the statistics as JSON, rather than a table")
+	if !parseFlags(fs, args, map[string]string{"state": "RULES_STATE_PATH", "rules": "RULES_PATH"}) {
+		return exitUsage
+	} else if *statePath == "" {
+		slog.Error("The -state flag (or RULES_STATE_PATH environment variable) is required")
+		return exitUsage
+	}
+
+	store, err := state.Open(*statePath)
+	if err != nil {
+		slog.Error("Failed to open rules state", "err", err)
+		return exitFailure
+	}
+	rules := store.Rules()
+	if *path != "" {
+		f, err := loadRules(*path)
+		if err != nil {
+			slog.Error("Failed to load rules", "err", err)
+			return exitCodeOf(err)
+		}
+		for _, r := range f.Rules {
+			if _, found := rules[r.Name]; !found {
+				rules[r.Name] = state.Rule{}
+			}
+		}
+	}
+
+	var stats []ruleStats
+	for _, name := range slices.Sorted(maps.Keys(rules)) {
+		stats = append(stats, newRuleStats(name, rules[name]))
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			slog.Error("Failed to print rule statistics", "err", err)
+			return exitFailure
+		}
+		return exitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "RULE\tRUNS\tLAST RUN\tLAST MATCHED\tLAST ACTED\tAVG MATCHED\tTOTAL ACTED\tWARNING")
+	for _, s := range stats {
+		lastRun := "-"
+		if !s.LastRun.IsZero() {
+			lastRun = s.LastRun.Local().Format(time.DateTime)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%.1f\t%d\t%s\n", s.Rule, s.Runs, lastRun, s.LastMatched, s.LastActed, s.AvgMatched, s.TotalActed, s.Warning)
+	}
+	_ = w.Flush()
+	return exitOK
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/state"
+)
+
+func TestNewRuleStatsWarnings(t *testing.T) {
+	history := func(matched ...int) state.Rule {
+		var r state.Rule
+		for _, m := range matched {
+			r.AddRun(state.RuleRun{Matched: m, Acted: m})
+		}
+		return r
+	}
+	tests := []struct {
+		name    string
+		rule    state.Rule
+		warning string
+	}{
+		{name: "never ran", rule: state.Rule{}, warning: "never ran"},
+		{name: "steady", rule: history(5, 4, 6, 5), warning: ""},
+		{name: "stopped matching", rule: history(5, 4, 0, 0, 0), warning: "stopped matching"},
+		{name: "never matched", rule: history(0, 0, 0, 0), warning: ""},
+		{name: "spiked", rule: history(5, 4, 6, 50), warning: "spiked"},
+		{name: "small spike", rule: history(1, 1, 1, 5), warning: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newRuleStats("r", tt.rule)
+			if tt.warning == "" && stats.Warning != "" || !strings.HasPrefix(stats.Warning, tt.warning) {
+				t.Errorf("warning = %q, want prefix %q", stats.Warning, tt.warning)
+			}
+		})
+	}
+}
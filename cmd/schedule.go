@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Speeds of scheduling windows.
+const (
+	scheduleModeFull    = "full"
+	scheduleModeReduced = "reduced"
+	scheduleModePaused  = "paused"
+)
+
+// defaultScheduleReducedWorkers is the number of workers per lane migrating messages during reduced-speed windows,
+// unless configured otherwise.
+const defaultScheduleReducedWorkers = 1
+
+// scheduleWindow is a recurring time window, during which the migration runs at a given speed.
+type scheduleWindow struct {
+	// Cron is a cron-like expression of the minutes within the window: "minute hour day-of-month month day-of-week",
+	// each field being "*", a number, a range ("1-5"), a step ("*/15" or "8-18/2") or a list thereof ("1,3,5"). Days of
+	// week are 0-6 (Sunday is 0, or 7). Unlike cron, a minute must match all fields (including both days) to be within
+	// the window. For example, "* 9-17 * * 1-5" is business hours.
+	Cron string `json:"cron"`
+	// Mode is the speed of the migration during the window: "full", "reduced" or "paused".
+	Mode string `json:"mode"`
+
+	fields [5][]bool
+}
+
+// migrationSchedule restricts the migration to full speed, reduced speed, or no progress at all during recurring time
+// windows (e.g. pausing during business hours), according to a schedule loaded from a JSON file. The first window
+// containing the current minute (in the schedule's timezone) applies; outside all windows, the migration runs at
+// full speed. During reduced-speed windows, only the first few workers of each lane migrate messages. A nil
+// migrationSchedule is valid, and always runs at full speed.
+type migrationSchedule struct {
+	// Timezone is the IANA name of the timezone of the windows (defaults to UTC).
+	Timezone string           `json:"timezone,omitempty"`
+	Windows  []scheduleWindow `json:"windows"`
+	// ReducedWorkers is the number of workers per lane migrating messages during reduced-speed windows (defaults to 1).
+	ReducedWorkers int `json:"reducedWorkers,omitempty"`
+
+	location *time.Location
+	mu       sync.Mutex // guards the windows (see update) & the mode
+	mode     string     // the mode last observed, for logging transitions
+}
+
+// loadMigrationSchedule loads the schedule from the given JSON file. Returns nil if the path is empty, in which case
+// the migration always runs at full speed.
+func loadMigrationSchedule(path string) (*migrationSchedule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read schedule file '%s': %w", errInvalidConfig, path, err)
+	}
+	s := &migrationSchedule{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse schedule file '%s': %w", errInvalidConfig, path, err)
+	}
+	if err := s.prepare(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepare validates the schedule as decoded from JSON (from the given file), and prepares it for use.
+func (s *migrationSchedule) prepare(path string) error {
+	var err error
+	s.mode = scheduleModeFull
+	if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("%w: invalid timezone '%s' in '%s': %w", errInvalidConfig, s.Timezone, path, err)
+	}
+	if s.ReducedWorkers == 0 {
+		s.ReducedWorkers = defaultScheduleReducedWorkers
+	} else if s.ReducedWorkers < 0 {
+		return fmt.Errorf("%w: reduced workers in '%s' must not be negative", errInvalidConfig, path)
+	}
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if !slices.Contains([]string{scheduleModeFull, scheduleModeReduced, scheduleModePaused}, w.Mode) {
+			return fmt.Errorf("%w: invalid mode '%s' of schedule window %d in '%s'", errInvalidConfig, w.Mode, i, path)
+		}
+		if w.fields, err = parseCronExpression(w.Cron); err != nil {
+			return fmt.Errorf("%w: invalid cron expression of schedule window %d in '%s': %w", errInvalidConfig, i, path, err)
+		}
+	}
+	return nil
+}
+
+// update replaces the windows of the schedule with those of the given (prepared) schedule while it's in use, e.g.
+// when configuration is reloaded. A nil schedule removes all windows, so the migration runs at full speed.
+func (s *migrationSchedule) update(other *migrationSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if other == nil {
+		s.Timezone, s.Windows, s.ReducedWorkers, s.location = "", nil, defaultScheduleReducedWorkers, time.UTC
+		return
+	}
+	s.Timezone, s.Windows, s.ReducedWorkers, s.location = other.Timezone, other.Windows, other.ReducedWorkers, other.location
+}
+
+// cronFieldRanges are the allowed values of each field of a cron expression.
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCronExpression parses the given cron-like expression into the set of values matched by each of its fields.
+func parseCronExpression(expr string) ([5][]bool, error) {
+	var fields [5][]bool
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return fields, fmt.Errorf("expected %d fields in '%s', got %d", len(fields), expr, len(parts))
+	}
+	for i, part := range parts {
+		lo, hi := cronFieldRanges[i][0], cronFieldRanges[i][1]
+		fields[i] = make([]bool, hi+1)
+		for _, item := range strings.Split(part, ",") {
+			rangeExpr, stepExpr, hasStep := strings.Cut(item, "/")
+			step := 1
+			if hasStep {
+				var err error
+				if step, err = strconv.Atoi(stepExpr); err != nil || step <= 0 {
+					return fields, fmt.Errorf("invalid step in '%s'", item)
+				}
+			}
+			from, to := lo, hi
+			if rangeExpr != "*" {
+				fromExpr, toExpr, isRange := strings.Cut(rangeExpr, "-")
+				var err error
+				if from, err = strconv.Atoi(fromExpr); err != nil {
+					return fields, fmt.Errorf("invalid value in '%s'", item)
+				}
+				to = from
+				if isRange {
+					if to, err = strconv.Atoi(toExpr); err != nil {
+						return fields, fmt.Errorf("invalid range in '%s'", item)
+					}
+				}
+			}
+			if from < lo || to > hi || from > to {
+				return fields, fmt.Errorf("'%s' is out of range %d-%d", item, lo, hi)
+			}
+			for v := from; v <= to; v += step {
+				fields[i][v] = true
+			}
+		}
+	}
+	// Sunday is both 0 and 7
+	fields[4][0] = fields[4][0] || fields[4][7]
+	return fields, nil
+}
+
+// contains returns whether the window contains the minute of the given time.
+func (w *scheduleWindow) contains(t time.Time) bool {
+	return w.fields[0][t.Minute()] && w.fields[1][t.Hour()] && w.fields[2][t.Day()] && w.fields[3][int(t.Month())] && w.fields[4][int(t.Weekday())]
+}
+
+// Mode returns the speed of the migration at the given time.
+func (s *migrationSchedule) Mode(t time.Time) string {
+	if s == nil {
+		return scheduleModeFull
+	}
+	mode, _ := s.at(t)
+	return mode
+}
+
+// at returns the speed of the migration at the given time, along with the number of workers per lane migrating
+// messages during reduced-speed windows.
+func (s *migrationSchedule) at(t time.Time) (mode string, reducedWorkers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t = t.In(s.location)
+	for i := range s.Windows {
+		if s.Windows[i].contains(t) {
+			return s.Windows[i].Mode, s.ReducedWorkers
+		}
+	}
+	return scheduleModeFull, s.ReducedWorkers
+}
+
+// Wait waits until the given worker (numbered from 0 within its lane) may migrate a message: immediately at full
+// speed, or during reduced-speed windows if it is among the first workers of its lane, and otherwise once the window
+// changes. Windows are checked again every minute.
+func (s *migrationSchedule) Wait(ctx context.Context, worker int) error {
+	if s == nil {
+		return nil
+	}
+	for {
+		now := time.Now()
+		mode, reducedWorkers := s.at(now)
+		s.observe(mode)
+		if mode == scheduleModeFull || (mode == scheduleModeReduced && worker < reducedWorkers) {
+			return nil
+		}
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// observe logs transitions between scheduling windows of different speeds.
+func (s *migrationSchedule) observe(mode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mode == s.mode {
+		return
+	}
+	slog.Info("Migration speed changed by schedule", "from", s.mode, "to", mode, "reducedWorkers", s.ReducedWorkers)
+	s.mode = mode
+}
+
+// current returns the mode last observed by workers.
+func (s *migrationSchedule) current() string {
+	if s == nil {
+		return scheduleModeFull
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode
+}
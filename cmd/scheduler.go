@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+)
+
+// fairSchedulerQueueSize is the number of collected messages queued per mailbox, before its collection blocks.
+const fairSchedulerQueueSize = messageEnvelopeFetchBatchSize
+
+// fairScheduler interleaves the migration of messages collected from several mailboxes, taking a message from each
+// mailbox in turn (round-robin), so that small mailboxes make progress while large ones are being migrated, instead
+// of waiting for them to finish. Messages are queued per mailbox, and forwarded to a single output channel (e.g. a
+// migration lane) as it has room for them. Messages of priority mailboxes are always forwarded before messages of
+// other mailboxes.
+type fairScheduler struct {
+	priority []string
+	others   []string
+	queues   map[string]chan *migrationRequest
+	out      chan<- *migrationRequest
+	ready    chan struct{}
+	closed   atomic.Bool
+}
+
+func newFairScheduler(mailboxes, priority []string, out chan<- *migrationRequest) *fairScheduler {
+	s := &fairScheduler{
+		priority: priority,
+		others:   slices.DeleteFunc(slices.Clone(mailboxes), func(m string) bool { return slices.Contains(priority, m) }),
+		queues:   make(map[string]chan *migrationRequest, len(mailboxes)),
+		out:      out,
+		ready:    make(chan struct{}, 1),
+	}
+	for _, mailbox := range mailboxes {
+		s.queues[mailbox] = make(chan *migrationRequest, fairSchedulerQueueSize)
+	}
+	return s
+}
+
+// Enqueue queues the given request of its source mailbox, blocking while the mailbox's queue is full. The caller is
+// expected to hold a slot of the given semaphore (bounding concurrent collections), which is released while blocked,
+// so a large mailbox waiting for its turn does not prevent other mailboxes from being collected.
+func (s *fairScheduler) Enqueue(ctx context.Context, r *migrationRequest, slots chan struct{}) error {
+	queue := s.queues[r.sourceMailbox]
+	select {
+	case queue <- r:
+	default:
+		<-slots
+		select {
+		case queue <- r:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of requests queued (of all mailboxes), waiting to be forwarded.
+func (s *fairScheduler) Len() int {
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Close signals that no more requests will be queued; once all queued requests are forwarded, the output channel is
+// closed.
+func (s *fairScheduler) Close() {
+	s.closed.Store(true)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Run forwards queued requests to the output channel, one mailbox at a time, until the scheduler is closed and all of
+// its queues are drained, or the given context is done.
+func (s *fairScheduler) Run(ctx context.Context) {
+	for {
+		// Closing happens after the last request was queued, so a pass finding nothing after that means we're done
+		closed := s.closed.Load()
+		if forwarded, ok := s.forwardRound(ctx, s.priority); !ok {
+			return
+		} else if forwarded {
+			continue
+		}
+		if forwarded, ok := s.forwardRound(ctx, s.others); !ok {
+			return
+		} else if forwarded {
+			continue
+		} else if closed {
+			slog.Debug("Fair scheduler drained")
+			close(s.out)
+			return
+		}
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forwardRound forwards a single queued request of each of the given mailboxes, if any. Returns whether any request was
+// forwarded, and false as its second value if the given context is done.
+func (s *fairScheduler) forwardRound(ctx context.Context, mailboxes []string) (bool, bool) {
+	forwarded := false
+	for _, mailbox := range mailboxes {
+		select {
+		case r := <-s.queues[mailbox]:
+			select {
+			case s.out <- r:
+				forwarded = true
+			case <-ctx.Done():
+				return forwarded, false
+			}
+		default:
+		}
+	}
+	return forwarded, true
+}
+
+// mailboxProgress tracks the migration progress of a single source mailbox. Messages also collected from another
+// mailbox are only counted as matched, so a mailbox is done once all of its collected messages are.
+type mailboxProgress struct {
+	matched   atomic.Uint64
+	collected atomic.Uint64
+	done      atomic.Uint64
+}
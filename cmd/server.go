@@ -0,0 +1,385 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/config"
+	"github.com/arikkfir-org/gmail-organizer/internal/notifications"
+	"github.com/arikkfir-org/gmail-organizer/internal/otel"
+)
+
+const (
+	defaultServerAddr = ":8080"
+
+	// serverMaxRequestBytes bounds the size of API request bodies.
+	serverMaxRequestBytes = 64 * 1024
+)
+
+// Run states reported by the management API.
+const (
+	managedRunRunning   = "running"
+	managedRunPaused    = "paused"
+	managedRunCompleted = "completed"
+	managedRunFailed    = "failed"
+)
+
+// runRequest is the body of "POST /runs": the accounts to migrate between, and the settings of the "migrate" command's
+// flags. All other settings are taken from the server's environment, like those of the "migrate" command.
+type runRequest struct {
+	Source         accountCredentials `json:"source"`
+	Target         accountCredentials `json:"target"`
+	Force          bool               `json:"force"`
+	ErrorPolicy    string             `json:"errorPolicy"`
+	MaxFailures    uint64             `json:"maxFailures"`
+	PriorityLabels []string           `json:"priorityLabels"`
+}
+
+// managedRun is a migration run started through the management API.
+type managedRun struct {
+	id      string
+	source  string
+	target  string
+	job     *WorkerJob
+	started time.Time
+	cancel  context.CancelFunc
+
+	mu    sync.Mutex
+	ended time.Time
+	err   error
+	done  bool
+}
+
+// managedRunStatus is the state & progress of a run, as returned by the management API. Account addresses are masked.
+type managedRunStatus struct {
+	ID       string            `json:"id"`
+	Source   string            `json:"source"`
+	Target   string            `json:"target"`
+	State    string            `json:"state"`
+	Error    string            `json:"error,omitempty"`
+	Started  time.Time         `json:"started"`
+	Ended    *time.Time        `json:"ended,omitempty"`
+	Done     uint64            `json:"done"`
+	Total    uint64            `json:"total"`
+	Progress string            `json:"progress"`
+	Summary  *migrationSummary `json:"summary"`
+}
+
+// active returns whether the run is still in progress.
+func (r *managedRun) active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.done
+}
+
+// status returns the run's state & progress.
+func (r *managedRun) status() *managedRunStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &managedRunStatus{
+		ID:       r.id,
+		Source:   config.MaskEmailAddress(r.source),
+		Target:   config.MaskEmailAddress(r.target),
+		Started:  r.started,
+		Done:     r.job.processed.Load(),
+		Total:    r.job.total(),
+		Progress: r.job.status().String(),
+		Summary:  r.job.summary(),
+	}
+	switch {
+	case r.done && r.err != nil:
+		s.State, s.Error = managedRunFailed, r.err.Error()
+	case r.done:
+		s.State = managedRunCompleted
+	default:
+		if state, _ := r.job.control.state(); state == "paused" {
+			s.State = managedRunPaused
+		} else {
+			s.State = managedRunRunning
+		}
+	}
+	if r.done {
+		s.Ended = &r.ended
+	}
+	return s
+}
+
+// managementServer starts migration runs on request, and reports their progress. Runs share the server's
+// environment, so state files it configures (e.g. FAILURE_LEDGER_PATH) are shared by all runs, and are best left
+// unset; runs against the same target account are rejected while one is in progress (like the target's lock would).
+type managementServer struct {
+	ctx      context.Context
+	notifier *notifications.Notifier
+
+	mu       sync.Mutex
+	runs     map[string]*managedRun
+	reserved map[string]bool // target accounts (lower-cased) of runs being started
+	active   sync.WaitGroup
+}
+
+// reserveTarget reserves the given target account for a run being started, unless a run is already migrating to it
+// (or being started), in which case the conflicting run's ID is returned (empty if it's still being started).
+func (s *managementServer) reserveTarget(target string) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reserved[strings.ToLower(target)] {
+		return false, ""
+	}
+	for _, run := range s.runs {
+		if strings.EqualFold(run.target, target) && run.active() {
+			return false, run.id
+		}
+	}
+	s.reserved[strings.ToLower(target)] = true
+	return true, ""
+}
+
+// releaseTarget releases the reservation of the given target account, and adds the given run (if any) to the runs of
+// the server, atomically, so no other run to the same target can start in between.
+func (s *managementServer) releaseTarget(target string, run *managedRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, strings.ToLower(target))
+	if run != nil {
+		s.runs[run.id] = run
+	}
+}
+
+// runServe runs the "serve" command: a server of a REST API for starting migrations between any accounts, and for
+// monitoring & pausing them, so a single deployment serves many account pairs.
+//
+//	POST /runs               start a run (see runRequest), returning its status with 201 Created
+//	GET  /runs               the status of all runs
+//	GET  /runs/{id}          the status of a run
+//	POST /runs/{id}/pause    pause a run, letting in-flight messages finish
+//	POST /runs/{id}/resume   resume a paused run
+//	POST /runs/{id}/abort    abort a run (in-flight messages are interrupted)
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", cmp.Or(os.Getenv("PORT"), defaultServerAddr), "Address to serve the API on (defaults to $SERVER_ADDR, or to $PORT on Cloud Run)")
+	envNames := map[string]string{"addr": "SERVER_ADDR"}
+	if !parseFlags(fs, args, envNames) {
+		return exitUsage
+	}
+	logEffectiveConfig(fs, envNames)
+	if !strings.Contains(*addr, ":") {
+		*addr = ":" + *addr // a bare port, e.g. from $PORT
+	}
+	token := os.Getenv("SERVER_TOKEN")
+	if token == "" && !isLoopbackAddr(*addr) && !lookupEnvBool("SERVER_ALLOW_NO_AUTH", false) {
+		slog.Error("SERVER_TOKEN is required when serving on other addresses than loopback ones (set SERVER_ALLOW_NO_AUTH=true to let anyone reaching the server start migrations)", "addr", *addr)
+		return exitConfig
+	} else if token == "" {
+		slog.Warn("SERVER_TOKEN is not set, so anyone reaching the server can start migrations", "addr", *addr)
+	}
+
+	// Create context that cancels on SIGINT and SIGTERM
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	notifier, err := newNotifierFromEnv()
+	if err != nil {
+		slog.Error("Failed to configure notifications", "err", err)
+		return exitCodeOf(err)
+	}
+
+	// Initialize OpenTelemetry for tracing and metrics
+	shutdown, err := otel.InitOtelProvider(ctx, "worker")
+	if err != nil {
+		slog.Error("Failed to initialize OTel provider", "err", err)
+		return exitCodeOf(err)
+	}
+	defer shutdown()
+
+	s := &managementServer{ctx: ctx, notifier: notifier, runs: make(map[string]*managedRun), reserved: make(map[string]bool)}
+	if err := s.serve(ctx, *addr, token); err != nil {
+		slog.Error("Management API failed", "err", err, "addr", *addr)
+		return exitCodeOf(err)
+	}
+	s.active.Wait()
+	return exitOK
+}
+
+// isLoopbackAddr returns whether the given address ("host:port") only accepts connections from the local host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serve serves the management API on the given address until the given context is done. If a token is given,
+// requests must carry it as a bearer token.
+func (s *managementServer) serve(ctx context.Context, addr, token string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /runs", s.handleStart)
+	mux.HandleFunc("GET /runs", func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		statuses := make([]*managedRunStatus, 0, len(s.runs))
+		for _, run := range s.runs {
+			statuses = append(statuses, run.status())
+		}
+		s.mu.Unlock()
+		slices.SortFunc(statuses, func(a, b *managedRunStatus) int { return a.Started.Compare(b.Started) })
+		writeJSON(w, http.StatusOK, statuses)
+	})
+	mux.HandleFunc("GET /runs/{id}", s.withRun(func(w http.ResponseWriter, _ *http.Request, run *managedRun) {
+		writeJSON(w, http.StatusOK, run.status())
+	}))
+	mux.HandleFunc("POST /runs/{id}/pause", s.withRun(func(w http.ResponseWriter, r *http.Request, run *managedRun) {
+		if run.job.control.Pause() {
+			slog.Info("Pausing run through the management API; in-flight messages will finish first", "run", run.id, "remote", r.RemoteAddr)
+		}
+		writeJSON(w, http.StatusOK, run.status())
+	}))
+	mux.HandleFunc("POST /runs/{id}/resume", s.withRun(func(w http.ResponseWriter, r *http.Request, run *managedRun) {
+		if run.job.control.Resume() {
+			slog.Info("Resuming run through the management API", "run", run.id, "remote", r.RemoteAddr)
+		}
+		writeJSON(w, http.StatusOK, run.status())
+	}))
+	mux.HandleFunc("POST /runs/{id}/abort", s.withRun(func(w http.ResponseWriter, r *http.Request, run *managedRun) {
+		slog.Warn("Aborting run through the management API", "run", run.id, "remote", r.RemoteAddr)
+		run.cancel()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	var handler http.Handler = mux
+	if token != "" {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving management API", "addr", addr, "authenticated", token != "")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve management API: %w", err)
+	}
+	return nil
+}
+
+// withRun wraps the given handler with a lookup of the run given by the request's path, responding with 404 Not Found
+// if there is no such run.
+func (s *managementServer) withRun(handler func(http.ResponseWriter, *http.Request, *managedRun)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		run, found := s.runs[r.PathValue("id")]
+		s.mu.Unlock()
+		if !found {
+			http.Error(w, "run not found", http.StatusNotFound)
+			return
+		}
+		handler(w, r, run)
+	}
+}
+
+// handleStart starts a run as requested, and responds with its status. The run goes on in the background, until it
+// ends, is aborted, or the server shuts down.
+func (s *managementServer) handleStart(w http.ResponseWriter, r *http.Request) {
+	var req runRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, serverMaxRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid run request: %s", err), http.StatusBadRequest)
+		return
+	}
+	req.ErrorPolicy = cmp.Or(req.ErrorPolicy, errorPolicyStrict)
+
+	// The target is reserved while connecting to the accounts, which takes a while, so concurrent requests for the same
+	// target cannot both start a run
+	if ok, conflicting := s.reserveTarget(req.Target.Username); !ok && conflicting != "" {
+		http.Error(w, fmt.Sprintf("run '%s' is already migrating to this target account", conflicting), http.StatusConflict)
+		return
+	} else if !ok {
+		http.Error(w, "a run to this target account is already being started", http.StatusConflict)
+		return
+	}
+
+	// Connecting to the accounts also validates their credentials, so bad requests fail here rather than in the run
+	job, err := newWorkerJob(req.Force, req.ErrorPolicy, req.MaxFailures, req.PriorityLabels, s.notifier, &req.Source, &req.Target, jobPathsFromEnv())
+	if err != nil {
+		s.releaseTarget(req.Target.Username, nil)
+		slog.Warn("Failed to start run through the management API", "err", err, "remote", r.RemoteAddr)
+		http.Error(w, fmt.Sprintf("failed to start run: %s", err), http.StatusUnprocessableEntity)
+		return
+	}
+	// Runs are controlled through this API, rather than each serving its own control API
+	job.controlAddr, job.control = "", newRunControl()
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	ctx, cancel := context.WithCancel(s.ctx)
+	run := &managedRun{
+		id:      hex.EncodeToString(b),
+		source:  req.Source.Username,
+		target:  req.Target.Username,
+		job:     job,
+		started: time.Now().UTC(),
+		cancel:  cancel,
+	}
+	s.releaseTarget(req.Target.Username, run)
+
+	slog.Info("Starting run through the management API", "run", run.id, "source", config.MaskEmailAddress(run.source), "target", config.MaskEmailAddress(run.target), "remote", r.RemoteAddr)
+	s.active.Go(func() {
+		defer cancel()
+		defer job.Close()
+		err := job.Run(ctx)
+		run.mu.Lock()
+		run.done, run.ended, run.err = true, time.Now().UTC(), err
+		run.mu.Unlock()
+
+		kind, message := notifications.KindCompleted, fmt.Sprintf("Run %s completed successfully", run.id)
+		if err != nil {
+			slog.Error("Run failed", "run", run.id, "err", err)
+			kind, message = notifications.KindFailed, fmt.Sprintf("Run %s failed: %s", run.id, err)
+		} else {
+			slog.Info("Run completed successfully", "run", run.id)
+		}
+		notify(context.WithoutCancel(ctx), s.notifier, notifications.Event{Kind: kind, Source: "serve", Message: message})
+	})
+	writeJSON(w, http.StatusCreated, run.status())
+}
+
+// writeJSON responds with the given status code and value, as JSON.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestReserveTarget(t *testing.T) {
+	s := &managementServer{runs: make(map[string]*managedRun), reserved: make(map[string]bool)}
+
+	if ok, _ := s.reserveTarget("target@example.com"); !ok {
+		t.Fatalf("first reservation of target was refused")
+	}
+	if ok, conflicting := s.reserveTarget("Target@Example.com"); ok || conflicting != "" {
+		t.Errorf("reservation of target being started = %t, %q; want refused without a run", ok, conflicting)
+	}
+
+	// A failed start releases the target
+	s.releaseTarget("target@example.com", nil)
+	if ok, _ := s.reserveTarget("target@example.com"); !ok {
+		t.Fatalf("reservation of released target was refused")
+	}
+
+	// A started run holds the target until it's done
+	run := &managedRun{id: "r1", target: "target@example.com"}
+	s.releaseTarget("target@example.com", run)
+	if ok, conflicting := s.reserveTarget("target@example.com"); ok || conflicting != "r1" {
+		t.Errorf("reservation of target of active run = %t, %q; want refused by 'r1'", ok, conflicting)
+	}
+	run.done = true
+	if ok, _ := s.reserveTarget("target@example.com"); !ok {
+		t.Errorf("reservation of target of completed run was refused")
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"8080":           false,
+	}
+	for addr, want := range tests {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %t, want %t", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/shadow"
+)
+
+// simulatedStatePaths are the files describing the target account, kept in the simulation directory when the target
+// is simulated, so that simulated runs never affect the state of real ones.
+var simulatedStatePaths = map[string]string{
+	"LABEL_STATE_PATH":      "state.json",
+	"TARGET_UID_STATE_PATH": "state.json",
+	"FAILURE_LEDGER_PATH":   "failures.jsonl",
+}
+
+var (
+	simulationOnce    sync.Once
+	simulationAddress string
+	simulationErr     error
+)
+
+// applySimulation prepares the simulation of the target account, if enabled by the SIMULATE_TARGET_DIR environment
+// variable: rather than the real target account, target connection pools talk to a local IMAP server, which keeps
+// everything appended & updated in Maildir shadow stores in that directory (see shadow.Backend). This exercises the
+// full pipeline (including deduplication & label mapping) end-to-end, without touching the destination account; and
+// since the shadow stores persist, later simulated runs behave like later real runs would.
+//
+// The label state, target UIDs & failure ledger are always kept in the simulation directory, since they describe the
+// target account. The target account's password is not needed.
+func applySimulation() error {
+	dir := os.Getenv("SIMULATE_TARGET_DIR")
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create simulation directory '%s': %w", dir, err)
+	}
+	for name, file := range simulatedStatePaths {
+		path := filepath.Join(dir, file)
+		if configured := os.Getenv(name); configured != "" && configured != path {
+			slog.Warn("Ignoring configured path while simulating the target account", "name", name, "configured", configured, "path", path)
+		}
+		if err := os.Setenv(name, path); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	slog.Warn("Simulating the target account; nothing is written to it", "dir", dir)
+	return nil
+}
+
+// simulatedTarget returns the address of the local IMAP server simulating the target account, starting it on first
+// use, or an empty address if the target account is not simulated.
+func simulatedTarget() (string, error) {
+	dir := os.Getenv("SIMULATE_TARGET_DIR")
+	if dir == "" {
+		return "", nil
+	}
+	simulationOnce.Do(func() {
+		simulationAddress, _, simulationErr = shadow.Serve(shadow.NewBackend(dir), "127.0.0.1:0")
+		if simulationErr == nil {
+			slog.Info("Started simulated target IMAP server", "address", simulationAddress, "dir", dir)
+		}
+	})
+	return simulationAddress, simulationErr
+}
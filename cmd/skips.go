@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+)
+
+// Reasons for not appending a source message to the target account. Every message counted by "source.emails" is
+// counted exactly once by one of the "appended.emails", "updated.emails" (messages already in the target, whose labels
+// & flags are updated instead), "skipped.emails" (broken down by these reasons) and "failed.units" counters. Messages
+// the target rejects as too large are skipped, since retrying cannot help, but are recorded in the failure ledger.
+const (
+	skipReasonDuplicate       = "duplicate"         // same message seen in another source mailbox (label) already
+	skipReasonOverLimit       = "over-limit"        // beyond the MAX_EMAILS limit
+	skipReasonTooLarge        = "too-large"         // rejected by the target for its size
+	skipReasonFilteredByLabel = "filtered-by-label" // carries one of the EXCLUDE_LABELS labels
+	skipReasonChatMessage     = "chat-message"      // chat transcript of Gmail's chats mailbox, rather than email
+)
+
+// errMessageTooLarge marks messages the target rejected for their size, which are skipped rather than failed.
+var errMessageTooLarge = errors.New("message too large for target")
+
+// gmailChatsMailbox is the mailbox Gmail keeps chat transcripts in, if shown in IMAP.
+const gmailChatsMailbox = "[Gmail]/Chats"
+
+// skipCounter counts skipped messages by reason, both as the "skipped.emails" metric and in-process, so that a summary
+// can be logged at the end of the run.
+type skipCounter struct {
+	skipped *metrics.Counter
+	mu      sync.Mutex
+	counts  map[string]uint64
+}
+
+func newSkipCounter(skipped *metrics.Counter) *skipCounter {
+	return &skipCounter{skipped: skipped, counts: make(map[string]uint64)}
+}
+
+// Add counts the given number of messages skipped for the given reason.
+func (c *skipCounter) Add(ctx context.Context, reason string, n uint64) {
+	if n == 0 {
+		return
+	}
+	c.skipped.AddWithReason(ctx, reason, int64(n))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[reason] += n
+}
+
+// Counts returns the number of messages skipped for each reason.
+func (c *skipCounter) Counts() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.counts)
+}
+
+// LogSummary logs the number of messages skipped for each reason.
+func (c *skipCounter) LogSummary() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var attrs []any
+	for _, reason := range slices.Sorted(maps.Keys(c.counts)) {
+		attrs = append(attrs, reason, c.counts[reason])
+	}
+	slog.Info("Skipped messages", attrs...)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultStatusInterval = 5 * time.Minute
+	gaugesInterval        = 10 * time.Second
+
+	// Gmail's daily IMAP bandwidth limits per account
+	defaultDailyDownloadBudget = 2500 * 1024 * 1024
+	defaultDailyUploadBudget   = 500 * 1024 * 1024
+)
+
+// runStatus is a snapshot of the progress of a migration run.
+type runStatus struct {
+	done           uint64
+	total          uint64
+	collecting     bool
+	ratePerMinute  float64
+	downloaded     int64
+	downloadBudget int64
+	uploaded       int64
+	uploadBudget   int64
+	eta            time.Time
+	throttle       string
+}
+
+// String formats the status as a single line for humans, e.g. "1200/5000 messages (24.0%), 85.3/min, downloaded
+// 310 MiB (12% of daily budget), uploaded 305 MiB (61% of daily budget), ETA 2025-01-02T15:04:05Z, throttling: none".
+func (s *runStatus) String() string {
+	total := fmt.Sprintf("%d", s.total)
+	if s.collecting {
+		total += "+"
+	}
+	percent := 0.0
+	if s.total > 0 {
+		percent = float64(s.done) / float64(s.total) * 100
+	}
+	eta := "unknown"
+	if !s.eta.IsZero() {
+		eta = s.eta.Format(time.RFC3339)
+	}
+	return fmt.Sprintf(
+		"%d/%s messages (%.1f%%), %.1f/min, downloaded %d MiB (%.0f%% of daily budget), uploaded %d MiB (%.0f%% of daily budget), ETA %s, throttling: %s",
+		s.done, total, percent, s.ratePerMinute,
+		s.downloaded/1024/1024, budgetUsed(s.downloaded, s.downloadBudget)*100,
+		s.uploaded/1024/1024, budgetUsed(s.uploaded, s.uploadBudget)*100,
+		eta, s.throttle,
+	)
+}
+
+// budgetUsed returns the fraction of the given daily budget used by the given number of bytes.
+func budgetUsed(bytes, budget int64) float64 {
+	if budget <= 0 {
+		return 0
+	}
+	return float64(bytes) / float64(budget)
+}
+
+// total returns the number of messages collected for migration so far.
+func (j *WorkerJob) total() uint64 {
+	return min(j.collectedCount.Load(), j.maxEmailsToProcess)
+}
+
+// status returns a snapshot of the run's progress. Since runs are usually much shorter than a day, bytes transferred
+// during the run are compared with the daily budgets as-is.
+func (j *WorkerJob) status() *runStatus {
+	elapsed := time.Since(j.startedAt)
+	source, target := j.sourceGmail.Usage(), j.targetGmail.Usage()
+	s := &runStatus{
+		done:           j.processed.Load(),
+		total:          j.total(),
+		collecting:     !j.collectionDone.Load(),
+		downloaded:     source.TransferredBytes,
+		downloadBudget: j.dailyDownloadBudget,
+		uploaded:       target.TransferredBytes,
+		uploadBudget:   j.dailyUploadBudget,
+		throttle:       "none",
+	}
+	if elapsed > 0 {
+		s.ratePerMinute = float64(s.done) / elapsed.Minutes()
+	}
+	if !s.collecting && s.ratePerMinute > 0 && s.total >= s.done {
+		remaining := float64(s.total-s.done) / s.ratePerMinute
+		s.eta = time.Now().Add(time.Duration(remaining * float64(time.Minute))).UTC().Truncate(time.Second)
+	}
+	if mode := j.schedule.current(); mode != scheduleModeFull {
+		s.throttle = fmt.Sprintf("%s by schedule", mode)
+	} else if source.PausedFor > 0 || target.PausedFor > 0 {
+		s.throttle = fmt.Sprintf("paused for %s", max(source.PausedFor, target.PausedFor).Round(time.Second))
+	} else if factor := min(source.ThrottleFactor, target.ThrottleFactor); factor < 1 {
+		s.throttle = fmt.Sprintf("slowed to %.0f%%", factor*100)
+	}
+	return s
+}
+
+// reportStatus logs the status of the run, and the progress of each source mailbox, at the configured interval, until
+// the given context is done.
+func (j *WorkerJob) reportStatus(ctx context.Context) {
+	if j.statusInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(j.statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s := j.status()
+			slog.Info("Run status",
+				"status", s.String(),
+				"done", s.done,
+				"total", s.total,
+				"collecting", s.collecting,
+				"ratePerMinute", s.ratePerMinute,
+				"downloadedBytes", s.downloaded,
+				"downloadBudgetUsed", budgetUsed(s.downloaded, s.downloadBudget),
+				"uploadedBytes", s.uploaded,
+				"uploadBudgetUsed", budgetUsed(s.uploaded, s.uploadBudget),
+				"eta", s.eta,
+				"throttle", s.throttle)
+		}
+	}
+}
+
+// reportGauges periodically reports the state of the connection pools (open & idle connections), of the migration
+// queues (requests waiting for a worker), and the message bytes in flight, until the given context is done.
+func (j *WorkerJob) reportGauges(ctx context.Context) {
+	ticker := time.NewTicker(gaugesInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			open, idle := j.sourceGmail.PoolStats()
+			j.metrics.sourcePoolOpen.Set(ctx, float64(open))
+			j.metrics.sourcePoolIdle.Set(ctx, float64(idle))
+			open, idle = j.targetGmail.PoolStats()
+			j.metrics.targetPoolOpen.Set(ctx, float64(open))
+			j.metrics.targetPoolIdle.Set(ctx, float64(idle))
+			j.metrics.regularQueue.Set(ctx, float64(j.messagesScheduler.Len()+len(j.messagesCh)))
+			j.metrics.largeQueue.Set(ctx, float64(j.largeScheduler.Len()+len(j.largeMessagesCh)))
+			j.metrics.inFlightMemory.Set(ctx, float64(j.memory.InFlight()))
+		}
+	}
+}
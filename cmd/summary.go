@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/bigquery"
+	"github.com/arikkfir-org/gmail-organizer/internal/httpretry"
+	"github.com/arikkfir-org/gmail-organizer/internal/version"
+)
+
+const (
+	summaryWebhookTimeout  = 10 * time.Second
+	summaryBigQueryTimeout = time.Minute
+)
+
+// summaryWebhookClient posts run summaries, honoring the webhook's rate-limiting hints.
+var summaryWebhookClient = httpretry.NewClient("summary-webhook", 0)
+
+// runSummary is the structured summary of a run of any command, emitted when the command returns.
+type runSummary struct {
+	mu        sync.Mutex
+	Command   string            `json:"command"`
+	Status    string            `json:"status"`
+	ExitCode  int               `json:"exitCode"`
+	Started   time.Time         `json:"started"`
+	Ended     time.Time         `json:"ended"`
+	Duration  string            `json:"duration"`
+	Counts    map[string]uint64 `json:"counts,omitempty"`
+	Migration *migrationSummary `json:"migration,omitempty"`
+}
+
+// migrationSummary are the details of a migration run.
+type migrationSummary struct {
+	DryRun            bool              `json:"dryRun"`
+	Migrated          uint64            `json:"migrated"`
+	Updated           uint64            `json:"updated"`
+	Skipped           map[string]uint64 `json:"skipped"`
+	Failed            uint64            `json:"failed"`
+	Mismatched        uint64            `json:"mismatched,omitempty"`      // migrated messages whose content differs from the source
+	RepairedDates     uint64            `json:"repairedDates,omitempty"`   // migrated messages whose invalid internal dates were replaced
+	UnresolvedDates   uint64            `json:"unresolvedDates,omitempty"` // migrated messages whose invalid internal dates were left for the target to assign
+	UploadedBytes     int64             `json:"uploadedBytes"`
+	DownloadedBytes   int64             `json:"downloadedBytes"`
+	MessagesPerMinute float64           `json:"messagesPerMinute"`
+	Labels            []*mailboxSummary `json:"labels"`
+	SanitizedLabels   map[string]string `json:"sanitizedLabels,omitempty"` // sanitized names of labels Gmail rejects
+}
+
+// mailboxSummary is the progress of a single source mailbox (label) at the end of a migration run.
+type mailboxSummary struct {
+	Label     string `json:"label"`
+	Matched   uint64 `json:"matched"`
+	Collected uint64 `json:"collected"`
+	Done      uint64 `json:"done"`
+}
+
+// runRow is the row of a run summary in BigQuery; migration fields are zero for other commands.
+type runRow struct {
+	Command           string    `bigquery:"command"`
+	Status            string    `bigquery:"status"`
+	ExitCode          int       `bigquery:"exitCode"`
+	Started           time.Time `bigquery:"started"`
+	Ended             time.Time `bigquery:"ended"`
+	DurationSeconds   float64   `bigquery:"durationSeconds"`
+	DryRun            bool      `bigquery:"dryRun"`
+	Migrated          int64     `bigquery:"migrated"`
+	Updated           int64     `bigquery:"updated"`
+	Skipped           int64     `bigquery:"skipped"`
+	Failed            int64     `bigquery:"failed"`
+	UploadedBytes     int64     `bigquery:"uploadedBytes"`
+	DownloadedBytes   int64     `bigquery:"downloadedBytes"`
+	MessagesPerMinute float64   `bigquery:"messagesPerMinute"`
+	Summary           string    `bigquery:"summary"` // the complete summary, as JSON
+}
+
+// summary is the summary of the current run; commands record their results in it.
+var summary = &runSummary{Counts: make(map[string]uint64)}
+
+// Count records the given count of the run's results (e.g. the number of exported messages) in the summary.
+func (s *runSummary) Count(name string, n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Counts[name] = n
+}
+
+// emit completes the summary of the given command, prints it to stdout as a single line of JSON, posts it to the
+// webhook given by the SUMMARY_WEBHOOK_URL environment variable, if any, and inserts it into the BigQuery table given
+// by the SUMMARY_BIGQUERY_TABLE environment variable ("project.dataset.table"), if any. Setting the RUN_SUMMARY
+// environment variable to false disables the summary.
+func (s *runSummary) emit(command string, started time.Time, exitCode int) {
+	if !lookupEnvBool("RUN_SUMMARY", true) {
+		return
+	}
+
+	s.mu.Lock()
+	s.Command, s.ExitCode, s.Started, s.Ended = command, exitCode, started.UTC(), time.Now().UTC()
+	s.Duration = s.Ended.Sub(s.Started).Round(time.Second).String()
+	switch exitCode {
+	case exitOK:
+		s.Status = "succeeded"
+	case exitPartial, exitMismatch:
+		s.Status = "partial"
+	default:
+		s.Status = "failed"
+	}
+	content, err := json.Marshal(s)
+	row := s.row(string(content))
+	s.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to encode run summary", "err", err)
+		return
+	}
+	fmt.Println(string(content))
+
+	if url := os.Getenv("SUMMARY_WEBHOOK_URL"); url != "" {
+		if err := postSummary(url, content); err != nil {
+			slog.Warn("Failed to post run summary to webhook", "err", err)
+		}
+	}
+	if table := os.Getenv("SUMMARY_BIGQUERY_TABLE"); table != "" {
+		if err := insertSummary(table, row); err != nil {
+			slog.Warn("Failed to insert run summary into BigQuery", "err", err)
+		}
+	}
+}
+
+// row returns the BigQuery row of the summary, with the given encoded summary. The caller must hold the lock.
+func (s *runSummary) row(content string) *runRow {
+	row := &runRow{
+		Command:         s.Command,
+		Status:          s.Status,
+		ExitCode:        s.ExitCode,
+		Started:         s.Started,
+		Ended:           s.Ended,
+		DurationSeconds: s.Ended.Sub(s.Started).Seconds(),
+		Summary:         content,
+	}
+	if m := s.Migration; m != nil {
+		row.DryRun = m.DryRun
+		row.Migrated, row.Updated, row.Failed = int64(m.Migrated), int64(m.Updated), int64(m.Failed)
+		for _, n := range m.Skipped {
+			row.Skipped += int64(n)
+		}
+		row.UploadedBytes, row.DownloadedBytes = m.UploadedBytes, m.DownloadedBytes
+		row.MessagesPerMinute = m.MessagesPerMinute
+	}
+	return row
+}
+
+// insertSummary inserts the given summary row into the given BigQuery table.
+func insertSummary(table string, row *runRow) error {
+	ctx, cancel := context.WithTimeout(context.Background(), summaryBigQueryTimeout)
+	defer cancel()
+
+	w, err := bigquery.NewWriter(ctx, table, runRow{})
+	if err != nil {
+		return err
+	} else if err := w.Write(row); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// postSummary posts the given encoded summary to the given webhook URL.
+func postSummary(url string, content []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), summaryWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gmail-organizer/"+version.Version)
+	resp, err := summaryWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status from webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// summary returns the migration details of the run so far.
+func (j *WorkerJob) summary() *migrationSummary {
+	s := &migrationSummary{
+		DryRun:          j.dryRun,
+		Migrated:        j.appended.Load(),
+		Updated:         j.updated.Load(),
+		Skipped:         j.skips.Counts(),
+		Failed:          j.errors.Failures(),
+		Mismatched:      j.mismatched.Load(),
+		UploadedBytes:   j.targetGmail.Usage().TransferredBytes,
+		DownloadedBytes: j.sourceGmail.Usage().TransferredBytes,
+		SanitizedLabels: j.labelNames.Renamed(),
+	}
+	s.RepairedDates, s.UnresolvedDates = j.dateRepairs.Counts()
+	if !j.startedAt.IsZero() {
+		if elapsed := time.Since(j.startedAt); elapsed > 0 {
+			s.MessagesPerMinute = float64(j.processed.Load()) / elapsed.Minutes()
+		}
+	}
+	for _, mailbox := range j.sourceMailboxes {
+		p := j.progress[mailbox]
+		s.Labels = append(s.Labels, &mailboxSummary{
+			Label:     mailbox,
+			Matched:   p.matched.Load(),
+			Collected: p.collected.Load(),
+			Done:      p.done.Load(),
+		})
+	}
+	return s
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/config"
+	"github.com/arikkfir-org/gmail-organizer/internal/version"
+)
+
+const supportBundleDialTimeout = 10 * time.Second
+
+// supportBundleEnvNames are the environment variables (or prefixes thereof, when ending with "_") that configure the
+// application, and are therefore collected into support bundles (with secrets redacted) and logged at startup.
+var supportBundleEnvNames = []string{
+	"SOURCE_", "TARGET_", "OTEL_", "METRICS_", "BACKUP_", "NOTIFY_", "MIRROR_", "CONTROL_", "POP3_", "JMAP_", "LOCAL_", "SIMULATE_",
+	"ATTACHMENTS_", "CLEANUP_", "DIFF_", "EXPLORE_", "EXPORT_", "IMPORT_", "LABELS_CLEANUP_", "MAPPINGS_", "MESSAGE_IMPORT_", "SUPPORT_BUNDLE_",
+	"LOG_LEVEL", "JSON_LOGGING", "VERSION_CHECK", "CLOSE_TIMEOUT",
+	"MAX_EMAILS", "DRY_RUN", "DRY_RUN_REPORT", "DATE_REPAIR_REPORT", "VERIFY_CONTENT", "VERIFY_THREADS", "FAILURE_LEDGER_PATH", "AUDIT_LOG", "LABEL_STATE_PATH", "SOURCE_MAILBOXES", "EXCLUDE_LABELS", "PRIORITY_LABELS",
+	"ERROR_POLICY", "MAX_FAILURES", "STATUS_INTERVAL", "TUI", "SERVER_ADDR", "SERVER_TOKEN", "SERVER_ALLOW_NO_AUTH", "PORT", "ORCHESTRATION_PATH", "SECRET_CACHE_TTL", "DAILY_DOWNLOAD_BUDGET", "DAILY_UPLOAD_BUDGET",
+	"MAILBOX_COLLECTION_CONCURRENCY", "LARGE_MESSAGE_THRESHOLD", "LARGE_MESSAGE_WORKERS", "RULES_PATH", "RULES_STATE_PATH", "SKIP_EMPTY_LABELS", "MAX_LABEL_CREATIONS",
+	"RUN_SUMMARY", "SUMMARY_WEBHOOK_URL", "SUMMARY_BIGQUERY_TABLE",
+	"SPOOL_THRESHOLD", "SPOOL_DIR", "FETCH_SPOOL_", "BODY_CHUNK_SIZE", "MEMORY_WATERMARK", "LOCK_TTL", "KEYWORD_MAPPINGS_PATH", "SCHEDULE_PATH", "IDENTITY_CACHE_SIZE",
+	"CLOUD_RUN_JOB", "CLOUD_RUN_EXECUTION", "CLOUD_RUN_TASK_INDEX", "CLOUD_RUN_TASK_COUNT", "CLOUD_RUN_TASK_ATTEMPT",
+	"K_SERVICE", "K_REVISION",
+}
+
+func runSupportBundle(args []string) int {
+	fs := flag.NewFlagSet("support-bundle", flag.ContinueOnError)
+	output := fs.String("output", "", "Path of the bundle to create (defaults to $SUPPORT_BUNDLE_OUTPUT, or to a timestamped file in the current directory)")
+	logFiles := fs.String("logs", "", "Comma-separated list of log files to include (e.g. captured output of previous runs; defaults to $SUPPORT_BUNDLE_LOGS)")
+	logLines := fs.Int("log-lines", 2000, "Number of trailing lines to include from each log file and from the failure ledger (defaults to $SUPPORT_BUNDLE_LOG_LINES)")
+	checkConnectivity := fs.Bool("check-connectivity", true, "Check network connectivity to the configured IMAP endpoints (defaults to $SUPPORT_BUNDLE_CHECK_CONNECTIVITY)")
+	if !parseFlags(fs, args, map[string]string{"output": "SUPPORT_BUNDLE_OUTPUT", "logs": "SUPPORT_BUNDLE_LOGS", "log-lines": "SUPPORT_BUNDLE_LOG_LINES", "check-connectivity": "SUPPORT_BUNDLE_CHECK_CONNECTIVITY"}) {
+		return exitUsage
+	}
+	if *output == "" {
+		*output = fmt.Sprintf("gmail-organizer-support-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		slog.Error("Failed to create support bundle", "err", err, "path", *output)
+		return exitCodeOf(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	files := map[string]any{
+		"version.json":     version.Get(),
+		"config.json":      config.Environment(supportBundleEnvNames),
+		"environment.json": collectSupportBundleEnvironment(),
+	}
+	if *checkConnectivity {
+		files["connectivity.json"] = checkSupportBundleConnectivity()
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		b, err := json.MarshalIndent(files[name], "", "  ")
+		if err != nil {
+			slog.Error("Failed to encode support bundle file", "err", err, "name", name)
+			return exitCodeOf(err)
+		}
+		if err := writeSupportBundleFile(tw, name, b); err != nil {
+			slog.Error("Failed to write support bundle file", "err", err, "name", name)
+			return exitCodeOf(err)
+		}
+	}
+
+	// Include the tail of the failure ledger & any given log files
+	var tails []string
+	if path := os.Getenv("FAILURE_LEDGER_PATH"); path != "" {
+		tails = append(tails, path)
+	}
+	if *logFiles != "" {
+		tails = append(tails, strings.Split(*logFiles, ",")...)
+	}
+	for _, path := range tails {
+		path = strings.TrimSpace(path)
+		content, err := tailFile(path, *logLines)
+		if err != nil {
+			slog.Warn("Skipping file in support bundle", "err", err, "path", path)
+			continue
+		}
+		if err := writeSupportBundleFile(tw, "logs/"+filepath.Base(path), content); err != nil {
+			slog.Error("Failed to write support bundle file", "err", err, "path", path)
+			return exitCodeOf(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		slog.Error("Failed to finalize support bundle", "err", err)
+		return exitCodeOf(err)
+	} else if err := gz.Close(); err != nil {
+		slog.Error("Failed to finalize support bundle", "err", err)
+		return exitCodeOf(err)
+	}
+
+	slog.Info("Support bundle created; please review it before attaching it to a bug report", "path", *output)
+	return exitOK
+}
+
+// collectSupportBundleEnvironment returns diagnostics about the runtime environment.
+func collectSupportBundleEnvironment() map[string]any {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	hostname, _ := os.Hostname()
+	wd, _ := os.Getwd()
+	return map[string]any{
+		"time":       time.Now().UTC(),
+		"hostname":   hostname,
+		"workingDir": wd,
+		"uid":        os.Getuid(),
+		"numCPU":     runtime.NumCPU(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"memSysMiB":  mem.Sys / 1024 / 1024,
+		"timezone":   time.Local.String(),
+	}
+}
+
+// checkSupportBundleConnectivity resolves & dials the IMAP endpoints of the source and target accounts, and returns
+// the outcome for each of them.
+func checkSupportBundleConnectivity() map[string]string {
+	results := make(map[string]string)
+	for _, prefix := range []string{"SOURCE", "TARGET"} {
+		address := os.Getenv(prefix + "_IMAP_ADDRESS")
+		if address == "" {
+			address = "imap.gmail.com:993"
+		}
+		started := time.Now()
+		conn, err := net.DialTimeout("tcp", address, supportBundleDialTimeout)
+		if err != nil {
+			results[prefix] = fmt.Sprintf("%s: %v", address, err)
+			continue
+		}
+		_ = conn.Close()
+		results[prefix] = fmt.Sprintf("%s: connected in %s", address, time.Since(started).Round(time.Millisecond))
+	}
+	return results
+}
+
+// tailFile returns the last given number of lines of the given file.
+func tailFile(path string, lines int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tail []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		tail = append(tail, scanner.Text())
+		if len(tail) > lines {
+			tail = tail[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	return []byte(strings.Join(tail, "\n") + "\n"), nil
+}
+
+func writeSupportBundleFile(tw *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/archive"
+	"github.com/emersion/go-imap"
+)
+
+// takeoutSystemLabels maps the names of Gmail system labels in Google Takeout exports to their IMAP (X-GM-LABELS)
+// names.
+var takeoutSystemLabels = map[string]string{
+	"Inbox":     `\Inbox`,
+	"Sent":      `\Sent`,
+	"Important": `\Important`,
+	"Starred":   `\Starred`,
+	"Drafts":    `\Draft`,
+	"Draft":     `\Draft`,
+	"Spam":      `\Spam`,
+	"Trash":     `\Trash`,
+}
+
+// takeoutIgnoredLabels are Takeout labels with no IMAP equivalent: read state is restored as the \Seen flag, and
+// Gmail categories cannot be set over IMAP.
+var takeoutIgnoredLabels = []string{"Opened", "Unread", "Archived"}
+
+// applyTakeoutLabels restores the labels, read state and starred state of a message read from a Google Takeout MBOX
+// export, from its "X-Gmail-Labels" header (which is removed, along with the other headers Takeout adds). Returns
+// false for Hangouts chat messages, which cannot be restored as mail.
+func applyTakeoutLabels(m *archive.Message) bool {
+	takeoutLabels := archive.SplitTakeoutLabels(m.Header(archive.GmailLabelsHeader))
+	if slices.Contains(takeoutLabels, "Chat") {
+		return false
+	}
+	m.RemoveHeaders(archive.GmailLabelsHeader, "X-GM-THRID")
+
+	flags := slices.DeleteFunc(slices.Clone(m.Flags), func(f string) bool { return f == imap.SeenFlag })
+	if !slices.Contains(takeoutLabels, "Unread") {
+		flags = append(flags, imap.SeenFlag)
+	}
+	for _, label := range takeoutLabels {
+		if systemLabel, ok := takeoutSystemLabels[label]; ok {
+			m.Labels = append(m.Labels, systemLabel)
+			switch systemLabel {
+			case `\Starred`:
+				flags = append(flags, imap.FlaggedFlag)
+			case `\Draft`:
+				flags = append(flags, imap.DraftFlag)
+			}
+		} else if !slices.Contains(takeoutIgnoredLabels, label) && !strings.HasPrefix(label, "Category ") {
+			m.Labels = append(m.Labels, label)
+		}
+	}
+
+	slices.Sort(flags)
+	m.Flags = slices.Compact(flags)
+	slices.Sort(m.Labels)
+	m.Labels = slices.Compact(m.Labels)
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// targetUIDsSaveInterval is the interval of saving the target UIDs recorded during a run, so a crashed run loses
+// few of them.
+const targetUIDsSaveInterval = time.Minute
+
+// validateTargetUIDs forgets the target UIDs recorded by previous runs if the target mailbox's UIDVALIDITY changed
+// since, in which case they no longer identify the same messages. Dry runs neither use nor record target UIDs.
+func (j *WorkerJob) validateTargetUIDs(ctx context.Context) error {
+	if j.targetUIDs == nil {
+		return nil
+	} else if j.dryRun {
+		j.targetUIDs = nil
+		return nil
+	}
+
+	status, err := j.targetGmail.MailboxStatus(ctx, j.targetGmail.DefaultMailbox())
+	if err != nil {
+		return fmt.Errorf("failed to get status of target mailbox: %w", err)
+	}
+	if forgotten := j.targetUIDs.ValidateTargetUIDs(status.UidValidity); forgotten > 0 {
+		slog.Warn("Target mailbox UIDVALIDITY changed, forgetting recorded target UIDs", "uidValidity", status.UidValidity, "forgotten", forgotten)
+	}
+	return nil
+}
+
+// saveTargetUIDsPeriodically saves the target UIDs recorded during the run at a fixed interval, until the given
+// context is done.
+func (j *WorkerJob) saveTargetUIDsPeriodically(ctx context.Context) {
+	if j.targetUIDs == nil {
+		return
+	}
+	ticker := time.NewTicker(targetUIDsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.saveTargetUIDs()
+		}
+	}
+}
+
+// saveTargetUIDs saves the target UIDs recorded during the run. Failures are only logged, since the UIDs merely save
+// searches in later runs.
+func (j *WorkerJob) saveTargetUIDs() {
+	if err := j.targetUIDs.Save(); err != nil {
+		slog.Warn("Failed to save target UIDs", "err", err)
+	}
+}
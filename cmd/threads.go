@@ -0,0 +1,31 @@
+package main
+
+import (
+	"sync"
+)
+
+// threadTracker maps source Gmail thread IDs to the thread IDs Gmail assigned to the appended messages in the target
+// account. Gmail threads appended messages on its own (based on References/In-Reply-To headers and subject), so the
+// tracker is used to detect cases where messages of a single source thread end up split across target threads.
+type threadTracker struct {
+	mu      sync.Mutex
+	threads map[uint64]uint64
+}
+
+func newThreadTracker() *threadTracker {
+	return &threadTracker{threads: make(map[uint64]uint64)}
+}
+
+// Track records that a message of the given source thread was placed in the given target thread. If a previous
+// message of the same source thread was placed in a different target thread, the thread is considered broken, and
+// the target thread ID of that previous message is returned along with false.
+func (t *threadTracker) Track(sourceThreadID, targetThreadID uint64) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if existing, found := t.threads[sourceThreadID]; found && existing != targetThreadID {
+		return existing, false
+	}
+	t.threads[sourceThreadID] = targetThreadID
+	return targetThreadID, true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/progress"
+)
+
+const (
+	tuiRefreshInterval = time.Second
+	tuiRecentErrors    = 8
+	tuiDefaultWidth    = 100
+	tuiBarWidth        = 30
+)
+
+// isTerminal reports whether the given file is a terminal (rather than a pipe, a file or /dev/null).
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the width of the terminal, as reported by the shell through $COLUMNS.
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return tuiDefaultWidth
+}
+
+// recentErrors keeps the most recent errors of a run, for the terminal UI.
+type recentErrors struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recentErrors) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, time.Now().Format("15:04:05")+" "+line)
+	if len(r.lines) > tuiRecentErrors {
+		r.lines = r.lines[len(r.lines)-tuiRecentErrors:]
+	}
+}
+
+func (r *recentErrors) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.lines)
+}
+
+// tuiLogHandler captures warnings & errors logged while the terminal UI is drawn, which would otherwise scroll it away,
+// and discards all other records (the UI shows the progress they would report).
+type tuiLogHandler struct {
+	recent *recentErrors
+	attrs  []slog.Attr
+}
+
+func (h *tuiLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn
+}
+
+func (h *tuiLogHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	appendAttr := func(a slog.Attr) bool {
+		_, _ = fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		appendAttr(a)
+	}
+	r.Attrs(appendAttr)
+	h.recent.add(b.String())
+	return nil
+}
+
+func (h *tuiLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &tuiLogHandler{recent: h.recent, attrs: append(slices.Clone(h.attrs), attrs...)}
+}
+
+func (h *tuiLogHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// startTUI draws the progress of the run on the terminal until the returned function is called, which restores the
+// terminal & the default logger. Logs are captured (see tuiLogHandler) only if they would be written to the same
+// terminal, so logs redirected to a file are kept in full; in that case, recent errors are taken from the failed
+// messages' progress events instead.
+func (j *WorkerJob) startTUI(ctx context.Context) func() {
+	recent := &recentErrors{}
+	logger := slog.Default()
+	var events <-chan progress.Event // nil (never ready) while logs are captured, since failures are logged as well
+	unsubscribe := func() {}
+	if isTerminal(os.Stderr) {
+		slog.SetDefault(slog.New(&tuiLogHandler{recent: recent}))
+	} else {
+		events, unsubscribe = j.events.Channel(100)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(tuiRefreshInterval)
+		defer ticker.Stop()
+		lastDone, lastTime := j.processed.Load(), time.Now()
+		var throughput float64
+		fmt.Print("\x1b[?25l") // hide the cursor
+		for {
+			select {
+			case <-ctx.Done():
+				j.drawTUI(throughput, recent.list())
+				fmt.Print("\x1b[?25h\n")
+				return
+			case e, ok := <-events:
+				if ok && e.Kind == progress.KindMessageDone && e.Err != nil {
+					recent.add(fmt.Sprintf("%s (%d): %s", e.Mailbox, e.SourceUID, e.Err))
+				}
+			case now := <-ticker.C:
+				processed := j.processed.Load()
+				if elapsed := now.Sub(lastTime).Minutes(); elapsed > 0 {
+					throughput = float64(processed-lastDone) / elapsed
+				}
+				lastDone, lastTime = processed, now
+				j.drawTUI(throughput, recent.list())
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		unsubscribe()
+		slog.SetDefault(logger)
+	}
+}
+
+// drawTUI redraws the whole screen: the run's status, a progress bar per source mailbox, the state of the connection
+// pools, and the most recent errors.
+func (j *WorkerJob) drawTUI(throughput float64, errs []string) {
+	width := terminalWidth()
+	s := j.status()
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J") // move to the top-left corner, and clear the screen
+
+	total := strconv.FormatUint(s.total, 10)
+	if s.collecting {
+		total += "+"
+	}
+	_, _ = fmt.Fprintf(&b, "Migrating %s %s\n\n", progressBar(s.done, s.total, tuiBarWidth), fitWidth(fmt.Sprintf("%d/%s messages", s.done, total), width))
+	eta := "unknown"
+	if !s.eta.IsZero() {
+		eta = time.Until(s.eta).Round(time.Second).String()
+	}
+	_, _ = fmt.Fprintf(&b, "Throughput:  %.1f/min now, %.1f/min average, ETA %s\n", throughput, s.ratePerMinute, eta)
+	_, _ = fmt.Fprintf(&b, "Transferred: downloaded %d MiB (%.0f%% of daily budget), uploaded %d MiB (%.0f%% of daily budget)\n",
+		s.downloaded/1024/1024, budgetUsed(s.downloaded, s.downloadBudget)*100,
+		s.uploaded/1024/1024, budgetUsed(s.uploaded, s.uploadBudget)*100)
+	sourceOpen, sourceIdle := j.sourceGmail.PoolStats()
+	targetOpen, targetIdle := j.targetGmail.PoolStats()
+	_, _ = fmt.Fprintf(&b, "Connections: source %d open (%d idle), target %d open (%d idle)\n", sourceOpen, sourceIdle, targetOpen, targetIdle)
+	_, _ = fmt.Fprintf(&b, "Throttling:  %s\n\n", s.throttle)
+
+	nameWidth := 0
+	for _, mailbox := range j.sourceMailboxes {
+		nameWidth = max(nameWidth, len(mailbox))
+	}
+	nameWidth = min(nameWidth, max(width-tuiBarWidth-30, 10))
+	for _, mailbox := range j.sourceMailboxes {
+		p := j.progress[mailbox]
+		done, total := p.done.Load(), max(p.collected.Load(), p.matched.Load())
+		_, _ = fmt.Fprintf(&b, "%-*s %s %d/%d\n", nameWidth, fitWidth(mailbox, nameWidth), progressBar(done, total, tuiBarWidth), done, total)
+	}
+
+	if len(errs) > 0 {
+		b.WriteString("\nRecent errors:\n")
+		for _, e := range errs {
+			b.WriteString(fitWidth(e, width) + "\n")
+		}
+	}
+	fmt.Print(b.String())
+}
+
+// progressBar renders the progress of done out of total as a bar of the given width, followed by its percentage.
+func progressBar(done, total uint64, width int) string {
+	fraction := 0.0
+	if total > 0 {
+		fraction = min(float64(done)/float64(total), 1)
+	}
+	filled := int(fraction * float64(width))
+	return fmt.Sprintf("[%s%s] %5.1f%%", strings.Repeat("#", filled), strings.Repeat("-", width-filled), fraction*100)
+}
+
+// fitWidth truncates the given line to the given width, marking it as truncated.
+func fitWidth(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) <= width {
+		return line
+	}
+	return string(runes[:max(width-1, 0)]) + "…"
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+)
+
+// mirrorConfigPollInterval is how often the mirror checks its configuration file for changes.
+const mirrorConfigPollInterval = 10 * time.Second
+
+// workerLimit limits the number of workers per lane migrating messages, and may be changed while they run (e.g. when
+// configuration is reloaded). Workers beyond the limit finish their current message, and then wait for the limit to
+// rise. A nil workerLimit is valid, and never limits workers.
+type workerLimit struct {
+	mu      sync.Mutex
+	limit   int           // zero means unlimited
+	changed chan struct{} // closed (and replaced) whenever the limit changes
+}
+
+func newWorkerLimit() *workerLimit {
+	return &workerLimit{changed: make(chan struct{})}
+}
+
+// Set changes the number of workers per lane that may migrate messages (zero means all of them).
+func (l *workerLimit) Set(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit == l.limit {
+		return
+	}
+	l.limit = limit
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Wait waits until the given worker (numbered from 0 within its lane) is within the limit.
+func (l *workerLimit) Wait(ctx context.Context, worker int) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		limit, changed := l.limit, l.changed
+		l.mu.Unlock()
+		if limit == 0 || worker < limit {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// mirrorRateLimits are the IMAP rate limits of an account (zero means unlimited).
+type mirrorRateLimits struct {
+	CommandsPerMinute int `json:"commandsPerMinute"`
+	BytesPerMinute    int `json:"bytesPerMinute"`
+}
+
+// mirrorTunables are the settings of the "mirror" command that may change while it runs, as loaded from the
+// MIRROR_CONFIG_PATH file, e.g.:
+//
+//	{
+//	  "freshness": "5m",
+//	  "workers": 4,
+//	  "source": {"commandsPerMinute": 600, "bytesPerMinute": 50000000},
+//	  "schedule": {"timezone": "Europe/London", "windows": [{"cron": "* 9-17 * * 1-5", "mode": "paused"}]}
+//	}
+//
+// The file is watched while the mirror runs, and changes are applied without restarting it: to the cycle in progress
+// (workers, rate limits & schedule) or to the following cycles (freshness & reconcile interval). Settings missing from
+// the file fall back to the command's flags and environment.
+type mirrorTunables struct {
+	// Freshness & ReconcileInterval override the -freshness & -reconcile-interval flags (e.g. "15m").
+	Freshness         string `json:"freshness,omitempty"`
+	ReconcileInterval string `json:"reconcileInterval,omitempty"`
+	// Workers is the number of workers per lane migrating messages (defaults to all of them).
+	Workers int `json:"workers,omitempty"`
+	// Source & Target override the IMAP rate limits of the accounts, given by the <prefix>_COMMANDS_PER_MINUTE &
+	// <prefix>_BYTES_PER_MINUTE environment variables.
+	Source *mirrorRateLimits `json:"source,omitempty"`
+	Target *mirrorRateLimits `json:"target,omitempty"`
+	// Schedule overrides the schedule of the SCHEDULE_PATH file (see migrationSchedule), e.g. for blackout windows.
+	Schedule *migrationSchedule `json:"schedule,omitempty"`
+
+	freshness         time.Duration
+	reconcileInterval time.Duration
+}
+
+// loadMirrorTunables loads the mirror's tunables from the given JSON file.
+func loadMirrorTunables(path string) (*mirrorTunables, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read mirror configuration file '%s': %w", errInvalidConfig, path, err)
+	}
+	// Unknown fields are rejected, so that misspelled settings are not silently ignored
+	t := &mirrorTunables{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(t); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse mirror configuration file '%s': %w", errInvalidConfig, path, err)
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{{"freshness", t.Freshness, &t.freshness}, {"reconcile interval", t.ReconcileInterval, &t.reconcileInterval}} {
+		if d.value == "" {
+			continue
+		} else if *d.into, err = time.ParseDuration(d.value); err != nil {
+			return nil, fmt.Errorf("%w: invalid %s in '%s': %w", errInvalidConfig, d.name, path, err)
+		} else if *d.into <= 0 {
+			return nil, fmt.Errorf("%w: %s in '%s' must be positive", errInvalidConfig, d.name, path)
+		}
+	}
+	if t.Workers < 0 {
+		return nil, fmt.Errorf("%w: workers in '%s' must not be negative", errInvalidConfig, path)
+	}
+	for name, limits := range map[string]*mirrorRateLimits{"source": t.Source, "target": t.Target} {
+		if limits != nil && (limits.CommandsPerMinute < 0 || limits.BytesPerMinute < 0) {
+			return nil, fmt.Errorf("%w: %s rate limits in '%s' must not be negative", errInvalidConfig, name, path)
+		}
+	}
+	if t.Schedule != nil {
+		if err := t.Schedule.prepare(path); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// rateLimits returns the rate limits of the account of the given prefix: those of the given tunables if set, and
+// otherwise those configured by the environment.
+func (l *mirrorRateLimits) rateLimits(prefix string) (commandsPerMinute, bytesPerMinute int, err error) {
+	if l != nil {
+		return l.CommandsPerMinute, l.BytesPerMinute, nil
+	}
+	return rateLimitsFromEnv(prefix)
+}
+
+// watchConfig reloads the mirror's configuration file whenever it changes (or on SIGHUP), until the given context is
+// done. Invalid configurations are reported and ignored, keeping the current one in effect.
+func (m *mirror) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(mirrorConfigPollInterval)
+	defer ticker.Stop()
+
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(m.configPath); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Reloading mirror configuration on SIGHUP", "path", m.configPath)
+		case <-ticker.C:
+			info, err := os.Stat(m.configPath)
+			if err != nil {
+				slog.Warn("Failed to check mirror configuration file", "err", err, "path", m.configPath)
+				continue
+			} else if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			slog.Info("Mirror configuration file changed, reloading", "path", m.configPath)
+		}
+		t, err := loadMirrorTunables(m.configPath)
+		if err != nil {
+			slog.Warn("Invalid mirror configuration, keeping the current one", "err", err)
+			continue
+		}
+		if err := m.apply(t); err != nil {
+			slog.Warn("Failed to apply mirror configuration", "err", err)
+			continue
+		}
+		slog.Info("Mirror configuration reloaded", "freshness", t.Freshness, "reconcileInterval", t.ReconcileInterval, "workers", t.Workers)
+	}
+}
+
+// apply puts the given tunables into effect: for the mirror itself, and for the cycle in progress (if any).
+func (m *mirror) apply(t *mirrorTunables) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := applyRateLimits(t, m.source, m.job); err != nil {
+		return err
+	}
+	m.tunables = t
+	m.freshness = cmp.Or(t.freshness, m.defaultFreshness)
+	m.reconcileInterval = cmp.Or(t.reconcileInterval, m.defaultReconcileInterval)
+	m.workers.Set(t.Workers)
+	m.schedule.update(cmp.Or(t.Schedule, m.defaultSchedule))
+	return nil
+}
+
+// applyRateLimits sets the rate limits of the given tunables on the given source pool, and on the pools of the given
+// job (if not nil).
+func applyRateLimits(t *mirrorTunables, source *gcp.ReadOnlyGmail, job *WorkerJob) error {
+	sourceCommands, sourceBytes, err := t.Source.rateLimits("SOURCE")
+	if err != nil {
+		return err
+	}
+	targetCommands, targetBytes, err := t.Target.rateLimits("TARGET")
+	if err != nil {
+		return err
+	}
+	source.SetRateLimits(sourceCommands, sourceBytes)
+	if job != nil {
+		job.sourceGmail.SetRateLimits(sourceCommands, sourceBytes)
+		job.targetGmail.SetRateLimits(targetCommands, targetBytes)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/httpretry"
+	"github.com/arikkfir-org/gmail-organizer/internal/version"
+)
+
+const versionCheckTimeout = 10 * time.Second
+
+// versionCheckClient queries GitHub for releases, honoring its rate-limiting hints.
+var versionCheckClient = httpretry.NewClient("github", 0)
+
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	check := fs.Bool("check", false, "Check for newer versions, and whether this version is known to be bad")
+	// -check is not bound to an environment variable, since VERSION_CHECK disables checks rather than requesting them
+	if !parseFlags(fs, args, nil) {
+		return exitUsage
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if !*check {
+		_ = enc.Encode(version.Get())
+		return exitOK
+	} else if !lookupEnvBool("VERSION_CHECK", true) {
+		slog.Error("Version check is disabled by the VERSION_CHECK environment variable")
+		return exitFailure
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), versionCheckTimeout)
+	defer cancel()
+	result, err := version.Check(ctx, versionCheckClient)
+	if err != nil {
+		slog.Error("Version check failed", "err", err)
+		return exitCodeOf(err)
+	}
+	_ = enc.Encode(result)
+	logVersionCheckResult(result)
+	if result.KnownBad {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// checkVersion checks the running version in the background of a run, warning if it is outdated or known to be bad.
+// Failures are only logged, and the check can be disabled with VERSION_CHECK=false (e.g. in air-gapped environments).
+func checkVersion(ctx context.Context) {
+	if !lookupEnvBool("VERSION_CHECK", true) || version.Version == "dev" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, versionCheckTimeout)
+	defer cancel()
+	result, err := version.Check(ctx, versionCheckClient)
+	if err != nil {
+		slog.Debug("Version check failed", "err", err)
+		return
+	}
+	logVersionCheckResult(result)
+}
+
+func logVersionCheckResult(result *version.CheckResult) {
+	if result.KnownBad {
+		slog.Warn("This version is known to be bad, please upgrade", "version", result.Current, "reason", result.KnownBadReason, "latest", result.Latest)
+	} else if result.UpdateAvailable {
+		slog.Warn("A newer version is available", "version", result.Current, "latest", result.Latest)
+	}
+}
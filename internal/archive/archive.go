@@ -0,0 +1,267 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/maildate"
+	"github.com/emersion/go-imap"
+)
+
+// Message is a single message stored in (or read from) a local archive.
+type Message struct {
+	Raw          []byte
+	Flags        []string
+	Labels       []string
+	InternalDate time.Time
+}
+
+// Writer writes messages into a local archive.
+type Writer interface {
+	Write(msg *Message) error
+	Close() error
+}
+
+// Reader reads messages from a local archive, one by one. Next returns io.EOF when there are no more messages.
+type Reader interface {
+	Next() (*Message, error)
+	Close() error
+}
+
+// Header returns the (unfolded) value of the first header of the message with the given name, or an empty string if
+// the message has no such header.
+func (m *Message) Header(name string) string {
+	return headerValue(m.Raw, name)
+}
+
+// RemoveHeaders removes all headers with the given names from the message.
+func (m *Message) RemoveHeaders(names ...string) {
+	m.Raw = withoutHeaders(m.Raw, names...)
+}
+
+// Open opens the archive at the given path for reading, detecting its format: a directory with a "cur" subdirectory
+// is read as a Maildir, any other directory as a collection of .eml files (recursively), a .eml file as a single
+// message, and any other file as an mbox file.
+func Open(path string) (Reader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive '%s': %w", path, err)
+	}
+	if info.IsDir() {
+		if cur, err := os.Stat(filepath.Join(path, "cur")); err == nil && cur.IsDir() {
+			return NewMaildirReader(path)
+		}
+		return NewEMLReader(path)
+	} else if strings.EqualFold(filepath.Ext(path), ".eml") {
+		return NewEMLReader(path)
+	}
+	return NewMboxReader(path)
+}
+
+// ParseMessage creates a message from the given raw message, as stored in an archive (or fetched from a mail server):
+// flags & labels are parsed from the archive headers (which are then removed), and line endings are converted to CRLF.
+// If the given date is zero (or otherwise implausible), the date of the message's "Received" or "Date" header is used
+// instead (see maildate.Resolve).
+func ParseMessage(raw []byte, date time.Time) *Message {
+	msg := &Message{InternalDate: date}
+	if status := headerValue(raw, StatusHeader); status != "" {
+		msg.Flags = mboxFlags(status, headerValue(raw, XStatusHeader))
+	}
+	msg.Labels = splitLabels(headerValue(raw, KeywordsHeader))
+	msg.Raw = toCRLF(withoutHeaders(raw, archiveHeaders...))
+	if !maildate.Valid(msg.InternalDate) {
+		msg.InternalDate = time.Time{}
+		if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			if t, _, ok := maildate.Resolve(m.Header); ok {
+				msg.InternalDate = t
+			}
+		}
+	}
+	return msg
+}
+
+const (
+	// KeywordsHeader carries the message's labels, as used by several mail clients & servers (e.g. Dovecot).
+	KeywordsHeader = "X-Keywords"
+
+	// GmailLabelsHeader carries the message's labels in Google Takeout exports.
+	GmailLabelsHeader = "X-Gmail-Labels"
+
+	// StatusHeader and XStatusHeader carry the message's flags in mbox files (as used by mutt, Thunderbird & others).
+	StatusHeader  = "Status"
+	XStatusHeader = "X-Status"
+)
+
+// archiveHeaders are headers added to messages by archive writers, and stripped from messages read by archive readers.
+var archiveHeaders = []string{KeywordsHeader, StatusHeader, XStatusHeader}
+
+// withHeaders returns the given raw message, with the given headers prepended to its existing headers. Existing
+// headers with the same names are removed, so that writing a message read from an archive does not duplicate them.
+func withHeaders(raw []byte, headers [][2]string) []byte {
+	var names []string
+	for _, h := range headers {
+		names = append(names, h[0])
+	}
+	raw = withoutHeaders(raw, names...)
+
+	var b bytes.Buffer
+	for _, h := range headers {
+		if h[1] != "" {
+			b.WriteString(h[0] + ": " + h[1] + "\r\n")
+		}
+	}
+	b.Write(raw)
+	return b.Bytes()
+}
+
+// withoutHeaders returns the given raw message without any of the given headers (including their continuation lines).
+func withoutHeaders(raw []byte, names ...string) []byte {
+	var out bytes.Buffer
+	skipping := false
+	rest := raw
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			// End of headers - copy the rest of the message as-is
+			out.Write(line)
+			out.Write(rest)
+			break
+		} else if line[0] == ' ' || line[0] == '\t' {
+			if !skipping {
+				out.Write(line)
+			}
+			continue
+		}
+		name, _, _ := bytes.Cut(trimmed, []byte(":"))
+		skipping = slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, string(name)) })
+		if !skipping {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
+
+// headerValue returns the (unfolded) value of the first header with the given name in the given raw message.
+func headerValue(raw []byte, name string) string {
+	var value []byte
+	found := false
+	rest := raw
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			break
+		} else if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if found {
+				value = append(value, trimmed...)
+			}
+			continue
+		} else if found {
+			break
+		}
+		if n, v, ok := bytes.Cut(trimmed, []byte(":")); ok && strings.EqualFold(string(n), name) {
+			found = true
+			value = append(value, bytes.TrimSpace(v)...)
+		}
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// splitLabels splits a comma-separated list of labels.
+func splitLabels(s string) []string {
+	var labels []string
+	for _, label := range strings.Split(s, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// SplitTakeoutLabels splits the value of an "X-Gmail-Labels" header of a Google Takeout export. Labels are separated by
+// commas, and labels that contain commas are quoted.
+func SplitTakeoutLabels(s string) []string {
+	var labels []string
+	var label strings.Builder
+	quoted := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			if l := strings.TrimSpace(label.String()); l != "" {
+				labels = append(labels, l)
+			}
+			label.Reset()
+		default:
+			label.WriteRune(c)
+		}
+	}
+	if l := strings.TrimSpace(label.String()); l != "" {
+		labels = append(labels, l)
+	}
+	return labels
+}
+
+// mboxStatus returns the values of the mbox "Status" and "X-Status" headers for the given IMAP flags.
+func mboxStatus(flags []string) (string, string) {
+	status, xStatus := "O", ""
+	if slices.Contains(flags, imap.SeenFlag) {
+		status = "RO"
+	}
+	if slices.Contains(flags, imap.AnsweredFlag) {
+		xStatus += "A"
+	}
+	if slices.Contains(flags, imap.FlaggedFlag) {
+		xStatus += "F"
+	}
+	if slices.Contains(flags, imap.DraftFlag) {
+		xStatus += "T"
+	}
+	if slices.Contains(flags, imap.DeletedFlag) {
+		xStatus += "D"
+	}
+	return status, xStatus
+}
+
+// mboxFlags returns the IMAP flags for the given values of the mbox "Status" and "X-Status" headers.
+func mboxFlags(status, xStatus string) []string {
+	var flags []string
+	if strings.Contains(status, "R") {
+		flags = append(flags, imap.SeenFlag)
+	}
+	for c, flag := range map[string]string{"A": imap.AnsweredFlag, "F": imap.FlaggedFlag, "T": imap.DraftFlag, "D": imap.DeletedFlag} {
+		if strings.Contains(xStatus, c) {
+			flags = append(flags, flag)
+		}
+	}
+	slices.Sort(flags)
+	return flags
+}
+
+// toLF converts CRLF line endings to LF.
+func toLF(raw []byte) []byte {
+	return bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+}
+
+// toCRLF converts LF line endings to CRLF, as required by IMAP.
+func toCRLF(raw []byte) []byte {
+	return bytes.ReplaceAll(toLF(raw), []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EMLReader reads messages from .eml files: either a single file, or all .eml files in a directory (recursively).
+// The internal date of each message is taken from its "Date" header, falling back to the file's modification time.
+type EMLReader struct {
+	paths []string
+}
+
+// NewEMLReader lists the .eml files at the given path for reading.
+func NewEMLReader(path string) (*EMLReader, error) {
+	r := &EMLReader{}
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".eml") {
+			r.paths = append(r.paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list .eml files in '%s': %w", path, err)
+	}
+	return r, nil
+}
+
+func (r *EMLReader) Next() (*Message, error) {
+	if len(r.paths) == 0 {
+		return nil, io.EOF
+	}
+	path := r.paths[0]
+	r.paths = r.paths[1:]
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message file '%s': %w", path, err)
+	}
+	msg := ParseMessage(raw, time.Time{})
+	if msg.InternalDate.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			msg.InternalDate = info.ModTime()
+		}
+	}
+	return msg, nil
+}
+
+func (r *EMLReader) Close() error {
+	return nil
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirFlags maps IMAP flags to Maildir info flags.
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// MaildirWriter writes messages into a Maildir directory, one file per message. Flags are stored in the file name's
+// info section (e.g. ":2,FS"), labels in an "X-Keywords" header, and the message's internal date as the file's
+// modification time.
+type MaildirWriter struct {
+	dir      string
+	hostname string
+	seq      atomic.Uint64
+}
+
+// NewMaildirWriter creates the given Maildir directory (and its "cur", "new" & "tmp" subdirectories) if necessary.
+func NewMaildirWriter(dir string) (*MaildirWriter, error) {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create Maildir directory '%s': %w", dir, err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// Slashes & colons are not allowed in Maildir file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &MaildirWriter{dir: dir, hostname: hostname}, nil
+}
+
+func (w *MaildirWriter) Write(msg *Message) error {
+	raw := toLF(withHeaders(msg.Raw, [][2]string{{KeywordsHeader, strings.Join(msg.Labels, ", ")}}))
+
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var info []byte
+	for _, flag := range msg.Flags {
+		if c, ok := maildirFlags[flag]; ok {
+			info = append(info, c)
+		}
+	}
+	slices.Sort(info)
+
+	name := fmt.Sprintf("%d.P%dQ%d.%s", date.Unix(), os.Getpid(), w.seq.Add(1), w.hostname)
+	tmpPath := filepath.Join(w.dir, "tmp", name)
+	curPath := filepath.Join(w.dir, "cur", name+":2,"+string(info))
+	if err := os.WriteFile(tmpPath, raw, 0o644); err != nil {
+		return fmt.Errorf("failed to write message file '%s': %w", tmpPath, err)
+	} else if err := os.Chtimes(tmpPath, date, date); err != nil {
+		return fmt.Errorf("failed to set times of message file '%s': %w", tmpPath, err)
+	} else if err := os.Rename(tmpPath, curPath); err != nil {
+		return fmt.Errorf("failed to move message file '%s' into place: %w", tmpPath, err)
+	}
+	return nil
+}
+
+func (w *MaildirWriter) Close() error {
+	return nil
+}
+
+// MaildirReader reads messages from a Maildir directory ("cur" and "new" subdirectories). Flags are parsed from the
+// file names' info section, and the internal date from the files' modification time.
+type MaildirReader struct {
+	paths []string
+}
+
+// NewMaildirReader lists the messages of the given Maildir directory for reading.
+func NewMaildirReader(dir string) (*MaildirReader, error) {
+	r := &MaildirReader{}
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to list Maildir directory '%s': %w", dir, err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				r.paths = append(r.paths, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *MaildirReader) Next() (*Message, error) {
+	if len(r.paths) == 0 {
+		return nil, io.EOF
+	}
+	path := r.paths[0]
+	r.paths = r.paths[1:]
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message file '%s': %w", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat message file '%s': %w", path, err)
+	}
+	msg := ParseMessage(raw, info.ModTime())
+	if _, flags, found := strings.Cut(filepath.Base(path), ":2,"); found {
+		for flag, c := range maildirFlags {
+			if strings.IndexByte(flags, c) >= 0 {
+				msg.Flags = append(msg.Flags, flag)
+			}
+		}
+		slices.Sort(msg.Flags)
+	}
+	return msg, nil
+}
+
+func (r *MaildirReader) Close() error {
+	return nil
+}
@@ -0,0 +1,182 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/compress"
+)
+
+// mboxDateLayouts are the date layouts found in mbox "From " lines, e.g. "Mon Jan  2 15:04:05 2006", or
+// "Mon Jan 02 15:04:05 -0700 2006" in Google Takeout exports.
+var mboxDateLayouts = []string{
+	time.ANSIC,
+	"Mon Jan 02 15:04:05 -0700 2006",
+	time.UnixDate,
+}
+
+// MboxWriter writes messages into an mbox file, in the "mboxrd" variant: "From " lines in message bodies are quoted
+// with a ">" (and already-quoted ones get another one), so they can be reliably unquoted when reading. Flags are
+// stored in "Status" & "X-Status" headers, and labels in an "X-Keywords" header.
+type MboxWriter struct {
+	f *os.File
+	z io.WriteCloser
+	w *bufio.Writer
+}
+
+// NewMboxWriter creates (or truncates) the given mbox file, compressing it with the given algorithm.
+func NewMboxWriter(path string, algorithm compress.Algorithm) (*MboxWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mbox file '%s': %w", path, err)
+	}
+	z, err := compress.NewWriter(f, algorithm)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &MboxWriter{f: f, z: z, w: bufio.NewWriter(z)}, nil
+}
+
+func (w *MboxWriter) Write(msg *Message) error {
+	status, xStatus := mboxStatus(msg.Flags)
+	raw := toLF(withHeaders(msg.Raw, [][2]string{
+		{StatusHeader, status},
+		{XStatusHeader, xStatus},
+		{KeywordsHeader, strings.Join(msg.Labels, ", ")},
+	}))
+
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	if _, err := fmt.Fprintf(w.w, "From MAILER-DAEMON %s\n", date.UTC().Format(time.ANSIC)); err != nil {
+		return fmt.Errorf("failed to write mbox separator: %w", err)
+	}
+
+	for line := range bytes.Lines(raw) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			if err := w.w.WriteByte('>'); err != nil {
+				return fmt.Errorf("failed to write message: %w", err)
+			}
+		}
+		if _, err := w.w.Write(line); err != nil {
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		if err := w.w.WriteByte('\n'); err != nil {
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+	if err := w.w.WriteByte('\n'); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+func (w *MboxWriter) Close() error {
+	if err := w.w.Flush(); err != nil {
+		_ = w.f.Close()
+		return fmt.Errorf("failed to flush mbox file: %w", err)
+	} else if err := w.z.Close(); err != nil {
+		_ = w.f.Close()
+		return fmt.Errorf("failed to flush mbox file: %w", err)
+	}
+	return w.f.Close()
+}
+
+// MboxReader reads messages from an mbox file. Quoted "From " lines (">From ", ">>From " etc.) are unquoted, which
+// is correct for "mboxrd" files, and for "mboxo" files (e.g. Google Takeout exports) unless bodies contain lines that
+// were already quoted.
+type MboxReader struct {
+	f        *os.File
+	z        io.ReadCloser
+	r        *bufio.Reader
+	fromLine []byte
+}
+
+// NewMboxReader opens the given mbox file for reading, decompressing it if it is compressed.
+func NewMboxReader(path string) (*MboxReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mbox file '%s': %w", path, err)
+	}
+	z, err := compress.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to read mbox file '%s': %w", path, err)
+	}
+	r := &MboxReader{f: f, z: z, r: bufio.NewReader(z)}
+	line, err := r.r.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to read mbox file '%s': %w", path, err)
+	} else if len(line) > 0 && !bytes.HasPrefix(line, []byte("From ")) {
+		_ = f.Close()
+		return nil, fmt.Errorf("'%s' is not an mbox file", path)
+	}
+	r.fromLine = line
+	return r, nil
+}
+
+func (r *MboxReader) Next() (*Message, error) {
+	if len(r.fromLine) == 0 {
+		return nil, io.EOF
+	}
+	date := parseMboxFromLine(r.fromLine)
+	r.fromLine = nil
+
+	var raw bytes.Buffer
+	previousBlank := false
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if len(line) > 0 {
+			if previousBlank && bytes.HasPrefix(line, []byte("From ")) {
+				r.fromLine = line
+				break
+			}
+			if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+				line = line[1:]
+			}
+			raw.Write(line)
+			previousBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read mbox file: %w", err)
+		}
+	}
+
+	// Drop the blank line separating this message from the next one
+	b := bytes.TrimSuffix(raw.Bytes(), []byte("\n"))
+	b = bytes.TrimSuffix(b, []byte("\r"))
+	return ParseMessage(b, date), nil
+}
+
+func (r *MboxReader) Close() error {
+	_ = r.z.Close()
+	return r.f.Close()
+}
+
+// parseMboxFromLine returns the date of the given mbox "From " line, or zero if it cannot be parsed.
+func parseMboxFromLine(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range mboxDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/backup"
+	"github.com/arikkfir-org/gmail-organizer/internal/bigquery"
+)
+
+// Outcomes of migrating a message.
+const (
+	OutcomeAppended = "appended" // the message was appended to the target account
+	OutcomeUpdated  = "updated"  // the message was already in the target account, and its labels & flags were updated
+	OutcomeSkipped  = "skipped"  // the message was not migrated, and will not be on retries (see Record.Error)
+	OutcomeFailed   = "failed"   // the message failed to migrate (see Record.Error)
+)
+
+// Record is the audit record of migrating a single message.
+type Record struct {
+	Time          time.Time `json:"time" bigquery:"time"`
+	SourceMailbox string    `json:"sourceMailbox" bigquery:"sourceMailbox"`
+	SourceUID     uint32    `json:"sourceUID" bigquery:"sourceUID"`
+	TargetUID     uint32    `json:"targetUID,omitempty" bigquery:"targetUID"`
+	MessageID     string    `json:"messageID" bigquery:"messageID"`
+	SenderDomain  string    `json:"senderDomain,omitempty" bigquery:"senderDomain"`
+	Labels        []string  `json:"labels,omitempty" bigquery:"labels"` // labels applied in the target account
+	Bytes         uint32    `json:"bytes" bigquery:"bytes"`
+	DurationMS    int64     `json:"durationMs" bigquery:"durationMs"`
+	Outcome       string    `json:"outcome" bigquery:"outcome"`
+	Error         string    `json:"error,omitempty" bigquery:"error"`
+	DryRun        bool      `json:"dryRun,omitempty" bigquery:"dryRun"`
+}
+
+// Log records one JSON line per migrated message, separately from operational logging, for compliance and later
+// reconciliation. A nil Log is valid, and silently discards all records.
+type Log struct {
+	mu       sync.Mutex
+	w        io.WriteCloser
+	enc      *json.Encoder
+	uploaded chan error       // result of streaming the log to GCS (nil for local files)
+	table    *bigquery.Writer // set instead of the above for BigQuery tables
+}
+
+// Open opens an audit log at the given destination: a local file path (appended to), a "gs://bucket/object" URL
+// of a GCS object, which is streamed as records are added, and complete once the log is closed, or a
+// "bq://project.dataset.table" URL of a BigQuery table (created if missing), into which records are inserted as rows.
+// If the destination is empty, nil is returned.
+func Open(ctx context.Context, destination string) (*Log, error) {
+	if destination == "" {
+		return nil, nil
+	}
+
+	if table, ok := strings.CutPrefix(destination, "bq://"); ok {
+		w, err := bigquery.NewWriter(ctx, table, Record{})
+		if err != nil {
+			return nil, err
+		}
+		return &Log{table: w}, nil
+	}
+
+	location, ok := strings.CutPrefix(destination, "gs://")
+	if !ok {
+		f, err := os.OpenFile(destination, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log '%s': %w", destination, err)
+		}
+		return &Log{w: f, enc: json.NewEncoder(f)}, nil
+	}
+
+	bucketName, object, found := strings.Cut(location, "/")
+	if !found || bucketName == "" || object == "" {
+		return nil, fmt.Errorf("invalid GCS object URL '%s' (expected 'gs://bucket/object')", destination)
+	}
+	bucket, err := backup.NewGCSBucket(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The upload outlives cancellation of the run, so records of interrupted runs are kept too
+	r, w := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		defer func() { _ = bucket.Close() }()
+		err := bucket.Put(context.WithoutCancel(ctx), object, r)
+		_ = r.CloseWithError(err)
+		uploaded <- err
+	}()
+	return &Log{w: w, enc: json.NewEncoder(w), uploaded: uploaded}, nil
+}
+
+// Record appends the given record to the log.
+func (l *Log) Record(r Record) error {
+	if l == nil {
+		return nil
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+
+	if l.table != nil {
+		return l.table.Write(r)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(r); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log, waiting for its upload to complete (for GCS objects).
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	} else if l.table != nil {
+		return l.table.Close()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	} else if l.uploaded != nil {
+		if err := <-l.uploaded; err != nil {
+			return fmt.Errorf("failed to upload audit log: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+	"github.com/emersion/go-imap"
+)
+
+const fetchBatchSize = 100
+
+// Backup backs up the messages of the given mailbox into the given bucket, under the given prefix. Unless a full
+// backup is requested, only messages added since the previous backup (i.e. with UIDs above its last UID) are backed
+// up, as long as the mailbox's UIDVALIDITY has not changed since; otherwise, all messages are backed up. Each message
+// is stored as its own object, and a manifest describing the snapshot (UIDs, Message-IDs, labels & flags) is written
+// once all messages are stored. Returns the snapshot's manifest.
+//
+// Note that incremental snapshots do not capture label or flag changes of previously backed-up messages; take a full
+// backup periodically to capture those.
+func Backup(ctx context.Context, g *gcp.Gmail, bucket Storage, prefix, account, mailbox string, full bool) (*Manifest, error) {
+	state, err := loadState(ctx, bucket, prefix, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the messages to back up
+	manifest := &Manifest{Time: time.Now().UTC(), Account: account, Mailbox: mailbox}
+	var uids []uint32
+	err = g.WithSession(ctx, mailbox, func(sess *gcp.Session) error {
+		manifest.UIDValidity = sess.Status().UidValidity
+		criteria := imap.NewSearchCriteria()
+		if !full && state != nil && state.UIDValidity == manifest.UIDValidity {
+			manifest.Incremental = true
+			manifest.Previous = state.LastManifest
+			criteria.Uid = new(imap.SeqSet)
+			criteria.Uid.AddRange(state.LastUID+1, 0)
+		} else if state != nil && !full {
+			slog.Warn("Mailbox UIDVALIDITY changed since last backup, taking a full backup", "mailbox", mailbox, "previous", state.UIDValidity, "current", manifest.UIDValidity)
+		}
+		var err error
+		uids, err = sess.Search(criteria)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find messages to back up: %w", err)
+	}
+	if manifest.Incremental {
+		// A "<n>:*" UID range always matches the last message, even when its UID is below n
+		uids = slices.DeleteFunc(uids, func(uid uint32) bool { return uid <= state.LastUID })
+		manifest.LastUID = state.LastUID
+	}
+	slices.Sort(uids)
+	slog.Info("Backing up messages", "mailbox", mailbox, "messages", len(uids), "incremental", manifest.Incremental)
+
+	// Store messages
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, gcp.GmailLabelsExt, gcp.GmailMsgIDExt}
+	for chunk := range slices.Chunk(uids, fetchBatchSize) {
+		err := g.FetchByUIDsStream(ctx, mailbox, chunk, items, func(msg *imap.Message) error {
+			entry, err := storeMessage(ctx, bucket, prefix, manifest, msg, section, !manifest.Incremental)
+			if err != nil {
+				return err
+			}
+			manifest.Entries = append(manifest.Entries, *entry)
+			manifest.LastUID = max(manifest.LastUID, msg.Uid)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up messages: %w", err)
+		}
+		slog.Info("Backed up messages", "mailbox", mailbox, "backedUp", len(manifest.Entries), "total", len(uids))
+	}
+
+	// Write the manifest, and only then advance the state
+	name := manifestObject(prefix, mailbox, manifest.Time)
+	if err := putJSON(ctx, bucket, name, manifest); err != nil {
+		return nil, err
+	}
+	newState := &State{UIDValidity: manifest.UIDValidity, LastUID: manifest.LastUID, LastManifest: name}
+	if err := putJSON(ctx, bucket, stateObject(prefix, mailbox), newState); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// storeMessage stores the body of the given message in its own object, and returns its manifest entry. If skipExisting
+// is true, the body is not stored again if its object already exists (e.g. from a previous full backup).
+func storeMessage(ctx context.Context, bucket Storage, prefix string, manifest *Manifest, msg *imap.Message, section *imap.BodySectionName, skipExisting bool) (*Entry, error) {
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return nil, fmt.Errorf("server did not provide body of message '%d'", msg.Uid)
+	}
+	gmailMessageID, err := gcp.GetGmailMessageID(msg)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := gcp.GetLabels(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gmail message IDs are unique & stable across mailboxes; otherwise fall back to the mailbox-scoped UID
+	id := strconv.FormatUint(gmailMessageID, 10)
+	if gmailMessageID == 0 {
+		id = fmt.Sprintf("%d-%d", manifest.UIDValidity, msg.Uid)
+	}
+	entry := &Entry{
+		UID:            msg.Uid,
+		GmailMessageID: gmailMessageID,
+		Labels:         labels,
+		Flags:          msg.Flags,
+		InternalDate:   msg.InternalDate,
+		Size:           literal.Len(),
+		Object:         messageObject(prefix, id),
+	}
+	if msg.Envelope != nil {
+		entry.MessageID = msg.Envelope.MessageId
+	}
+
+	if skipExisting {
+		if exists, err := bucket.Exists(ctx, entry.Object); err != nil {
+			return nil, err
+		} else if exists {
+			return entry, nil
+		}
+	}
+	if err := bucket.Put(ctx, entry.Object, literal); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// loadState loads the latest backup state of the given mailbox, or nil if it was never backed up.
+func loadState(ctx context.Context, bucket Storage, prefix, mailbox string) (*State, error) {
+	state := &State{}
+	if err := getJSON(ctx, bucket, stateObject(prefix, mailbox), state); errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// LoadManifest loads the manifest stored in the given object.
+func LoadManifest(ctx context.Context, bucket Storage, name string) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := getJSON(ctx, bucket, name, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func putJSON(ctx context.Context, bucket Storage, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode '%s': %w", name, err)
+	}
+	return bucket.Put(ctx, name, bytes.NewReader(b))
+}
+
+func getJSON(ctx context.Context, bucket Storage, name string, v any) error {
+	r, err := bucket.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read '%s': %w", name, err)
+	} else if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to decode '%s': %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/compress"
+)
+
+// CompressedStorage compresses objects before storing them in the underlying storage, and decompresses them when
+// read. Decompression is based on the content itself, so objects stored uncompressed (or with another algorithm)
+// remain readable. When combined with encryption, compression must wrap the encrypted storage, since encrypted data
+// does not compress.
+type CompressedStorage struct {
+	Storage
+	algorithm compress.Algorithm
+	stats     compress.Stats
+}
+
+// NewCompressedStorage compresses objects of the given storage with the given algorithm.
+func NewCompressedStorage(s Storage, algorithm compress.Algorithm) *CompressedStorage {
+	return &CompressedStorage{Storage: s, algorithm: algorithm}
+}
+
+func (s *CompressedStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read content of object '%s': %w", name, err)
+	}
+	compressed, err := compress.Compress(data, s.algorithm)
+	if err != nil {
+		return fmt.Errorf("failed to compress object '%s': %w", name, err)
+	}
+	if err := s.Storage.Put(ctx, name, bytes.NewReader(compressed)); err != nil {
+		return err
+	}
+	s.stats.Add(int64(len(data)), int64(len(compressed)))
+	return nil
+}
+
+func (s *CompressedStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := s.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	zr, err := compress.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress object '%s': %w", name, err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress object '%s': %w", name, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Stats returns the sizes of the objects stored so far, before and after compression.
+func (s *CompressedStorage) Stats() *compress.Stats {
+	return &s.stats
+}
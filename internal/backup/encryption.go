@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// encryptedMagic prefixes encrypted objects. It is followed by the length of the wrapped data key (a big-endian
+// uint16; zero when the key is used directly), the wrapped data key, the nonce, and the AES-256-GCM ciphertext.
+var encryptedMagic = []byte("GMOENC1\n")
+
+// KeySize is the size of AES-256 keys.
+const KeySize = 32
+
+// KeyWrapper wraps and unwraps data keys with a key held by a key management service.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, key []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// EncryptedStorage encrypts objects (messages, manifests & state) with AES-256-GCM on the client side before storing
+// them in the underlying storage, so their content is unreadable to the owner of the bucket. Objects are encrypted
+// either with a user-supplied key, or with a random data key generated once per EncryptedStorage and wrapped by a KMS
+// key; the wrapped data key is stored in each object, so objects remain readable as long as the KMS key is.
+type EncryptedStorage struct {
+	Storage
+	wrapper    KeyWrapper
+	aead       cipher.AEAD
+	wrappedKey []byte
+	mu         sync.Mutex
+	unwrapped  map[string]cipher.AEAD
+}
+
+// NewKeyEncryptedStorage encrypts objects of the given storage with the given AES-256 key.
+func NewKeyEncryptedStorage(s Storage, key []byte) (*EncryptedStorage, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStorage{Storage: s, aead: aead}, nil
+}
+
+// NewWrappedKeyEncryptedStorage encrypts objects of the given storage with a random data key, wrapped by the given
+// key wrapper.
+func NewWrappedKeyEncryptedStorage(ctx context.Context, s Storage, wrapper KeyWrapper) (*EncryptedStorage, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := wrapper.Wrap(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	} else if len(wrappedKey) > 0xFFFF {
+		return nil, fmt.Errorf("wrapped data key is too large (%d bytes)", len(wrappedKey))
+	}
+	return &EncryptedStorage{
+		Storage:    s,
+		wrapper:    wrapper,
+		aead:       aead,
+		wrappedKey: wrappedKey,
+		unwrapped:  map[string]cipher.AEAD{string(wrappedKey): aead},
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// Put encrypts the given content and stores it in the given object. The object name is bound to the ciphertext as
+// additional data, so objects cannot be swapped undetected.
+func (s *EncryptedStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read content of object '%s': %w", name, err)
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(encryptedMagic)+2+len(s.wrappedKey)+len(nonce)+len(plaintext)+s.aead.Overhead()))
+	buf.Write(encryptedMagic)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(s.wrappedKey)))
+	buf.Write(s.wrappedKey)
+	buf.Write(nonce)
+	buf.Write(s.aead.Seal(nil, nonce, plaintext, []byte(name)))
+	return s.Storage.Put(ctx, name, buf)
+}
+
+// Get reads and decrypts the given object.
+func (s *EncryptedStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := s.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object '%s': %w", name, err)
+	}
+
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return nil, fmt.Errorf("object '%s' is not encrypted", name)
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < 2 {
+		return nil, fmt.Errorf("object '%s' is truncated", name)
+	}
+	wrappedKeyLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < wrappedKeyLen {
+		return nil, fmt.Errorf("object '%s' is truncated", name)
+	}
+	aead, err := s.aeadFor(ctx, data[:wrappedKeyLen])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object '%s': %w", name, err)
+	}
+	data = data[wrappedKeyLen:]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("object '%s' is truncated", name)
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object '%s': %w", name, err)
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), nil
+}
+
+// Close closes the underlying storage, and the key wrapper if it holds resources (e.g. a KMS client).
+func (s *EncryptedStorage) Close() error {
+	err := s.Storage.Close()
+	if c, ok := s.wrapper.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+// aeadFor returns the cipher for objects encrypted with the given wrapped data key (or with the user-supplied key, if
+// empty), unwrapping it on first use.
+func (s *EncryptedStorage) aeadFor(ctx context.Context, wrappedKey []byte) (cipher.AEAD, error) {
+	if len(wrappedKey) == 0 {
+		if s.wrapper != nil {
+			return nil, errors.New("object was encrypted with a user-supplied key, but a KMS key is configured")
+		}
+		return s.aead, nil
+	} else if s.wrapper == nil {
+		return nil, errors.New("object was encrypted with a KMS key, but a user-supplied key is configured")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if aead, ok := s.unwrapped[string(wrappedKey)]; ok {
+		return aead, nil
+	}
+	key, err := s.wrapper.Unwrap(ctx, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	s.unwrapped[string(wrappedKey)] = aead
+	return aead, nil
+}
+
+// CloudKMSKeyWrapper wraps data keys with a Google Cloud KMS symmetric key.
+type CloudKMSKeyWrapper struct {
+	client *kms.KeyManagementClient
+	key    string
+}
+
+// NewCloudKMSKeyWrapper creates a key wrapper using the given Cloud KMS key, referenced by its resource name, e.g.
+// "projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>".
+func NewCloudKMSKeyWrapper(ctx context.Context, key string) (*CloudKMSKeyWrapper, error) {
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %w", err)
+	}
+	return &CloudKMSKeyWrapper{client: client, key: key}, nil
+}
+
+func (w *CloudKMSKeyWrapper) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	res, err := w.client.Encrypt(ctx, &kmspb.EncryptRequest{Name: w.key, Plaintext: key})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with KMS key '%s': %w", w.key, err)
+	}
+	return res.Ciphertext, nil
+}
+
+func (w *CloudKMSKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	res, err := w.client.Decrypt(ctx, &kmspb.DecryptRequest{Name: w.key, Ciphertext: wrapped})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with KMS key '%s': %w", w.key, err)
+	}
+	return res.Plaintext, nil
+}
+
+func (w *CloudKMSKeyWrapper) Close() error {
+	return w.client.Close()
+}
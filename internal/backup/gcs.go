@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCSBucket stores backups in a Google Cloud Storage bucket.
+type GCSBucket struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+// NewGCSBucket creates a GCS client for the given bucket, authenticating with application default credentials.
+func NewGCSBucket(ctx context.Context, bucket string) (*GCSBucket, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	return &GCSBucket{client: client, bucket: client.Bucket(bucket)}, nil
+}
+
+func (b *GCSBucket) Put(ctx context.Context, name string, r io.Reader) error {
+	w := b.bucket.Object(name).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to write object '%s': %w", name, err)
+	} else if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write object '%s': %w", name, err)
+	}
+	return nil
+}
+
+func (b *GCSBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := b.bucket.Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("failed to read object '%s': %w", name, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read object '%s': %w", name, err)
+	}
+	return r, nil
+}
+
+func (b *GCSBucket) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := b.bucket.Object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat object '%s': %w", name, err)
+	}
+	return true, nil
+}
+
+func (b *GCSBucket) Close() error {
+	return b.client.Close()
+}
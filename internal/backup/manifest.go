@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"net/url"
+	"path"
+	"time"
+)
+
+// Entry describes a single message in a backup snapshot.
+type Entry struct {
+	UID            uint32    `json:"uid"`
+	GmailMessageID uint64    `json:"gmailMessageID,omitempty"`
+	MessageID      string    `json:"messageID,omitempty"`
+	Labels         []string  `json:"labels,omitempty"`
+	Flags          []string  `json:"flags,omitempty"`
+	InternalDate   time.Time `json:"internalDate"`
+	Size           int       `json:"size"`
+	Object         string    `json:"object"`
+}
+
+// Manifest describes a single backup snapshot of a mailbox: either a full snapshot of all its messages, or an
+// incremental snapshot of the messages added since the previous snapshot.
+type Manifest struct {
+	Time        time.Time `json:"time"`
+	Account     string    `json:"account"`
+	Mailbox     string    `json:"mailbox"`
+	UIDValidity uint32    `json:"uidValidity"`
+	LastUID     uint32    `json:"lastUID"`
+	Incremental bool      `json:"incremental"`
+	Previous    string    `json:"previous,omitempty"`
+	Entries     []Entry   `json:"entries"`
+}
+
+// State is the latest backup state of a mailbox, used to determine which messages the next incremental snapshot
+// should include.
+type State struct {
+	UIDValidity  uint32 `json:"uidValidity"`
+	LastUID      uint32 `json:"lastUID"`
+	LastManifest string `json:"lastManifest"`
+}
+
+// Object names, relative to the backup prefix:
+//
+//	messages/<id>.eml                     raw message (content-addressed by Gmail message ID where available)
+//	manifests/<mailbox>/<timestamp>.json  snapshot manifests
+//	state/<mailbox>.json                  latest backup state of each mailbox
+const (
+	messagesDir  = "messages"
+	manifestsDir = "manifests"
+	stateDir     = "state"
+)
+
+func messageObject(prefix, id string) string {
+	return path.Join(prefix, messagesDir, id+".eml")
+}
+
+func manifestObject(prefix, mailbox string, t time.Time) string {
+	return path.Join(prefix, manifestsDir, url.PathEscape(mailbox), t.UTC().Format("20060102T150405Z")+".json")
+}
+
+func stateObject(prefix, mailbox string) string {
+	return path.Join(prefix, stateDir, url.PathEscape(mailbox)+".json")
+}
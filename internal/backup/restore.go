@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Filter selects the entries of a snapshot to restore. Zero fields match all entries.
+type Filter struct {
+	Label      string
+	Since      time.Time
+	Before     time.Time
+	MessageIDs []string
+}
+
+// Matches returns true if the given entry matches all criteria of the filter.
+func (f *Filter) Matches(e *Entry) bool {
+	if f.Label != "" && !slices.Contains(e.Labels, f.Label) {
+		return false
+	} else if !f.Since.IsZero() && e.InternalDate.Before(f.Since) {
+		return false
+	} else if !f.Before.IsZero() && !e.InternalDate.Before(f.Before) {
+		return false
+	} else if len(f.MessageIDs) > 0 && !slices.Contains(f.MessageIDs, e.MessageID) {
+		return false
+	}
+	return true
+}
+
+// LoadSnapshot returns the entries of the given snapshot manifest (or, if no manifest is given, of the latest snapshot
+// of the given mailbox), sorted by UID. Incremental snapshots are resolved by following their chain of previous
+// manifests back to the last full snapshot, so the result describes every message backed up as of that snapshot.
+func LoadSnapshot(ctx context.Context, bucket Storage, prefix, mailbox, manifestName string) ([]Entry, error) {
+	if manifestName == "" {
+		state, err := loadState(ctx, bucket, prefix, mailbox)
+		if err != nil {
+			return nil, err
+		} else if state == nil {
+			return nil, fmt.Errorf("mailbox '%s' was never backed up under '%s'", mailbox, prefix)
+		}
+		manifestName = state.LastManifest
+	}
+
+	// Walk back the chain; entries of more recent snapshots take precedence
+	entries := make(map[uint32]Entry)
+	for name := manifestName; name != ""; {
+		manifest, err := LoadManifest(ctx, bucket, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range manifest.Entries {
+			if _, found := entries[e.UID]; !found {
+				entries[e.UID] = e
+			}
+		}
+		if !manifest.Incremental {
+			break
+		}
+		name = manifest.Previous
+	}
+
+	result := make([]Entry, 0, len(entries))
+	for _, uid := range slices.Sorted(maps.Keys(entries)) {
+		result = append(result, entries[uid])
+	}
+	return result, nil
+}
+
+// ReadMessage returns the raw message stored for the given entry.
+func ReadMessage(ctx context.Context, bucket Storage, e *Entry) ([]byte, error) {
+	r, err := bucket.Get(ctx, e.Object)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", e.Object, err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize is the size of the parts of multipart uploads of objects whose size is not known upfront, which bounds
+// the memory used to buffer them.
+const s3PartSize = 16 * 1024 * 1024
+
+// S3Config configures a connection to an S3-compatible object store (e.g. AWS S3, MinIO or Backblaze B2).
+type S3Config struct {
+	Endpoint        string // host[:port] of the S3 API, e.g. "s3.amazonaws.com" or "s3.us-west-002.backblazeb2.com"
+	Region          string // bucket region; empty to detect it automatically
+	AccessKeyID     string // empty to use credentials from the AWS_* environment variables or the instance's IAM role
+	SecretAccessKey string
+	Insecure        bool // use plain HTTP, e.g. for a local MinIO server
+	PathStyle       bool // address buckets by path rather than by virtual host, as required by some MinIO setups
+}
+
+// S3Bucket stores backups in a bucket of an S3-compatible object store.
+type S3Bucket struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Bucket creates an S3 client for the given bucket.
+func NewS3Bucket(cfg S3Config, bucket string) (*S3Bucket, error) {
+	var creds *credentials.Credentials
+	if cfg.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !cfg.Insecure,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	return &S3Bucket{client: client, bucket: bucket}, nil
+}
+
+func (b *S3Bucket) Put(ctx context.Context, name string, r io.Reader) error {
+	size := int64(-1)
+	if l, ok := r.(interface{ Len() int }); ok {
+		size = int64(l.Len())
+	}
+	_, err := b.client.PutObject(ctx, b.bucket, name, r, size, minio.PutObjectOptions{PartSize: s3PartSize})
+	if err != nil {
+		return fmt.Errorf("failed to write object '%s': %w", name, err)
+	}
+	return nil
+}
+
+func (b *S3Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object '%s': %w", name, err)
+	}
+	// Objects are fetched lazily; stat the object to surface a missing object here rather than on the first read
+	if _, err := obj.Stat(); isS3NotFound(err) {
+		_ = obj.Close()
+		return nil, fmt.Errorf("failed to read object '%s': %w", name, ErrNotFound)
+	} else if err != nil {
+		_ = obj.Close()
+		return nil, fmt.Errorf("failed to read object '%s': %w", name, err)
+	}
+	return obj, nil
+}
+
+func (b *S3Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := b.client.StatObject(ctx, b.bucket, name, minio.StatObjectOptions{})
+	if isS3NotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat object '%s': %w", name, err)
+	}
+	return true, nil
+}
+
+func (b *S3Bucket) Close() error {
+	return nil
+}
+
+// isS3NotFound returns true if the given error is an S3 "no such key" error.
+func isS3NotFound(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == minio.NoSuchKey
+}
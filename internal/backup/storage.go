@@ -0,0 +1,26 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when a requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Storage is an object store holding backups, e.g. a GCS or S3 bucket.
+type Storage interface {
+
+	// Put writes the given content into the given object, replacing it if it exists.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get opens the given object for reading. Returns ErrNotFound if the object does not exist.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Exists returns true if the given object exists.
+	Exists(ctx context.Context, name string) (bool, error)
+
+	// Close releases the resources held by the storage client.
+	Close() error
+}
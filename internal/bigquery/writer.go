@@ -0,0 +1,140 @@
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	insertBatchSize = 500
+	flushInterval   = 10 * time.Second
+	insertTimeout   = time.Minute
+)
+
+// Writer streams rows into a BigQuery table. Rows are inserted in batches: whenever enough rows accumulate, every few
+// seconds, and when the writer is closed.
+type Writer struct {
+	client   *bq.Client
+	inserter *bq.Inserter
+	name     string
+	mu       sync.Mutex
+	rows     []any
+	err      error // first failure of a periodic flush, returned by the next write
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewWriter creates a writer of rows of the given sample's type (a struct, optionally with "bigquery" field tags) into
+// the given table ("project.dataset.table"), authenticating with application default credentials. If the table does
+// not exist, it is created with the schema inferred from the sample.
+func NewWriter(ctx context.Context, table string, sample any) (*Writer, error) {
+	project, rest, _ := strings.Cut(table, ".")
+	dataset, name, _ := strings.Cut(rest, ".")
+	if project == "" || dataset == "" || name == "" || strings.Contains(name, ".") {
+		return nil, fmt.Errorf("invalid BigQuery table '%s' (expected 'project.dataset.table')", table)
+	}
+
+	client, err := bq.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %w", err)
+	}
+	t := client.Dataset(dataset).Table(name)
+	if _, err := t.Metadata(ctx); err != nil {
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+			_ = client.Close()
+			return nil, fmt.Errorf("failed to get BigQuery table '%s': %w", table, err)
+		}
+		schema, err := bq.InferSchema(sample)
+		if err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("failed to infer schema of BigQuery table '%s': %w", table, err)
+		} else if err := t.Create(ctx, &bq.TableMetadata{Schema: schema}); err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("failed to create BigQuery table '%s': %w", table, err)
+		}
+		slog.Info("Created BigQuery table", "table", table)
+	}
+
+	w := &Writer{
+		client:   client,
+		inserter: t.Inserter(),
+		name:     table,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go w.flushPeriodically()
+	return w, nil
+}
+
+// Write queues the given row for insertion, inserting the queued rows if enough have accumulated.
+func (w *Writer) Write(row any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.err; err != nil {
+		w.err = nil
+		return err
+	}
+	w.rows = append(w.rows, row)
+	if len(w.rows) >= insertBatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush inserts the queued rows. The caller must hold the writer's lock.
+func (w *Writer) flush() error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), insertTimeout)
+	defer cancel()
+	rows := w.rows
+	w.rows = nil
+	if err := w.inserter.Put(ctx, rows); err != nil {
+		return fmt.Errorf("failed to insert %d rows into BigQuery table '%s': %w", len(rows), w.name, err)
+	}
+	return nil
+}
+
+// flushPeriodically inserts queued rows at a fixed interval, until the writer is closed.
+func (w *Writer) flushPeriodically() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if err := w.flush(); err != nil && w.err == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Close inserts the remaining queued rows, and closes the writer.
+func (w *Writer) Close() error {
+	close(w.stop)
+	<-w.stopped
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := errors.Join(w.err, w.flush())
+	if closeErr := w.client.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close BigQuery client: %w", closeErr))
+	}
+	return err
+}
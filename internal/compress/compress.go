@@ -0,0 +1,145 @@
+// Package compress compresses message archives & backups with gzip or zstd, and transparently decompresses them based
+// on their magic bytes, so readers need not know how (or whether) their input was compressed.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm is a compression algorithm.
+type Algorithm string
+
+const (
+	None Algorithm = "none"
+	Gzip Algorithm = "gzip"
+	Zstd Algorithm = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseAlgorithm parses the given algorithm name; an empty name means no compression.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch a := Algorithm(name); a {
+	case "":
+		return None, nil
+	case None, Gzip, Zstd:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown compression algorithm '%s' (expected 'none', 'gzip' or 'zstd')", name)
+	}
+}
+
+// Extension returns the file name extension of the algorithm, e.g. ".zst" (or an empty string for None).
+func (a Algorithm) Extension() string {
+	switch a {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// NewWriter returns a writer compressing into the given writer with the given algorithm. Closing it flushes the
+// compressed stream, but does not close the given writer.
+func NewWriter(w io.Writer, a Algorithm) (io.WriteCloser, error) {
+	switch a {
+	case None, "":
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm '%s'", a)
+	}
+}
+
+// NewReader returns a reader decompressing the given reader, detecting the algorithm by its magic bytes. Input that
+// is not compressed is returned as-is. Closing the reader does not close the given reader.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip stream: %w", err)
+		}
+		return gr, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd stream: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// Compress compresses the given data with the given algorithm.
+func Compress(data []byte, a Algorithm) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, a)
+	if err != nil {
+		return nil, err
+	} else if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	} else if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Stats accumulates the sizes of data before and after compression. It is safe for concurrent use.
+type Stats struct {
+	raw        atomic.Int64
+	compressed atomic.Int64
+}
+
+// Add records the given sizes of data before and after compression.
+func (s *Stats) Add(raw, compressed int64) {
+	s.raw.Add(raw)
+	s.compressed.Add(compressed)
+}
+
+// Raw returns the total size of the data before compression.
+func (s *Stats) Raw() int64 {
+	return s.raw.Load()
+}
+
+// Compressed returns the total size of the data after compression.
+func (s *Stats) Compressed() int64 {
+	return s.compressed.Load()
+}
+
+// Ratio returns the compression ratio (e.g. 4 when data compressed to a quarter of its size), or 1 if no data was
+// recorded.
+func (s *Stats) Ratio() float64 {
+	if s.compressed.Load() == 0 {
+		return 1
+	}
+	return float64(s.raw.Load()) / float64(s.compressed.Load())
+}
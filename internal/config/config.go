@@ -0,0 +1,105 @@
+// Package config loads command configuration from flags and their environment variables, and describes the effective
+// configuration with secrets redacted.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Redacted replaces the values of secrets in descriptions of the configuration.
+const Redacted = "REDACTED"
+
+// secretMarkers mark environment variables whose values are secrets, and must never be printed or leave the machine.
+var secretMarkers = []string{"PASSWORD", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "HEADERS", "WEBHOOK"}
+
+// EnvName returns the environment variable of the given flag: its name in upper snake case, e.g. "max-failures"
+// becomes "MAX_FAILURES".
+func EnvName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ErrInvalidEnv is returned for invalid values of environment variables, which (unlike invalid command line
+// arguments) are not reported by the flag package itself.
+var ErrInvalidEnv = errors.New("invalid environment variable")
+
+// Load sets each of the given flags from its environment variable, if set, and then parses the given command line
+// arguments into the given flag set, so flags given on the command line take precedence. Flags are mapped to the names
+// of their environment variables, or to "" for the name given by EnvName. Values of environment variables are
+// validated by the flags just like command line arguments. Panics if a given flag is not defined (like the flag
+// package does for flags defined twice).
+func Load(fs *flag.FlagSet, args []string, envNames map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(envNames)) {
+		if fs.Lookup(name) == nil {
+			panic(fmt.Sprintf("flag '%s' bound to an environment variable is not defined", name))
+		}
+		envName := envOf(name, envNames)
+		if value, found := os.LookupEnv(envName); found && value != "" {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%w %s: %w", ErrInvalidEnv, envName, err)
+			}
+		}
+	}
+	return fs.Parse(args)
+}
+
+// Effective returns the effective values of all flags of the given set, as loaded by Load with the given environment
+// variable names, with secrets redacted (see Redact).
+func Effective(fs *flag.FlagSet, envNames map[string]string) map[string]string {
+	effective := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		effective[f.Name] = Redact(envOf(f.Name, envNames), f.Value.String())
+	})
+	return effective
+}
+
+// Environment returns the values of the environment variables with the given names (or prefixes thereof, when ending
+// with "_"), with secrets redacted (see Redact).
+func Environment(names []string) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if slices.ContainsFunc(names, func(n string) bool {
+			return name == n || (strings.HasSuffix(n, "_") && strings.HasPrefix(name, n))
+		}) {
+			env[name] = Redact(name, value)
+		}
+	}
+	return env
+}
+
+// Redact returns the value of the given setting (named by its environment variable) as it may be printed: secrets are
+// redacted, and account usernames are masked.
+func Redact(name, value string) string {
+	switch {
+	case slices.ContainsFunc(secretMarkers, func(m string) bool { return strings.Contains(name, m) }):
+		return Redacted
+	case strings.HasSuffix(name, "_USERNAME"):
+		return MaskEmailAddress(value)
+	default:
+		return value
+	}
+}
+
+// MaskEmailAddress masks the local part of the given email address, keeping its first character and domain, e.g.
+// "john.doe@gmail.com" becomes "j***@gmail.com".
+func MaskEmailAddress(address string) string {
+	local, domain, found := strings.Cut(address, "@")
+	if !found || local == "" {
+		return Redacted
+	}
+	return local[:1] + "***@" + domain
+}
+
+// envOf returns the environment variable of the given flag, by the given names.
+func envOf(flagName string, envNames map[string]string) string {
+	if envName := envNames[flagName]; envName != "" {
+		return envName
+	}
+	return EnvName(flagName)
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := map[string]struct {
+		env     string
+		args    []string
+		want    int
+		wantErr error
+	}{
+		"default":           {want: 10},
+		"environment":       {env: "20", want: 20},
+		"empty env":         {env: "", want: 10},
+		"flag":              {args: []string{"-max-failures=30"}, want: 30},
+		"flag over env":     {env: "20", args: []string{"-max-failures=30"}, want: 30},
+		"invalid env":       {env: "many", wantErr: ErrInvalidEnv},
+		"invalid env, flag": {env: "many", args: []string{"-max-failures=30"}, wantErr: ErrInvalidEnv},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("TEST_MAX_FAILURES", tt.env)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			maxFailures := fs.Int("max-failures", 10, "")
+			err := Load(fs, tt.args, map[string]string{"max-failures": "TEST_MAX_FAILURES"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Load() returned %v, want %v", err, tt.wantErr)
+			} else if err == nil && *maxFailures != tt.want {
+				t.Errorf("max-failures = %d, want %d", *maxFailures, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDefaultEnvName(t *testing.T) {
+	t.Setenv("ERROR_POLICY", "continue")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	policy := fs.String("error-policy", "strict", "")
+	if err := Load(fs, nil, map[string]string{"error-policy": ""}); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	} else if *policy != "continue" {
+		t.Errorf("error-policy = %q, want %q from ERROR_POLICY", *policy, "continue")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := map[string]struct{ name, value, want string }{
+		"password":         {name: "SOURCE_ACCOUNT_PASSWORD", value: "hunter2", want: Redacted},
+		"token":            {name: "SERVER_TOKEN", value: "abc", want: Redacted},
+		"key":              {name: "BACKUP_ENCRYPTION_KEY", value: "abc", want: Redacted},
+		"webhook":          {name: "NOTIFY_SLACK_WEBHOOK_URL", value: "https://hooks.example.com/x", want: Redacted},
+		"username":         {name: "TARGET_ACCOUNT_USERNAME", value: "john.doe@example.com", want: "j***@example.com"},
+		"invalid username": {name: "TARGET_ACCOUNT_USERNAME", value: "john.doe", want: Redacted},
+		"other":            {name: "MAX_FAILURES", value: "10", want: "10"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := Redact(tt.name, tt.value); got != tt.want {
+				t.Errorf("Redact(%q, %q) = %q, want %q", tt.name, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskEmailAddress(t *testing.T) {
+	tests := map[string]string{
+		"john.doe@gmail.com": "j***@gmail.com",
+		"a@example.com":      "a***@example.com",
+		"@example.com":       Redacted,
+		"john.doe":           Redacted,
+		"":                   Redacted,
+	}
+	for address, want := range tests {
+		if got := MaskEmailAddress(address); got != want {
+			t.Errorf("MaskEmailAddress(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
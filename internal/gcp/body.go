@@ -0,0 +1,116 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cenkalti/backoff/v5"
+	"github.com/emersion/go-imap"
+)
+
+// FileLiteral is an IMAP literal backed by a file, e.g. a message body spooled to disk, allowing large messages to be
+// appended without holding them in memory.
+type FileLiteral struct {
+	*os.File
+	size int
+}
+
+// NewFileLiteral creates a literal reading the given file from its start. The file must not be modified afterward.
+func NewFileLiteral(f *os.File) (*FileLiteral, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat '%s': %w", f.Name(), err)
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind '%s': %w", f.Name(), err)
+	}
+	return &FileLiteral{File: f, size: int(info.Size())}, nil
+}
+
+// Len returns the size of the literal.
+func (l *FileLiteral) Len() int {
+	return l.size
+}
+
+// messageIDHeader returns the raw "Message-ID" header line for the given Message-ID.
+func messageIDHeader(messageID string) []byte {
+	return []byte("Message-ID: " + messageID + "\r\n")
+}
+
+// FetchBodyChunk fetches up to the given number of bytes of the raw body of the message with the given UID, starting
+// at the given offset, without marking the message as seen. A chunk shorter than requested means the end of the body
+// was reached.
+func (s *Session) FetchBodyChunk(uid uint32, offset, length int) ([]byte, error) {
+	section := &imap.BodySectionName{Peek: true, Partial: []int{offset, length}}
+	msg, err := s.FetchMessageByUID(uid, section.FetchItem())
+	if err != nil {
+		return nil, err
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		// Servers may omit the section entirely when the offset is past the end of the body
+		return nil, nil
+	}
+	data, err := io.ReadAll(literal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body chunk of message '%d' at offset %d: %w", uid, offset, err)
+	}
+	return data, nil
+}
+
+// FetchTextPrefix fetches up to the given number of bytes of the text (the body after its header) of the message with
+// the given UID, without marking the message as seen.
+func (g *Gmail) FetchTextPrefix(ctx context.Context, mailbox string, uid uint32, length int) ([]byte, error) {
+	section := &imap.BodySectionName{Peek: true, BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier}, Partial: []int{0, length}}
+	msg, err := g.FetchMessageByUID(ctx, mailbox, uid, section.FetchItem())
+	if err != nil {
+		return nil, err
+	}
+	literal := msg.GetBody(section)
+	if literal == nil {
+		// Servers may omit the section entirely for messages without text
+		return nil, nil
+	}
+	data, err := io.ReadAll(literal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read text of message '%d': %w", uid, err)
+	}
+	return data, nil
+}
+
+// DownloadBody downloads the raw body of the message with the given UID into the given writer, in ranged chunks of
+// the given size (BODY.PEEK[]<offset.size>), so that very large messages are not transferred as a single literal.
+// When a chunk fails, the download is retried from that chunk rather than from the start of the body. If a synthetic
+// Message-ID is given, a "Message-ID" header with it is written before the body (see SetMessageIDHeader). Returns the
+// number of bytes written.
+func (g *Gmail) DownloadBody(ctx context.Context, mailbox string, uid uint32, chunkSize int, syntheticMessageID string, w io.Writer) (int64, error) {
+	var written int64
+	if syntheticMessageID != "" {
+		n, err := w.Write(messageIDHeader(syntheticMessageID))
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("failed to write Message-ID header of message '%d': %w", uid, err)
+		}
+	}
+
+	offset := 0
+	err := g.WithSession(ctx, mailbox, func(sess *Session) error {
+		for {
+			chunk, err := sess.FetchBodyChunk(uid, offset, chunkSize)
+			if err != nil {
+				return err
+			}
+			n, err := w.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				return backoff.Permanent(fmt.Errorf("failed to write body chunk of message '%d' at offset %d: %w", uid, offset, err))
+			}
+			offset += len(chunk)
+			if len(chunk) < chunkSize {
+				return nil
+			}
+		}
+	})
+	return written, err
+}
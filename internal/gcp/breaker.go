@@ -0,0 +1,108 @@
+package gcp
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	circuitBreakerThreshold     = 5
+	circuitBreakerWindow        = time.Minute
+	circuitBreakerOpenPeriod    = 5 * time.Minute
+	circuitBreakerMaxOpenPeriod = time.Hour
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker pauses all operations of a Gmail connection pool when the account is clearly throttled, i.e. when
+// several throttle responses are received within a short window. While open, all operations wait; once the open
+// period elapses, operations resume (half-open), and the first throttle response re-opens the circuit for twice as
+// long, while the first successful operation closes it.
+type circuitBreaker struct {
+	username   string
+	mu         sync.Mutex
+	state      circuitState
+	throttles  []time.Time
+	openUntil  time.Time
+	openPeriod time.Duration
+}
+
+func newCircuitBreaker(username string) *circuitBreaker {
+	return &circuitBreaker{username: username, openPeriod: circuitBreakerOpenPeriod}
+}
+
+// Wait blocks while the circuit is open.
+func (b *circuitBreaker) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if b.state != circuitOpen {
+			b.mu.Unlock()
+			return nil
+		} else if !now.Before(b.openUntil) {
+			b.state = circuitHalfOpen
+			b.mu.Unlock()
+			slog.Info("Resuming Gmail operations after circuit breaker pause", "username", b.username)
+			return nil
+		}
+		wait := b.openUntil.Sub(now)
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RecordSuccess records a successful operation, closing the circuit if it was half-open.
+func (b *circuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		slog.Info("Gmail account no longer throttled, closing circuit breaker", "username", b.username)
+		b.state = circuitClosed
+		b.openPeriod = circuitBreakerOpenPeriod
+		b.throttles = nil
+	}
+}
+
+// RecordThrottle records a throttle response, opening the circuit if enough of these were recorded recently (or
+// immediately, if the circuit is half-open).
+func (b *circuitBreaker) RecordThrottle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case circuitOpen:
+		return
+	case circuitHalfOpen:
+		b.openPeriod = min(b.openPeriod*2, circuitBreakerMaxOpenPeriod)
+	default:
+		b.throttles = append(b.throttles, now)
+		for len(b.throttles) > 0 && now.Sub(b.throttles[0]) > circuitBreakerWindow {
+			b.throttles = b.throttles[1:]
+		}
+		if len(b.throttles) < circuitBreakerThreshold {
+			return
+		}
+	}
+
+	b.state = circuitOpen
+	b.openUntil = now.Add(b.openPeriod)
+	b.throttles = nil
+	slog.Warn("Gmail account is throttled, pausing all operations", "username", b.username, "until", b.openUntil)
+}
@@ -0,0 +1,79 @@
+package gcp
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// GmailConnectionLimit is the number of simultaneous IMAP connections Gmail allows per account, shared by all clients
+// connected to that account (including other runs of this application, mail clients and phones).
+const GmailConnectionLimit = 15
+
+// ErrConnectionLimit is returned when Gmail refuses a connection because the account has too many simultaneous
+// connections open.
+var ErrConnectionLimit = errors.New("too many simultaneous connections")
+
+// isConnectionLimitResponse returns true if the given error is Gmail refusing a new connection due to its
+// simultaneous connections limit.
+func isConnectionLimitResponse(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Too many simultaneous connections")
+}
+
+// connectionBudget tracks the maximum number of connections reserved by the pools of each account in this process.
+var connectionBudget = struct {
+	sync.Mutex
+	reserved map[string]int
+}{reserved: make(map[string]int)}
+
+// reserveConnections reserves the given number of connections for the given account, and returns the total number
+// of connections reserved for that account in this process.
+func reserveConnections(username string, n int) int {
+	connectionBudget.Lock()
+	defer connectionBudget.Unlock()
+	connectionBudget.reserved[username] += n
+	return connectionBudget.reserved[username]
+}
+
+// releaseConnections releases connections previously reserved for the given account.
+func releaseConnections(username string, n int) {
+	connectionBudget.Lock()
+	defer connectionBudget.Unlock()
+	connectionBudget.reserved[username] -= n
+	if connectionBudget.reserved[username] <= 0 {
+		delete(connectionBudget.reserved, username)
+	}
+}
+
+// reservedConnections returns the number of connections reserved for the given account in this process.
+func reservedConnections(username string) int {
+	connectionBudget.Lock()
+	defer connectionBudget.Unlock()
+	return connectionBudget.reserved[username]
+}
+
+// connectionLimitReached shrinks the pool after Gmail refused a connection due to its simultaneous connections limit,
+// which usually means other clients (e.g. another run) are connected to the same account. The pool's maximum size is
+// reduced to the number of connections currently open (but never below one), so it stops competing for connections
+// it will not get.
+func (g *Gmail) connectionLimitReached(err error) {
+	g.mu.Lock()
+	previous := g.maxConns
+	g.maxConns = max(1, g.open)
+	g.minConns = min(g.minConns, g.maxConns)
+	current := g.maxConns
+	g.mu.Unlock()
+
+	if current < previous {
+		slog.Warn(
+			"Gmail refused a connection because the account has too many simultaneous connections; reducing pool size",
+			"err", err,
+			"username", g.username,
+			"previousMaxConnections", previous,
+			"maxConnections", current,
+			"accountConnectionLimit", GmailConnectionLimit,
+			"reservedInProcess", reservedConnections(g.username),
+		)
+	}
+}
@@ -0,0 +1,126 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+)
+
+// ErrorClass classifies errors returned by Gmail IMAP operations, determining how they should be handled.
+type ErrorClass int
+
+const (
+	// ErrorClassTransient errors (network failures, unexpected server responses) are retried with backoff.
+	ErrorClassTransient ErrorClass = iota
+	// ErrorClassAuth errors (invalid credentials, disabled IMAP access) are permanent and fail fast.
+	ErrorClassAuth
+	// ErrorClassQuota errors signal that the account is being throttled; they are retried after a cooldown.
+	ErrorClassQuota
+	// ErrorClassInvalidMessage errors signal that the server rejected a message; they are permanent and fail fast.
+	ErrorClassInvalidMessage
+	// ErrorClassCanceled errors are caused by the operation's context being canceled or exceeding its deadline.
+	ErrorClassCanceled
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassAuth:
+		return "auth"
+	case ErrorClassQuota:
+		return "quota"
+	case ErrorClassInvalidMessage:
+		return "invalid-message"
+	case ErrorClassCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// Permanent returns true if errors of this class should not be retried.
+func (c ErrorClass) Permanent() bool {
+	return c == ErrorClassAuth || c == ErrorClassInvalidMessage || c == ErrorClassCanceled
+}
+
+// authResponses are substrings of Gmail IMAP responses indicating an authentication or authorization failure.
+var authResponses = []string{
+	"[AUTHENTICATIONFAILED]",
+	"[AUTHORIZATIONFAILED]",
+	"Invalid credentials",
+	"Application-specific password required",
+	"Please log in via your web browser",
+	"IMAP access is disabled",
+	"Your account is not enabled for IMAP use",
+}
+
+// quotaResponses are substrings of Gmail IMAP responses indicating the account is being throttled.
+var quotaResponses = []string{
+	"[THROTTLED]",
+	"[OVERQUOTA]",
+	"[LIMIT]",
+	"Account exceeded command or bandwidth limits",
+	"Too many simultaneous connections",
+	"Bandwidth limits exceeded",
+}
+
+// invalidMessageResponses are substrings of Gmail IMAP responses indicating a message was rejected by the server.
+var invalidMessageResponses = []string{
+	"[TOOBIG]",
+	"[PARSE]",
+	"Message too large",
+	"Invalid Arguments",
+}
+
+// tooLargeResponses are substrings of Gmail IMAP responses indicating a message was rejected for its size.
+var tooLargeResponses = []string{
+	"[TOOBIG]",
+	"Message too large",
+}
+
+// IsMessageTooLarge returns whether the given error returned by a Gmail IMAP operation is the rejection of a message
+// for its size. Such errors are also classified as ErrorClassInvalidMessage.
+func IsMessageTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return slices.ContainsFunc(tooLargeResponses, func(r string) bool { return strings.Contains(msg, r) })
+}
+
+// ClassifyError determines the class of the given error returned by a Gmail IMAP operation.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassTransient
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassCanceled
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorClassTransient
+	}
+
+	msg := err.Error()
+	for _, r := range authResponses {
+		if strings.Contains(msg, r) {
+			return ErrorClassAuth
+		}
+	}
+	for _, r := range quotaResponses {
+		if strings.Contains(msg, r) {
+			return ErrorClassQuota
+		}
+	}
+	for _, r := range invalidMessageResponses {
+		if strings.Contains(msg, r) {
+			return ErrorClassInvalidMessage
+		}
+	}
+	return ErrorClassTransient
+}
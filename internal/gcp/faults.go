@@ -0,0 +1,67 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// ErrInjectedFault is returned by IMAP operation attempts failed on purpose by fault injection (see WithFaultInjection). It is
+// classified as a transient error, like the network failures it stands for.
+var ErrInjectedFault = errors.New("injected fault")
+
+// Faults configures the faults injected into the IMAP operations of a pool, for exercising retries, checkpoints and
+// idempotency against unreliable servers. Percentages are of all operation attempts (including retries), and are drawn
+// independently per attempt.
+type Faults struct {
+	FailurePercent int           // attempts failed with ErrInjectedFault before sending any command
+	DelayPercent   int           // attempts delayed by a random duration of up to MaxDelay before sending any command
+	MaxDelay       time.Duration // maximum delay of delayed attempts
+	DropPercent    int           // attempts whose connection is dropped before sending any command, failing them
+}
+
+// enabled returns true if any faults are injected.
+func (f Faults) enabled() bool {
+	return f.FailurePercent > 0 || (f.DelayPercent > 0 && f.MaxDelay > 0) || f.DropPercent > 0
+}
+
+// WithFaultInjection makes the pool inject the given faults into its IMAP operations. Never use this against real
+// accounts; it is meant for chaos testing, e.g. in CI against a fake IMAP server.
+func WithFaultInjection(faults Faults) GmailOption {
+	return func(o *gmailOptions) {
+		o.faults = faults
+	}
+}
+
+// injectFault injects a random fault (if any) into an operation attempt about to use the given connection.
+func (g *Gmail) injectFault(ctx context.Context, c *client.Client) error {
+	f := g.faults
+	if !f.enabled() {
+		return nil
+	}
+
+	if f.DelayPercent > 0 && f.MaxDelay > 0 && rand.IntN(100) < f.DelayPercent {
+		timer := time.NewTimer(rand.N(f.MaxDelay))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.DropPercent > 0 && rand.IntN(100) < f.DropPercent {
+		// The attempt's first command fails on the closed connection, just like it would on a real network failure
+		slog.Debug("Injecting fault: dropping connection", "username", g.username)
+		_ = c.Terminate()
+		return nil
+	}
+	if f.FailurePercent > 0 && rand.IntN(100) < f.FailurePercent {
+		slog.Debug("Injecting fault: failing operation", "username", g.username)
+		return ErrInjectedFault
+	}
+	return nil
+}
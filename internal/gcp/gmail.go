@@ -1,14 +1,24 @@
 package gcp
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
 	"github.com/cenkalti/backoff/v5"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
@@ -16,38 +26,200 @@ import (
 
 const (
 	GmailAllMailLabel = "[Gmail]/All Mail"
+	InboxMailbox      = "INBOX"
 	gmailImapHost     = "imap.gmail.com"
 	gmailImapPort     = 993
 	GmailLabelsExt    = "X-GM-LABELS"
+	GmailThreadIDExt  = "X-GM-THRID"
+	GmailMsgIDExt     = "X-GM-MSGID"
+	GmailRawSearchExt = "X-GM-RAW"
 )
 
 var (
 	gmailImapURL = fmt.Sprintf("%s:%d", gmailImapHost, gmailImapPort)
+
+	// ErrMessageNotFound is returned when updating a message that is not in the account.
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+const (
+	poolShrinkInterval = time.Minute
+	poolIdleTimeout    = 5 * time.Minute
+
+	// defaultWarmUpConcurrency is the default number of initial connections opened simultaneously; logging in with
+	// many connections at once may get the account throttled.
+	defaultWarmUpConcurrency = 4
+	warmUpTimeout            = 5 * time.Minute
+
+	// MessageIDSearchBatchSize is the number of Message-IDs checked per SEARCH command by FindUIDsByMessageIDs.
+	MessageIDSearchBatchSize = 50
 )
 
+// pooledConnection is an idle connection waiting in the pool.
+type pooledConnection struct {
+	client    *client.Client
+	idleSince time.Time
+}
+
+// Gmail is a pool of authenticated IMAP connections to a single Gmail account. The pool keeps at least minConns
+// connections open, grows up to maxConns connections under load, and shrinks back by closing connections that have
+// been idle for a while.
 type Gmail struct {
-	getConnTimeout time.Duration
-	newConnMU      sync.Mutex
-	username       string
-	password       string
-	mu             sync.Mutex
-	conns          chan *client.Client
-	factory        func(context.Context) (*client.Client, error)
+	getConnTimeout  time.Duration
+	username        string
+	password        string
+	gmailExtensions bool
+	dryRun          bool
+	readOnly        atomic.Bool
+	minConns        int
+	maxConns        int
+	reserved        int
+	mu              sync.Mutex
+	open            int
+	conns           chan *pooledConnection
+	done            chan struct{}
+	factory         func(context.Context) (*client.Client, error)
+	limiter         *rateLimiter
+	breaker         *circuitBreaker
+	closed          bool
+	delimiterMu     sync.Mutex
+	delimiter       *string
+	namespaceMu     sync.Mutex
+	namespace       *string // the personal namespace prefix (nil until first queried)
+	labelsMu        sync.Mutex
+	labels          map[string]bool // existing labels, tracked for ensureLabels (nil until first listed)
+	fetchDuration   *metrics.Timer  // durations of IMAP commands (nil unless metrics are enabled)
+	appendDuration  *metrics.Timer
+	searchDuration  *metrics.Timer
+	faults          Faults
+}
+
+// GmailOption configures optional behavior of a Gmail connection pool.
+type GmailOption func(*gmailOptions)
+
+type gmailOptions struct {
+	commandsPerMinute int
+	bytesPerMinute    int
+	address           string
+	plaintext         bool
+	noGmailExtensions bool
+	warmUpConcurrency int
+	minReadyConns     int
+	dryRun            bool
+	reporter          *metrics.Reporter
+	metricsPrefix     string
+	faults            Faults
 }
 
-func NewGmail(username, password string, connLimit uint8, getConnTimeout time.Duration) (*Gmail, error) {
+// WithEndpoint connects to the given IMAP server address ("host:port") instead of Gmail's. If useTLS is false, the
+// connection is made in plaintext, which is only suitable for local test servers.
+func WithEndpoint(address string, useTLS bool) GmailOption {
+	return func(o *gmailOptions) {
+		o.address = address
+		o.plaintext = !useTLS
+	}
+}
+
+// WithGmailExtensions enables or disables the use of Gmail-specific IMAP extensions (X-GM-LABELS, X-GM-MSGID and
+// X-GM-THRID) and mailboxes. They are enabled by default; disable them when connecting to a generic IMAP server.
+// When disabled, Gmail extension fetch items are silently dropped, labels are not stored, and mailboxes are addressed
+// within the server's personal namespace (e.g. "INBOX.Work" for the "Work" label), as advertised by NAMESPACE.
+func WithGmailExtensions(enabled bool) GmailOption {
+	return func(o *gmailOptions) {
+		o.noGmailExtensions = !enabled
+	}
+}
+
+// WithRateLimits limits the number of IMAP commands and transferred message bytes per minute across all connections
+// of the pool. A zero value means no limit. Regardless of these limits, the pool slows down when Gmail signals that
+// the account is being throttled.
+func WithRateLimits(commandsPerMinute, bytesPerMinute int) GmailOption {
+	return func(o *gmailOptions) {
+		o.commandsPerMinute = commandsPerMinute
+		o.bytesPerMinute = bytesPerMinute
+	}
+}
+
+// WithWarmUp configures how the pool's minimum connections are opened on creation: at most concurrency connections
+// are opened simultaneously, and NewGmail blocks until minReady of them are ready (the rest are opened in the
+// background). By default, 4 connections are opened simultaneously and NewGmail does not wait for any of them.
+func WithWarmUp(concurrency, minReady int) GmailOption {
+	return func(o *gmailOptions) {
+		o.warmUpConcurrency = concurrency
+		o.minReadyConns = minReady
+	}
+}
+
+// WithDryRun makes the pool skip (and log) every operation that would modify the account: appending and deleting
+// messages, storing flags and labels, and creating, deleting and renaming mailboxes. Skipped operations succeed, and
+// appends return a zero UID.
+func WithDryRun(dryRun bool) GmailOption {
+	return func(o *gmailOptions) {
+		o.dryRun = dryRun
+	}
+}
+
+// WithMetrics makes the pool report the latency of IMAP fetch, append & search commands to the given reporter, in
+// histograms named "<prefix>.imap.<command>.duration" (e.g. "source.imap.fetch.duration").
+func WithMetrics(reporter *metrics.Reporter, prefix string) GmailOption {
+	return func(o *gmailOptions) {
+		o.reporter = reporter
+		o.metricsPrefix = prefix
+	}
+}
+
+func NewGmail(username, password string, minConns, maxConns int, getConnTimeout time.Duration, opts ...GmailOption) (*Gmail, error) {
+	if maxConns < 1 {
+		return nil, fmt.Errorf("maximum connections must be positive")
+	} else if minConns < 0 || minConns > maxConns {
+		return nil, fmt.Errorf("minimum connections must be between 0 and the maximum connections (%d)", maxConns)
+	}
+
+	o := gmailOptions{address: gmailImapURL, warmUpConcurrency: defaultWarmUpConcurrency}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.warmUpConcurrency < 1 {
+		return nil, fmt.Errorf("warm-up concurrency must be positive")
+	} else if o.minReadyConns < 0 || o.minReadyConns > minConns {
+		return nil, fmt.Errorf("minimum ready connections must be between 0 and the minimum connections (%d)", minConns)
+	}
+
+	dial := func() (*client.Client, error) { return client.DialTLS(o.address, nil) }
+	if o.plaintext {
+		dial = func() (*client.Client, error) { return client.Dial(o.address) }
+	}
+
 	g := &Gmail{
-		getConnTimeout: getConnTimeout,
-		username:       username,
-		password:       password,
-		conns:          make(chan *client.Client, connLimit),
+		gmailExtensions: !o.noGmailExtensions,
+		dryRun:          o.dryRun,
+		fetchDuration:   o.reporter.Timer(o.metricsPrefix + ".imap.fetch.duration"),
+		appendDuration:  o.reporter.Timer(o.metricsPrefix + ".imap.append.duration"),
+		searchDuration:  o.reporter.Timer(o.metricsPrefix + ".imap.search.duration"),
+		faults:          o.faults,
+		getConnTimeout:  getConnTimeout,
+		username:        username,
+		password:        password,
+		minConns:        minConns,
+		maxConns:        maxConns,
+		conns:           make(chan *pooledConnection, maxConns),
+		done:            make(chan struct{}),
+		limiter:         newRateLimiter(username, o.commandsPerMinute, o.bytesPerMinute),
+		breaker:         newCircuitBreaker(username),
 		factory: func(ctx context.Context) (*client.Client, error) {
 			return backoff.Retry[*client.Client](
 				ctx,
 				func() (*client.Client, error) {
-					if c, err := client.DialTLS(gmailImapURL, nil); err != nil {
+					if c, err := dial(); err != nil {
 						return nil, fmt.Errorf("failed to dial: %w", err)
 					} else if err := c.Login(username, password); err != nil {
+						_ = c.Logout()
+						if isConnectionLimitResponse(err) {
+							// Retrying will not help while other clients hold the account's connections
+							return nil, backoff.Permanent(fmt.Errorf("failed to login: %w: %w", ErrConnectionLimit, err))
+						} else if ClassifyError(err) == ErrorClassAuth {
+							return nil, backoff.Permanent(fmt.Errorf("failed to login: %w", err))
+						}
 						return nil, fmt.Errorf("failed to login: %w", err)
 					} else {
 						return c, nil
@@ -58,347 +230,559 @@ func NewGmail(username, password string, connLimit uint8, getConnTimeout time.Du
 		},
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
+	if g.faults.enabled() {
+		slog.Warn(
+			"Injecting faults into IMAP operations",
+			"username", username,
+			"failurePercent", g.faults.FailurePercent,
+			"delayPercent", g.faults.DelayPercent,
+			"maxDelay", g.faults.MaxDelay,
+			"dropPercent", g.faults.DropPercent,
+		)
+	}
+
+	if g.gmailExtensions {
+		g.reserved = maxConns
+		if reserved := reserveConnections(username, maxConns); reserved > GmailConnectionLimit {
+			slog.Warn(
+				"Connection pools of this account may exceed Gmail's simultaneous connections limit",
+				"username", username,
+				"maxConnections", maxConns,
+				"reservedInProcess", reserved,
+				"accountConnectionLimit", GmailConnectionLimit,
+			)
+		}
+	}
 
-	var i uint8
-	for i = 0; i < connLimit; i++ {
-		time.Sleep(time.Second)
-		go func(i uint8) {
-			if c, err := g.factory(ctx); err != nil {
-				slog.Warn("Failed to create initial IMAP connection", "err", err, "username", g.username)
-			} else {
-				slog.Debug("Creating initial IMAP connection", "index", i, "username", g.username)
-				g.conns <- c
-			}
-		}(i)
+	if err := g.warmUp(o.warmUpConcurrency, o.minReadyConns); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = g.Close(ctx)
+		return nil, err
 	}
 
+	go g.shrink()
+
 	return g, nil
 }
 
-func (g *Gmail) Close() {
+// Close closes the pool: idle connections are logged out in parallel, and connections still checked out are logged
+// out when released. If the given context is done before all idle connections are logged out, their sockets are
+// closed forcibly, so shutdown completes within the caller's deadline (e.g. Cloud Run's termination grace period).
+func (g *Gmail) Close(ctx context.Context) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	close(g.done)
 	close(g.conns)
-	for c := range g.conns {
-		if c != nil {
-			if err := c.Logout(); err != nil {
-				if !strings.Contains(err.Error(), "Already logged out") {
-					slog.Warn("Failed to logout from Gmail IMAP server (closing pool)", "err", err, "username", g.username)
-				}
-			}
+	g.mu.Unlock()
+	releaseConnections(g.username, g.reserved)
+
+	var clients []*client.Client
+	for pc := range g.conns {
+		if pc != nil {
+			clients = append(clients, pc.client)
 		}
 	}
-}
-
-func (g *Gmail) releaseIMAPConnection(c *client.Client) {
-	slog.Debug("Releasing IMAP connection", "username", g.username)
-	g.conns <- c
-}
-
-func (g *Gmail) getIMAPConnection(ctx context.Context) (*client.Client, func(), error) {
-	timer := time.NewTimer(g.getConnTimeout)
-	defer timer.Stop()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Go(func() { g.logout(c, "closing pool") })
+	}
+	loggedOut := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(loggedOut)
+	}()
 
 	select {
-	case c := <-g.conns:
-		// Should never happen, but just in case
-		if c == nil {
-			panic("ILLEGAL STATE: got nil IMAP connection from pool")
+	case <-loggedOut:
+		return nil
+	case <-ctx.Done():
+		for _, c := range clients {
+			_ = c.Terminate()
 		}
+		return fmt.Errorf("failed to log out of %d connections in time, closed them forcibly: %w", len(clients), ctx.Err())
+	}
+}
 
-		if err := c.Noop(); err != nil {
+// warmUp opens the pool's minimum connections, at most concurrency at a time, and blocks until minReady of them are
+// ready; the rest are opened in the background. Once all connections were attempted, a summary is logged. Returns an
+// error if fewer than minReady connections could be opened.
+func (g *Gmail) warmUp(concurrency, minReady int) error {
+	count := g.minConns
+	if count == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	g.open += count
+	g.mu.Unlock()
 
-			// Discard the bad connection
-			slog.Warn("Discarding bad IMAP connection", "err", err, "username", g.username)
-			if err := c.Logout(); err != nil {
-				if !strings.Contains(err.Error(), "Already logged out") {
-					slog.Warn("Failed logging out of a bad IMAP connection", "err", err, "username", g.username)
+	ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+	results := make(chan error, count)
+	go func() {
+		var limited atomic.Bool
+		sem := make(chan struct{}, concurrency)
+		for i := range count {
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem }()
+				select {
+				case <-g.done:
+					results <- errors.New("pool closed during warm-up")
+					return
+				default:
 				}
-			}
+				if limited.Load() {
+					// Other connections would be refused as well
+					results <- fmt.Errorf("skipped: %w", ErrConnectionLimit)
+					return
+				}
+				c, err := g.factory(ctx)
+				if err != nil {
+					if errors.Is(err, ErrConnectionLimit) && !limited.Swap(true) {
+						g.connectionLimitReached(err)
+					}
+					slog.Debug("Failed to create initial IMAP connection", "err", err, "index", i, "username", g.username)
+					results <- err
+					return
+				}
+				slog.Debug("Created initial IMAP connection", "index", i, "username", g.username)
+				g.putIdleConnection(&pooledConnection{client: c, idleSince: time.Now()}, "pool closed during warm-up")
+				results <- nil
+			}()
+		}
+	}()
 
-			// Create a new one in place of the one we just discarded
-			if c, err := g.factory(ctx); err != nil {
-				return nil, nil, fmt.Errorf("failed to create initial IMAP connections: %w", err)
-			} else {
-				return c, func() { g.releaseIMAPConnection(c) }, nil
+	readyCh := make(chan error, 1)
+	if minReady == 0 {
+		readyCh <- nil
+	}
+	go func() {
+		defer cancel()
+		start := time.Now()
+		ready, failed := 0, 0
+		var firstErr error
+		for range count {
+			if err := <-results; err != nil {
+				g.mu.Lock()
+				g.open--
+				g.mu.Unlock()
+				failed++
+				firstErr = cmp.Or(firstErr, err)
+			} else if ready++; ready == minReady {
+				readyCh <- nil
 			}
+		}
 
+		attrs := []any{"username", g.username, "ready", ready, "failed", failed, "duration", time.Since(start)}
+		if failed > 0 {
+			slog.Warn("IMAP connection pool warmed up with failures", append(attrs, "err", firstErr)...)
 		} else {
-			// Good connection, return it
-			return c, func() { g.releaseIMAPConnection(c) }, nil
+			slog.Info("IMAP connection pool warmed up", attrs...)
 		}
-	case <-timer.C:
-		// Timed out :(
-		return nil, nil, fmt.Errorf("failed to get IMAP connection within timeout")
+		if ready < minReady {
+			readyCh <- fmt.Errorf("only %d of %d required IMAP connections could be opened: %w", ready, minReady, firstErr)
+		}
+	}()
+	return <-readyCh
+}
+
+// putIdleConnection returns the given connection to the pool, or logs out of it if the pool is closed.
+func (g *Gmail) putIdleConnection(pc *pooledConnection, reason string) {
+	g.mu.Lock()
+	if !g.closed {
+		// The channel is sized for the maximum number of connections, so this never blocks
+		g.conns <- pc
+		g.mu.Unlock()
+		return
 	}
+	g.mu.Unlock()
+	g.logout(pc.client, reason)
 }
 
-func (g *Gmail) FindAllUIDs(ctx context.Context, mailbox string) ([]uint32, error) {
-	return backoff.Retry[[]uint32](
-		ctx,
-		func() ([]uint32, error) {
-			c, release, err := g.getIMAPConnection(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
-			}
-			defer release()
+// logout logs out of the given connection, ignoring (but logging) failures.
+func (g *Gmail) logout(c *client.Client, reason string) {
+	if err := c.Logout(); err != nil {
+		if !strings.Contains(err.Error(), "Already logged out") {
+			slog.Warn("Failed to logout from Gmail IMAP server", "err", err, "reason", reason, "username", g.username)
+		}
+	}
+}
 
-			if _, err := c.Select(mailbox, true); err != nil {
-				return nil, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
-			}
+// shrink periodically closes connections that have been idle for too long, as long as the pool has more than its
+// minimum number of connections open.
+func (g *Gmail) shrink() {
+	ticker := time.NewTicker(poolShrinkInterval)
+	defer ticker.Stop()
 
-			criteria := imap.NewSearchCriteria()
-			criteria.SeqNum = new(imap.SeqSet)
-			criteria.SeqNum.AddRange(1, 0)
-			uids, err := c.UidSearch(criteria)
-			if err != nil {
-				return nil, fmt.Errorf("failed performing criteria search for all UIDs: %w", err)
-			}
-			return uids, nil
-		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
-	)
-}
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			for range len(g.conns) {
+				var pc *pooledConnection
+				select {
+				case pc = <-g.conns:
+				default:
+				}
+				if pc == nil {
+					break
+				}
 
-func (g *Gmail) FetchByUIDs(ctx context.Context, mailbox string, uids []uint32, items ...imap.FetchItem) ([]*imap.Message, error) {
-	return backoff.Retry[[]*imap.Message](
-		ctx,
-		func() ([]*imap.Message, error) {
-			c, release, err := g.getIMAPConnection(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
-			}
-			defer release()
+				g.mu.Lock()
+				expired := time.Since(pc.idleSince) > poolIdleTimeout && g.open > g.minConns
+				if expired {
+					g.open--
+				}
+				g.mu.Unlock()
 
-			if _, err := c.Select(mailbox, true); err != nil {
-				return nil, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
+				if expired {
+					slog.Debug("Closing idle IMAP connection", "username", g.username)
+					g.logout(pc.client, "idle")
+				} else {
+					g.putIdleConnection(pc, "pool closed")
+				}
 			}
+		}
+	}
+}
 
-			if !slices.Contains(items, imap.FetchUid) {
-				items = append(items, imap.FetchUid)
-			}
-			seqSet := new(imap.SeqSet)
-			seqSet.AddNum(uids...)
-			messagesCh := make(chan *imap.Message, len(uids))
-			if err := c.UidFetch(seqSet, items, messagesCh); err != nil {
-				return nil, fmt.Errorf("failed to fetch message IDs: %w", err)
-			}
-			messages := make([]*imap.Message, 0, len(uids))
-			for msg := range messagesCh {
-				messages = append(messages, msg)
-			}
-			return messages, nil
-		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
-	)
+func (g *Gmail) releaseIMAPConnection(c *client.Client) {
+	slog.Debug("Releasing IMAP connection", "username", g.username)
+	g.putIdleConnection(&pooledConnection{client: c, idleSince: time.Now()}, "pool closed")
 }
 
-func (g *Gmail) FindUIDByMessageID(ctx context.Context, mailbox string, messageID string) (*uint32, error) {
-	return backoff.Retry[*uint32](
-		ctx,
-		func() (*uint32, error) {
-			c, release, err := g.getIMAPConnection(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
-			}
-			defer release()
+// discardIMAPConnection logs out of a bad connection, and frees its slot in the pool.
+func (g *Gmail) discardIMAPConnection(c *client.Client, err error) {
+	slog.Warn("Discarding bad IMAP connection", "err", err, "username", g.username)
+	g.logout(c, "bad connection")
+	g.mu.Lock()
+	g.open--
+	g.mu.Unlock()
+}
 
-			if _, err := c.Select(mailbox, true); err != nil {
-				return nil, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
-			}
+// growIMAPConnections opens a new connection if the pool is below its maximum size. Returns nil if the pool is full.
+func (g *Gmail) growIMAPConnections(ctx context.Context) (*client.Client, error) {
+	g.mu.Lock()
+	if g.open >= g.maxConns {
+		g.mu.Unlock()
+		return nil, nil
+	}
+	g.open++
+	g.mu.Unlock()
 
-			criteria := imap.NewSearchCriteria()
-			criteria.Header.Add("Message-Id", messageID)
-			uids, err := c.UidSearch(criteria)
-			if err != nil {
-				return nil, fmt.Errorf("failed to search for message by Message-ID: %w", err)
-			} else if len(uids) == 0 {
+	slog.Debug("Growing IMAP connection pool", "username", g.username)
+	c, err := g.factory(ctx)
+	if err != nil {
+		g.mu.Lock()
+		g.open--
+		open := g.open
+		g.mu.Unlock()
+		if errors.Is(err, ErrConnectionLimit) {
+			g.connectionLimitReached(err)
+			if open > 0 {
+				// Wait for one of the open connections to be released instead
 				return nil, nil
-			} else {
-				if len(uids) > 1 {
-					slog.Warn("Found multiple UIDs for Message-ID", "messageID", messageID, "uids", uids)
-				}
-				return &uids[0], nil
 			}
-		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
-	)
+		}
+		return nil, fmt.Errorf("failed to create IMAP connection: %w", err)
+	}
+	return c, nil
 }
 
-func (g *Gmail) FetchMessageByUID(ctx context.Context, mailbox string, uid uint32, items ...imap.FetchItem) (*imap.Message, error) {
-	return backoff.Retry[*imap.Message](
-		ctx,
-		func() (*imap.Message, error) {
-			c, release, err := g.getIMAPConnection(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
-			}
-			defer release()
+// GmailExtensions returns true if Gmail-specific IMAP extensions are used by this pool.
+func (g *Gmail) GmailExtensions() bool {
+	return g.gmailExtensions
+}
 
-			if _, err := c.Select(mailbox, true); err != nil {
-				return nil, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
-			}
+// PoolStats returns the number of open connections in this pool, and how many of them are idle.
+func (g *Gmail) PoolStats() (open, idle int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.open, len(g.conns)
+}
 
-			if !slices.Contains(items, imap.FetchUid) {
-				items = append(items, imap.FetchUid)
-			}
-			seqSet := new(imap.SeqSet)
-			seqSet.AddNum(uid)
-			messages := make(chan *imap.Message, 1)
-			if err := c.UidFetch(seqSet, items, messages); err != nil {
-				return nil, fmt.Errorf("failed to fetch message '%d' from account '%s': %w", uid, g.username, err)
+// DefaultMailbox returns the mailbox containing all messages of the account: "[Gmail]/All Mail" for Gmail, and
+// "INBOX" for generic IMAP servers.
+func (g *Gmail) DefaultMailbox() string {
+	if g.gmailExtensions {
+		return GmailAllMailLabel
+	}
+	return InboxMailbox
+}
+
+// fetchItems returns the given fetch items, adding the UID item (if missing), and removing Gmail-specific items if
+// Gmail extensions are disabled.
+func (g *Gmail) fetchItems(items []imap.FetchItem) []imap.FetchItem {
+	result := make([]imap.FetchItem, 0, len(items)+1)
+	for _, item := range items {
+		if !g.gmailExtensions && strings.HasPrefix(string(item), "X-GM-") {
+			continue
+		}
+		result = append(result, item)
+	}
+	if !slices.Contains(result, imap.FetchUid) {
+		result = append(result, imap.FetchUid)
+	}
+	return result
+}
+
+// withRetry executes the given operation, retrying it with exponential backoff on failure. Errors are classified
+// first: permanent errors (e.g. authentication failures or rejected messages) fail fast without retrying, while
+// throttle responses slow down the pool's rate limiter, feed its circuit breaker, and are retried after the throttle
+// cooldown without escalating the backoff.
+func withRetry[T any](ctx context.Context, g *Gmail, operation backoff.Operation[T]) (T, error) {
+	return backoff.Retry[T](
+		ctx,
+		func() (T, error) {
+			result, err := operation()
+			if err == nil {
+				g.breaker.RecordSuccess()
+				return result, nil
 			}
-			msg := <-messages
-			if msg == nil {
-				return nil, fmt.Errorf("server did not provide message '%d' from account '%s'", uid, g.username)
+			switch class := ClassifyError(err); {
+			case errors.Is(err, ErrReadOnly), errors.Is(err, ErrMessageNotFound):
+				return result, backoff.Permanent(err)
+			case class == ErrorClassQuota:
+				g.breaker.RecordThrottle()
+				cooldown := g.limiter.Throttled(err)
+				return result, fmt.Errorf("%w: %w", &backoff.RetryAfterError{Duration: cooldown}, err)
+			case class.Permanent():
+				return result, backoff.Permanent(err)
+			default:
+				return result, err
 			}
-
-			return msg, nil
 		},
 		backoff.WithBackOff(backoff.NewExponentialBackOff()),
 	)
 }
 
-func (g *Gmail) AppendMessage(ctx context.Context, mailbox string, msg *imap.Message) (uint32, error) {
-	return backoff.Retry[uint32](
-		ctx,
-		func() (uint32, error) {
-			c, release, err := g.getIMAPConnection(ctx)
-			if err != nil {
-				return 0, fmt.Errorf("failed to get Gmail connection: %w", err)
-			}
-			defer release()
+// getIMAPConnection checks out a connection for a single attempt of an operation, returning it along with a function
+// releasing it back to the pool. Faults are injected here, if configured.
+func (g *Gmail) getIMAPConnection(ctx context.Context) (*client.Client, func(), error) {
+	c, release, err := g.checkoutIMAPConnection(ctx)
+	if err != nil {
+		return nil, nil, err
+	} else if err := g.injectFault(ctx, c); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return c, release, nil
+}
 
-			if _, err := c.Select(mailbox, false); err != nil {
-				return 0, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
-			}
+func (g *Gmail) checkoutIMAPConnection(ctx context.Context) (*client.Client, func(), error) {
+	if err := g.breaker.Wait(ctx); err != nil {
+		return nil, nil, err
+	} else if err := g.limiter.WaitCommand(ctx); err != nil {
+		return nil, nil, err
+	}
 
-			if msg.Uid == 0 {
-				return 0, fmt.Errorf("cannot append message %d - it has no UID", msg.Uid)
-			}
+	timer := time.NewTimer(g.getConnTimeout)
+	defer timer.Stop()
 
-			r := msg.GetBody(&imap.BodySectionName{})
-			if r == nil {
-				return 0, fmt.Errorf("cannot append message %d - it is missing body", msg.Uid)
+	for {
+		// Prefer an idle connection; if there is none, grow the pool (if allowed), or wait for one to be released
+		var pc *pooledConnection
+		select {
+		case pc = <-g.conns:
+		default:
+			if c, err := g.growIMAPConnections(ctx); err != nil {
+				return nil, nil, err
+			} else if c != nil {
+				return c, func() { g.releaseIMAPConnection(c) }, nil
 			}
-
-			if err := c.Append(GmailAllMailLabel, msg.Flags, msg.InternalDate, r); err != nil {
-				return 0, fmt.Errorf("failed to append message %d to target: %w", msg.Uid, err)
+			select {
+			case pc = <-g.conns:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-timer.C:
+				// Timed out :(
+				return nil, nil, fmt.Errorf("failed to get IMAP connection within timeout")
 			}
+		}
 
-			messageID := msg.Envelope.MessageId
-			uid, err := g.FindUIDByMessageID(ctx, mailbox, messageID)
-			if err != nil {
-				return 0, fmt.Errorf("failed to find UID for newly-appended message '%s' in target account: %w", messageID, err)
-			} else if uid == nil {
-				return 0, fmt.Errorf("could not find UID for newly appended message '%s' in target account", messageID)
-			}
+		// The pool's channel only yields nil once the pool is closed
+		if pc == nil {
+			return nil, nil, backoff.Permanent(errors.New("connection pool is closed"))
+		}
 
-			var labels []string
-			if rawLabels, ok := msg.Items[GmailLabelsExt]; ok {
-				if labelInterfaces, ok := rawLabels.([]any); ok {
-					for _, l := range labelInterfaces {
-						if label, ok := l.(string); ok {
-							labels = append(labels, label)
-						} else {
-							return 0, fmt.Errorf("invalid label type '%T'", l)
-						}
-					}
-					slices.Sort(labels)
-				} else {
-					return 0, fmt.Errorf("invalid labels type '%T'", rawLabels)
-				}
-			}
-			labelsAsAnyArray := make([]any, len(labels))
-			for i, label := range labels {
-				labelsAsAnyArray[i] = label
-			}
+		if err := pc.client.Noop(); err != nil {
+			// Discard the bad connection, and try again (which will create a new one in its place)
+			g.discardIMAPConnection(pc.client, err)
+			continue
+		}
 
-			seqSet := new(imap.SeqSet)
-			seqSet.AddNum(*uid)
-			if err := c.UidStore(seqSet, GmailLabelsExt+".SILENT", labelsAsAnyArray, nil); err != nil {
-				return 0, fmt.Errorf("failed to store labels on target message '%d': %w", *uid, err)
-			}
+		// Good connection, return it
+		c := pc.client
+		return c, func() { g.releaseIMAPConnection(c) }, nil
+	}
+}
 
-			return *uid, nil
-		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
-	)
+// Search returns the UIDs of the messages in the given mailbox matching the given query: a Gmail search query (e.g.
+// "from:alice has:attachment") if Gmail extensions are enabled, or text to find anywhere in messages otherwise.
+func (g *Gmail) Search(ctx context.Context, mailbox, query string) ([]uint32, error) {
+	var uids []uint32
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		if g.gmailExtensions {
+			uids, err = sess.SearchRaw(query)
+			return err
+		}
+		criteria := imap.NewSearchCriteria()
+		criteria.Text = []string{query}
+		uids, err = sess.Search(criteria)
+		return err
+	})
+	return uids, err
 }
 
-func (g *Gmail) UpdateMessage(ctx context.Context, mailbox string, msg *imap.Message) error {
-	_, err := backoff.Retry(
-		ctx,
-		func() (any, error) {
-			c, release, err := g.getIMAPConnection(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
-			}
-			defer release()
+func (g *Gmail) FindAllUIDs(ctx context.Context, mailbox string) ([]uint32, error) {
+	var uids []uint32
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		uids, err = sess.FindAllUIDs()
+		return err
+	})
+	return uids, err
+}
 
-			if _, err := c.Select(mailbox, false); err != nil {
-				return nil, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
-			}
+func (g *Gmail) FetchByUIDs(ctx context.Context, mailbox string, uids []uint32, items ...imap.FetchItem) ([]*imap.Message, error) {
+	var messages []*imap.Message
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		messages, err = sess.Fetch(uids, items...)
+		return err
+	})
+	return messages, err
+}
 
-			// We use the `Message-Id` value to find the message in this account
-			messageID := msg.Envelope.MessageId
-			if messageID == "" {
-				return nil, fmt.Errorf("cannot append message %d - it has no Message-ID (missing envelope?)", msg.Uid)
+// FetchByUIDsStream fetches the given items of the messages with the given UIDs, invoking the given callback for each
+// message as it arrives, so that large chunks of messages (e.g. with bodies) need not be buffered in memory. If the
+// fetch is retried, messages already processed by the callback are not fetched again. Errors returned by the callback
+// are not retried, and abort the stream.
+func (g *Gmail) FetchByUIDsStream(ctx context.Context, mailbox string, uids []uint32, items []imap.FetchItem, fn func(msg *imap.Message) error) error {
+	processed := make(map[uint32]bool, len(uids))
+	return g.WithSession(ctx, mailbox, func(sess *Session) error {
+		remaining := slices.DeleteFunc(slices.Clone(uids), func(uid uint32) bool { return processed[uid] })
+		if len(remaining) == 0 {
+			return nil
+		}
+		return sess.FetchStream(remaining, items, func(msg *imap.Message) error {
+			if err := fn(msg); err != nil {
+				return backoff.Permanent(err)
 			}
+			processed[msg.Uid] = true
+			return nil
+		})
+	})
+}
+
+func (g *Gmail) FindUIDByMessageID(ctx context.Context, mailbox string, messageID string) (*uint32, error) {
+	var uid *uint32
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		uid, err = sess.FindUIDByMessageID(messageID)
+		return err
+	})
+	return uid, err
+}
 
-			// Fetch message
-			uid, err := g.FindUIDByMessageID(ctx, mailbox, messageID)
+// FindUIDsByMessageIDs returns the UIDs of the messages with the given Message-ID headers in the given mailbox, keyed
+// by Message-ID. The Message-IDs are checked in batches of MessageIDSearchBatchSize per round trip, on one session.
+func (g *Gmail) FindUIDsByMessageIDs(ctx context.Context, mailbox string, messageIDs []string) (map[string]uint32, error) {
+	found := make(map[string]uint32, len(messageIDs))
+	err := g.WithSession(ctx, mailbox, func(sess *Session) error {
+		for batch := range slices.Chunk(messageIDs, MessageIDSearchBatchSize) {
+			batchFound, err := sess.FindUIDsByMessageIDs(batch)
 			if err != nil {
-				return nil, fmt.Errorf("failed to fetch message '%d' from account '%s': %w", uid, g.username, err)
-			} else if uid == nil {
-				return nil, fmt.Errorf("could not find UID for message '%s' in target account", messageID)
-			}
-			seqSet := new(imap.SeqSet)
-			seqSet.AddNum(*uid)
-
-			// Get labels
-			var labels []string
-			if rawLabels, ok := msg.Items[GmailLabelsExt]; ok {
-				if labelInterfaces, ok := rawLabels.([]any); ok {
-					for _, l := range labelInterfaces {
-						if label, ok := l.(string); ok {
-							labels = append(labels, label)
-						} else {
-							return nil, fmt.Errorf("invalid label type '%T'", l)
-						}
-					}
-					slices.Sort(labels)
-				} else {
-					return nil, fmt.Errorf("invalid labels type '%T'", rawLabels)
-				}
-			}
-			labelsAsAnyArray := make([]any, len(labels))
-			for i, label := range labels {
-				labelsAsAnyArray[i] = label
-			}
-			if err := c.UidStore(seqSet, GmailLabelsExt+".SILENT", labelsAsAnyArray, nil); err != nil {
-				return nil, fmt.Errorf("failed to update labels of target message '%d': %w", *uid, err)
+				return err
 			}
+			maps.Copy(found, batchFound)
+		}
+		return nil
+	})
+	return found, err
+}
 
-			// Get flags
-			flagsAsAnyArray := make([]any, len(msg.Flags))
-			for i, flag := range msg.Flags {
-				flagsAsAnyArray[i] = flag
-			}
-			if err := c.UidStore(seqSet, imap.FormatFlagsOp(imap.SetFlags, true), flagsAsAnyArray, nil); err != nil {
-				return nil, fmt.Errorf("failed to update flags of target message '%d': %w", *uid, err)
-			}
+// MoveToTrash moves the messages with the given UIDs to the trash: on Gmail by labeling them "\Trash" (from which
+// they are deleted after 30 days), and on other servers by flagging them as deleted (without expunging them).
+func (g *Gmail) MoveToTrash(ctx context.Context, mailbox string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	return g.WithSession(ctx, mailbox, func(sess *Session) error {
+		if g.gmailExtensions {
+			return sess.Store(uids, "+"+GmailLabelsExt+".SILENT", []any{`\Trash`})
+		}
+		return sess.Store(uids, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag})
+	})
+}
 
-			return nil, nil
-		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
-	)
-	return err
+// DeleteByUID flags the messages with the given UIDs as deleted and expunges them from the mailbox. Note that on
+// Gmail, expunging a message from a label only removes that label (unless the account is configured otherwise);
+// use MoveToTrash to delete messages from all labels.
+func (g *Gmail) DeleteByUID(ctx context.Context, mailbox string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	return g.WithSession(ctx, mailbox, func(sess *Session) error {
+		if err := sess.Store(uids, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag}); err != nil {
+			return err
+		}
+		return sess.Expunge(uids)
+	})
+}
+
+// MoveMessage moves the messages with the given UIDs from the given mailbox into the destination mailbox. On Gmail,
+// this replaces the source label of the messages with the destination label.
+func (g *Gmail) MoveMessage(ctx context.Context, mailbox string, uids []uint32, destination string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	return g.WithSession(ctx, mailbox, func(sess *Session) error {
+		return sess.Move(uids, destination)
+	})
+}
+
+func (g *Gmail) FetchMessageByUID(ctx context.Context, mailbox string, uid uint32, items ...imap.FetchItem) (*imap.Message, error) {
+	var msg *imap.Message
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		msg, err = sess.FetchMessageByUID(uid, items...)
+		return err
+	})
+	return msg, err
+}
+
+func (g *Gmail) AppendMessage(ctx context.Context, mailbox string, msg *imap.Message) (uint32, error) {
+	var uid uint32
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		uid, err = sess.Append(msg)
+		return err
+	})
+	return uid, err
+}
+
+func (g *Gmail) UpdateMessage(ctx context.Context, mailbox string, msg *imap.Message) error {
+	return g.WithSession(ctx, mailbox, func(sess *Session) error {
+		return sess.Update(msg)
+	})
+}
+
+// UpdateMessageAt updates the labels and flags of the message at the given UID (see Session.UpdateAt), returning its
+// (possibly different) UID.
+func (g *Gmail) UpdateMessageAt(ctx context.Context, mailbox string, uid uint32, msg *imap.Message) (uint32, error) {
+	var updated uint32
+	err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+		updated, err = sess.UpdateAt(uid, msg)
+		return err
+	})
+	return updated, err
 }
 
 func (g *Gmail) FetchMailboxNames(ctx context.Context, ignoreSystemLabels, ignoreUnselectables bool) ([]string, error) {
-	return backoff.Retry[[]string](
+	return withRetry(
 		ctx,
+		g,
 		func() ([]string, error) {
 			c, release, err := g.getIMAPConnection(ctx)
 			if err != nil {
@@ -406,6 +790,10 @@ func (g *Gmail) FetchMailboxNames(ctx context.Context, ignoreSystemLabels, ignor
 			}
 			defer release()
 
+			prefix, err := g.namespacePrefix(c)
+			if err != nil {
+				return nil, err
+			}
 			imapMailBoxes := make(chan *imap.MailboxInfo, 100)
 			done := make(chan error, 1)
 			go func() {
@@ -437,20 +825,25 @@ func (g *Gmail) FetchMailboxNames(ctx context.Context, ignoreSystemLabels, ignor
 				if ignoreUnselectables && slices.Contains(m.Attributes, imap.NoSelectAttr) {
 					continue
 				}
-				names = append(names, m.Name)
+				names = append(names, labelPath(withoutNamespace(m.Name, prefix), m.Delimiter))
 			}
 			if err := <-done; err != nil {
 				return nil, fmt.Errorf("failed to fetch mailboxes names: %w", err)
 			}
 			return names, nil
 		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
 	)
 }
 
 func (g *Gmail) CreateMailboxes(ctx context.Context, names ...string) error {
-	_, err := backoff.Retry[any](
+	if err := g.checkWritable("create mailboxes"); err != nil {
+		return err
+	} else if g.skipWrite("create mailboxes", "mailboxes", names) {
+		return nil
+	}
+	_, err := withRetry(
 		ctx,
+		g,
 		func() (any, error) {
 			c, release, err := g.getIMAPConnection(ctx)
 			if err != nil {
@@ -458,17 +851,260 @@ func (g *Gmail) CreateMailboxes(ctx context.Context, names ...string) error {
 			}
 			defer release()
 
-			for _, name := range names {
-				if err := c.Create(name); err != nil {
-					if !strings.Contains(err.Error(), "Duplicate folder name") {
-						return nil, fmt.Errorf("failed to create mailbox '%s': %w", name, err)
+			for _, label := range names {
+				// Create missing parents first, since not all servers create them implicitly
+				mailboxes, err := g.mailboxNames(c, label)
+				if err != nil {
+					return nil, err
+				}
+				for _, mailbox := range mailboxes {
+					if err := c.Create(mailbox); err != nil && !isMailboxExistsError(err) {
+						return nil, fmt.Errorf("failed to create mailbox '%s': %w", mailbox, err)
 					}
 				}
 			}
 
 			return nil, nil
 		},
-		backoff.WithBackOff(backoff.NewExponentialBackOff()),
 	)
 	return err
 }
+
+func (g *Gmail) DeleteMailbox(ctx context.Context, name string) error {
+	if err := g.checkWritable("delete mailbox"); err != nil {
+		return err
+	} else if g.skipWrite("delete mailbox", "mailbox", name) {
+		return nil
+	}
+	_, err := withRetry(
+		ctx,
+		g,
+		func() (any, error) {
+			c, release, err := g.getIMAPConnection(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
+			}
+			defer release()
+
+			mailbox, err := g.mailboxName(c, name)
+			if err != nil {
+				return nil, err
+			} else if err := c.Delete(mailbox); err != nil {
+				return nil, fmt.Errorf("failed to delete mailbox '%s': %w", name, err)
+			}
+			g.forgetLabels()
+			return nil, nil
+		},
+	)
+	return err
+}
+
+func (g *Gmail) RenameMailbox(ctx context.Context, existingName, newName string) error {
+	if err := g.checkWritable("rename mailbox"); err != nil {
+		return err
+	} else if g.skipWrite("rename mailbox", "mailbox", existingName, "newName", newName) {
+		return nil
+	}
+	_, err := withRetry(
+		ctx,
+		g,
+		func() (any, error) {
+			c, release, err := g.getIMAPConnection(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
+			}
+			defer release()
+
+			existingMailbox, err := g.mailboxName(c, existingName)
+			if err != nil {
+				return nil, err
+			}
+			newMailbox, err := g.mailboxName(c, newName)
+			if err != nil {
+				return nil, err
+			} else if err := c.Rename(existingMailbox, newMailbox); err != nil {
+				return nil, fmt.Errorf("failed to rename mailbox '%s' to '%s': %w", existingName, newName, err)
+			}
+			g.forgetLabels()
+			return nil, nil
+		},
+	)
+	return err
+}
+
+// skipWrite returns true if the given operation modifying the account should be skipped because the pool is in
+// dry-run mode, in which case the operation is logged with the given attributes.
+func (g *Gmail) skipWrite(operation string, attrs ...any) bool {
+	if !g.dryRun {
+		return false
+	}
+	slog.Info("Skipping write operation", append([]any{"dryRun", true, "operation", operation, "username", g.username}, attrs...)...)
+	return true
+}
+
+// CountMessages returns the number of messages in the given mailbox, without selecting it.
+func (g *Gmail) CountMessages(ctx context.Context, name string) (uint32, error) {
+	status, err := g.MailboxStatus(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	return status.Messages, nil
+}
+
+// MailboxStatus returns the number of messages, the UIDVALIDITY and the next UID of the given mailbox, without
+// selecting it. Messages appended to the mailbox since a previous status have UIDs of at least that status's next UID,
+// as long as the UIDVALIDITY did not change.
+func (g *Gmail) MailboxStatus(ctx context.Context, name string) (*imap.MailboxStatus, error) {
+	return withRetry(
+		ctx,
+		g,
+		func() (*imap.MailboxStatus, error) {
+			c, release, err := g.getIMAPConnection(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
+			}
+			defer release()
+
+			mailbox, err := g.mailboxName(c, name)
+			if err != nil {
+				return nil, err
+			}
+			status, err := c.Status(mailbox, []imap.StatusItem{imap.StatusMessages, imap.StatusUidValidity, imap.StatusUidNext})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get status of mailbox '%s': %w", name, err)
+			}
+			return status, nil
+		},
+	)
+}
+
+// GetLabels returns the sorted Gmail labels (X-GM-LABELS) of the given message, which must have been fetched with the
+// GmailLabelsExt item. Returns nil if the message carries no labels.
+func GetLabels(msg *imap.Message) ([]string, error) {
+	rawLabels, ok := msg.Items[GmailLabelsExt]
+	if !ok || rawLabels == nil {
+		return nil, nil
+	}
+	labelInterfaces, ok := rawLabels.([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid labels type '%T'", rawLabels)
+	}
+	labels := make([]string, 0, len(labelInterfaces))
+	for _, l := range labelInterfaces {
+		if label, ok := l.(string); ok {
+			labels = append(labels, label)
+		} else {
+			return nil, fmt.Errorf("invalid label type '%T'", l)
+		}
+	}
+	slices.Sort(labels)
+	return labels, nil
+}
+
+// SetLabels replaces the Gmail labels (X-GM-LABELS) of the given message, e.g. before appending it.
+func SetLabels(msg *imap.Message, labels []string) {
+	labelsAsAnyArray := make([]any, len(labels))
+	for i, label := range labels {
+		labelsAsAnyArray[i] = label
+	}
+	if msg.Items == nil {
+		msg.Items = make(map[imap.FetchItem]any)
+	}
+	msg.Items[GmailLabelsExt] = labelsAsAnyArray
+}
+
+// GetThreadID returns the Gmail thread ID (X-GM-THRID) of the given message, which must have been fetched with the
+// GmailThreadIDExt item. Returns zero if the message carries no thread ID.
+func GetThreadID(msg *imap.Message) (uint64, error) {
+	return getUint64Item(msg, GmailThreadIDExt)
+}
+
+// GetGmailMessageID returns the Gmail message ID (X-GM-MSGID) of the given message, which must have been fetched with
+// the GmailMsgIDExt item. Returns zero if the message carries no Gmail message ID.
+func GetGmailMessageID(msg *imap.Message) (uint64, error) {
+	return getUint64Item(msg, GmailMsgIDExt)
+}
+
+func getUint64Item(msg *imap.Message, item imap.FetchItem) (uint64, error) {
+	raw, ok := msg.Items[item]
+	if !ok || raw == nil {
+		return 0, nil
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid %s type '%T'", item, raw)
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", item, s, err)
+	}
+	return v, nil
+}
+
+// SyntheticMessageID returns a deterministic Message-ID for a message that has none, derived from its Gmail message ID
+// in the source account. Since it only depends on the source message, it is stable across runs.
+func SyntheticMessageID(gmailMessageID uint64) string {
+	return fmt.Sprintf("<%d@gmail-organizer.invalid>", gmailMessageID)
+}
+
+// ContentMessageID returns a deterministic Message-ID for a message that has neither a Message-ID nor a Gmail message
+// ID (e.g. on generic IMAP servers), derived from a hash of its date, senders & subject, and the given prefix of its
+// text (see FetchTextPrefix). Since it only depends on the source message's content, it is stable across runs.
+func ContentMessageID(envelope *imap.Envelope, textPrefix []byte) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00", envelope.Date.UTC().Format(time.RFC3339))
+	for _, from := range envelope.From {
+		_, _ = fmt.Fprintf(h, "%s\x00", strings.ToLower(from.Address()))
+	}
+	_, _ = fmt.Fprintf(h, "%s\x00", envelope.Subject)
+	h.Write(textPrefix)
+	return fmt.Sprintf("<%s@gmail-organizer.invalid>", hex.EncodeToString(h.Sum(nil)[:16]))
+}
+
+// SetMessageIDHeader prepends a "Message-ID" header with the given value to the raw body of the given message, which
+// must have been fetched with imap.FetchRFC822, and updates its envelope accordingly. This is used for messages that
+// have no Message-ID, so they can later be found in the target account by it.
+func SetMessageIDHeader(msg *imap.Message, messageID string) error {
+	body, err := GetRawBody(msg)
+	if err != nil {
+		return err
+	}
+	for name := range msg.Body {
+		if name.Equal(&imap.BodySectionName{}) {
+			msg.Body[name] = bytes.NewBuffer(append(messageIDHeader(messageID), body...))
+		}
+	}
+	msg.Envelope.MessageId = messageID
+	return nil
+}
+
+// bodySize returns the total size of all body sections fetched for the given message.
+func bodySize(msg *imap.Message) int {
+	size := 0
+	for _, literal := range msg.Body {
+		if literal != nil {
+			size += literal.Len()
+		}
+	}
+	return size
+}
+
+// GetRawBody returns the full RFC822 body of the given message, which must have been fetched with imap.FetchRFC822.
+// The body literal is replaced with a fresh copy, so the message can still be appended after this call.
+func GetRawBody(msg *imap.Message) ([]byte, error) {
+	section := &imap.BodySectionName{}
+	for name, literal := range msg.Body {
+		if !name.Equal(section) {
+			continue
+		} else if literal == nil {
+			break
+		}
+		data, err := io.ReadAll(literal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body of message '%d': %w", msg.Uid, err)
+		}
+		msg.Body[name] = bytes.NewBuffer(data)
+		return data, nil
+	}
+	return nil, fmt.Errorf("message '%d' is missing body", msg.Uid)
+}
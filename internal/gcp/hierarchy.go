@@ -0,0 +1,128 @@
+package gcp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// LabelDelimiter is the hierarchy delimiter of label paths (e.g. "Clients/Acme/Invoices"), as used throughout this
+// application and by Gmail itself. Label paths are translated to and from mailbox names using the server's own
+// hierarchy delimiter, which differs on some generic IMAP servers (e.g. "." on Dovecot or Courier setups).
+const LabelDelimiter = "/"
+
+// hierarchyDelimiter returns the server's hierarchy delimiter, querying it (with a `LIST "" ""` command) on first use.
+// Returns an empty string for servers with a flat namespace.
+func (g *Gmail) hierarchyDelimiter(c *client.Client) (string, error) {
+	g.delimiterMu.Lock()
+	defer g.delimiterMu.Unlock()
+	if g.delimiter != nil {
+		return *g.delimiter, nil
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "", mailboxes)
+	}()
+	delimiter := ""
+	for m := range mailboxes {
+		delimiter = m.Delimiter
+	}
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("failed to query hierarchy delimiter: %w", err)
+	}
+	g.delimiter = &delimiter
+	return delimiter, nil
+}
+
+// mailboxName translates the given label path to a mailbox name using the server's hierarchy delimiter, within the
+// server's personal namespace.
+func (g *Gmail) mailboxName(c *client.Client, label string) (string, error) {
+	delimiter, err := g.hierarchyDelimiter(c)
+	if err != nil {
+		return "", err
+	}
+	prefix, err := g.namespacePrefix(c)
+	if err != nil {
+		return "", err
+	}
+	return withNamespace(translateHierarchy(label, LabelDelimiter, delimiter), prefix), nil
+}
+
+// mailboxNames returns the names of the mailboxes to create for the given label path: those of its ancestors (from
+// the top-most down) followed by its own, since not all servers create parents implicitly.
+func (g *Gmail) mailboxNames(c *client.Client, label string) ([]string, error) {
+	delimiter, err := g.hierarchyDelimiter(c)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := g.namespacePrefix(c)
+	if err != nil {
+		return nil, err
+	}
+	name := translateHierarchy(label, LabelDelimiter, delimiter)
+	names := append(parentMailboxes(name, delimiter), name)
+	for i, name := range names {
+		names[i] = withNamespace(name, prefix)
+	}
+	return names, nil
+}
+
+// labelOf translates the given mailbox name (as listed by the server) to a label path, given the server's hierarchy
+// delimiter, dropping the server's personal namespace prefix.
+func (g *Gmail) labelOf(c *client.Client, name, delimiter string) (string, error) {
+	prefix, err := g.namespacePrefix(c)
+	if err != nil {
+		return "", err
+	}
+	return labelPath(withoutNamespace(name, prefix), delimiter), nil
+}
+
+// labelPath translates the given mailbox name to a label path, given the server's hierarchy delimiter.
+func labelPath(name, delimiter string) string {
+	return translateHierarchy(name, delimiter, LabelDelimiter)
+}
+
+// translateHierarchy replaces the given hierarchy delimiter in the given path with another one. Occurrences of the
+// target delimiter within path segments are replaced with "_", since they would otherwise introduce extra levels.
+// Paths are kept as-is if either delimiter is empty (i.e. a flat namespace), or if both delimiters are the same.
+func translateHierarchy(path, from, to string) string {
+	if from == "" || to == "" || from == to {
+		return path
+	}
+	segments := strings.Split(path, from)
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(segment, to, "_")
+	}
+	return strings.Join(segments, to)
+}
+
+// parentMailboxes returns the names of the ancestors of the given mailbox name, from the top-most down, given the
+// server's hierarchy delimiter.
+func parentMailboxes(name, delimiter string) []string {
+	if delimiter == "" {
+		return nil
+	}
+	var parents []string
+	for i := strings.Index(name, delimiter); i > 0; {
+		parents = append(parents, name[:i])
+		next := strings.Index(name[i+len(delimiter):], delimiter)
+		if next < 0 {
+			break
+		}
+		i += len(delimiter) + next
+	}
+	return parents
+}
+
+// isMailboxExistsError returns true if the given error reports an attempt to create an existing mailbox, as reported by
+// Gmail ("Duplicate folder name") or by servers supporting RFC 5530 response codes ("[ALREADYEXISTS]").
+func isMailboxExistsError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Duplicate folder name") ||
+		strings.Contains(msg, "ALREADYEXISTS") ||
+		strings.Contains(strings.ToLower(msg), "already exists")
+}
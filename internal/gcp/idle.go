@@ -0,0 +1,68 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// WaitForNewMessages waits (using IMAP IDLE, or polling on servers without it) until new messages arrive in the given
+// mailbox, or until the given timeout elapses. Returns true if new messages arrived. Since IDLE occupies its connection,
+// and unilateral updates must be subscribed to before the connection is used, a dedicated connection is opened for the
+// wait (in addition to the pool's connections), and logged out afterwards.
+func (g *Gmail) WaitForNewMessages(ctx context.Context, mailbox string, timeout time.Duration) (bool, error) {
+	c, err := g.factory(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer g.logout(c, "done waiting")
+	updates := make(chan client.Update, 16)
+	c.Updates = updates
+
+	name, err := g.mailboxName(c, mailbox)
+	if err != nil {
+		return false, err
+	}
+	status, err := c.Select(name, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to select '%s' in account %s: %w", mailbox, g.username, err)
+	}
+
+	// The client blocks on the updates channel, so it's drained until IDLE is done
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- c.Idle(stop, nil) }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	arrived, stopped := false, false
+	stopIdle := func() {
+		if !stopped {
+			close(stop)
+			stopped = true
+		}
+	}
+	for {
+		select {
+		case update := <-updates:
+			if u, ok := update.(*client.MailboxUpdate); ok && u.Mailbox.Messages > status.Messages {
+				arrived = true
+				stopIdle()
+			}
+		case <-timer.C:
+			stopIdle()
+		case <-ctx.Done():
+			stopIdle()
+		case err := <-done:
+			if err != nil {
+				return arrived, fmt.Errorf("failed to wait for messages in '%s': %w", mailbox, err)
+			} else if ctx.Err() != nil {
+				return arrived, ctx.Err()
+			}
+			return arrived, nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package gcp
+
+import (
+	"cmp"
+	"context"
+	"iter"
+	"slices"
+
+	"github.com/emersion/go-imap"
+)
+
+// DefaultIteratePageSize is the number of messages fetched per round trip by Iterate, unless configured otherwise.
+const DefaultIteratePageSize = 500
+
+// IterateOptions configure the messages yielded by Gmail.Iterate, and how they are fetched.
+type IterateOptions struct {
+	// Criteria selects the messages to iterate; all messages of the mailbox are iterated if nil.
+	Criteria *imap.SearchCriteria
+	// Items are the items fetched for each message (its UID is always fetched).
+	Items []imap.FetchItem
+	// PageSize is the number of messages fetched per round trip (defaults to DefaultIteratePageSize). A page is held
+	// in memory until all of its messages are yielded, so it should be smaller when fetching bodies.
+	PageSize int
+	// Limit is the maximum number of messages to iterate (with the lowest UIDs); zero means no limit.
+	Limit int
+	// Matched, if set, is invoked with the number of matching messages (before applying the limit) before the first
+	// page is fetched.
+	Matched func(n int)
+}
+
+// Iterate returns an iterator over the messages of the given mailbox matching the given options, in ascending UID
+// order. Besides the UIDs of the matching messages, only a single page of messages is held in memory: pages are
+// fetched one at a time as the iteration proceeds. Each page is yielded after its connection is returned to the pool,
+// so consumers may use the pool themselves (e.g. to fetch message bodies) without starving it. Failed fetches are
+// retried like other Gmail operations; if they ultimately fail, the error is yielded (with a nil message) and the
+// iteration ends.
+func (g *Gmail) Iterate(ctx context.Context, mailbox string, opts IterateOptions) iter.Seq2[*imap.Message, error] {
+	return func(yield func(*imap.Message, error) bool) {
+		criteria := opts.Criteria
+		if criteria == nil {
+			criteria = imap.NewSearchCriteria()
+		}
+		var uids []uint32
+		err := g.WithSession(ctx, mailbox, func(sess *Session) (err error) {
+			uids, err = sess.Search(criteria)
+			return err
+		})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		slices.Sort(uids)
+		if opts.Matched != nil {
+			opts.Matched(len(uids))
+		}
+		if opts.Limit > 0 && len(uids) > opts.Limit {
+			uids = uids[:opts.Limit]
+		}
+
+		pageSize := opts.PageSize
+		if pageSize <= 0 {
+			pageSize = DefaultIteratePageSize
+		}
+		for page := range slices.Chunk(uids, pageSize) {
+			messages, err := g.FetchByUIDs(ctx, mailbox, page, opts.Items...)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			slices.SortFunc(messages, func(a, b *imap.Message) int { return cmp.Compare(a.Uid, b.Uid) })
+			for _, msg := range messages {
+				if !yield(msg, nil) {
+					return
+				}
+			}
+		}
+	}
+}
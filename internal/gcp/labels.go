@@ -0,0 +1,87 @@
+package gcp
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// ensureLabels creates the given labels (and their parents) if they do not exist yet, since Gmail silently ignores
+// labels that do not exist when storing X-GM-LABELS. This covers labels created in the source account after the
+// label structure was synced. System labels (e.g. "\Inbox" or "\Starred") are ignored. Existing labels are listed
+// on first use, and then tracked by the pool.
+func (g *Gmail) ensureLabels(c *client.Client, labels []string) error {
+	if err := g.checkWritable("create labels"); err != nil {
+		return err
+	} else if g.dryRun {
+		// Labels are never stored in dry runs
+		return nil
+	}
+	g.labelsMu.Lock()
+	defer g.labelsMu.Unlock()
+	if g.labels == nil {
+		existing, err := g.listLabels(c)
+		if err != nil {
+			return err
+		}
+		g.labels = existing
+	}
+
+	delimiter, err := g.hierarchyDelimiter(c)
+	if err != nil {
+		return err
+	}
+	for _, label := range labels {
+		if strings.HasPrefix(label, `\`) || g.labels[label] {
+			continue
+		}
+		mailboxes, err := g.mailboxNames(c, label)
+		if err != nil {
+			return err
+		}
+		for _, mailbox := range mailboxes {
+			if err := c.Create(mailbox); err != nil && !isMailboxExistsError(err) {
+				return fmt.Errorf("failed to create label '%s': %w", label, err)
+			}
+			path, err := g.labelOf(c, mailbox, delimiter)
+			if err != nil {
+				return err
+			}
+			g.labels[path] = true
+		}
+		slog.Info("Created missing label", "label", label, "username", g.username)
+	}
+	return nil
+}
+
+// listLabels returns the set of label paths of all mailboxes of the account.
+func (g *Gmail) listLabels(c *client.Client) (map[string]bool, error) {
+	prefix, err := g.namespacePrefix(c)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make(chan *imap.MailboxInfo, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+	labels := make(map[string]bool)
+	for m := range mailboxes {
+		labels[labelPath(withoutNamespace(m.Name, prefix), m.Delimiter)] = true
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list labels: %w", err)
+	}
+	return labels, nil
+}
+
+// forgetLabels drops the tracked set of existing labels (e.g. after labels were deleted or renamed), so it is listed
+// again on next use.
+func (g *Gmail) forgetLabels() {
+	g.labelsMu.Lock()
+	defer g.labelsMu.Unlock()
+	g.labels = nil
+}
@@ -0,0 +1,91 @@
+package gcp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// namespaceResponse handles the untagged response of the NAMESPACE command (RFC 2342), e.g.
+// `* NAMESPACE (("INBOX." ".")) NIL NIL`, collecting the prefixes of the personal namespaces.
+type namespaceResponse struct {
+	personal []string
+}
+
+func (r *namespaceResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "NAMESPACE" {
+		return responses.ErrUnhandled
+	} else if len(fields) == 0 {
+		return errors.New("invalid NAMESPACE response: no namespaces")
+	}
+	personal, _ := fields[0].([]any) // NIL if the server has no personal namespace
+	for _, field := range personal {
+		namespace, ok := field.([]any)
+		if !ok || len(namespace) == 0 {
+			return fmt.Errorf("invalid NAMESPACE response: invalid personal namespace '%v'", field)
+		}
+		prefix, err := imap.ParseString(namespace[0])
+		if err != nil {
+			return fmt.Errorf("invalid NAMESPACE response: invalid prefix: %w", err)
+		}
+		r.personal = append(r.personal, prefix)
+	}
+	return nil
+}
+
+// namespacePrefix returns the prefix of the server's personal namespace (e.g. "INBOX." on Courier and some Dovecot
+// setups), under which mailboxes other than INBOX must be created, querying it (with a NAMESPACE command) on first use.
+// Returns an empty string for Gmail (whose personal namespace has no prefix), and for servers not supporting the
+// NAMESPACE extension.
+func (g *Gmail) namespacePrefix(c *client.Client) (string, error) {
+	if g.gmailExtensions {
+		return "", nil
+	}
+	g.namespaceMu.Lock()
+	defer g.namespaceMu.Unlock()
+	if g.namespace != nil {
+		return *g.namespace, nil
+	}
+
+	prefix := ""
+	if supported, err := c.Support("NAMESPACE"); err != nil {
+		return "", fmt.Errorf("failed to check server capabilities: %w", err)
+	} else if supported {
+		res := &namespaceResponse{}
+		if status, err := c.Execute(&imap.Command{Name: "NAMESPACE"}, res); err != nil {
+			return "", fmt.Errorf("failed to query namespaces: %w", err)
+		} else if err := status.Err(); err != nil {
+			return "", fmt.Errorf("failed to query namespaces: %w", err)
+		} else if len(res.personal) > 0 {
+			prefix = res.personal[0]
+		}
+		if prefix != "" {
+			slog.Info("Server requires a prefix for mailboxes", "username", g.username, "prefix", prefix)
+		}
+	}
+	g.namespace = &prefix
+	return prefix, nil
+}
+
+// withNamespace returns the given mailbox name within the given personal namespace prefix. INBOX is never prefixed,
+// since it exists outside any namespace.
+func withNamespace(name, prefix string) string {
+	if prefix == "" || strings.EqualFold(name, InboxMailbox) || strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// withoutNamespace returns the given mailbox name without the given personal namespace prefix.
+func withoutNamespace(name, prefix string) string {
+	if prefix == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, prefix)
+}
@@ -0,0 +1,193 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	minThrottleFactor       = 1.0 / 64
+	throttleRecoveryFactor  = 1.25
+	throttleRecoveryPeriod  = time.Minute
+	initialThrottleCooldown = 30 * time.Second
+	maxThrottleCooldown     = 10 * time.Minute
+)
+
+// rateLimiter limits the rate of IMAP commands and transferred bytes of a Gmail connection pool, and adapts these
+// rates when Gmail signals the account is being throttled: each throttle response halves the effective rates and
+// pauses all commands for a cooldown period, and rates are gradually restored while no throttling is observed.
+type rateLimiter struct {
+	username          string
+	commandsPerMinute int
+	bytesPerMinute    int
+	commands          *rate.Limiter
+	bytes             *rate.Limiter
+	transferred       atomic.Int64
+
+	mu             sync.Mutex
+	factor         float64
+	cooldown       time.Duration
+	pausedUntil    time.Time
+	lastAdjustment time.Time
+}
+
+// newRateLimiter creates a rate limiter allowing the given number of commands and bytes per minute. A zero value for
+// either means that dimension is not limited (throttle cooldowns are still applied).
+func newRateLimiter(username string, commandsPerMinute, bytesPerMinute int) *rateLimiter {
+	l := &rateLimiter{
+		username:          username,
+		commandsPerMinute: commandsPerMinute,
+		bytesPerMinute:    bytesPerMinute,
+		commands:          rate.NewLimiter(rate.Inf, 1),
+		bytes:             rate.NewLimiter(rate.Inf, 1),
+		factor:            1,
+		cooldown:          initialThrottleCooldown,
+	}
+	l.apply()
+	return l
+}
+
+// apply updates the underlying limiters with the configured rates, scaled by the current throttle factor.
+// Must be called while holding the lock (or before the limiter is shared).
+func (l *rateLimiter) apply() {
+	if l.commandsPerMinute > 0 {
+		perSecond := float64(l.commandsPerMinute) / 60 * l.factor
+		l.commands.SetLimit(rate.Limit(perSecond))
+		l.commands.SetBurst(max(1, int(perSecond)))
+	} else {
+		l.commands.SetLimit(rate.Inf)
+	}
+	if l.bytesPerMinute > 0 {
+		perSecond := float64(l.bytesPerMinute) / 60 * l.factor
+		l.bytes.SetLimit(rate.Limit(perSecond))
+		l.bytes.SetBurst(max(1, int(perSecond)))
+	} else {
+		l.bytes.SetLimit(rate.Inf)
+	}
+}
+
+// set changes the configured rates; the current throttle factor still applies to them.
+func (l *rateLimiter) set(commandsPerMinute, bytesPerMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commandsPerMinute, l.bytesPerMinute = commandsPerMinute, bytesPerMinute
+	l.apply()
+}
+
+// pause returns how long commands should currently be paused for (zero if not paused), and gradually recovers the
+// rates if no throttling was observed for a while.
+func (l *rateLimiter) pause() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.factor < 1 && now.Sub(l.lastAdjustment) >= throttleRecoveryPeriod {
+		l.factor = min(1, l.factor*throttleRecoveryFactor)
+		l.cooldown = initialThrottleCooldown
+		l.lastAdjustment = now
+		l.apply()
+		slog.Info("Recovering Gmail IMAP rates", "username", l.username, "factor", l.factor)
+	}
+	return 0
+}
+
+// WaitCommand blocks until a single IMAP command may be sent.
+func (l *rateLimiter) WaitCommand(ctx context.Context) error {
+	if d := l.pause(); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err := l.commands.Wait(ctx); err != nil {
+		return fmt.Errorf("failed waiting for command rate limiter: %w", err)
+	}
+	return nil
+}
+
+// WaitBytes blocks until the given number of bytes may be transferred, in chunks no larger than the burst of the bytes
+// limiter, which may change concurrently.
+func (l *rateLimiter) WaitBytes(ctx context.Context, n int) error {
+	l.transferred.Add(int64(n))
+	l.mu.Lock()
+	limited := l.bytesPerMinute > 0
+	l.mu.Unlock()
+	if !limited {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, l.bytes.Burst())
+		if err := l.bytes.WaitN(ctx, chunk); err != nil {
+			if ctx.Err() == nil && chunk > l.bytes.Burst() {
+				// The burst was lowered since the chunk was sized (e.g. by a throttle response), so it's resized
+				continue
+			}
+			return fmt.Errorf("failed waiting for bandwidth rate limiter: %w", err)
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Throttled records that Gmail throttled the account: rates are halved, and all commands are paused for a cooldown
+// period, which doubles for consecutive throttle responses. Returns the cooldown period.
+func (l *rateLimiter) Throttled(err error) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		// Already cooling down (likely another connection hitting the same throttle)
+		return l.pausedUntil.Sub(now)
+	}
+
+	cooldown := l.cooldown
+	l.cooldown = min(l.cooldown*2, maxThrottleCooldown)
+	l.pausedUntil = now.Add(cooldown)
+	l.factor = max(minThrottleFactor, l.factor/2)
+	l.lastAdjustment = now
+	l.apply()
+	slog.Warn("Gmail is throttling the account, slowing down", "err", err, "username", l.username, "factor", l.factor, "cooldown", cooldown)
+	return cooldown
+}
+
+// SetRateLimits changes the number of IMAP commands and transferred bytes per minute allowed by the pool (zero means
+// unlimited) while it's in use, e.g. when configuration is reloaded. If Gmail is throttling the account, the new rates
+// are slowed down just like the previous ones were.
+func (g *Gmail) SetRateLimits(commandsPerMinute, bytesPerMinute int) {
+	g.limiter.set(commandsPerMinute, bytesPerMinute)
+}
+
+// Usage describes the consumption and throttling state of a Gmail connection pool.
+type Usage struct {
+	// TransferredBytes is the number of message bytes fetched and appended since the pool was created.
+	TransferredBytes int64
+	// ThrottleFactor is the fraction of the configured rates currently in effect (1 when not throttled).
+	ThrottleFactor float64
+	// PausedFor is how long commands remain paused because Gmail throttled the account (zero if not paused).
+	PausedFor time.Duration
+}
+
+// Usage returns the current consumption and throttling state of the pool.
+func (g *Gmail) Usage() Usage {
+	l := g.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Usage{
+		TransferredBytes: l.transferred.Load(),
+		ThrottleFactor:   l.factor,
+		PausedFor:        max(0, time.Until(l.pausedUntil)),
+	}
+}
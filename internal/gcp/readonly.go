@@ -0,0 +1,117 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// ErrReadOnly is returned by operations that would modify an account accessed through a read-only pool.
+var ErrReadOnly = errors.New("account is read-only")
+
+// ReadOnlyGmail is a view of a Gmail connection pool that only exposes operations reading from the account, so code
+// holding it cannot modify the account. It is used for the source account, which must never be modified.
+type ReadOnlyGmail struct {
+	g *Gmail
+}
+
+// ReadOnly returns a read-only view of the pool. From then on, the pool itself refuses any command that would modify
+// the account with ErrReadOnly (even through other references to it), as a safety net for code paths shared with
+// writable pools.
+func (g *Gmail) ReadOnly() *ReadOnlyGmail {
+	g.readOnly.Store(true)
+	return &ReadOnlyGmail{g: g}
+}
+
+// checkWritable returns ErrReadOnly if the pool is read-only.
+func (g *Gmail) checkWritable(operation string) error {
+	if g.readOnly.Load() {
+		return fmt.Errorf("refusing to %s in account %s: %w", operation, g.username, ErrReadOnly)
+	}
+	return nil
+}
+
+func (r *ReadOnlyGmail) Close(ctx context.Context) error {
+	return r.g.Close(ctx)
+}
+
+func (r *ReadOnlyGmail) GmailExtensions() bool {
+	return r.g.GmailExtensions()
+}
+
+func (r *ReadOnlyGmail) PoolStats() (open, idle int) {
+	return r.g.PoolStats()
+}
+
+func (r *ReadOnlyGmail) DefaultMailbox() string {
+	return r.g.DefaultMailbox()
+}
+
+func (r *ReadOnlyGmail) Usage() Usage {
+	return r.g.Usage()
+}
+
+func (r *ReadOnlyGmail) SetRateLimits(commandsPerMinute, bytesPerMinute int) {
+	r.g.SetRateLimits(commandsPerMinute, bytesPerMinute)
+}
+
+func (r *ReadOnlyGmail) FetchMailboxNames(ctx context.Context, ignoreSystemLabels, ignoreUnselectables bool) ([]string, error) {
+	return r.g.FetchMailboxNames(ctx, ignoreSystemLabels, ignoreUnselectables)
+}
+
+func (r *ReadOnlyGmail) CountMessages(ctx context.Context, name string) (uint32, error) {
+	return r.g.CountMessages(ctx, name)
+}
+
+func (r *ReadOnlyGmail) Search(ctx context.Context, mailbox, query string) ([]uint32, error) {
+	return r.g.Search(ctx, mailbox, query)
+}
+
+func (r *ReadOnlyGmail) FindAllUIDs(ctx context.Context, mailbox string) ([]uint32, error) {
+	return r.g.FindAllUIDs(ctx, mailbox)
+}
+
+func (r *ReadOnlyGmail) FindUIDByMessageID(ctx context.Context, mailbox string, messageID string) (*uint32, error) {
+	return r.g.FindUIDByMessageID(ctx, mailbox, messageID)
+}
+
+func (r *ReadOnlyGmail) FindUIDsByMessageIDs(ctx context.Context, mailbox string, messageIDs []string) (map[string]uint32, error) {
+	return r.g.FindUIDsByMessageIDs(ctx, mailbox, messageIDs)
+}
+
+func (r *ReadOnlyGmail) FetchByUIDs(ctx context.Context, mailbox string, uids []uint32, items ...imap.FetchItem) ([]*imap.Message, error) {
+	return r.g.FetchByUIDs(ctx, mailbox, uids, items...)
+}
+
+func (r *ReadOnlyGmail) FetchByUIDsStream(ctx context.Context, mailbox string, uids []uint32, items []imap.FetchItem, fn func(msg *imap.Message) error) error {
+	return r.g.FetchByUIDsStream(ctx, mailbox, uids, items, fn)
+}
+
+func (r *ReadOnlyGmail) FetchMessageByUID(ctx context.Context, mailbox string, uid uint32, items ...imap.FetchItem) (*imap.Message, error) {
+	return r.g.FetchMessageByUID(ctx, mailbox, uid, items...)
+}
+
+func (r *ReadOnlyGmail) Iterate(ctx context.Context, mailbox string, opts IterateOptions) iter.Seq2[*imap.Message, error] {
+	return r.g.Iterate(ctx, mailbox, opts)
+}
+
+func (r *ReadOnlyGmail) DownloadBody(ctx context.Context, mailbox string, uid uint32, chunkSize int, syntheticMessageID string, w io.Writer) (int64, error) {
+	return r.g.DownloadBody(ctx, mailbox, uid, chunkSize, syntheticMessageID, w)
+}
+
+func (r *ReadOnlyGmail) FetchTextPrefix(ctx context.Context, mailbox string, uid uint32, length int) ([]byte, error) {
+	return r.g.FetchTextPrefix(ctx, mailbox, uid, length)
+}
+
+func (r *ReadOnlyGmail) MailboxStatus(ctx context.Context, name string) (*imap.MailboxStatus, error) {
+	return r.g.MailboxStatus(ctx, name)
+}
+
+func (r *ReadOnlyGmail) WaitForNewMessages(ctx context.Context, mailbox string, timeout time.Duration) (bool, error) {
+	return r.g.WaitForNewMessages(ctx, mailbox, timeout)
+}
@@ -0,0 +1,523 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Session is a single pooled connection with a mailbox selected on it. It allows a sequence of commands (e.g. search,
+// fetch & store) to run on the same connection, without checking out a connection and re-selecting the mailbox for
+// each of them. A session is only valid inside the callback given to Gmail.WithSession, and is not safe for
+// concurrent use.
+type Session struct {
+	ctx      context.Context
+	g        *Gmail
+	client   *client.Client
+	mailbox  string
+	status   *imap.MailboxStatus
+	readOnly bool
+}
+
+// WithSession checks out a connection, selects the given mailbox on it, and invokes the given callback with a session
+// pinned to that connection. The mailbox is selected read-only, and is re-selected for writing on the first command
+// that modifies it. Like all other Gmail operations, the callback is retried as a whole on failure, and should
+// therefore be safe to repeat.
+func (g *Gmail) WithSession(ctx context.Context, mailbox string, fn func(sess *Session) error) error {
+	_, err := withRetry(
+		ctx,
+		g,
+		func() (any, error) {
+			c, release, err := g.getIMAPConnection(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get Gmail connection: %w", err)
+			}
+			defer release()
+
+			sess := &Session{ctx: ctx, g: g, client: c, mailbox: mailbox}
+			if err := sess.selectMailbox(true); err != nil {
+				return nil, err
+			}
+			return nil, fn(sess)
+		},
+	)
+	return err
+}
+
+// Mailbox returns the name of the mailbox selected by this session.
+func (s *Session) Mailbox() string {
+	return s.mailbox
+}
+
+// Status returns the status of the selected mailbox (e.g. its UIDVALIDITY and next UID), as of its selection.
+func (s *Session) Status() *imap.MailboxStatus {
+	return s.status
+}
+
+func (s *Session) selectMailbox(readOnly bool) error {
+	name, err := s.g.mailboxName(s.client, s.mailbox)
+	if err != nil {
+		return err
+	}
+	status, err := s.client.Select(name, readOnly)
+	if err != nil {
+		return fmt.Errorf("failed to select '%s' in account %s: %w", s.mailbox, s.g.username, err)
+	}
+	s.status = status
+	s.readOnly = readOnly
+	return nil
+}
+
+// beginCommand waits for the pool's rate limiter to allow another command, and re-selects the mailbox for writing if
+// the command is going to modify it and the mailbox is currently selected read-only. Commands modifying a read-only
+// pool's account fail with ErrReadOnly.
+func (s *Session) beginCommand(write bool) error {
+	if write {
+		if err := s.g.checkWritable("modify '" + s.mailbox + "'"); err != nil {
+			return err
+		}
+	}
+	if err := s.g.limiter.WaitCommand(s.ctx); err != nil {
+		return err
+	}
+	if write && s.readOnly {
+		return s.selectMailbox(false)
+	}
+	return nil
+}
+
+// Search returns the UIDs of all messages in the mailbox matching the given criteria.
+func (s *Session) Search(criteria *imap.SearchCriteria) ([]uint32, error) {
+	if err := s.beginCommand(false); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	uids, err := s.client.UidSearch(criteria)
+	s.g.searchDuration.Record(s.ctx, time.Since(started))
+	if err != nil {
+		return nil, fmt.Errorf("failed performing search in '%s': %w", s.mailbox, err)
+	}
+	return uids, nil
+}
+
+// SearchRaw returns the UIDs of all messages in the mailbox matching the given Gmail search query (e.g.
+// "from:alice has:attachment"), using the X-GM-RAW search extension.
+func (s *Session) SearchRaw(query string) ([]uint32, error) {
+	if !s.g.gmailExtensions {
+		return nil, fmt.Errorf("raw Gmail search queries require Gmail extensions")
+	} else if err := s.beginCommand(false); err != nil {
+		return nil, err
+	}
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "SEARCH", Arguments: []any{imap.RawString(GmailRawSearchExt), query}}}
+	res := new(responses.Search)
+	started := time.Now()
+	status, err := s.client.Execute(cmd, res)
+	s.g.searchDuration.Record(s.ctx, time.Since(started))
+	if err != nil {
+		return nil, fmt.Errorf("failed performing raw search in '%s': %w", s.mailbox, err)
+	} else if err := status.Err(); err != nil {
+		return nil, fmt.Errorf("failed performing raw search in '%s': %w", s.mailbox, err)
+	}
+	return res.Ids, nil
+}
+
+// FindAllUIDs returns the UIDs of all messages in the mailbox.
+func (s *Session) FindAllUIDs() ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.SeqNum = new(imap.SeqSet)
+	criteria.SeqNum.AddRange(1, 0)
+	uids, err := s.Search(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("failed performing criteria search for all UIDs: %w", err)
+	}
+	return uids, nil
+}
+
+// FindUIDByMessageID returns the UID of the message with the given Message-ID header, or nil if there is no such
+// message in the mailbox.
+func (s *Session) FindUIDByMessageID(messageID string) (*uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	uids, err := s.Search(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for message by Message-ID: %w", err)
+	} else if len(uids) == 0 {
+		return nil, nil
+	} else if len(uids) > 1 {
+		slog.Warn("Found multiple UIDs for Message-ID", "messageID", messageID, "uids", uids)
+	}
+	return &uids[0], nil
+}
+
+// FindUIDsByMessageIDs returns the UIDs of the messages with the given Message-ID headers, keyed by Message-ID. Message-IDs
+// with no matching message are absent from the result. All given Message-IDs are checked with a single SEARCH command
+// of OR'd HEADER terms, followed by a single FETCH of the envelopes of the matching messages (header searches match
+// substrings, so the envelopes are needed both to attribute and to confirm the matches). Callers should limit the
+// number of Message-IDs per call (see MessageIDSearchBatchSize) to keep the command reasonably short.
+func (s *Session) FindUIDsByMessageIDs(messageIDs []string) (map[string]uint32, error) {
+	found := make(map[string]uint32)
+	if len(messageIDs) == 0 {
+		return found, nil
+	}
+
+	uids, err := s.Search(messageIDsCriteria(messageIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for messages by Message-ID: %w", err)
+	} else if len(uids) == 0 {
+		return found, nil
+	}
+
+	messages, err := s.Fetch(uids, imap.FetchEnvelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch envelopes of messages found by Message-ID: %w", err)
+	}
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, messageID := range messageIDs {
+		wanted[messageID] = true
+	}
+	for _, msg := range messages {
+		if msg.Envelope == nil || !wanted[msg.Envelope.MessageId] {
+			continue
+		} else if uid, ok := found[msg.Envelope.MessageId]; ok {
+			slog.Warn("Found multiple UIDs for Message-ID", "messageID", msg.Envelope.MessageId, "uids", []uint32{uid, msg.Uid})
+			continue
+		}
+		found[msg.Envelope.MessageId] = msg.Uid
+	}
+	return found, nil
+}
+
+// messageIDsCriteria returns search criteria matching any of the given Message-IDs, as a balanced tree of OR'd HEADER
+// terms (IMAP's OR is binary, and a balanced tree keeps nesting depth logarithmic).
+func messageIDsCriteria(messageIDs []string) *imap.SearchCriteria {
+	if len(messageIDs) == 1 {
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Add("Message-Id", messageIDs[0])
+		return criteria
+	}
+	criteria := imap.NewSearchCriteria()
+	half := len(messageIDs) / 2
+	criteria.Or = [][2]*imap.SearchCriteria{{messageIDsCriteria(messageIDs[:half]), messageIDsCriteria(messageIDs[half:])}}
+	return criteria
+}
+
+// Fetch fetches the given items of the messages with the given UIDs.
+func (s *Session) Fetch(uids []uint32, items ...imap.FetchItem) ([]*imap.Message, error) {
+	if err := s.beginCommand(false); err != nil {
+		return nil, err
+	}
+
+	items = s.g.fetchItems(items)
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	messagesCh := make(chan *imap.Message, len(uids))
+	started := time.Now()
+	err := s.client.UidFetch(seqSet, items, messagesCh)
+	s.g.fetchDuration.Record(s.ctx, time.Since(started))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages from '%s': %w", s.mailbox, err)
+	}
+	messages := make([]*imap.Message, 0, len(uids))
+	size := 0
+	for msg := range messagesCh {
+		messages = append(messages, msg)
+		size += bodySize(msg)
+	}
+	if err := s.g.limiter.WaitBytes(s.ctx, size); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// FetchStream fetches the given items of the messages with the given UIDs, invoking the given callback for each
+// message as it arrives rather than collecting all of them in memory first. If the callback fails, the remaining
+// messages are drained (but not processed), and the callback's error is returned.
+func (s *Session) FetchStream(uids []uint32, items []imap.FetchItem, fn func(msg *imap.Message) error) error {
+	if err := s.beginCommand(false); err != nil {
+		return err
+	}
+
+	items = s.g.fetchItems(items)
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	messagesCh := make(chan *imap.Message, 1)
+	fetchErrCh := make(chan error, 1)
+	started := time.Now()
+	go func() { fetchErrCh <- s.client.UidFetch(seqSet, items, messagesCh) }()
+
+	// Time spent processing messages (rather than waiting for them) is excluded from the reported latency
+	var fnErr error
+	var processing time.Duration
+	for msg := range messagesCh {
+		if fnErr != nil {
+			continue
+		}
+		processingStarted := time.Now()
+		if err := s.g.limiter.WaitBytes(s.ctx, bodySize(msg)); err != nil {
+			fnErr = err
+		} else {
+			fnErr = fn(msg)
+		}
+		processing += time.Since(processingStarted)
+	}
+	err := <-fetchErrCh
+	s.g.fetchDuration.Record(s.ctx, time.Since(started)-processing)
+	if err != nil {
+		return fmt.Errorf("failed to fetch messages from '%s': %w", s.mailbox, err)
+	}
+	return fnErr
+}
+
+// FetchMessageByUID fetches the given items of the message with the given UID.
+func (s *Session) FetchMessageByUID(uid uint32, items ...imap.FetchItem) (*imap.Message, error) {
+	messages, err := s.Fetch([]uint32{uid}, items...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message '%d' from account '%s': %w", uid, s.g.username, err)
+	} else if len(messages) == 0 {
+		return nil, fmt.Errorf("server did not provide message '%d' from account '%s'", uid, s.g.username)
+	}
+	return messages[0], nil
+}
+
+// Store updates the given item (e.g. flags or labels) of the messages with the given UIDs.
+func (s *Session) Store(uids []uint32, item imap.StoreItem, value []any) error {
+	if err := s.g.checkWritable("store in '" + s.mailbox + "'"); err != nil {
+		return err
+	} else if s.g.skipWrite("store", "mailbox", s.mailbox, "uids", uids, "item", item, "value", value) {
+		return nil
+	} else if err := s.beginCommand(true); err != nil {
+		return err
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	if err := s.client.UidStore(seqSet, item, value, nil); err != nil {
+		return fmt.Errorf("failed to store '%s' in '%s': %w", item, s.mailbox, err)
+	}
+	return nil
+}
+
+// Expunge permanently removes the messages with the given UIDs that are flagged as deleted. Servers without the
+// UIDPLUS extension can only expunge all messages of the mailbox that are flagged as deleted, so the deleted flag of
+// the other messages is cleared before expunging, and restored afterwards.
+func (s *Session) Expunge(uids []uint32) error {
+	if err := s.g.checkWritable("expunge in '" + s.mailbox + "'"); err != nil {
+		return err
+	} else if s.g.skipWrite("expunge", "mailbox", s.mailbox, "uids", uids) {
+		return nil
+	} else if err := s.beginCommand(true); err != nil {
+		return err
+	}
+	if uidPlus, err := s.client.Support("UIDPLUS"); err != nil {
+		return fmt.Errorf("failed to check server capabilities: %w", err)
+	} else if !uidPlus {
+		return s.expungeOnly(uids)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []any{seqSet}}}
+	if status, err := s.client.Execute(cmd, nil); err != nil {
+		return fmt.Errorf("failed to expunge messages of '%s': %w", s.mailbox, err)
+	} else if err := status.Err(); err != nil {
+		return fmt.Errorf("failed to expunge messages of '%s': %w", s.mailbox, err)
+	}
+	return nil
+}
+
+// expungeOnly expunges the messages with the given UIDs that are flagged as deleted, without UIDPLUS: the deleted flag
+// of other messages is cleared before expunging the mailbox, and restored afterwards (even if expunging fails).
+// Messages flagged as deleted by other clients meanwhile are expunged too.
+func (s *Session) expungeOnly(uids []uint32) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	deleted, err := s.client.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("failed to search deleted messages of '%s': %w", s.mailbox, err)
+	}
+	others := slices.DeleteFunc(deleted, func(uid uint32) bool { return slices.Contains(uids, uid) })
+	if len(others) == 0 {
+		if err := s.client.Expunge(nil); err != nil {
+			return fmt.Errorf("failed to expunge '%s': %w", s.mailbox, err)
+		}
+		return nil
+	}
+
+	kept := new(imap.SeqSet)
+	kept.AddNum(others...)
+	if err := s.client.UidStore(kept, imap.FormatFlagsOp(imap.RemoveFlags, true), []any{imap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("failed to clear deleted flag of other messages of '%s': %w", s.mailbox, err)
+	}
+	expungeErr := s.client.Expunge(nil)
+	if err := s.client.UidStore(kept, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("failed to restore deleted flag of messages %v of '%s': %w", others, s.mailbox, errors.Join(err, expungeErr))
+	} else if expungeErr != nil {
+		return fmt.Errorf("failed to expunge '%s': %w", s.mailbox, expungeErr)
+	}
+	return nil
+}
+
+// Move moves the messages with the given UIDs into the given mailbox, using the MOVE extension if the server supports
+// it, or copying and expunging them otherwise.
+func (s *Session) Move(uids []uint32, mailbox string) error {
+	if err := s.g.checkWritable("move in '" + s.mailbox + "'"); err != nil {
+		return err
+	} else if s.g.skipWrite("move", "mailbox", s.mailbox, "uids", uids, "destination", mailbox) {
+		return nil
+	} else if err := s.beginCommand(true); err != nil {
+		return err
+	}
+	name, err := s.g.mailboxName(s.client, mailbox)
+	if err != nil {
+		return err
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	if err := s.client.UidMove(seqSet, name); err != nil {
+		return fmt.Errorf("failed to move messages from '%s' to '%s': %w", s.mailbox, mailbox, err)
+	}
+	return nil
+}
+
+// storeLabels replaces the labels of the message with the given UID with the labels of the given message, creating
+// labels missing in the account first. This is a no-op when Gmail extensions are disabled.
+func (s *Session) storeLabels(uid uint32, msg *imap.Message) error {
+	if !s.g.gmailExtensions {
+		return nil
+	}
+	labels, err := GetLabels(msg)
+	if err != nil {
+		return err
+	} else if err := s.g.ensureLabels(s.client, labels); err != nil {
+		return err
+	}
+	labelsAsAnyArray := make([]any, len(labels))
+	for i, label := range labels {
+		labelsAsAnyArray[i] = label
+	}
+	return s.Store([]uint32{uid}, GmailLabelsExt+".SILENT", labelsAsAnyArray)
+}
+
+// Append appends the given message (which must include its full body) to the mailbox, applies its labels, and returns
+// the UID of the new message.
+func (s *Session) Append(msg *imap.Message) (uint32, error) {
+	if msg.Uid == 0 {
+		return 0, fmt.Errorf("cannot append message %d - it has no UID", msg.Uid)
+	}
+
+	r := msg.GetBody(&imap.BodySectionName{})
+	if r == nil {
+		return 0, fmt.Errorf("cannot append message %d - it is missing body", msg.Uid)
+	}
+
+	if err := s.g.checkWritable("append to '" + s.mailbox + "'"); err != nil {
+		return 0, err
+	} else if s.g.skipWrite("append", "mailbox", s.mailbox, "messageID", msg.Envelope.MessageId, "size", r.Len()) {
+		return 0, nil
+	}
+
+	if seeker, ok := r.(io.Seeker); ok {
+		// Rewind seekable literals (e.g. spooled bodies), in case a previous attempt consumed them
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("cannot append message %d - failed to rewind body: %w", msg.Uid, err)
+		}
+	}
+
+	if err := s.beginCommand(true); err != nil {
+		return 0, err
+	} else if err := s.g.limiter.WaitBytes(s.ctx, r.Len()); err != nil {
+		return 0, err
+	}
+
+	name, err := s.g.mailboxName(s.client, s.mailbox)
+	if err != nil {
+		return 0, err
+	}
+	started := time.Now()
+	err = s.client.Append(name, msg.Flags, msg.InternalDate, r)
+	s.g.appendDuration.Record(s.ctx, time.Since(started))
+	if err != nil {
+		return 0, fmt.Errorf("failed to append message %d to target: %w", msg.Uid, err)
+	}
+
+	messageID := msg.Envelope.MessageId
+	uid, err := s.FindUIDByMessageID(messageID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find UID for newly-appended message '%s' in target account: %w", messageID, err)
+	} else if uid == nil {
+		return 0, fmt.Errorf("could not find UID for newly appended message '%s' in target account", messageID)
+	}
+
+	if err := s.storeLabels(*uid, msg); err != nil {
+		return 0, fmt.Errorf("failed to store labels on target message '%d': %w", *uid, err)
+	}
+
+	return *uid, nil
+}
+
+// Update finds the message with the same Message-ID as the given message, and replaces its labels and flags with
+// those of the given message.
+func (s *Session) Update(msg *imap.Message) error {
+	_, err := s.UpdateAt(0, msg)
+	return err
+}
+
+// UpdateAt is like Update, but addresses the message by the given UID (e.g. recorded when it was appended) if it is
+// not zero, rather than searching for it. The UID is verified to still hold a message with the same Message-ID first;
+// if it does not, the message is searched for like Update does. Returns the UID of the updated message.
+func (s *Session) UpdateAt(uid uint32, msg *imap.Message) (uint32, error) {
+	// We use the `Message-Id` value to find the message in this account
+	messageID := msg.Envelope.MessageId
+	if messageID == "" {
+		return 0, fmt.Errorf("cannot update message %d - it has no Message-ID (missing envelope?)", msg.Uid)
+	}
+	if err := s.g.checkWritable("update messages of '" + s.mailbox + "'"); err != nil {
+		return 0, err
+	}
+
+	if uid != 0 {
+		// An expunged UID yields no message, rather than an error
+		existing, err := s.Fetch([]uint32{uid}, imap.FetchEnvelope)
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch message '%d' in account '%s': %w", uid, s.g.username, err)
+		} else if len(existing) == 1 && existing[0].Envelope != nil && existing[0].Envelope.MessageId == messageID {
+			return uid, s.update(uid, msg)
+		}
+		slog.Debug("UID no longer holds message, searching for it", "uid", uid, "messageID", messageID, "username", s.g.username)
+	}
+
+	found, err := s.FindUIDByMessageID(messageID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find message '%s' in account '%s': %w", messageID, s.g.username, err)
+	} else if found == nil && s.g.dryRun {
+		// The message may have been "appended" earlier in this dry run
+		return 0, nil
+	} else if found == nil {
+		return 0, fmt.Errorf("could not find UID for message '%s' in target account: %w", messageID, ErrMessageNotFound)
+	}
+	return *found, s.update(*found, msg)
+}
+
+// update replaces the labels and flags of the message with the given UID with those of the given message.
+func (s *Session) update(uid uint32, msg *imap.Message) error {
+	if err := s.storeLabels(uid, msg); err != nil {
+		return fmt.Errorf("failed to update labels of target message '%d': %w", uid, err)
+	}
+
+	flagsAsAnyArray := make([]any, len(msg.Flags))
+	for i, flag := range msg.Flags {
+		flagsAsAnyArray[i] = flag
+	}
+	if err := s.Store([]uint32{uid}, imap.FormatFlagsOp(imap.SetFlags, true), flagsAsAnyArray); err != nil {
+		return fmt.Errorf("failed to update flags of target message '%d': %w", uid, err)
+	}
+
+	return nil
+}
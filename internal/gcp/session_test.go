@@ -0,0 +1,212 @@
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/shadow/imaptest"
+	"github.com/emersion/go-imap"
+)
+
+const testUsername = "test@example.com"
+
+// newShadowGmail serves a shadow account, seeded with the given number of INBOX messages, and returns a pool connected
+// to it along with the server (to inspect the account without going through the pool).
+func newShadowGmail(t *testing.T, messages int, opts ...GmailOption) (*Gmail, *imaptest.Server) {
+	t.Helper()
+	srv := imaptest.NewServer(t)
+	u, err := srv.Backend.Login(nil, testUsername, "")
+	if err != nil {
+		t.Fatalf("failed to create shadow account: %v", err)
+	}
+	inbox, err := u.GetMailbox(InboxMailbox)
+	if err != nil {
+		t.Fatalf("failed to get shadow inbox: %v", err)
+	}
+	for i := range messages {
+		raw := fmt.Sprintf("Message-ID: <%d@example.com>\r\nSubject: Message %d\r\n\r\nBody %d\r\n", i, i, i)
+		if err := inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(raw)); err != nil {
+			t.Fatalf("failed to seed shadow message: %v", err)
+		}
+	}
+
+	opts = append([]GmailOption{WithEndpoint(srv.Addr, false), WithGmailExtensions(false)}, opts...)
+	g, err := NewGmail(testUsername, "password", 0, 1, 10*time.Second, opts...)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	t.Cleanup(func() { _ = g.Close(context.Background()) })
+	return g, srv
+}
+
+// inboxFlags returns the flags of the INBOX messages of the shadow account, by UID.
+func inboxFlags(t *testing.T, srv *imaptest.Server) map[uint32][]string {
+	t.Helper()
+	u, err := srv.Backend.Login(nil, testUsername, "")
+	if err != nil {
+		t.Fatalf("failed to open shadow account: %v", err)
+	}
+	inbox, err := u.GetMailbox(InboxMailbox)
+	if err != nil {
+		t.Fatalf("failed to get shadow inbox: %v", err)
+	}
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 16)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- inbox.ListMessages(true, seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch)
+	}()
+	flags := make(map[uint32][]string)
+	for msg := range ch {
+		flags[msg.Uid] = msg.Flags
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("failed to list shadow messages: %v", err)
+	}
+	return flags
+}
+
+func TestDeleteByUIDWithoutUIDPlusKeepsOtherDeletedMessages(t *testing.T) {
+	ctx := context.Background()
+	g, srv := newShadowGmail(t, 3)
+
+	// Another client flagged the first message as deleted, without expunging it
+	err := g.WithSession(ctx, InboxMailbox, func(sess *Session) error {
+		return sess.Store([]uint32{1}, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag})
+	})
+	if err != nil {
+		t.Fatalf("failed to flag message as deleted: %v", err)
+	}
+
+	if err := g.DeleteByUID(ctx, InboxMailbox, []uint32{2}); err != nil {
+		t.Fatalf("DeleteByUID() failed: %v", err)
+	}
+
+	flags := inboxFlags(t, srv)
+	if _, found := flags[2]; found {
+		t.Errorf("message 2 was not expunged")
+	}
+	if f, found := flags[1]; !found {
+		t.Errorf("message 1 was expunged, although it was not given")
+	} else if !slices.Contains(f, imap.DeletedFlag) {
+		t.Errorf("message 1 lost its deleted flag: %v", f)
+	}
+	if f, found := flags[3]; !found {
+		t.Errorf("message 3 was expunged, although it was not given")
+	} else if slices.Contains(f, imap.DeletedFlag) {
+		t.Errorf("message 3 was flagged as deleted: %v", f)
+	}
+}
+
+// snapshot returns the contents of every file in the given directory, by path.
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		files[path] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to snapshot '%s': %v", dir, err)
+	}
+	return files
+}
+
+// writeOperations returns every operation of the pool that modifies the account, applied to the given message (fetched
+// with its full body) of the INBOX.
+func writeOperations(msg *imap.Message) map[string]func(ctx context.Context, g *Gmail) error {
+	return map[string]func(ctx context.Context, g *Gmail) error{
+		"store": func(ctx context.Context, g *Gmail) error {
+			return g.WithSession(ctx, InboxMailbox, func(sess *Session) error {
+				return sess.Store([]uint32{msg.Uid}, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.FlaggedFlag})
+			})
+		},
+		"expunge": func(ctx context.Context, g *Gmail) error {
+			return g.WithSession(ctx, InboxMailbox, func(sess *Session) error { return sess.Expunge([]uint32{msg.Uid}) })
+		},
+		"move": func(ctx context.Context, g *Gmail) error {
+			return g.MoveMessage(ctx, InboxMailbox, []uint32{msg.Uid}, "Work")
+		},
+		"append": func(ctx context.Context, g *Gmail) error {
+			_, err := g.AppendMessage(ctx, InboxMailbox, msg)
+			return err
+		},
+		"update": func(ctx context.Context, g *Gmail) error {
+			_, err := g.UpdateMessageAt(ctx, InboxMailbox, msg.Uid, msg)
+			return err
+		},
+		"delete": func(ctx context.Context, g *Gmail) error { return g.DeleteByUID(ctx, InboxMailbox, []uint32{msg.Uid}) },
+		"trash":  func(ctx context.Context, g *Gmail) error { return g.MoveToTrash(ctx, InboxMailbox, []uint32{msg.Uid}) },
+		"create mailbox": func(ctx context.Context, g *Gmail) error {
+			return g.CreateMailboxes(ctx, "Work")
+		},
+		"delete mailbox": func(ctx context.Context, g *Gmail) error { return g.DeleteMailbox(ctx, InboxMailbox) },
+		"rename mailbox": func(ctx context.Context, g *Gmail) error {
+			return g.RenameMailbox(ctx, InboxMailbox, "Renamed")
+		},
+	}
+}
+
+// fetchForWrite fetches the first INBOX message with everything the write operations need.
+func fetchForWrite(t *testing.T, g *Gmail) *imap.Message {
+	t.Helper()
+	msg, err := g.FetchMessageByUID(context.Background(), InboxMailbox, 1, imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822)
+	if err != nil {
+		t.Fatalf("failed to fetch message: %v", err)
+	}
+	msg.Flags = append(msg.Flags, imap.SeenFlag)
+	return msg
+}
+
+func TestDryRunPerformsNoWrites(t *testing.T) {
+	g, srv := newShadowGmail(t, 2, WithDryRun(true))
+	msg := fetchForWrite(t, g)
+	before := snapshot(t, srv.Dir)
+
+	for name, op := range writeOperations(msg) {
+		t.Run(name, func(t *testing.T) {
+			if err := op(context.Background(), g); err != nil {
+				t.Fatalf("dry-run %s failed: %v", name, err)
+			}
+			after := snapshot(t, srv.Dir)
+			for path, content := range after {
+				if previous, found := before[path]; !found {
+					t.Errorf("dry-run %s created '%s'", name, path)
+				} else if previous != content {
+					t.Errorf("dry-run %s modified '%s'", name, path)
+				}
+			}
+			for path := range before {
+				if _, found := after[path]; !found {
+					t.Errorf("dry-run %s removed '%s'", name, path)
+				}
+			}
+		})
+	}
+}
+
+func TestReadOnlyRefusesWritesInDryRun(t *testing.T) {
+	g, _ := newShadowGmail(t, 2, WithDryRun(true))
+	msg := fetchForWrite(t, g)
+	g.ReadOnly()
+
+	for name, op := range writeOperations(msg) {
+		t.Run(name, func(t *testing.T) {
+			if err := op(context.Background(), g); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("read-only dry-run %s returned %v, want %v", name, err, ErrReadOnly)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package httpretry retries requests to HTTP dependencies (webhooks, the GitHub API, etc.) that are rate-limited or
+// temporarily unavailable, waiting as long as their Retry-After hints ask for rather than backing off blindly, and
+// surfaces sustained backpressure as metrics & log warnings.
+package httpretry
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
+)
+
+const (
+	// maxAttempts is the number of times a throttled request is sent before its response is returned as is.
+	maxAttempts = 4
+
+	// defaultRetryDelay is the delay before the first retry of responses without a Retry-After hint; it doubles for
+	// each subsequent retry.
+	defaultRetryDelay = time.Second
+
+	// maxRetryDelay is the longest Retry-After hint waited for; responses asking for longer delays are returned as is,
+	// rather than blocking the caller.
+	maxRetryDelay = time.Minute
+
+	// sustainedBackpressure is how long a dependency must keep throttling requests before a warning is logged.
+	sustainedBackpressure = time.Minute
+)
+
+var (
+	instrumentsOnce  sync.Once
+	throttledCounter *metrics.Counter
+	delayTimer       *metrics.Timer
+)
+
+// instruments returns the counter of throttled responses (by dependency), and the timer of delays waited for them.
+func instruments() (*metrics.Counter, *metrics.Timer) {
+	instrumentsOnce.Do(func() {
+		reporter, err := metrics.NewReporter("http")
+		if err != nil {
+			slog.Warn("Failed to create metrics reporter", "err", err)
+			return
+		}
+		throttledCounter, delayTimer = reporter.Counter("http.throttled"), reporter.Timer("http.throttled.delay")
+	})
+	return throttledCounter, delayTimer
+}
+
+// Transport is an http.RoundTripper retrying requests rejected because the dependency is rate-limiting them (429) or
+// temporarily unavailable (503). Retries wait for the delay given by the response's Retry-After header (in seconds
+// or as an HTTP date), or otherwise for an exponentially growing delay. Requests are retried only if their body can be
+// replayed (see http.Request.GetBody), and only while the delay fits the request's deadline.
+type Transport struct {
+	// Dependency names the dependency in metrics & logs (e.g. "slack").
+	Dependency string
+	// Base sends the requests (defaults to http.DefaultTransport).
+	Base http.RoundTripper
+
+	mu             sync.Mutex
+	throttledSince time.Time // when the dependency started throttling requests (zero if it isn't)
+	warned         bool      // whether sustained backpressure was already warned about
+}
+
+// NewClient returns an HTTP client of the given dependency, retrying throttled requests within the given timeout.
+func NewClient(dependency string, timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: &Transport{Dependency: dependency}}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := cmp.Or(t.Base, http.DefaultTransport)
+	for attempt := 1; ; attempt++ {
+		resp, err := base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		} else if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			t.recovered()
+			return resp, nil
+		}
+
+		delay := retryAfter(resp.Header, attempt)
+		t.throttled(req.Context(), resp.Status, delay)
+		if attempt >= maxAttempts || delay > maxRetryDelay || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		} else if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		_, delays := instruments()
+		delays.Record(req.Context(), delay)
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter returns the delay before retrying a throttled request after the given attempt (counting from 1), as given
+// by the response's Retry-After header, or otherwise growing exponentially with the attempts.
+func retryAfter(header http.Header, attempt int) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(value); err == nil {
+			return max(0, time.Until(date))
+		}
+	}
+	return defaultRetryDelay << (attempt - 1)
+}
+
+// throttled records a throttled response, warning once the dependency has been throttling requests for a while.
+func (t *Transport) throttled(ctx context.Context, status string, delay time.Duration) {
+	counter, _ := instruments()
+	counter.AddWithReason(ctx, t.Dependency, 1)
+	slog.Debug("Request throttled by dependency", "dependency", t.Dependency, "status", status, "retryAfter", delay)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.throttledSince.IsZero() {
+		t.throttledSince = time.Now()
+	} else if since := time.Since(t.throttledSince); since >= sustainedBackpressure && !t.warned {
+		t.warned = true
+		slog.Warn("Dependency has been throttling requests for a while", "dependency", t.Dependency, "since", since.Round(time.Second), "status", status)
+	}
+}
+
+// recovered records a response that was not throttled, ending any backpressure.
+func (t *Transport) recovered() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.warned {
+		slog.Info("Dependency stopped throttling requests", "dependency", t.Dependency, "after", time.Since(t.throttledSince).Round(time.Second))
+	}
+	t.throttledSince, t.warned = time.Time{}, false
+}
@@ -0,0 +1,563 @@
+// Package jmap reads the messages of JMAP accounts (RFC 8620 & RFC 8621, e.g. Fastmail), so they can be imported like
+// local archives, and imports messages into them, so they can be exported into like local archives. Reading an account
+// never calls a method that modifies it.
+package jmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/archive"
+	"github.com/arikkfir-org/gmail-organizer/internal/httpretry"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// requestTimeout bounds the time spent sending a request and reading its response (including downloaded messages).
+	requestTimeout = 5 * time.Minute
+
+	// mailCapability is the capability of accounts holding mail.
+	mailCapability = "urn:ietf:params:jmap:mail"
+
+	// defaultPageSize is the number of emails queried & fetched per request, unless the server allows fewer.
+	defaultPageSize = 256
+)
+
+// ErrServer is returned (wrapped) when the server responds to a method call with an error.
+var ErrServer = errors.New("JMAP server error")
+
+// keywordFlags maps the JMAP keywords of emails to their IMAP flags (RFC 8621, section 4.1.1).
+var keywordFlags = map[string]string{
+	"$seen":     imap.SeenFlag,
+	"$flagged":  imap.FlaggedFlag,
+	"$answered": imap.AnsweredFlag,
+	"$draft":    imap.DraftFlag,
+}
+
+// flagKeywords maps IMAP flags to the JMAP keywords of emails (the reverse of keywordFlags).
+var flagKeywords = map[string]string{
+	imap.SeenFlag:     "$seen",
+	imap.FlaggedFlag:  "$flagged",
+	imap.AnsweredFlag: "$answered",
+	imap.DraftFlag:    "$draft",
+}
+
+// roleLabels maps the roles of JMAP mailboxes to Gmail system labels; mailboxes with other roles (e.g. "archive") are
+// not turned into labels, and mailboxes without a role are turned into labels named after them.
+var roleLabels = map[string]string{
+	"inbox":  `\Inbox`,
+	"sent":   `\Sent`,
+	"drafts": `\Draft`,
+	"junk":   `\Spam`,
+	"trash":  `\Trash`,
+}
+
+// Session is the JMAP session resource (RFC 8620, section 2), listing the URLs & limits of the server.
+type Session struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	UploadURL       string            `json:"uploadUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+	Capabilities    struct {
+		Core struct {
+			MaxObjectsInGet int `json:"maxObjectsInGet"`
+		} `json:"urn:ietf:params:jmap:core"`
+	} `json:"capabilities"`
+}
+
+// Mailbox is a JMAP mailbox, as returned by "Mailbox/get".
+type Mailbox struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	Role     string `json:"role"`
+}
+
+// Email is the metadata of a JMAP email, as returned by "Email/get".
+type Email struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	Keywords   map[string]bool `json:"keywords"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+}
+
+// setResponse is the response of methods creating objects ("Mailbox/set" & "Email/import"), by creation ID.
+type setResponse struct {
+	Created map[string]struct {
+		ID string `json:"id"`
+	} `json:"created"`
+	NotCreated map[string]struct {
+		Type        string `json:"type"`
+		Description string `json:"description"`
+	} `json:"notCreated"`
+}
+
+// createdID returns the ID of the object created under the given creation ID, or an error describing (the given
+// description of) the object and why it was not created.
+func (r *setResponse) createdID(creationID, what string) (string, error) {
+	if created, ok := r.Created[creationID]; ok && created.ID != "" {
+		return created.ID, nil
+	} else if e, ok := r.NotCreated[creationID]; ok {
+		return "", fmt.Errorf("failed to create %s: %w: %s %s", what, ErrServer, e.Type, e.Description)
+	}
+	return "", fmt.Errorf("failed to create %s: unexpected response", what)
+}
+
+// Client is a client of a JMAP server, authenticated with a bearer token. It only implements the methods needed to
+// read an account, and to import messages into it.
+type Client struct {
+	http      *http.Client
+	token     string
+	session   Session
+	accountID string
+}
+
+// Dial fetches the session resource at the given URL (usually "https://host/.well-known/jmap") with the given bearer
+// token, and selects the primary mail account of the session.
+func Dial(sessionURL, token string) (*Client, error) {
+	c := &Client{http: httpretry.NewClient("jmap", requestTimeout), token: token}
+	req, err := http.NewRequest(http.MethodGet, sessionURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JMAP session URL '%s': %w", sessionURL, err)
+	}
+	if err := c.do(req, &c.session); err != nil {
+		return nil, fmt.Errorf("failed to fetch JMAP session from '%s': %w", sessionURL, err)
+	}
+	c.accountID = c.session.PrimaryAccounts[mailCapability]
+	if c.accountID == "" {
+		return nil, fmt.Errorf("JMAP session of '%s' has no mail account", sessionURL)
+	} else if c.session.APIURL == "" || c.session.DownloadURL == "" {
+		return nil, fmt.Errorf("JMAP session of '%s' has no API or download URL", sessionURL)
+	}
+	return c, nil
+}
+
+// do sends the given request and decodes its JSON response into the given value.
+func (c *Client) do(req *http.Request, v any) error {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: %s: %s", ErrServer, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// call invokes the given method of the primary mail account with the given arguments (to which the account ID is
+// added), and decodes its response arguments into the given value.
+func (c *Client) call(method string, args map[string]any, v any) error {
+	args["accountId"] = c.accountID
+	body, err := json.Marshal(map[string]any{
+		"using":       []string{"urn:ietf:params:jmap:core", mailCapability},
+		"methodCalls": []any{[]any{method, args, "0"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s call: %w", method, err)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.session.APIURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := c.do(req, &resp); err != nil {
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	} else if len(resp.MethodResponses) != 1 || len(resp.MethodResponses[0]) < 2 {
+		return fmt.Errorf("failed to call %s: unexpected response", method)
+	}
+
+	var name string
+	if err := json.Unmarshal(resp.MethodResponses[0][0], &name); err != nil {
+		return fmt.Errorf("failed to call %s: unexpected response: %w", method, err)
+	} else if name == "error" {
+		var e struct {
+			Type        string `json:"type"`
+			Description string `json:"description"`
+		}
+		_ = json.Unmarshal(resp.MethodResponses[0][1], &e)
+		return fmt.Errorf("failed to call %s: %w: %s %s", method, ErrServer, e.Type, e.Description)
+	} else if err := json.Unmarshal(resp.MethodResponses[0][1], v); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+	return nil
+}
+
+// pageSize returns the number of objects to query & fetch per request.
+func (c *Client) pageSize() int {
+	if limit := c.session.Capabilities.Core.MaxObjectsInGet; limit > 0 && limit < defaultPageSize {
+		return limit
+	}
+	return defaultPageSize
+}
+
+// Mailboxes returns all mailboxes of the account.
+func (c *Client) Mailboxes() ([]Mailbox, error) {
+	var resp struct {
+		List []Mailbox `json:"list"`
+	}
+	if err := c.call("Mailbox/get", map[string]any{"ids": nil}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.List, nil
+}
+
+// EmailIDs returns the IDs of all emails of the account, oldest first.
+func (c *Client) EmailIDs() ([]string, error) {
+	var ids []string
+	for {
+		var resp struct {
+			IDs   []string `json:"ids"`
+			Total int      `json:"total"`
+		}
+		args := map[string]any{
+			"sort":            []any{map[string]any{"property": "receivedAt", "isAscending": true}},
+			"position":        len(ids),
+			"limit":           c.pageSize(),
+			"calculateTotal":  true,
+			"collapseThreads": false,
+		}
+		if err := c.call("Email/query", args, &resp); err != nil {
+			return nil, err
+		}
+		ids = append(ids, resp.IDs...)
+		if len(resp.IDs) == 0 || len(ids) >= resp.Total {
+			return ids, nil
+		}
+	}
+}
+
+// Emails returns the metadata of the emails of the given IDs.
+func (c *Client) Emails(ids []string) ([]Email, error) {
+	var resp struct {
+		List     []Email  `json:"list"`
+		NotFound []string `json:"notFound"`
+	}
+	args := map[string]any{"ids": ids, "properties": []string{"id", "blobId", "keywords", "mailboxIds", "receivedAt"}}
+	if err := c.call("Email/get", args, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.NotFound) > 0 {
+		slog.Warn("Skipping emails deleted while reading JMAP account", "emails", len(resp.NotFound))
+	}
+	return resp.List, nil
+}
+
+// Download downloads the raw content of the blob of the given ID.
+func (c *Client) Download(blobID string) ([]byte, error) {
+	u := strings.NewReplacer(
+		"{accountId}", url.PathEscape(c.accountID),
+		"{blobId}", url.PathEscape(blobID),
+		"{name}", "message.eml",
+		"{type}", url.QueryEscape("message/rfc822"),
+	).Replace(c.session.DownloadURL)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob '%s': %w", blobID, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob '%s': %w", blobID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download blob '%s': %w: %s", blobID, ErrServer, resp.Status)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob '%s': %w", blobID, err)
+	}
+	return raw, nil
+}
+
+// CreateMailbox creates a mailbox of the given name under the mailbox of the given ID (or at the top level, if empty),
+// and returns its ID.
+func (c *Client) CreateMailbox(name, parentID string) (string, error) {
+	mailbox := map[string]any{"name": name}
+	if parentID != "" {
+		mailbox["parentId"] = parentID
+	}
+	var resp setResponse
+	if err := c.call("Mailbox/set", map[string]any{"create": map[string]any{"m": mailbox}}, &resp); err != nil {
+		return "", err
+	}
+	return resp.createdID("m", fmt.Sprintf("mailbox '%s'", name))
+}
+
+// Upload uploads the given raw message as a blob (RFC 8620, section 6.1), and returns the blob's ID.
+func (c *Client) Upload(raw []byte) (string, error) {
+	if c.session.UploadURL == "" {
+		return "", fmt.Errorf("failed to upload blob: %w: session has no upload URL", ErrServer)
+	}
+	u := strings.ReplaceAll(c.session.UploadURL, "{accountId}", url.PathEscape(c.accountID))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(raw))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload blob: %w", err)
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	var resp struct {
+		BlobID string `json:"blobId"`
+	}
+	if err := c.do(req, &resp); err != nil {
+		return "", fmt.Errorf("failed to upload blob: %w", err)
+	} else if resp.BlobID == "" {
+		return "", fmt.Errorf("failed to upload blob: %w: no blob ID in response", ErrServer)
+	}
+	return resp.BlobID, nil
+}
+
+// ImportEmail imports the blob of the given ID as an email (RFC 8621, section 4.8) into the mailboxes of the given
+// IDs, with the given keywords & received date (unless zero), and returns the email's ID.
+func (c *Client) ImportEmail(blobID string, mailboxIDs, keywords []string, receivedAt time.Time) (string, error) {
+	email := map[string]any{"blobId": blobID, "mailboxIds": trueSet(mailboxIDs), "keywords": trueSet(keywords)}
+	if !receivedAt.IsZero() {
+		email["receivedAt"] = receivedAt.UTC().Format(time.RFC3339)
+	}
+	var resp setResponse
+	if err := c.call("Email/import", map[string]any{"emails": map[string]any{"e": email}}, &resp); err != nil {
+		return "", err
+	}
+	return resp.createdID("e", fmt.Sprintf("email of blob '%s'", blobID))
+}
+
+// trueSet returns the given keys as a JMAP set: a map of each key to true.
+func trueSet(keys []string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set
+}
+
+// Reader reads the emails of a JMAP account, oldest first, as an archive.Reader. Keywords are translated to flags, and
+// mailboxes to labels (see roleLabels); nested mailboxes are named by their path, separated by "/". Emails without a
+// Message-ID are given one derived from the account & their ID, so that importing them again finds the previously
+// imported copies.
+type Reader struct {
+	client  *Client
+	account string
+	labels  map[string]string
+	ids     []string
+	emails  []Email
+}
+
+// Open connects to the JMAP server of the given session URL with the given bearer token, and lists the mailboxes &
+// emails of the account for reading (see Dial).
+func Open(sessionURL, token string) (*Reader, error) {
+	c, err := Dial(sessionURL, token)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes, err := c.Mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := c.EmailIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{client: c, account: c.accountID + "@" + sessionURL, labels: mailboxLabels(mailboxes), ids: ids}
+	slog.Info("Listed emails of JMAP account", "emails", len(ids), "mailboxes", len(mailboxes))
+	return r, nil
+}
+
+// mailboxLabels returns the labels of the given mailboxes, by mailbox ID.
+func mailboxLabels(mailboxes []Mailbox) map[string]string {
+	byID := make(map[string]Mailbox, len(mailboxes))
+	for _, m := range mailboxes {
+		byID[m.ID] = m
+	}
+	labels := make(map[string]string, len(mailboxes))
+	for _, m := range mailboxes {
+		if m.Role != "" {
+			if label, ok := roleLabels[m.Role]; ok {
+				labels[m.ID] = label
+			}
+			continue
+		}
+		// Parents are followed at most once per mailbox, in case of (invalid) cycles
+		path := m.Name
+		parent, ok := byID[m.ParentID]
+		for range len(mailboxes) {
+			if !ok {
+				break
+			}
+			path = parent.Name + "/" + path
+			parent, ok = byID[parent.ParentID]
+		}
+		labels[m.ID] = path
+	}
+	return labels
+}
+
+func (r *Reader) Next() (*archive.Message, error) {
+	for len(r.emails) == 0 {
+		if len(r.ids) == 0 {
+			return nil, io.EOF
+		}
+		batch := r.ids[:min(len(r.ids), r.client.pageSize())]
+		r.ids = r.ids[len(batch):]
+		emails, err := r.client.Emails(batch)
+		if err != nil {
+			return nil, err
+		}
+		r.emails = emails
+	}
+	e := r.emails[0]
+	r.emails = r.emails[1:]
+
+	raw, err := r.client.Download(e.BlobID)
+	if err != nil {
+		return nil, err
+	}
+	msg := archive.ParseMessage(raw, e.ReceivedAt)
+	if msg.Header("Message-ID") == "" {
+		messageID := fmt.Sprintf("<%x@jmap.gmail-organizer.invalid>", sha256.Sum256([]byte(r.account+"/"+e.ID)))
+		msg.Raw = append([]byte("Message-ID: "+messageID+"\r\n"), msg.Raw...)
+	}
+	for keyword, set := range e.Keywords {
+		if flag, ok := keywordFlags[strings.ToLower(keyword)]; ok && set {
+			msg.Flags = append(msg.Flags, flag)
+		}
+	}
+	for mailboxID, in := range e.MailboxIDs {
+		if label, ok := r.labels[mailboxID]; ok && in {
+			msg.Labels = append(msg.Labels, label)
+		}
+	}
+	slices.Sort(msg.Flags)
+	msg.Flags = slices.Compact(msg.Flags)
+	slices.Sort(msg.Labels)
+	msg.Labels = slices.Compact(msg.Labels)
+	return msg, nil
+}
+
+func (r *Reader) Close() error {
+	r.client.http.CloseIdleConnections()
+	return nil
+}
+
+// Writer imports messages into a JMAP account, as an archive.Writer. Flags are translated to keywords, and labels to
+// mailboxes (the reverse of Reader): system labels go into the mailboxes of the matching roles (other system labels,
+// e.g. "\Important", are dropped), and other labels into mailboxes named by their path, which are created as needed.
+// Every JMAP email must be in some mailbox, so messages without any go into the archive mailbox (or the inbox, if the
+// account has no archive mailbox). Messages are not deduplicated: writing a message twice imports it twice.
+type Writer struct {
+	client   *Client
+	fallback string // ID of the mailbox of messages without labels
+
+	mu        sync.Mutex
+	mailboxes map[string]string // mailbox IDs by label
+}
+
+// Create connects to the JMAP server of the given session URL with the given bearer token, and lists the mailboxes of
+// the account for writing (see Dial).
+func Create(sessionURL, token string) (*Writer, error) {
+	c, err := Dial(sessionURL, token)
+	if err != nil {
+		return nil, err
+	} else if c.session.UploadURL == "" {
+		return nil, fmt.Errorf("JMAP session of '%s' has no upload URL", sessionURL)
+	}
+	mailboxes, err := c.Mailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{client: c, mailboxes: make(map[string]string, len(mailboxes))}
+	for id, label := range mailboxLabels(mailboxes) {
+		w.mailboxes[label] = id
+	}
+	// The archive mailbox is preferred over the inbox, if the account has one
+	for _, role := range []string{"inbox", "archive"} {
+		if i := slices.IndexFunc(mailboxes, func(m Mailbox) bool { return m.Role == role }); i >= 0 {
+			w.fallback = mailboxes[i].ID
+		}
+	}
+	if w.fallback == "" {
+		return nil, fmt.Errorf("JMAP account of '%s' has neither an archive nor an inbox mailbox", sessionURL)
+	}
+	return w, nil
+}
+
+// mailboxID returns the ID of the mailbox of the given label, creating it (and its parents) if necessary. Returns ""
+// for system labels without a mailbox.
+func (w *Writer) mailboxID(label string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if id, ok := w.mailboxes[label]; ok {
+		return id, nil
+	} else if strings.HasPrefix(label, `\`) {
+		return "", nil
+	}
+
+	parentID := ""
+	parts := strings.Split(label, "/")
+	for i, name := range parts {
+		path := strings.Join(parts[:i+1], "/")
+		id, ok := w.mailboxes[path]
+		if !ok {
+			var err error
+			if id, err = w.client.CreateMailbox(name, parentID); err != nil {
+				return "", err
+			}
+			w.mailboxes[path] = id
+			slog.Debug("Created JMAP mailbox", "label", path)
+		}
+		parentID = id
+	}
+	return parentID, nil
+}
+
+func (w *Writer) Write(msg *archive.Message) error {
+	var mailboxIDs []string
+	for _, label := range msg.Labels {
+		id, err := w.mailboxID(label)
+		if err != nil {
+			return err
+		} else if id != "" && !slices.Contains(mailboxIDs, id) {
+			mailboxIDs = append(mailboxIDs, id)
+		}
+	}
+	if len(mailboxIDs) == 0 {
+		mailboxIDs = []string{w.fallback}
+	}
+	var keywords []string
+	for _, flag := range msg.Flags {
+		if keyword, ok := flagKeywords[flag]; ok {
+			keywords = append(keywords, keyword)
+		}
+	}
+
+	blobID, err := w.client.Upload(msg.Raw)
+	if err != nil {
+		return err
+	}
+	_, err = w.client.ImportEmail(blobID, mailboxIDs, keywords, msg.InternalDate)
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.client.http.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,291 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/archive"
+	"github.com/emersion/go-imap"
+)
+
+const testToken = "secret"
+
+// testEmails are the emails of the test account, oldest first, with their raw content as blobs.
+var testEmails = []struct {
+	Email
+	raw string
+}{
+	{
+		Email: Email{ID: "e1", BlobID: "b1", Keywords: map[string]bool{"$seen": true, "$flagged": true}, MailboxIDs: map[string]bool{"inbox": true}, ReceivedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		raw:   "Message-ID: <1@example.com>\nSubject: First\n\nBody\n",
+	},
+	{
+		Email: Email{ID: "e2", BlobID: "b2", MailboxIDs: map[string]bool{"child": true, "archive": true}, ReceivedAt: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		raw:   "Subject: Second\n\nBody\n",
+	},
+	{
+		Email: Email{ID: "e3", BlobID: "b3", Keywords: map[string]bool{"$draft": true, "custom": true}, MailboxIDs: map[string]bool{"drafts": true}, ReceivedAt: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		raw:   "Message-ID: <3@example.com>\nSubject: Third\n\nBody\n",
+	},
+}
+
+// testAccount records what was written into the account of the test server.
+type testAccount struct {
+	mu        sync.Mutex
+	mailboxes []Mailbox // created mailboxes
+	blobs     map[string]string
+	imported  []importedEmail
+}
+
+// importedEmail is an email imported into the account of the test server.
+type importedEmail struct {
+	raw        string
+	mailboxIDs []string
+	keywords   []string
+	receivedAt time.Time
+}
+
+// newTestServer serves a JMAP account holding testEmails, paging results by 2 to exercise paging, and records what is
+// written into it.
+func newTestServer(t *testing.T) (*httptest.Server, *testAccount) {
+	t.Helper()
+	account := &testAccount{blobs: make(map[string]string)}
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("GET /.well-known/jmap", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"apiUrl":          srv.URL + "/api",
+			"downloadUrl":     srv.URL + "/download/{accountId}/{blobId}/{name}?accept={type}",
+			"uploadUrl":       srv.URL + "/upload/{accountId}/",
+			"primaryAccounts": map[string]string{mailCapability: "a1"},
+			"capabilities":    map[string]any{"urn:ietf:params:jmap:core": map[string]any{"maxObjectsInGet": 2}},
+		})
+	})
+	mux.HandleFunc("POST /api", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var method string
+		var args struct {
+			AccountID string   `json:"accountId"`
+			IDs       []string `json:"ids"`
+			Position  int      `json:"position"`
+			Limit     int      `json:"limit"`
+			Create    map[string]struct {
+				Name     string `json:"name"`
+				ParentID string `json:"parentId"`
+			} `json:"create"`
+			Emails map[string]struct {
+				BlobID     string          `json:"blobId"`
+				MailboxIDs map[string]bool `json:"mailboxIds"`
+				Keywords   map[string]bool `json:"keywords"`
+				ReceivedAt time.Time       `json:"receivedAt"`
+			} `json:"emails"`
+		}
+		_ = json.Unmarshal(req.MethodCalls[0][0], &method)
+		_ = json.Unmarshal(req.MethodCalls[0][1], &args)
+		if args.AccountID != "a1" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"methodResponses": []any{[]any{"error", map[string]any{"type": "accountNotFound"}, "0"}}})
+			return
+		}
+
+		var resp any
+		switch method {
+		case "Mailbox/get":
+			resp = map[string]any{"list": []Mailbox{
+				{ID: "inbox", Name: "Inbox", Role: "inbox"},
+				{ID: "drafts", Name: "Drafts", Role: "drafts"},
+				{ID: "archive", Name: "Archive", Role: "archive"},
+				{ID: "parent", Name: "Work"},
+				{ID: "child", Name: "Projects", ParentID: "parent"},
+			}}
+		case "Email/query":
+			var ids []string
+			for _, e := range testEmails[min(args.Position, len(testEmails)):min(args.Position+args.Limit, len(testEmails))] {
+				ids = append(ids, e.ID)
+			}
+			resp = map[string]any{"ids": ids, "total": len(testEmails)}
+		case "Email/get":
+			var list []Email
+			for _, e := range testEmails {
+				if slices.Contains(args.IDs, e.ID) {
+					list = append(list, e.Email)
+				}
+			}
+			resp = map[string]any{"list": list}
+		case "Mailbox/set":
+			account.mu.Lock()
+			created := make(map[string]any)
+			for creationID, m := range args.Create {
+				id := fmt.Sprintf("new%d", len(account.mailboxes)+1)
+				account.mailboxes = append(account.mailboxes, Mailbox{ID: id, Name: m.Name, ParentID: m.ParentID})
+				created[creationID] = map[string]string{"id": id}
+			}
+			account.mu.Unlock()
+			resp = map[string]any{"created": created}
+		case "Email/import":
+			account.mu.Lock()
+			created, notCreated := make(map[string]any), make(map[string]any)
+			for creationID, e := range args.Emails {
+				raw, ok := account.blobs[e.BlobID]
+				if !ok {
+					notCreated[creationID] = map[string]string{"type": "blobNotFound"}
+					continue
+				}
+				imported := importedEmail{raw: raw, mailboxIDs: slices.Sorted(maps.Keys(e.MailboxIDs)), keywords: slices.Sorted(maps.Keys(e.Keywords)), receivedAt: e.ReceivedAt}
+				account.imported = append(account.imported, imported)
+				created[creationID] = map[string]string{"id": fmt.Sprintf("imported%d", len(account.imported))}
+			}
+			account.mu.Unlock()
+			resp = map[string]any{"created": created, "notCreated": notCreated}
+		default:
+			resp = map[string]any{"type": "unknownMethod"}
+			method = "error"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"methodResponses": []any{[]any{method, resp, "0"}}})
+	})
+	mux.HandleFunc("GET /download/a1/{blobId}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		for _, e := range testEmails {
+			if e.BlobID == r.PathValue("blobId") {
+				_, _ = io.WriteString(w, e.raw)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("POST /upload/a1/", func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		account.mu.Lock()
+		blobID := fmt.Sprintf("upload%d", len(account.blobs)+1)
+		account.blobs[blobID] = string(raw)
+		account.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"accountId": "a1", "blobId": blobID, "type": r.Header.Get("Content-Type"), "size": len(raw)})
+	})
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, account
+}
+
+func TestReader(t *testing.T) {
+	srv, _ := newTestServer(t)
+	r, err := Open(srv.URL+"/.well-known/jmap", testToken)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+
+	want := []struct {
+		subject string
+		flags   []string
+		labels  []string
+	}{
+		{subject: "First", flags: []string{imap.FlaggedFlag, imap.SeenFlag}, labels: []string{`\Inbox`}},
+		{subject: "Second", labels: []string{"Work/Projects"}},
+		{subject: "Third", flags: []string{imap.DraftFlag}, labels: []string{`\Draft`}},
+	}
+	for i, w := range want {
+		msg, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() of message %d failed: %v", i, err)
+		}
+		if got := msg.Header("Subject"); got != w.subject {
+			t.Errorf("message %d subject = %q, want %q", i, got, w.subject)
+		}
+		if !slices.Equal(msg.Flags, w.flags) {
+			t.Errorf("message %d flags = %v, want %v", i, msg.Flags, w.flags)
+		}
+		if !slices.Equal(msg.Labels, w.labels) {
+			t.Errorf("message %d labels = %v, want %v", i, msg.Labels, w.labels)
+		}
+		if !msg.InternalDate.Equal(testEmails[i].ReceivedAt) {
+			t.Errorf("message %d internal date = %s, want %s", i, msg.InternalDate, testEmails[i].ReceivedAt)
+		}
+		if messageID := msg.Header("Message-ID"); messageID == "" {
+			t.Errorf("message %d has no Message-ID", i)
+		}
+		if !strings.Contains(string(msg.Raw), "\r\n") {
+			t.Errorf("message %d line endings were not converted to CRLF", i)
+		}
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() after last message returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestOpenWithInvalidToken(t *testing.T) {
+	srv, _ := newTestServer(t)
+	if _, err := Open(srv.URL+"/.well-known/jmap", "wrong"); !errors.Is(err, ErrServer) {
+		t.Errorf("Open() with invalid token returned %v, want %v", err, ErrServer)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	srv, account := newTestServer(t)
+	w, err := Create(srv.URL+"/.well-known/jmap", testToken)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer w.Close()
+
+	date := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	messages := []*archive.Message{
+		{Raw: []byte("Subject: Labeled\r\n\r\nBody\r\n"), Flags: []string{imap.SeenFlag, imap.FlaggedFlag, imap.RecentFlag}, Labels: []string{`\Inbox`, "Work/Projects", "Work/Projects/New", `\Important`}, InternalDate: date},
+		{Raw: []byte("Subject: Unlabeled\r\n\r\nBody\r\n"), Labels: []string{`\Important`}},
+	}
+	for i, msg := range messages {
+		if err := w.Write(msg); err != nil {
+			t.Fatalf("Write() of message %d failed: %v", i, err)
+		}
+	}
+
+	// Only the missing mailbox is created, under its existing parent
+	if want := []Mailbox{{ID: "new1", Name: "New", ParentID: "child"}}; !slices.Equal(account.mailboxes, want) {
+		t.Errorf("created mailboxes = %v, want %v", account.mailboxes, want)
+	}
+	want := []importedEmail{
+		{raw: string(messages[0].Raw), mailboxIDs: []string{"child", "inbox", "new1"}, keywords: []string{"$flagged", "$seen"}, receivedAt: date},
+		{raw: string(messages[1].Raw), mailboxIDs: []string{"archive"}},
+	}
+	if len(account.imported) != len(want) {
+		t.Fatalf("imported %d emails, want %d", len(account.imported), len(want))
+	}
+	for i, e := range account.imported {
+		if e.raw != want[i].raw || !slices.Equal(e.mailboxIDs, want[i].mailboxIDs) || !slices.Equal(e.keywords, want[i].keywords) || !e.receivedAt.Equal(want[i].receivedAt) {
+			t.Errorf("imported email %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestMailboxLabelsWithCycle(t *testing.T) {
+	labels := mailboxLabels([]Mailbox{{ID: "a", Name: "A", ParentID: "b"}, {ID: "b", Name: "B", ParentID: "a"}})
+	if len(labels) != 2 {
+		t.Errorf("mailboxLabels() = %v, want labels for both mailboxes", labels)
+	}
+	for id, label := range labels {
+		if len(label) > 16 {
+			t.Errorf("label of mailbox %s = %s, want parents followed at most once each", id, label)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ledger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is a single record in the failure ledger.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	SourceUID uint32    `json:"sourceUID,omitempty"`
+	TargetUID uint32    `json:"targetUID,omitempty"`
+	MessageID string    `json:"messageID,omitempty"`
+	Reason    string    `json:"reason"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// Ledger records per-message failures as JSON lines in a file, so they can be reviewed (and acted upon) after the run.
+// A nil Ledger is valid, and silently discards all records.
+type Ledger struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewLedger creates a ledger appending to the given file path. If the path is empty, nil is returned.
+func NewLedger(path string) (*Ledger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open failure ledger '%s': %w", path, err)
+	}
+	return &Ledger{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends the given entry to the ledger.
+func (l *Ledger) Record(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		return fmt.Errorf("failed to write failure ledger entry: %w", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the ledger file.
+func (l *Ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,142 @@
+// Package maildate parses the dates found in message headers, tolerating the malformed dates common in old messages
+// (e.g. two-digit years, missing seconds, localized or misspelled names, and stray comments).
+package maildate
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// earliest is the earliest plausible date of an email message; earlier dates are the result of parsing failures (e.g.
+// zero-valued dates, or Unix epoch dates of broken clients).
+var earliest = time.Date(1971, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// layouts are date layouts tried, in order, after net/mail fails to parse a date.
+var layouts = []string{
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04 MST",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04:05 MST",
+	"2 Jan 06 15:04 -0700",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 06 15:04:05",
+	"Jan 2 15:04:05 2006",
+	"Jan 2 15:04:05 MST 2006",
+	"Jan 2 2006 15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	// Numeric dates are ambiguous; they are read day first, rather than guessing the order by whether the day is
+	// above 12
+	"02/01/2006 15:04:05",
+}
+
+// monthNames maps the prefixes of English, localized (and misspelled) month names to their English abbreviations.
+// Prefixes are three letters long, except where three letters are ambiguous (e.g. French "juin" & "juillet").
+var monthNames = map[string]string{
+	"jan": "Jan", "jän": "Jan", "ene": "Jan", "gen": "Jan",
+	"feb": "Feb", "fév": "Feb", "fev": "Feb",
+	"mar": "Mar", "mär": "Mar", "mae": "Mar", "maa": "Mar", "mrz": "Mar",
+	"apr": "Apr", "avr": "Apr", "abr": "Apr",
+	"may": "May", "mai": "May", "mei": "May", "mag": "May",
+	"jun": "Jun", "juin": "Jun", "giu": "Jun",
+	"jul": "Jul", "juil": "Jul", "lug": "Jul",
+	"aug": "Aug", "aoû": "Aug", "aou": "Aug", "ago": "Aug",
+	"sep": "Sep", "set": "Sep",
+	"oct": "Oct", "okt": "Oct", "ott": "Oct", "out": "Oct",
+	"nov": "Nov",
+	"dec": "Dec", "déc": "Dec", "dez": "Dec", "dic": "Dec",
+}
+
+// monthName returns the English abbreviation of the month whose (English, localized or misspelled) name the given
+// word is, or starts like.
+func monthName(word string) (string, bool) {
+	runes := []rune(strings.ToLower(word))
+	for _, n := range []int{4, 3} {
+		if len(runes) >= n {
+			if m, ok := monthNames[string(runes[:n])]; ok {
+				return m, true
+			}
+		}
+	}
+	return "", false
+}
+
+var (
+	commentPattern  = regexp.MustCompile(`\([^)]*\)`)
+	weekdayPattern  = regexp.MustCompile(`^[^\d,]*,\s*`)
+	spacePattern    = regexp.MustCompile(`\s+`)
+	wordPattern     = regexp.MustCompile(`\p{L}+\.?`)
+	zoneOnlyPattern = regexp.MustCompile(`^(.*\d)\s*([+-]\d{4})$`)
+)
+
+// Valid returns true if the given date is a plausible date for an email message: not zero, not before 1971 and not more
+// than a day in the future.
+func Valid(t time.Time) bool {
+	return !t.Before(earliest) && t.Before(time.Now().Add(24*time.Hour))
+}
+
+// Parse parses the given header date, falling back to a set of lenient layouts if it is not a valid RFC 5322 date.
+// Returns false if the date cannot be parsed, or is not plausible (see Valid).
+func Parse(s string) (time.Time, bool) {
+	if t, err := mail.ParseDate(s); err == nil && Valid(t) {
+		return t, true
+	}
+
+	s = normalize(s)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil && Valid(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalize removes comments, weekdays & redundant whitespace from the given date, and translates localized month
+// names to English.
+func normalize(s string) string {
+	s = commentPattern.ReplaceAllString(s, " ")
+	s = strings.TrimSpace(spacePattern.ReplaceAllString(s, " "))
+	s = weekdayPattern.ReplaceAllString(s, "")
+	s = wordPattern.ReplaceAllStringFunc(s, func(w string) string {
+		w = strings.TrimSuffix(w, ".")
+		if m, ok := monthName(w); ok {
+			return m
+		}
+		return w
+	})
+	s = zoneOnlyPattern.ReplaceAllString(s, "$1 $2")
+	return s
+}
+
+// FromReceived returns the date of the first parseable "Received" header among the given ones, which are expected in
+// header order (i.e. the most recent hop first). The date of a "Received" header follows its last semicolon.
+func FromReceived(received []string) (time.Time, bool) {
+	for _, r := range received {
+		i := strings.LastIndex(r, ";")
+		if i < 0 {
+			continue
+		}
+		if t, ok := Parse(r[i+1:]); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Resolve returns the best available date of a message with the given header: the date of its most recent "Received"
+// header (which reflects when the message arrived, like an IMAP INTERNALDATE), or else its "Date" header. Returns the
+// header the date was taken from, or false if neither yields a plausible date.
+func Resolve(header mail.Header) (time.Time, string, bool) {
+	if t, ok := FromReceived(header["Received"]); ok {
+		return t, "Received", true
+	} else if t, ok := Parse(header.Get("Date")); ok {
+		return t, "Date", true
+	}
+	return time.Time{}, "", false
+}
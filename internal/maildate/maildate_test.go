@@ -0,0 +1,91 @@
+package maildate
+
+import (
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		date  string
+		want  time.Time
+		valid bool
+	}{
+		{name: "RFC 5322", date: "Tue, 3 Mar 2009 10:20:30 +0200", want: time.Date(2009, 3, 3, 8, 20, 30, 0, time.UTC), valid: true},
+		{name: "comment", date: "Tue, 3 Mar 2009 10:20:30 +0000 (GMT)", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "two-digit year", date: "3 Mar 09 10:20:30 +0000", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "no seconds", date: "3 Mar 2009 10:20 +0000", want: time.Date(2009, 3, 3, 10, 20, 0, 0, time.UTC), valid: true},
+		{name: "English full month", date: "3 January 2009 10:20:30 +0000", want: time.Date(2009, 1, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "English full month of March", date: "3 March 2009 10:20:30 +0000", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "German abbreviation", date: "3 Mrz 2009 10:20:30 +0000", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "German full month", date: "Do, 3 Dezember 2009 10:20:30 +0000", want: time.Date(2009, 12, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "German full month with umlaut", date: "3 März 2009 10:20:30 +0000", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "German January", date: "3 Januar 2009 10:20:30 +0000", want: time.Date(2009, 1, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "French full month", date: "3 janvier 2009 10:20:30 +0000", want: time.Date(2009, 1, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "French abbreviation", date: "3 juil. 2009 10:20:30 +0000", want: time.Date(2009, 7, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "French June", date: "3 juin 2009 10:20:30 +0000", want: time.Date(2009, 6, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "French accented month", date: "3 décembre 2009 10:20:30 +0000", want: time.Date(2009, 12, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "Spanish full month", date: "3 diciembre 2009 10:20:30 +0000", want: time.Date(2009, 12, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "Dutch full month", date: "3 maart 2009 10:20:30 +0000", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "ISO", date: "2009-03-03 10:20:30", want: time.Date(2009, 3, 3, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "numeric day first", date: "04/03/2009 10:20:30", want: time.Date(2009, 3, 4, 10, 20, 30, 0, time.UTC), valid: true},
+		{name: "numeric month first", date: "03/24/2009 10:20:30", valid: false},
+		{name: "epoch", date: "Thu, 1 Jan 1970 00:00:00 +0000", valid: false},
+		{name: "garbage", date: "sometime last week", valid: false},
+		{name: "empty", date: "", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, valid := Parse(tt.date)
+			if valid != tt.valid {
+				t.Fatalf("Parse(%q) valid = %t, want %t", tt.date, valid, tt.valid)
+			} else if valid && !got.Equal(tt.want) {
+				t.Errorf("Parse(%q) = %s, want %s", tt.date, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		header mail.Header
+		want   time.Time
+		source string
+	}{
+		{
+			name: "received first",
+			header: mail.Header{
+				"Received": {"from a by b; 4 Mar 2009 10:20:30 +0000", "from c by a; 3 Mar 2009 10:20:30 +0000"},
+				"Date":     {"1 Mar 2009 10:20:30 +0000"},
+			},
+			want:   time.Date(2009, 3, 4, 10, 20, 30, 0, time.UTC),
+			source: "Received",
+		},
+		{
+			name: "unparseable received",
+			header: mail.Header{
+				"Received": {"from a by b; sometime"},
+				"Date":     {"1 Mar 2009 10:20:30 +0000"},
+			},
+			want:   time.Date(2009, 3, 1, 10, 20, 30, 0, time.UTC),
+			source: "Date",
+		},
+		{
+			name:   "none",
+			header: mail.Header{"Date": {"Thu, 1 Jan 1970 00:00:00 +0000"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, source, ok := Resolve(tt.header)
+			if ok != (tt.source != "") || source != tt.source {
+				t.Fatalf("Resolve() source = %q (%t), want %q", source, ok, tt.source)
+			} else if ok && !got.Equal(tt.want) {
+				t.Errorf("Resolve() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
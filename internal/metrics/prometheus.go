@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// PrometheusExporter exposes the metrics reported by all Reporters over HTTP, for scraping by Prometheus (rather than
+// pushing them to an OTel collector).
+type PrometheusExporter struct {
+	reader  sdkmetric.Reader
+	handler http.Handler
+}
+
+// NewPrometheusExporter creates a Prometheus exporter, with a registry of its own (so only this program's metrics
+// are exposed).
+func NewPrometheusExporter() (*PrometheusExporter, error) {
+	registry := prometheus.NewRegistry()
+	reader, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Prometheus exporter: %w", err)
+	}
+	return &PrometheusExporter{
+		reader:  reader,
+		handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	}, nil
+}
+
+// Reader returns the reader to register in the MeterProvider, collecting metrics on each scrape.
+func (e *PrometheusExporter) Reader() sdkmetric.Reader {
+	return e.reader
+}
+
+// Serve listens on the given address (e.g. ":9464"), serving metrics at "/metrics" until the given context is done.
+func (e *PrometheusExporter) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e.handler)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving Prometheus metrics", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve Prometheus metrics: %w", err)
+	}
+	return nil
+}
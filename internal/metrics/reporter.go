@@ -3,14 +3,25 @@ package metrics
 import (
 	"context"
 	"log/slog"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
-// Reporter uses the OpenTelemetry SDK to create and increment metrics.
+// Reporter registers OpenTelemetry instruments of a single meter. Instruments are registered once per name, and
+// then shared by all goroutines, so callers look them up once (e.g. when a job is created) and record measurements
+// through them without further lookups. A nil Reporter is valid, and returns nil instruments, which record nothing.
 type Reporter struct {
 	meter metric.Meter
+
+	mu         sync.Mutex
+	counters   map[string]*Counter
+	histograms map[string]*Histogram
+	timers     map[string]*Timer
+	gauges     map[string]*Gauge
 }
 
 // NewReporter creates a new OTel-based metrics reporter.
@@ -18,25 +29,176 @@ func NewReporter(jobName string) (*Reporter, error) {
 	// Get a meter from the global MeterProvider.
 	// The provider is responsible for the entire metrics pipeline.
 	meter := otel.GetMeterProvider().Meter(jobName)
-	return &Reporter{meter: meter}, nil
+	return &Reporter{
+		meter:      meter,
+		counters:   make(map[string]*Counter),
+		histograms: make(map[string]*Histogram),
+		timers:     make(map[string]*Timer),
+		gauges:     make(map[string]*Gauge),
+	}, nil
 }
 
-// Increment finds or creates a counter and increments it by 1.
-// The underlying OTel Meter handles caching instruments, so it's efficient
-// to call this repeatedly for the same counter name.
-func (r *Reporter) Increment(ctx context.Context, name string) {
-	// Create an Int64Counter instrument. If one with the same name
-	// already exists, the Meter will return the existing instance.
+// Counter returns the counter of the given name, registering it if necessary.
+func (r *Reporter) Counter(name string) *Counter {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, found := r.counters[name]; found {
+		return c
+	}
 	counter, err := r.meter.Int64Counter(name)
 	if err != nil {
-		slog.Error("Failed to create/get OTel counter", "name", name, "error", err)
-		return
+		slog.Error("Failed to create OTel counter", "name", name, "error", err)
+		return nil
+	}
+	c := &Counter{counter: counter}
+	r.counters[name] = c
+	return c
+}
+
+// BytesHistogram returns the histogram of the given name, measured in bytes, registering it if necessary.
+func (r *Reporter) BytesHistogram(name string) *Histogram {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, found := r.histograms[name]; found {
+		return h
+	}
+	histogram, err := r.meter.Int64Histogram(name, metric.WithUnit("By"))
+	if err != nil {
+		slog.Error("Failed to create OTel histogram", "name", name, "error", err)
+		return nil
+	}
+	h := &Histogram{histogram: histogram}
+	r.histograms[name] = h
+	return h
+}
+
+// Timer returns the timer of the given name, a histogram measured in seconds, registering it if necessary.
+func (r *Reporter) Timer(name string) *Timer {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, found := r.timers[name]; found {
+		return t
 	}
+	histogram, err := r.meter.Float64Histogram(name, metric.WithUnit("s"))
+	if err != nil {
+		slog.Error("Failed to create OTel histogram", "name", name, "error", err)
+		return nil
+	}
+	t := &Timer{histogram: histogram}
+	r.timers[name] = t
+	return t
+}
 
-	// Add 1 to the counter.
-	counter.Add(ctx, 1)
+// Gauge returns the gauge of the given name, registering it if necessary.
+func (r *Reporter) Gauge(name string) *Gauge {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, found := r.gauges[name]; found {
+		return g
+	}
+	gauge, err := r.meter.Float64Gauge(name)
+	if err != nil {
+		slog.Error("Failed to create OTel gauge", "name", name, "error", err)
+		return nil
+	}
+	g := &Gauge{gauge: gauge}
+	r.gauges[name] = g
+	return g
 }
 
 // Close is a no-op for this reporter implementation because the lifecycle
 // of the underlying MeterProvider is managed globally in the main application setup.
 func (r *Reporter) Close() {}
+
+// Counter is a registered counter. A nil Counter is valid, and counts nothing.
+type Counter struct {
+	counter metric.Int64Counter
+	reasons sync.Map // attribute sets by reason, since few distinct reasons are counted over and over
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc(ctx context.Context) {
+	c.Add(ctx, 1)
+}
+
+// Add adds the given value to the counter.
+func (c *Counter) Add(ctx context.Context, n int64) {
+	if c == nil {
+		return
+	}
+	c.counter.Add(ctx, n)
+}
+
+// AddWithReason adds the given value to the counter, attributed to the given reason (e.g. why a message was skipped),
+// so that a single counter can be broken down by reason.
+func (c *Counter) AddWithReason(ctx context.Context, reason string, n int64) {
+	if c == nil {
+		return
+	}
+	attrs, found := c.reasons.Load(reason)
+	if !found {
+		attrs, _ = c.reasons.LoadOrStore(reason, metric.WithAttributeSet(attribute.NewSet(attribute.String("reason", reason))))
+	}
+	c.counter.Add(ctx, n, attrs.(metric.MeasurementOption))
+}
+
+// Histogram is a registered histogram of integer values. A nil Histogram is valid, and records nothing.
+type Histogram struct {
+	histogram metric.Int64Histogram
+}
+
+// Record records the given value in the histogram.
+func (h *Histogram) Record(ctx context.Context, n int64) {
+	if h == nil {
+		return
+	}
+	h.histogram.Record(ctx, n)
+}
+
+// Timer is a registered histogram of durations, e.g. for latency distributions of operations. A nil Timer is valid,
+// and records nothing.
+type Timer struct {
+	histogram metric.Float64Histogram
+}
+
+// Record records the given duration.
+func (t *Timer) Record(ctx context.Context, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.histogram.Record(ctx, d.Seconds())
+}
+
+// Start starts timing an operation, and returns a function recording its duration when called, e.g.
+// "defer timer.Start()(ctx)".
+func (t *Timer) Start() func(ctx context.Context) {
+	started := time.Now()
+	return func(ctx context.Context) {
+		t.Record(ctx, time.Since(started))
+	}
+}
+
+// Gauge is a registered gauge, for values that go up and down over time. A nil Gauge is valid, and records nothing.
+type Gauge struct {
+	gauge metric.Float64Gauge
+}
+
+// Set sets the gauge to the given value.
+func (g *Gauge) Set(ctx context.Context, value float64) {
+	if g == nil {
+		return
+	}
+	g.gauge.Record(ctx, value)
+}
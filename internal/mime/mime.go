@@ -0,0 +1,271 @@
+// Package mime parses the MIME structure of raw RFC 5322 messages, keeping track of where each part lies in the raw
+// message, so that parts can be extracted and replaced without re-encoding the rest of the message.
+package mime
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"io"
+	stdmime "mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// maxDepth bounds the nesting of multipart entities, to protect against maliciously deep messages.
+const maxDepth = 32
+
+// Part is a MIME entity of a message: the message itself, or one of its (possibly nested) body parts.
+type Part struct {
+	Header    textproto.MIMEHeader
+	Path      []int // IMAP part path, e.g. [2, 1] for the first part of the second part; empty for the message itself
+	Start     int   // offset of the part's header in the raw message
+	BodyStart int   // offset of the part's body in the raw message
+	End       int   // offset just past the part's body in the raw message
+	Children  []*Part
+}
+
+// Parse parses the MIME structure of the given raw message. Parts of multipart entities are parsed recursively; other
+// entities (including attached messages) are leaves.
+func Parse(raw []byte) (*Part, error) {
+	return parsePart(raw, nil, 0, len(raw), 0)
+}
+
+func parsePart(raw []byte, path []int, start, end, depth int) (*Part, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("MIME structure is nested too deeply")
+	}
+
+	part := &Part{Path: path, Start: start, End: end}
+	headerEnd, bodyStart := findHeaderEnd(raw[start:end])
+	if headerEnd < 0 {
+		// No header terminator: the whole part is a header (e.g. an empty body without its blank line)
+		headerEnd, bodyStart = end-start, end-start
+	}
+	part.BodyStart = start + bodyStart
+
+	header, err := textproto.NewReader(bufio.NewReader(io.MultiReader(
+		bytes.NewReader(raw[start:start+headerEnd]),
+		strings.NewReader("\r\n\r\n"),
+	))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 && headerEnd > 0 {
+		return nil, fmt.Errorf("failed to parse header of part %v: %w", path, err)
+	}
+	part.Header = header
+
+	mediaType, params, _ := stdmime.ParseMediaType(part.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return part, nil
+	}
+
+	// Split the body by its boundary delimiters
+	delimiter := []byte("--" + params["boundary"])
+	body := raw[part.BodyStart:end]
+	var bounds []int // offsets (in body) of the delimiter lines, each followed by a part (except the closing one)
+	for offset := 0; offset < len(body); {
+		i := bytes.Index(body[offset:], delimiter)
+		if i < 0 {
+			break
+		}
+		i += offset
+		if i == 0 || body[i-1] == '\n' {
+			bounds = append(bounds, i)
+			if bytes.HasPrefix(body[i+len(delimiter):], []byte("--")) {
+				break
+			}
+		}
+		offset = i + len(delimiter)
+	}
+
+	for n := 0; n+1 <= len(bounds); n++ {
+		// A part starts after its delimiter line, and ends before the line break preceding the next delimiter
+		partStart := bounds[n] + len(delimiter)
+		if bytes.HasPrefix(body[partStart:], []byte("--")) {
+			break
+		}
+		lineEnd := bytes.IndexByte(body[partStart:], '\n')
+		if lineEnd < 0 {
+			break
+		}
+		partStart += lineEnd + 1
+		partEnd := len(body)
+		if n+1 < len(bounds) {
+			partEnd = bounds[n+1]
+			partEnd -= len(lineBreakBefore(body[:partEnd]))
+		}
+		if partEnd < partStart {
+			partEnd = partStart
+		}
+		childPath := append(append([]int{}, path...), len(part.Children)+1)
+		child, err := parsePart(raw, childPath, part.BodyStart+partStart, part.BodyStart+partEnd, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		part.Children = append(part.Children, child)
+	}
+	return part, nil
+}
+
+// findHeaderEnd returns the length of the header of the given entity (excluding the blank line terminating it), and
+// the offset of its body. Returns -1 if the header is not terminated.
+func findHeaderEnd(b []byte) (int, int) {
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return 0, 2
+	} else if bytes.HasPrefix(b, []byte("\n")) {
+		return 0, 1
+	}
+	crlf := bytes.Index(b, []byte("\r\n\r\n"))
+	lf := bytes.Index(b, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return crlf + 2, crlf + 4
+	case lf >= 0:
+		return lf + 1, lf + 2
+	default:
+		return -1, -1
+	}
+}
+
+// lineBreakBefore returns the line break ending the given bytes ("\r\n" or "\n"), if any.
+func lineBreakBefore(b []byte) string {
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		return "\r\n"
+	} else if bytes.HasSuffix(b, []byte("\n")) {
+		return "\n"
+	}
+	return ""
+}
+
+// Walk calls the given function for the part and all its descendants, depth-first, in order.
+func (p *Part) Walk(fn func(part *Part)) {
+	fn(p)
+	for _, child := range p.Children {
+		child.Walk(fn)
+	}
+}
+
+// MediaType returns the lower-case media type of the part, e.g. "image/png", defaulting to "text/plain".
+func (p *Part) MediaType() string {
+	mediaType, _, err := stdmime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		return "text/plain"
+	}
+	return mediaType
+}
+
+// Filename returns the (decoded) file name of the part, from its Content-Disposition "filename" parameter or its
+// Content-Type "name" parameter; empty if it has neither.
+func (p *Part) Filename() string {
+	if _, params, err := stdmime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return decodeWords(params["filename"])
+	}
+	if _, params, err := stdmime.ParseMediaType(p.Header.Get("Content-Type")); err == nil && params["name"] != "" {
+		return decodeWords(params["name"])
+	}
+	return ""
+}
+
+func decodeWords(s string) string {
+	decoded, err := new(stdmime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// IsAttachment returns true if the part is a leaf part that is explicitly an attachment, or that has a file name and
+// is not an inline text part.
+func (p *Part) IsAttachment() bool {
+	if len(p.Children) > 0 || len(p.Path) == 0 {
+		return false
+	}
+	disposition, _, _ := stdmime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if strings.EqualFold(disposition, "attachment") {
+		return true
+	}
+	return p.Filename() != "" && !strings.HasPrefix(p.MediaType(), "text/")
+}
+
+// Body returns the raw (encoded) body of the part.
+func (p *Part) Body(raw []byte) []byte {
+	return raw[p.BodyStart:p.End]
+}
+
+// Decode returns the body of the part, decoded according to its Content-Transfer-Encoding.
+func (p *Part) Decode(raw []byte) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(p.Body(raw))
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{r: r})
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode part %v: %w", p.Path, err)
+	}
+	return data, nil
+}
+
+// newlineSkipper drops line breaks (and other whitespace) from base64 content, which the standard decoder only
+// tolerates in limited forms.
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (s *newlineSkipper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+			p[j] = c
+			j++
+		}
+	}
+	return j, err
+}
+
+// Replacement is a replacement of a part of a message.
+type Replacement struct {
+	Part    *Part
+	Content []byte // the replacement entity, including its header
+}
+
+// Rewrite returns a copy of the given raw message with the given parts (which must not overlap) replaced. The rest of
+// the message is kept byte-for-byte.
+func Rewrite(raw []byte, replacements ...Replacement) []byte {
+	var buf bytes.Buffer
+	offset := 0
+	sorted := slices.Clone(replacements)
+	slices.SortFunc(sorted, func(a, b Replacement) int { return cmp.Compare(a.Part.Start, b.Part.Start) })
+	for _, r := range sorted {
+		buf.Write(raw[offset:r.Part.Start])
+		buf.Write(r.Content)
+		offset = r.Part.End
+	}
+	buf.Write(raw[offset:])
+	return buf.Bytes()
+}
+
+// Placeholder returns a text/plain entity replacing an offloaded attachment, describing it and linking to the location
+// it was offloaded to.
+func Placeholder(filename, mediaType string, size int, url string) []byte {
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	_, _ = fmt.Fprintf(w, "The attachment '%s' (%s, %d bytes) was removed from this message to save space.\r\n", filename, mediaType, size)
+	_, _ = fmt.Fprintf(w, "It is available at: %s\r\n", url)
+	_ = w.Close()
+
+	var part bytes.Buffer
+	part.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	part.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	part.WriteString("Content-Disposition: " + stdmime.FormatMediaType("inline", map[string]string{"filename": filename + ".txt"}) + "\r\n")
+	part.WriteString("\r\n")
+	// The line break ending the body belongs to the delimiter following the part
+	part.Write(bytes.TrimSuffix(body.Bytes(), []byte("\r\n")))
+	return part.Bytes()
+}
@@ -0,0 +1,145 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/httpretry"
+)
+
+// Kinds of events notified about.
+const (
+	KindCompleted = "completed" // the run completed successfully
+	KindFailed    = "failed"    // the run failed
+	KindThreshold = "threshold" // a threshold was breached during the run (e.g. too many failed messages)
+)
+
+// Event is a notable occurrence in a run, notified to the configured channels.
+type Event struct {
+	Time    time.Time      `json:"time"`
+	Kind    string         `json:"kind"`
+	Source  string         `json:"source"`  // what the event is about, e.g. "migrate"
+	Message string         `json:"message"` // a single line for humans
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// text formats the event for humans, with its details on separate lines.
+func (e Event) text() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "[%s] %s: %s", e.Kind, e.Source, e.Message)
+	for _, key := range slices.Sorted(maps.Keys(e.Details)) {
+		_, _ = fmt.Fprintf(&b, "\n%s: %v", key, e.Details[key])
+	}
+	return b.String()
+}
+
+// SMTPConfig configures notifications by email.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string // no authentication if empty
+	Password string
+	From     string
+	To       []string
+}
+
+// Config configures the channels notified of events; channels left empty are not notified.
+type Config struct {
+	SlackWebhookURL string
+	WebhookURL      string // receives events as JSON
+	SMTP            *SMTPConfig
+}
+
+// Notifier sends events to the configured channels. A nil Notifier is valid, and silently discards all events.
+type Notifier struct {
+	config Config
+	client *http.Client
+}
+
+// New creates a notifier for the given configuration. If no channel is configured, nil is returned.
+func New(config Config) *Notifier {
+	if config.SlackWebhookURL == "" && config.WebhookURL == "" && config.SMTP == nil {
+		return nil
+	}
+	return &Notifier{config: config, client: httpretry.NewClient("notifications", 10*time.Second)}
+}
+
+// Notify sends the given event to all configured channels. Failures of some channels do not prevent notifying the
+// others; they are all returned.
+func (n *Notifier) Notify(ctx context.Context, e Event) error {
+	if n == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	var errs []error
+	if n.config.SlackWebhookURL != "" {
+		if err := n.post(ctx, n.config.SlackWebhookURL, map[string]string{"text": e.text()}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to notify Slack: %w", err))
+		}
+	}
+	if n.config.WebhookURL != "" {
+		if err := n.post(ctx, n.config.WebhookURL, e); err != nil {
+			errs = append(errs, fmt.Errorf("failed to notify webhook: %w", err))
+		}
+	}
+	if n.config.SMTP != nil {
+		if err := n.sendMail(e); err != nil {
+			errs = append(errs, fmt.Errorf("failed to notify by email: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// post posts the given value as JSON to the given URL.
+func (n *Notifier) post(ctx context.Context, url string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// sendMail sends the given event by email.
+func (n *Notifier) sendMail(e Event) error {
+	c := n.config.SMTP
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+	var msg bytes.Buffer
+	_, _ = fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	_, _ = fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	_, _ = fmt.Fprintf(&msg, "Subject: [gmail-organizer] %s %s\r\n", e.Source, e.Kind)
+	_, _ = fmt.Fprintf(&msg, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	_, _ = fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(e.text(), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return smtp.SendMail(net.JoinHostPort(c.Host, strconv.Itoa(c.Port)), auth, c.From, c.To, msg.Bytes())
+}
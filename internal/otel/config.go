@@ -0,0 +1,143 @@
+package otel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/contrib/detectors/gcp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// defaultTracesPerSecond is the rate of traces sampled by the "ratelimited" sampler when no rate is given.
+const defaultTracesPerSecond = 10
+
+// sampler returns the trace sampler configured by the standard OTEL_TRACES_SAMPLER & OTEL_TRACES_SAMPLER_ARG
+// environment variables: "always_on", "always_off", "traceidratio", "ratelimited" (at most OTEL_TRACES_SAMPLER_ARG
+// traces per second, 10 by default), or their "parentbased_" variants (the default is "parentbased_always_on"). Since
+// each migrated message is traced separately, "parentbased_traceidratio" or "parentbased_ratelimited" keep large runs
+// from overwhelming the trace backend. Unlike the SDK, invalid values are reported rather than silently ignored.
+// Span limits (e.g. OTEL_SPAN_ATTRIBUTE_COUNT_LIMIT & OTEL_SPAN_EVENT_COUNT_LIMIT) are read by the SDK itself.
+func sampler() (sdktrace.Sampler, error) {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_SAMPLER")))
+	ratio := 1.0
+	if strings.HasSuffix(name, "traceidratio") {
+		if s, found := os.LookupEnv("OTEL_TRACES_SAMPLER_ARG"); found {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || v < 0 || v > 1 {
+				return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a ratio between 0 and 1, got '%s'", s)
+			}
+			ratio = v
+		}
+	}
+	perSecond := float64(defaultTracesPerSecond)
+	if strings.HasSuffix(name, "ratelimited") {
+		if s, found := os.LookupEnv("OTEL_TRACES_SAMPLER_ARG"); found {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a positive number of traces per second, got '%s'", s)
+			}
+			perSecond = v
+		}
+	}
+
+	switch name {
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case "ratelimited":
+		return newRateLimitedSampler(perSecond), nil
+	case "", "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	case "parentbased_ratelimited":
+		return sdktrace.ParentBased(newRateLimitedSampler(perSecond)), nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER '%s'", name)
+	}
+}
+
+// rateLimitedSampler samples at most a given number of spans per second (allowing bursts of as many), and drops the
+// rest. Wrapped by a parent-based sampler, it limits the rate of new traces, while keeping sampled traces whole.
+type rateLimitedSampler struct {
+	limiter     *rate.Limiter
+	description string
+}
+
+func newRateLimitedSampler(perSecond float64) *rateLimitedSampler {
+	return &rateLimitedSampler{
+		limiter:     rate.NewLimiter(rate.Limit(perSecond), max(int(perSecond), 1)),
+		description: fmt.Sprintf("RateLimited{%g}", perSecond),
+	}
+}
+
+func (s *rateLimitedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	decision := sdktrace.Drop
+	if s.limiter.Allow() {
+		decision = sdktrace.RecordAndSample
+	}
+	return sdktrace.SamplingResult{Decision: decision, Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState()}
+}
+
+func (s *rateLimitedSampler) Description() string {
+	return s.description
+}
+
+// insecure returns whether the OTLP exporter of the given signal ("TRACES" or "METRICS") should connect in plaintext.
+// Connections are in plaintext by default (e.g. to a collector sidecar), unless TLS is configured by the standard
+// OTEL_EXPORTER_OTLP_[<SIGNAL>_]INSECURE or OTEL_EXPORTER_OTLP_[<SIGNAL>_]CERTIFICATE environment variables, in which
+// case the exporter configures itself from them (along with OTEL_EXPORTER_OTLP_[<SIGNAL>_]HEADERS, which is always
+// honored).
+func insecure(signal string) bool {
+	for _, name := range []string{"INSECURE", "CERTIFICATE"} {
+		if os.Getenv("OTEL_EXPORTER_OTLP_"+name) != "" || os.Getenv("OTEL_EXPORTER_OTLP_"+signal+"_"+name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// runAttributes returns resource attributes identifying this run: its execution ID (Cloud Run's job execution, or a
+// random ID elsewhere), and hashes of the source & target accounts (so runs of the same accounts can be correlated
+// without exposing the addresses).
+func runAttributes() []attribute.KeyValue {
+	executionID := os.Getenv("CLOUD_RUN_EXECUTION")
+	if executionID == "" {
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+		executionID = hex.EncodeToString(b)
+	}
+	attrs := []attribute.KeyValue{attribute.String("run.execution_id", executionID)}
+	for _, prefix := range []string{"SOURCE", "TARGET"} {
+		if username := os.Getenv(prefix + "_ACCOUNT_USERNAME"); username != "" {
+			sum := sha256.Sum256([]byte(strings.ToLower(username)))
+			attrs = append(attrs, attribute.String(strings.ToLower(prefix)+".account.hash", hex.EncodeToString(sum[:8])))
+		}
+	}
+	return attrs
+}
+
+// cloudRunDetectors returns the resource detectors of Cloud Run attributes, so telemetry of different workers,
+// revisions & executions can be told apart: the service (or job) name, its revision, execution & task index, and its
+// region (queried from the metadata server). Outside Cloud Run (as told by the K_SERVICE & CLOUD_RUN_JOB environment
+// variables it sets) no detectors are returned, so local runs don't wait for a metadata server that isn't there.
+func cloudRunDetectors() []resource.Detector {
+	if os.Getenv("K_SERVICE") == "" && os.Getenv("CLOUD_RUN_JOB") == "" {
+		return nil
+	}
+	return []resource.Detector{gcp.NewDetector()}
+}
@@ -0,0 +1,163 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	// Defaults of the batch span processor, as defined by the OTel specification.
+	defaultBSPMaxQueueSize       = 2048
+	defaultBSPMaxExportBatchSize = 512
+	defaultBSPScheduleDelay      = 5 * time.Second
+	defaultBSPExportTimeout      = 30 * time.Second
+
+	defaultMetricExportInterval = 10 * time.Second
+)
+
+// telemetryLoss counts telemetry that never reaches the backend: spans dropped because the export queue is full, and
+// spans & metrics whose export failed. The counters are exported like any other metric (so a collector that is down
+// for a while reports the loss once it's back), and export failures are also logged.
+type telemetryLoss struct {
+	droppedSpans        metric.Int64Counter
+	failedSpans         metric.Int64Counter
+	failedMetricExports metric.Int64Counter
+}
+
+// newTelemetryLoss creates the loss counters through the global MeterProvider, which forwards them to the actual
+// provider once it's registered.
+func newTelemetryLoss() (*telemetryLoss, error) {
+	meter := otel.GetMeterProvider().Meter("otel")
+	droppedSpans, err := meter.Int64Counter("otel.spans.dropped", metric.WithDescription("Spans dropped because the export queue was full"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTel counter: %w", err)
+	}
+	failedSpans, err := meter.Int64Counter("otel.spans.export.failed", metric.WithDescription("Spans whose export failed"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTel counter: %w", err)
+	}
+	failedMetricExports, err := meter.Int64Counter("otel.metrics.export.failed", metric.WithDescription("Failed exports of metrics"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTel counter: %w", err)
+	}
+	return &telemetryLoss{droppedSpans: droppedSpans, failedSpans: failedSpans, failedMetricExports: failedMetricExports}, nil
+}
+
+// batcherOptions returns the batch span processor options configured by the standard OTEL_BSP_MAX_QUEUE_SIZE,
+// OTEL_BSP_MAX_EXPORT_BATCH_SIZE, OTEL_BSP_SCHEDULE_DELAY & OTEL_BSP_EXPORT_TIMEOUT (in milliseconds) environment
+// variables, along with the maximum queue size. Unlike the SDK, invalid values are reported rather than silently
+// ignored.
+func batcherOptions() ([]sdktrace.BatchSpanProcessorOption, int, error) {
+	maxQueueSize, err := lookupPositiveInt("OTEL_BSP_MAX_QUEUE_SIZE", defaultBSPMaxQueueSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	maxExportBatchSize, err := lookupPositiveInt("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", defaultBSPMaxExportBatchSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	scheduleDelay, err := lookupPositiveInt("OTEL_BSP_SCHEDULE_DELAY", int(defaultBSPScheduleDelay.Milliseconds()))
+	if err != nil {
+		return nil, 0, err
+	}
+	exportTimeout, err := lookupPositiveInt("OTEL_BSP_EXPORT_TIMEOUT", int(defaultBSPExportTimeout.Milliseconds()))
+	if err != nil {
+		return nil, 0, err
+	}
+	return []sdktrace.BatchSpanProcessorOption{
+		sdktrace.WithMaxQueueSize(maxQueueSize),
+		sdktrace.WithMaxExportBatchSize(min(maxExportBatchSize, maxQueueSize)),
+		sdktrace.WithBatchTimeout(time.Duration(scheduleDelay) * time.Millisecond),
+		sdktrace.WithExportTimeout(time.Duration(exportTimeout) * time.Millisecond),
+	}, maxQueueSize, nil
+}
+
+// metricExportInterval returns the interval of metric exports, configured by the standard OTEL_METRIC_EXPORT_INTERVAL
+// environment variable (in milliseconds), or 10 seconds by default.
+func metricExportInterval() (time.Duration, error) {
+	interval, err := lookupPositiveInt("OTEL_METRIC_EXPORT_INTERVAL", int(defaultMetricExportInterval.Milliseconds()))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(interval) * time.Millisecond, nil
+}
+
+// lookupPositiveInt returns the value of the given environment variable parsed as a positive integer, or the given
+// default value if the variable is not set.
+func lookupPositiveInt(name string, defaultValue int) (int, error) {
+	s, found := os.LookupEnv(name)
+	if !found || strings.TrimSpace(s) == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer, got '%s'", name, s)
+	}
+	return v, nil
+}
+
+// queueBoundedProcessor wraps a batch span processor, dropping (and counting) ended spans itself once as many spans
+// as the batcher's queue holds are waiting for export, since the batcher drops them silently. Spans handed to the
+// exporter (see lossCountingSpanExporter) no longer count as waiting.
+type queueBoundedProcessor struct {
+	sdktrace.SpanProcessor
+	maxQueueSize int64
+	pending      *atomic.Int64
+	loss         *telemetryLoss
+}
+
+func (p *queueBoundedProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if !s.SpanContext().IsSampled() {
+		return
+	}
+	if p.pending.Add(1) > p.maxQueueSize {
+		p.pending.Add(-1)
+		p.loss.droppedSpans.Add(context.Background(), 1)
+		return
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// lossCountingSpanExporter wraps a span exporter, counting (and logging) spans whose export failed.
+type lossCountingSpanExporter struct {
+	sdktrace.SpanExporter
+	pending *atomic.Int64
+	loss    *telemetryLoss
+}
+
+func (e *lossCountingSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	e.pending.Add(-int64(len(spans)))
+	if err != nil {
+		e.loss.failedSpans.Add(context.WithoutCancel(ctx), int64(len(spans)))
+		slog.Warn("Failed to export spans", "err", err, "spans", len(spans))
+	}
+	return err
+}
+
+// lossCountingMetricExporter wraps a metric exporter, counting (and logging) failed exports.
+type lossCountingMetricExporter struct {
+	sdkmetric.Exporter
+	loss *telemetryLoss
+}
+
+func (e *lossCountingMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, rm)
+	if err != nil {
+		e.loss.failedMetricExports.Add(context.WithoutCancel(ctx), 1)
+		slog.Warn("Failed to export metrics", "err", err)
+	}
+	return err
+}
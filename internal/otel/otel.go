@@ -1,10 +1,16 @@
 package otel
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
 	"time"
 
+	"github.com/arikkfir-org/gmail-organizer/internal/metrics"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
@@ -14,48 +20,127 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
+const defaultPrometheusAddr = ":9464"
+
 // InitOtelProvider initializes and registers global TracerProvider and MeterProvider.
 // It sets up OTLP exporters that send telemetry to the endpoint specified
-// by the OTEL_EXPORTER_OTLP_ENDPOINT environment variable.
+// by the OTEL_EXPORTER_OTLP_ENDPOINT environment variable, in plaintext unless TLS is configured (see insecure).
+// Traces are exported unless OTEL_TRACES_EXPORTER is "none" (e.g. when running locally, without a collector), and
+// sampled according to OTEL_TRACES_SAMPLER (see sampler), and batched for export according to the OTEL_BSP_*
+// variables (see batcherOptions). Resources carry the run's attributes (see runAttributes) along with any given by
+// OTEL_RESOURCE_ATTRIBUTES, and the Cloud Run service or job, revision, execution, task index & region when running on
+// Cloud Run (see cloudRunDetectors).
+// Metrics are exported according to the METRICS_EXPORTER environment variable: "otlp" (the default, every
+// OTEL_METRIC_EXPORT_INTERVAL milliseconds), "prometheus" to serve them for scraping at "/metrics" on the METRICS_ADDR
+// address (defaults to ":9464"), or "none". Spans dropped or failing to export, and failed metric exports, are counted
+// as metrics themselves (see telemetryLoss).
 // The returned function should be deferred to shut down the providers gracefully.
 func InitOtelProvider(ctx context.Context, serviceName string) (func(), error) {
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
 			semconv.ServiceNameKey.String(serviceName),
 		),
+		resource.WithAttributes(runAttributes()...),
+		resource.WithDetectors(cloudRunDetectors()...),
+		resource.WithFromEnv(),
 	)
-	if err != nil {
+	if errors.Is(err, resource.ErrPartialResource) {
+		// Some attributes could not be detected (e.g. the metadata server is unreachable); the rest are still useful
+		slog.Warn("Failed to detect some OTel resource attributes", "err", err)
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to create OTel resource: %w", err)
 	}
 
 	// --- TRACER ---
-	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure())
+	traceSampler, err := sampler()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		return nil, err
 	}
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(traceExporter),
-		sdktrace.WithResource(res),
-	)
+	tpOpts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res), sdktrace.WithSampler(traceSampler)}
+	loss, err := newTelemetryLoss()
+	if err != nil {
+		return nil, err
+	}
+	switch exporter := cmp.Or(os.Getenv("OTEL_TRACES_EXPORTER"), "otlp"); exporter {
+	case "otlp":
+		var traceOpts []otlptracegrpc.Option
+		if insecure("TRACES") {
+			traceOpts = append(traceOpts, otlptracegrpc.WithInsecure())
+		}
+		traceExporter, err := otlptracegrpc.New(ctx, traceOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		batcherOpts, maxQueueSize, err := batcherOptions()
+		if err != nil {
+			return nil, err
+		}
+		pending := &atomic.Int64{}
+		batcher := sdktrace.NewBatchSpanProcessor(&lossCountingSpanExporter{SpanExporter: traceExporter, pending: pending, loss: loss}, batcherOpts...)
+		tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(&queueBoundedProcessor{SpanProcessor: batcher, maxQueueSize: int64(maxQueueSize), pending: pending, loss: loss}))
+	case "none":
+		// Spans are still created (e.g. so logs & the dashboard carry trace IDs), but not exported
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER '%s' (expected 'otlp' or 'none')", exporter)
+	}
+	tp := sdktrace.NewTracerProvider(tpOpts...)
 	otel.SetTracerProvider(tp)
 
 	// --- METRICS ---
-	metricExporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithInsecure())
-	if err != nil {
-		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	serveCtx, stopServing := context.WithCancel(context.WithoutCancel(ctx))
+	var mp *metric.MeterProvider
+	switch exporter := cmp.Or(os.Getenv("METRICS_EXPORTER"), "otlp"); exporter {
+	case "otlp":
+		var metricOpts []otlpmetricgrpc.Option
+		if insecure("METRICS") {
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+		}
+		metricExporter, err := otlpmetricgrpc.New(ctx, metricOpts...)
+		if err != nil {
+			stopServing()
+			return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+		}
+		interval, err := metricExportInterval()
+		if err != nil {
+			stopServing()
+			return nil, err
+		}
+		mp = metric.NewMeterProvider(
+			metric.WithReader(metric.NewPeriodicReader(&lossCountingMetricExporter{Exporter: metricExporter, loss: loss}, metric.WithInterval(interval))),
+			metric.WithResource(res),
+		)
+	case "prometheus":
+		promExporter, err := metrics.NewPrometheusExporter()
+		if err != nil {
+			stopServing()
+			return nil, err
+		}
+		mp = metric.NewMeterProvider(metric.WithReader(promExporter.Reader()), metric.WithResource(res))
+		addr := cmp.Or(os.Getenv("METRICS_ADDR"), defaultPrometheusAddr)
+		go func() {
+			if err := promExporter.Serve(serveCtx, addr); err != nil {
+				slog.Error("Prometheus metrics endpoint failed", "err", err, "addr", addr)
+			}
+		}()
+	case "none":
+		// Leave the default (no-op) MeterProvider in place
+	default:
+		stopServing()
+		return nil, fmt.Errorf("unsupported METRICS_EXPORTER '%s' (expected 'otlp', 'prometheus' or 'none')", exporter)
+	}
+	if mp != nil {
+		otel.SetMeterProvider(mp)
 	}
-	mp := metric.NewMeterProvider(
-		metric.WithReader(metric.NewPeriodicReader(metricExporter, metric.WithInterval(10*time.Second))),
-		metric.WithResource(res),
-	)
-	otel.SetMeterProvider(mp)
 
 	// Return a shutdown function to be called on application exit.
 	shutdown := func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		_ = tp.Shutdown(ctx)
-		_ = mp.Shutdown(ctx)
+		if mp != nil {
+			_ = mp.Shutdown(ctx)
+		}
+		stopServing()
 	}
 	return shutdown, nil
 }
@@ -0,0 +1,205 @@
+// Package pop3 reads the messages of POP3 mailboxes, e.g. of legacy providers that offer no IMAP access, so they can
+// be imported like local archives. Mailboxes are only ever read: messages are never deleted from the server.
+package pop3
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/archive"
+)
+
+const (
+	// dialTimeout bounds the time spent connecting to the server.
+	dialTimeout = 30 * time.Second
+
+	// commandTimeout bounds the time spent sending a command and reading its response (including retrieved messages).
+	commandTimeout = 5 * time.Minute
+)
+
+// ErrServer is returned (wrapped) when the server responds to a command with an error ("-ERR").
+var ErrServer = errors.New("POP3 server error")
+
+// Entry is a message listed by the server: its number (valid for the current session only), and its unique ID
+// (stable across sessions).
+type Entry struct {
+	Number int
+	UID    string
+}
+
+// Client is a connection to a POP3 server. It only implements the commands needed to read a mailbox.
+type Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// Dial connects to the POP3 server at the given address ("host:port"), over TLS unless useTLS is false (which is only
+// suitable for local test servers), and reads its greeting.
+func Dial(address string, useTLS bool) (*Client, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to POP3 server '%s': %w", address, err)
+	}
+
+	c := &Client{conn: conn, text: textproto.NewConn(conn)}
+	_ = conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := c.response(); err != nil {
+		_ = c.text.Close()
+		return nil, fmt.Errorf("failed to read greeting of POP3 server '%s': %w", address, err)
+	}
+	return c, nil
+}
+
+// cmd sends the given command and reads the first line of its response, returning the text following "+OK".
+func (c *Client) cmd(format string, args ...any) (string, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// response reads the first line of a response, returning the text following "+OK".
+func (c *Client) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if rest, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(rest), nil
+	} else if rest, ok := strings.CutPrefix(line, "-ERR"); ok {
+		return "", fmt.Errorf("%w: %s", ErrServer, strings.TrimSpace(rest))
+	}
+	return "", fmt.Errorf("unexpected POP3 response: %s", line)
+}
+
+// Login authenticates with the given username & password.
+func (c *Client) Login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return fmt.Errorf("failed to login as '%s': %w", username, err)
+	}
+	if _, err := c.cmd("PASS %s", password); err != nil {
+		return fmt.Errorf("failed to login as '%s': %w", username, err)
+	}
+	return nil
+}
+
+// UIDL lists the messages of the mailbox, along with their unique IDs.
+func (c *Client) UIDL() ([]Entry, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	entries := make([]Entry, 0, len(lines))
+	for _, line := range lines {
+		number, uid, found := strings.Cut(strings.TrimSpace(line), " ")
+		n, err := strconv.Atoi(number)
+		if !found || err != nil || uid == "" {
+			return nil, fmt.Errorf("failed to list messages: invalid UIDL line '%s'", line)
+		}
+		entries = append(entries, Entry{Number: n, UID: uid})
+	}
+	return entries, nil
+}
+
+// Retr retrieves the raw content of the message of the given number.
+func (c *Client) Retr(number int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", number); err != nil {
+		return nil, fmt.Errorf("failed to retrieve message %d: %w", number, err)
+	}
+	raw, err := io.ReadAll(c.text.DotReader())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve message %d: %w", number, err)
+	}
+	return raw, nil
+}
+
+// Quit ends the session (without deleting any message) and closes the connection.
+func (c *Client) Quit() error {
+	_, err := c.cmd("QUIT")
+	return errors.Join(err, c.text.Close())
+}
+
+// Reader reads the messages of a POP3 mailbox, in the order listed by the server, as an archive.Reader. Messages
+// listed more than once with the same unique ID (as some servers do) are read only once. Messages without a
+// Message-ID are given one derived from the account & their unique ID, so that importing them again (even after the
+// server rewrote their headers) finds the previously imported copies.
+type Reader struct {
+	client  *Client
+	account string
+	entries []Entry
+}
+
+// Open connects to the POP3 server at the given address as the given user, and lists the messages of the mailbox for
+// reading (see Dial).
+func Open(address string, useTLS bool, username, password string) (*Reader, error) {
+	c, err := Dial(address, useTLS)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Login(username, password); err != nil {
+		_ = c.text.Close()
+		return nil, err
+	}
+	entries, err := c.UIDL()
+	if err != nil {
+		_ = c.Quit()
+		return nil, err
+	}
+
+	r := &Reader{client: c, account: username + "@" + address}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if seen[e.UID] {
+			slog.Debug("Skipping message listed more than once", "number", e.Number, "uid", e.UID)
+			continue
+		}
+		seen[e.UID] = true
+		r.entries = append(r.entries, e)
+	}
+	slog.Info("Listed messages of POP3 mailbox", "messages", len(r.entries), "duplicates", len(entries)-len(r.entries))
+	return r, nil
+}
+
+func (r *Reader) Next() (*archive.Message, error) {
+	if len(r.entries) == 0 {
+		return nil, io.EOF
+	}
+	e := r.entries[0]
+	r.entries = r.entries[1:]
+
+	raw, err := r.client.Retr(e.Number)
+	if err != nil {
+		return nil, err
+	}
+	msg := archive.ParseMessage(raw, time.Time{})
+	if msg.Header("Message-ID") == "" {
+		messageID := fmt.Sprintf("<%x@pop3.gmail-organizer.invalid>", sha256.Sum256([]byte(r.account+"/"+e.UID)))
+		msg.Raw = append([]byte("Message-ID: "+messageID+"\r\n"), msg.Raw...)
+	}
+	return msg, nil
+}
+
+func (r *Reader) Close() error {
+	return r.client.Quit()
+}
@@ -0,0 +1,93 @@
+package progress
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of progress events.
+const (
+	KindMailboxMatched = "mailboxMatched" // the number of messages to migrate from a source mailbox is known
+	KindCollectionDone = "collectionDone" // all source messages to migrate were collected, so the run's total is final
+	KindMessageDone    = "messageDone"    // a message was migrated, or failed to (see Event.Err)
+)
+
+// Event is a single step in the progress of a migration run.
+type Event struct {
+	Time      time.Time
+	Kind      string
+	Mailbox   string // source mailbox the event is about (empty for run-wide events)
+	MessageID string // for KindMessageDone
+	SourceUID uint32 // for KindMessageDone
+	Err       error  // for KindMessageDone, the failure of a message skipped by the error policy (nil if migrated)
+	Matched   uint64 // for KindMailboxMatched, the number of messages matched in the mailbox
+	Done      uint64 // number of messages processed in the run so far
+	Total     uint64 // number of messages collected for migration so far (final once KindCollectionDone is published)
+}
+
+// Publisher broadcasts progress events to its subscribers, so applications embedding a migration (e.g. GUIs or web
+// portals) can render its progress without parsing logs. A nil Publisher is valid, and silently discards all events.
+type Publisher struct {
+	mu          sync.RWMutex
+	next        int
+	subscribers map[int]func(Event)
+}
+
+// New creates a publisher with no subscribers.
+func New() *Publisher {
+	return &Publisher{subscribers: make(map[int]func(Event))}
+}
+
+// Subscribe registers the given callback for all events published from now on, and returns a function unregistering
+// it. Callbacks are invoked synchronously by the goroutine publishing the event (possibly concurrently with other
+// events), so they should return quickly, and must not unsubscribe themselves.
+func (p *Publisher) Subscribe(fn func(Event)) func() {
+	if p == nil {
+		return func() {}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.next
+	p.next++
+	p.subscribers[id] = fn
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.subscribers, id)
+	}
+}
+
+// Channel subscribes a channel of the given buffer size to all events published from now on, and returns it along
+// with a function unsubscribing (and closing) it. Events are dropped rather than delivered late when the channel's
+// buffer is full, so a slow consumer never stalls the migration.
+func (p *Publisher) Channel(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+	unsubscribe := p.Subscribe(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			unsubscribe()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends the given event to all subscribers.
+func (p *Publisher) Publish(e Event) {
+	if p == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, fn := range p.subscribers {
+		fn(e)
+	}
+}
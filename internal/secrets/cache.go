@@ -0,0 +1,128 @@
+// Package secrets resolves secrets (e.g. the app passwords of accounts) from Google Secret Manager, caching their
+// payloads so that resolving the same secrets over & over doesn't call Secret Manager each time.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+)
+
+// prefetchConcurrency bounds the number of secret versions accessed concurrently by Prefetch.
+const prefetchConcurrency = 8
+
+// versionName matches the resource names of secret versions, capturing the version.
+var versionName = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+/versions/([^/]+)$`)
+
+// entry is a cached secret payload.
+type entry struct {
+	payload string
+	expires time.Time // zero if never (the version is pinned)
+}
+
+// Cache accesses secret versions in Secret Manager, caching their payloads. Versions are pinned by their number (e.g.
+// "projects/p/secrets/s/versions/3"), in which case their payloads never change and are cached for as long as the
+// cache is used; other versions (aliases such as "latest") are accessed again once the TTL expires, so rotated secrets
+// are picked up. Secrets given without a version (e.g. "projects/p/secrets/s") refer to their latest version.
+type Cache struct {
+	client *secretmanager.Client
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// NewCache creates a cache of secret payloads, authenticating with application default credentials.
+func NewCache(ctx context.Context, ttl time.Duration) (*Cache, error) {
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Secret Manager client: %w", err)
+	}
+	return &Cache{client: client, ttl: ttl, entries: make(map[string]*entry)}, nil
+}
+
+// Close closes the connection to Secret Manager.
+func (c *Cache) Close() error {
+	return c.client.Close()
+}
+
+// Validate returns an error if the given name is not the resource name of a secret, or of a secret version.
+func Validate(name string) error {
+	if !versionName.MatchString(versionOf(name)) {
+		return fmt.Errorf("invalid secret '%s' (expected 'projects/PROJECT/secrets/SECRET[/versions/VERSION]')", name)
+	}
+	return nil
+}
+
+// versionOf returns the resource name of the secret version given by name: the name itself if it names a version,
+// and otherwise the latest version of the secret it names.
+func versionOf(name string) string {
+	if strings.Contains(name, "/versions/") {
+		return name
+	}
+	return strings.TrimSuffix(name, "/") + "/versions/latest"
+}
+
+// Prefetch accesses the given secrets concurrently, e.g. at startup, so later calls to Get are served from the cache.
+// Secrets already cached are not accessed again.
+func (c *Cache) Prefetch(ctx context.Context, names []string) error {
+	slots := make(chan struct{}, prefetchConcurrency)
+	errs := make(chan error, len(names))
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Go(func() {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if _, err := c.Get(ctx, name); err != nil {
+				errs <- err
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Get returns the payload of the given secret, from the cache if possible.
+func (c *Cache) Get(ctx context.Context, name string) (string, error) {
+	if err := Validate(name); err != nil {
+		return "", err
+	}
+	name = versionOf(name)
+
+	c.mu.Lock()
+	e, found := c.entries[name]
+	c.mu.Unlock()
+	if found && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		return e.payload, nil
+	}
+
+	resp, err := c.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("failed to access secret '%s': %w", name, err)
+	}
+	data := resp.GetPayload().GetData()
+	if checksum := resp.GetPayload().DataCrc32C; checksum != nil && int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))) != *checksum {
+		return "", fmt.Errorf("payload of secret '%s' is corrupt (checksum mismatch)", name)
+	}
+
+	e = &entry{payload: string(data)}
+	if _, err := strconv.Atoi(versionName.FindStringSubmatch(name)[1]); err != nil {
+		// Accessed through an alias (e.g. "latest"), which may point at another version later on
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Lock()
+	c.entries[name] = e
+	c.mu.Unlock()
+	slog.Debug("Accessed secret", "secret", name, "version", resp.GetName(), "pinned", e.expires.IsZero())
+	return e.payload, nil
+}
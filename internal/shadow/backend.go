@@ -0,0 +1,105 @@
+// Package shadow simulates Gmail accounts with local Maildir stores, served over IMAP along with Gmail's X-GM-LABELS,
+// X-GM-MSGID & X-GM-THRID extensions. Pointing a connection pool at a shadow server exercises the full pipeline
+// (appends, deduplication by Message-ID, label creation & mapping, flag updates, verification) without touching the
+// real account.
+//
+// Each account is a directory of mailboxes, each of which is a Maildir (readable by any Maildir client) along with:
+//   - a "uidvalidity" file, holding the mailbox's UIDVALIDITY & next UID;
+//   - a "meta" directory, holding the labels & keywords (flags Maildir cannot represent) of messages, by UID.
+//
+// Unlike Gmail, messages are stored only in the mailbox they were appended to: their labels are recorded, but do not
+// make them appear in the mailboxes of those labels.
+package shadow
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+// Backend is a go-imap backend serving the shadow accounts kept in a directory, one sub-directory per account. Any
+// password is accepted, and accounts are created on first login.
+type Backend struct {
+	// Namespace is the prefix of the personal namespace (e.g. "INBOX/"), advertised by the NAMESPACE command, outside
+	// which mailboxes (other than the default ones) cannot be created; like on some generic IMAP servers. Empty by
+	// default, like on Gmail. Must be set before serving.
+	Namespace string
+	// MaxMessageSize is the size (in bytes) above which appended messages are rejected, like Gmail rejects messages
+	// larger than its limit (with a [TOOBIG] response code). Zero means no limit. Must be set before serving.
+	MaxMessageSize int64
+
+	dir   string
+	mu    sync.Mutex
+	users map[string]*user
+}
+
+// NewBackend returns a backend serving the shadow accounts kept in the given directory.
+func NewBackend(dir string) *Backend {
+	return &Backend{dir: dir, users: make(map[string]*user)}
+}
+
+func (b *Backend) Login(_ *imap.ConnInfo, username, _ string) (backend.User, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if u, ok := b.users[username]; ok {
+		return u, nil
+	}
+	u, err := openUser(b, filepath.Join(b.dir, escapeName(username)), username)
+	if err != nil {
+		return nil, err
+	}
+	b.users[username] = u
+	return u, nil
+}
+
+// Serve serves the given backend over plaintext IMAP at the given address (e.g. "127.0.0.1:0") in the background.
+// Returns the address actually listened on, and a function that stops serving and closes all connections.
+func Serve(b *Backend, address string) (string, func() error, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to listen on '%s': %w", address, err)
+	}
+	s := server.New(b)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+	s.Enable(&extension{namespace: b.Namespace})
+	go func() {
+		if err := s.Serve(l); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			slog.Error("Shadow IMAP server failed", "err", err, "address", l.Addr().String())
+		}
+	}()
+	return l.Addr().String(), s.Close, nil
+}
+
+// escapeName escapes the given account or mailbox name into a single directory name: hierarchy delimiters are
+// escaped (so that label & mailbox names cannot collide with Maildir's own directories), as are leading dots (so that
+// names cannot refer to parent directories or hidden files).
+func escapeName(name string) string {
+	name = strings.NewReplacer("%", "%25", "/", "%2F", `\`, "%5C").Replace(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// unescapeName reverses escapeName.
+func unescapeName(name string) (string, error) {
+	return url.PathUnescape(name)
+}
+
+// ensureDir creates the given directory (and its parents) if missing.
+func ensureDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create directory '%s': %w", dir, err)
+	}
+	return nil
+}
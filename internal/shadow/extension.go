@@ -0,0 +1,126 @@
+package shadow
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+)
+
+// extension implements the IMAP extensions that go-imap's server does not handle by itself: Gmail's extensions
+// (advertising them, and storing labels with STORE X-GM-LABELS; fetching labels, message IDs & thread IDs is handled
+// by the mailboxes), and NAMESPACE if the backend has a personal namespace prefix.
+type extension struct {
+	namespace string
+}
+
+func (e *extension) Capabilities(server.Conn) []string {
+	if e.namespace != "" {
+		return []string{"X-GM-EXT-1", "NAMESPACE"}
+	}
+	return []string{"X-GM-EXT-1"}
+}
+
+func (e *extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "STORE":
+		return func() server.Handler { return &store{} }
+	case "NAMESPACE":
+		if e.namespace != "" {
+			return func() server.Handler { return &namespace{prefix: e.namespace} }
+		}
+	}
+	return nil
+}
+
+// namespace handles the NAMESPACE command, responding with the personal namespace only.
+type namespace struct {
+	prefix string
+}
+
+func (cmd *namespace) Parse([]any) error {
+	return nil
+}
+
+func (cmd *namespace) Handle(conn server.Conn) error {
+	personal := []any{[]any{cmd.prefix, Delimiter}}
+	return conn.WriteResp(&imap.DataResp{Fields: []any{imap.RawString("NAMESPACE"), personal, nil, nil}})
+}
+
+// store handles the STORE command, storing labels if given X-GM-LABELS items, and flags otherwise.
+type store struct {
+	server.Store
+}
+
+func (cmd *store) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *store) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+func (cmd *store) handle(uid bool, conn server.Conn) error {
+	op, silent, ok := parseLabelsOp(cmd.Item)
+	if !ok && uid {
+		return cmd.Store.UidHandle(conn)
+	} else if !ok {
+		return cmd.Store.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	m, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return server.ErrNoMailboxSelected
+	} else if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	var labels []string
+	if list, ok := cmd.Value.([]any); ok {
+		var err error
+		if labels, err = imap.ParseStringList(list); err != nil {
+			return err
+		}
+	} else if label, err := imap.ParseString(cmd.Value); err != nil {
+		return err
+	} else {
+		labels = []string{label}
+	}
+	if err := m.updateLabels(uid, cmd.SeqSet, op, labels); err != nil {
+		return err
+	} else if silent {
+		return nil
+	}
+
+	// Respond with the updated labels, like Gmail does
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(&responses.Fetch{Messages: ch})
+		for range ch {
+		}
+	}()
+	items := []imap.FetchItem{gmailLabels}
+	if uid {
+		items = append(items, imap.FetchUid)
+	}
+	if err := m.ListMessages(uid, cmd.SeqSet, items, ch); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// parseLabelsOp parses the given STORE item if it stores labels (e.g. "+X-GM-LABELS.SILENT"), returning the operation
+// and whether it is silent.
+func parseLabelsOp(item imap.StoreItem) (op imap.FlagsOp, silent, ok bool) {
+	s := strings.ToUpper(string(item))
+	s, silent = strings.CutSuffix(s, ".SILENT")
+	op = imap.SetFlags
+	if rest, found := strings.CutPrefix(s, "+"); found {
+		op, s = imap.AddFlags, rest
+	} else if rest, found := strings.CutPrefix(s, "-"); found {
+		op, s = imap.RemoveFlags, rest
+	}
+	return op, silent, s == gmailLabels
+}
@@ -0,0 +1,50 @@
+// Package imaptest serves shadow accounts (see shadow.Backend) over local IMAP for tests, so that whole runs (including
+// updates, deduplication & failures) can be exercised without real accounts. Any password is accepted, which is why
+// the server is only available to tests, and never served by the application itself.
+package imaptest
+
+import (
+	"testing"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/shadow"
+)
+
+// Server is a shadow IMAP server, serving the accounts kept in a temporary directory of a test.
+type Server struct {
+	// Addr is the address the server listens on, as "127.0.0.1:port"; connections must not use TLS.
+	Addr string
+	// Dir is the directory the accounts are kept in, one sub-directory per account.
+	Dir string
+	// Backend serves the accounts, and can be used to inspect or seed them without going through IMAP.
+	Backend *shadow.Backend
+}
+
+// Option configures the backend of a Server.
+type Option func(b *shadow.Backend)
+
+// WithNamespace makes the server require the given personal namespace prefix (e.g. "INBOX/") for mailboxes, like
+// generic IMAP servers do, rather than behaving like Gmail.
+func WithNamespace(namespace string) Option {
+	return func(b *shadow.Backend) { b.Namespace = namespace }
+}
+
+// WithMaxMessageSize makes the server reject appended messages larger than the given size (in bytes), like Gmail does.
+func WithMaxMessageSize(size int64) Option {
+	return func(b *shadow.Backend) { b.MaxMessageSize = size }
+}
+
+// NewServer starts serving shadow accounts kept in a new temporary directory of the given test, until it completes.
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	b := shadow.NewBackend(dir)
+	for _, opt := range opts {
+		opt(b)
+	}
+	address, stop, err := shadow.Serve(b, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to serve shadow accounts: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+	return &Server{Addr: address, Dir: dir, Backend: b}
+}
@@ -0,0 +1,588 @@
+package shadow
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	// gmailLabels, gmailMsgID & gmailThreadID are the fetch items of Gmail's IMAP extensions.
+	gmailLabels   = "X-GM-LABELS"
+	gmailMsgID    = "X-GM-MSGID"
+	gmailThreadID = "X-GM-THRID"
+)
+
+// messageIDPattern matches Message-IDs, e.g. in the References & In-Reply-To headers.
+var messageIDPattern = regexp.MustCompile(`<[^<>]+>`)
+
+// message is a message of a mailbox. Its raw content is kept in its Maildir file, except for its header, which is
+// kept in memory for searching.
+type message struct {
+	uid       uint32
+	file      string // name of the message's file in the Maildir's "cur" directory
+	date      time.Time
+	size      uint32
+	flags     []string // sorted
+	labels    []string // sorted
+	header    []byte
+	messageID string
+	threadID  uint64
+}
+
+// mailbox is a mailbox of a shadow account, kept as a Maildir. Its state is guarded by its account's mutex.
+type mailbox struct {
+	u           *user
+	name        string
+	dir         string
+	noSelect    bool // an ancestor of mailboxes, listed but not stored
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*message // by UID
+	byMessageID map[string][]*message
+}
+
+// openMailbox opens the mailbox kept in the given Maildir, creating it if missing.
+func openMailbox(u *user, name, dir string) (*mailbox, error) {
+	for _, sub := range []string{"cur", "new", "tmp", "meta"} {
+		if err := ensureDir(filepath.Join(dir, sub)); err != nil {
+			return nil, err
+		}
+	}
+	m := &mailbox{u: u, name: name, dir: dir, byMessageID: make(map[string][]*message)}
+	var err error
+	if m.uidValidity, m.uidNext, err = m.readUIDs(); err != nil {
+		return nil, err
+	} else if m.uidValidity == 0 {
+		m.uidValidity, m.uidNext = uint32(time.Now().Unix()), 1
+		if err := m.writeUIDs(); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages of mailbox '%s': %w", name, err)
+	}
+	for _, entry := range entries {
+		uid, date, flags, err := parseMessageFileName(entry.Name())
+		if err != nil {
+			slog.Warn("Ignoring unrecognized message file in shadow mailbox", "err", err, "mailbox", name)
+			continue
+		}
+		msg := &message{uid: uid, file: entry.Name(), date: date, flags: flags}
+		if err := m.load(msg); err != nil {
+			return nil, err
+		}
+		m.messages = append(m.messages, msg)
+		m.uidNext = max(m.uidNext, uid+1)
+	}
+	slices.SortFunc(m.messages, func(a, b *message) int { return cmp.Compare(a.uid, b.uid) })
+	for _, msg := range m.messages {
+		m.index(msg)
+	}
+	return m, nil
+}
+
+// load reads the header, size & metadata of the given message from its files.
+func (m *mailbox) load(msg *message) error {
+	f, err := os.Open(filepath.Join(m.dir, "cur", msg.file))
+	if err != nil {
+		return fmt.Errorf("failed to open message %d in '%s': %w", msg.uid, m.name, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat message %d in '%s': %w", msg.uid, m.name, err)
+	}
+	msg.size = uint32(info.Size())
+
+	r := bufio.NewReader(f)
+	var header bytes.Buffer
+	for {
+		line, err := r.ReadBytes('\n')
+		header.Write(line)
+		if err == io.EOF || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read message %d in '%s': %w", msg.uid, m.name, err)
+		}
+	}
+	msg.header = header.Bytes()
+
+	meta, err := m.readMeta(msg.uid)
+	if err != nil {
+		return err
+	}
+	msg.labels = meta.Labels
+	msg.flags = normalizeFlags(append(msg.flags, meta.Keywords...))
+	return nil
+}
+
+// index records the Message-ID of the given message, and assigns it a thread, identified by the first Message-ID of
+// its References header (i.e. the root of its conversation), its In-Reply-To header, or its own Message-ID. Threads
+// therefore don't depend on the order in which messages are appended, unlike Gmail's.
+func (m *mailbox) index(msg *message) {
+	msg.threadID = m.gmailID(msg)
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg.header)))
+	if err != nil {
+		return
+	}
+	msg.messageID = strings.TrimSpace(hdr.Get("Message-Id"))
+	if msg.messageID != "" {
+		m.byMessageID[msg.messageID] = append(m.byMessageID[msg.messageID], msg)
+	}
+	if roots := messageIDPattern.FindAllString(hdr.Get("References")+" "+hdr.Get("In-Reply-To")+" "+msg.messageID, 1); len(roots) > 0 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(roots[0]))
+		msg.threadID = h.Sum64()
+	}
+}
+
+// gmailID returns the Gmail message ID of the given message, unique within the account for as long as the mailbox's
+// UIDVALIDITY is unchanged.
+func (m *mailbox) gmailID(msg *message) uint64 {
+	return uint64(m.uidValidity)<<32 | uint64(msg.uid)
+}
+
+// normalizeFlags returns the given flags sorted & without duplicates, with system flags in canonical form (keywords
+// keep their case, like on Gmail), dropping the session-only \Recent flag.
+func normalizeFlags(flags []string) []string {
+	normalized := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, `\`) {
+			flag = imap.CanonicalFlag(flag)
+		}
+		if flag != imap.RecentFlag {
+			normalized = append(normalized, flag)
+		}
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{Delimiter: Delimiter, Name: m.name}
+	if m.noSelect {
+		info.Attributes = append(info.Attributes, imap.NoSelectAttr)
+	}
+	if attr := defaultMailboxes[m.name]; attr != "" {
+		info.Attributes = append(info.Attributes, attr)
+	}
+	return info, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = []string{imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.SeenFlag, imap.DraftFlag}
+	status.PermanentFlags = append(slices.Clone(status.Flags), `\*`)
+	var unseen uint32
+	for i, msg := range m.messages {
+		if !slices.Contains(msg.flags, imap.SeenFlag) {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+	}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = m.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = m.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(bool) error {
+	return nil
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+// each invokes the given function for each message in the given set of UIDs (or sequence numbers, unless uid is set),
+// in order. Must be called with the mutex held; the function may not remove messages.
+func (m *mailbox) each(uid bool, seqSet *imap.SeqSet, fn func(seqNum uint32, msg *message) error) error {
+	for i, msg := range m.messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.uid
+		}
+		if seqSet.Contains(id) {
+			if err := fn(uint32(i+1), msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	// Messages are fetched from a snapshot, so that the account isn't locked while responses are written
+	type selected struct {
+		seqNum uint32
+		msg    message
+	}
+	m.u.mu.Lock()
+	dir := m.dir
+	var snapshot []selected
+	_ = m.each(uid, seqSet, func(seqNum uint32, msg *message) error {
+		snapshot = append(snapshot, selected{seqNum: seqNum, msg: *msg})
+		return nil
+	})
+	m.u.mu.Unlock()
+
+	for _, s := range snapshot {
+		fetched, err := m.fetch(dir, s.seqNum, &s.msg, items)
+		if err != nil {
+			slog.Warn("Failed to fetch shadow message", "err", err, "mailbox", m.name, "uid", s.msg.uid)
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// fetch returns the given items of the given message, read from the given Maildir if needed.
+func (m *mailbox) fetch(dir string, seqNum uint32, msg *message, items []imap.FetchItem) (*imap.Message, error) {
+	var raw []byte
+	content := func() (textproto.Header, io.Reader, error) {
+		if raw == nil {
+			var err error
+			if raw, err = os.ReadFile(filepath.Join(dir, "cur", msg.file)); err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+		r := bufio.NewReader(bytes.NewReader(raw))
+		hdr, err := textproto.ReadHeader(r)
+		return hdr, r, err
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg.header)))
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, r, err := content()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, r, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = msg.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.date
+		case imap.FetchRFC822Size:
+			fetched.Size = msg.size
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		case gmailLabels:
+			labels := make([]any, len(msg.labels))
+			for i, label := range msg.labels {
+				labels[i] = label
+			}
+			fetched.Items[item] = labels
+		case gmailMsgID:
+			fetched.Items[item] = imap.RawString(strconv.FormatUint(m.gmailID(msg), 10))
+		case gmailThreadID:
+			fetched.Items[item] = imap.RawString(strconv.FormatUint(msg.threadID, 10))
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			hdr, r, err := content()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Body[section], _ = backendutil.FetchBodySection(hdr, r, section)
+		}
+	}
+	return fetched, nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+
+	// Searches by Message-ID (as used to deduplicate messages) are served by the index, rather than by matching the
+	// headers of every message
+	if messageIDs, ok := messageIDTerms(criteria); ok {
+		var ids []uint32
+		for _, messageID := range messageIDs {
+			for _, msg := range m.byMessageID[messageID] {
+				id := msg.uid
+				if !uid {
+					id = uint32(slices.Index(m.messages, msg) + 1)
+				}
+				ids = append(ids, id)
+			}
+		}
+		slices.Sort(ids)
+		return slices.Compact(ids), nil
+	}
+
+	withBody := needsBody(criteria)
+	var ids []uint32
+	for i, msg := range m.messages {
+		raw := msg.header
+		if withBody {
+			var err error
+			if raw, err = os.ReadFile(filepath.Join(m.dir, "cur", msg.file)); err != nil {
+				return nil, fmt.Errorf("failed to read message %d in '%s': %w", msg.uid, m.name, err)
+			}
+		}
+		e, err := gomessage.Read(bytes.NewReader(raw))
+		if err != nil && !gomessage.IsUnknownCharset(err) {
+			continue
+		}
+		if ok, err := backendutil.Match(e, uint32(i+1), msg.uid, msg.date, msg.flags, criteria); err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, uint32(i+1))
+		}
+	}
+	return ids, nil
+}
+
+// messageIDTerms returns the Message-IDs searched for by the given criteria, if it consists of nothing but (OR'd)
+// Message-ID header terms.
+func messageIDTerms(c *imap.SearchCriteria) ([]string, bool) {
+	rest := *c
+	rest.Header, rest.Or = nil, nil
+	if !reflect.ValueOf(rest).IsZero() {
+		return nil, false
+	} else if len(c.Header) == 1 && len(c.Or) == 0 {
+		if values := c.Header.Values("Message-Id"); len(values) == 1 {
+			return values, true
+		}
+	} else if len(c.Header) == 0 && len(c.Or) == 1 {
+		left, ok := messageIDTerms(c.Or[0][0])
+		if !ok {
+			return nil, false
+		}
+		right, ok := messageIDTerms(c.Or[0][1])
+		if !ok {
+			return nil, false
+		}
+		return append(left, right...), true
+	}
+	return nil, false
+}
+
+// needsBody returns true if matching the given criteria requires the messages' bodies, rather than just their headers.
+func needsBody(c *imap.SearchCriteria) bool {
+	if len(c.Body) > 0 || len(c.Text) > 0 || c.Larger > 0 || c.Smaller > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if needsBody(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if needsBody(or[0]) || needsBody(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if limit := m.u.maxMessageSize; limit > 0 && int64(body.Len()) > limit {
+		return fmt.Errorf("[TOOBIG] Message too large (%d bytes, maximum is %d)", body.Len(), limit)
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	_, err = m.append(raw, flags, date, nil)
+	return err
+}
+
+// append stores a new message with the given content, flags, internal date & labels. Must be called with the mutex
+// held.
+func (m *mailbox) append(raw []byte, flags []string, date time.Time, labels []string) (*message, error) {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	msg := &message{
+		uid:    m.uidNext,
+		date:   date,
+		size:   uint32(len(raw)),
+		flags:  normalizeFlags(flags),
+		labels: slices.Clone(labels),
+		header: bytes.Clone(splitHeader(raw)),
+	}
+	msg.file = messageFileName(msg.uid, msg.date, msg.flags)
+
+	// Messages are written to "tmp" first, and then moved to "cur", so that readers never see partial messages
+	tmp := filepath.Join(m.dir, "tmp", msg.file)
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write message to '%s': %w", m.name, err)
+	} else if err := os.Rename(tmp, filepath.Join(m.dir, "cur", msg.file)); err != nil {
+		return nil, fmt.Errorf("failed to write message to '%s': %w", m.name, err)
+	}
+	m.uidNext++
+	if err := m.writeUIDs(); err != nil {
+		return nil, err
+	} else if err := m.writeMeta(msg); err != nil {
+		return nil, err
+	}
+	m.messages = append(m.messages, msg)
+	m.index(msg)
+	return msg, nil
+}
+
+// remove deletes the given message. Must be called with the mutex held.
+func (m *mailbox) remove(msg *message) error {
+	if err := os.Remove(filepath.Join(m.dir, "cur", msg.file)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete message %d of '%s': %w", msg.uid, m.name, err)
+	} else if err := os.Remove(m.metaPath(msg.uid)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete metadata of message %d of '%s': %w", msg.uid, m.name, err)
+	}
+	m.messages = slices.DeleteFunc(m.messages, func(other *message) bool { return other == msg })
+	if msg.messageID != "" {
+		m.byMessageID[msg.messageID] = slices.DeleteFunc(m.byMessageID[msg.messageID], func(other *message) bool { return other == msg })
+		if len(m.byMessageID[msg.messageID]) == 0 {
+			delete(m.byMessageID, msg.messageID)
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	return m.each(uid, seqSet, func(_ uint32, msg *message) error {
+		updated := normalizeFlags(backendutil.UpdateFlags(slices.Clone(msg.flags), op, flags))
+		file := messageFileName(msg.uid, msg.date, updated)
+		if file != msg.file {
+			if err := os.Rename(filepath.Join(m.dir, "cur", msg.file), filepath.Join(m.dir, "cur", file)); err != nil {
+				return fmt.Errorf("failed to update flags of message %d in '%s': %w", msg.uid, m.name, err)
+			}
+		}
+		msg.file, msg.flags = file, updated
+		return m.writeMeta(msg)
+	})
+}
+
+// updateLabels alters the labels of the given messages, like UpdateMessagesFlags does for flags.
+func (m *mailbox) updateLabels(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, labels []string) error {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	return m.each(uid, seqSet, func(_ uint32, msg *message) error {
+		updated := backendutil.UpdateFlags(slices.Clone(msg.labels), op, labels)
+		slices.Sort(updated)
+		msg.labels = slices.Compact(updated)
+		return m.writeMeta(msg)
+	})
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	_, err := m.copyMessages(uid, seqSet, dest)
+	return err
+}
+
+// copyMessages copies the given messages to the given mailbox, returning the copied messages. Must be called with
+// the mutex held.
+func (m *mailbox) copyMessages(uid bool, seqSet *imap.SeqSet, dest string) ([]*message, error) {
+	target, ok := m.u.mailboxes[canonicalName(dest)]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	var copied []*message
+	err := m.each(uid, seqSet, func(_ uint32, msg *message) error {
+		copied = append(copied, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range copied {
+		raw, err := os.ReadFile(filepath.Join(m.dir, "cur", msg.file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message %d in '%s': %w", msg.uid, m.name, err)
+		} else if _, err := target.append(raw, msg.flags, msg.date, msg.labels); err != nil {
+			return nil, err
+		}
+	}
+	return copied, nil
+}
+
+// MoveMessages implements the MOVE extension, by copying the given messages and then deleting them.
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	moved, err := m.copyMessages(uid, seqSet, dest)
+	if err != nil {
+		return err
+	}
+	for _, msg := range moved {
+		if err := m.remove(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mailbox) Expunge() error {
+	m.u.mu.Lock()
+	defer m.u.mu.Unlock()
+	for _, msg := range slices.Clone(m.messages) {
+		if slices.Contains(msg.flags, imap.DeletedFlag) {
+			if err := m.remove(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
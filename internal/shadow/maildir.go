@@ -0,0 +1,145 @@
+package shadow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirFlags maps the flags Maildir represents in file names to their letters; other flags are kept as keywords.
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// messageFileName returns the Maildir file name of the message with the given UID, internal date & flags, e.g.
+// "1700000000.U42.gmail-organizer:2,FS".
+func messageFileName(uid uint32, date time.Time, flags []string) string {
+	var letters []byte
+	for _, flag := range flags {
+		if letter, ok := maildirFlags[flag]; ok {
+			letters = append(letters, letter)
+		}
+	}
+	slices.Sort(letters)
+	return fmt.Sprintf("%d.U%d.gmail-organizer:2,%s", date.Unix(), uid, letters)
+}
+
+// parseMessageFileName parses a file name returned by messageFileName, returning the UID, internal date & Maildir
+// flags of the message.
+func parseMessageFileName(name string) (uint32, time.Time, []string, error) {
+	base, info, _ := strings.Cut(name, ":2,")
+	parts := strings.Split(base, ".")
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "U") {
+		return 0, time.Time{}, nil, fmt.Errorf("unrecognized message file name '%s'", name)
+	}
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, nil, fmt.Errorf("invalid date in message file name '%s': %w", name, err)
+	}
+	uid, err := strconv.ParseUint(parts[1][1:], 10, 32)
+	if err != nil || uid == 0 {
+		return 0, time.Time{}, nil, fmt.Errorf("invalid UID in message file name '%s'", name)
+	}
+	var flags []string
+	for flag, letter := range maildirFlags {
+		if strings.IndexByte(info, letter) >= 0 {
+			flags = append(flags, flag)
+		}
+	}
+	slices.Sort(flags)
+	return uint32(uid), time.Unix(seconds, 0), flags, nil
+}
+
+// messageMeta is what Maildir cannot represent of a message: its labels & keywords (flags other than Maildir's).
+type messageMeta struct {
+	Labels   []string `json:"labels,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// metaPath returns the path of the file holding the metadata of the message with the given UID.
+func (m *mailbox) metaPath(uid uint32) string {
+	return filepath.Join(m.dir, "meta", strconv.FormatUint(uint64(uid), 10)+".json")
+}
+
+// readMeta reads the metadata of the message with the given UID; messages without labels & keywords have none.
+func (m *mailbox) readMeta(uid uint32) (*messageMeta, error) {
+	meta := &messageMeta{}
+	if b, err := os.ReadFile(m.metaPath(uid)); errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of message %d in '%s': %w", uid, m.name, err)
+	} else if err := json.Unmarshal(b, meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of message %d in '%s': %w", uid, m.name, err)
+	}
+	return meta, nil
+}
+
+// writeMeta writes the labels & keywords of the given message, removing its metadata file if it has neither.
+func (m *mailbox) writeMeta(msg *message) error {
+	meta := messageMeta{Labels: msg.labels}
+	for _, flag := range msg.flags {
+		if _, ok := maildirFlags[flag]; !ok {
+			meta.Keywords = append(meta.Keywords, flag)
+		}
+	}
+	path := m.metaPath(msg.uid)
+	if len(meta.Labels) == 0 && len(meta.Keywords) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove metadata of message %d in '%s': %w", msg.uid, m.name, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata of message %d in '%s': %w", msg.uid, m.name, err)
+	} else if err := os.WriteFile(path, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write metadata of message %d in '%s': %w", msg.uid, m.name, err)
+	}
+	return nil
+}
+
+// readUIDs reads the UIDVALIDITY & next UID of the mailbox, returning zeros if they were never written.
+func (m *mailbox) readUIDs() (uidValidity, uidNext uint32, err error) {
+	b, err := os.ReadFile(filepath.Join(m.dir, "uidvalidity"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to read UIDs of mailbox '%s': %w", m.name, err)
+	} else if _, err := fmt.Sscanf(string(bytes.TrimSpace(b)), "%d %d", &uidValidity, &uidNext); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse UIDs of mailbox '%s': %w", m.name, err)
+	}
+	return uidValidity, uidNext, nil
+}
+
+// writeUIDs writes the UIDVALIDITY & next UID of the mailbox, so that UIDs are never reused, even after the messages
+// holding them were expunged.
+func (m *mailbox) writeUIDs() error {
+	content := fmt.Sprintf("%d %d\n", m.uidValidity, m.uidNext)
+	if err := os.WriteFile(filepath.Join(m.dir, "uidvalidity"), []byte(content), 0o600); err != nil {
+		return fmt.Errorf("failed to write UIDs of mailbox '%s': %w", m.name, err)
+	}
+	return nil
+}
+
+// splitHeader returns the header of the given raw message, including the blank line ending it.
+func splitHeader(raw []byte) []byte {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+4]
+	} else if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return raw[:i+2]
+	}
+	return raw
+}
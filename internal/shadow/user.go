@@ -0,0 +1,197 @@
+package shadow
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Delimiter is the hierarchy delimiter of shadow accounts, the same as Gmail's.
+const Delimiter = "/"
+
+// defaultMailboxes are the mailboxes every shadow account has, like a Gmail account, by their special-use attributes.
+var defaultMailboxes = map[string]string{
+	"INBOX":            "",
+	"[Gmail]/All Mail": imap.AllAttr,
+	"[Gmail]/Trash":    imap.TrashAttr,
+}
+
+// user is a shadow account. All of its mailboxes are guarded by its mutex, since they are shared by all connections
+// to the account.
+type user struct {
+	name           string
+	dir            string
+	namespace      string
+	maxMessageSize int64
+	mu             sync.Mutex
+	mailboxes      map[string]*mailbox
+}
+
+// openUser opens the shadow account kept in the given directory, creating it (with its default mailboxes) if missing.
+// The account is subject to the limits of the given backend (namespace & message size).
+func openUser(b *Backend, dir, name string) (*user, error) {
+	if err := ensureDir(dir); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mailboxes of shadow account '%s': %w", name, err)
+	}
+
+	u := &user{name: name, dir: dir, namespace: b.Namespace, maxMessageSize: b.MaxMessageSize, mailboxes: make(map[string]*mailbox)}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		mailboxName, err := unescapeName(entry.Name())
+		if err != nil {
+			slog.Warn("Ignoring unrecognized directory in shadow account", "account", name, "dir", entry.Name())
+			continue
+		}
+		m, err := openMailbox(u, mailboxName, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		u.mailboxes[mailboxName] = m
+	}
+	for name := range defaultMailboxes {
+		if _, ok := u.mailboxes[name]; !ok {
+			if err := u.createMailbox(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	slog.Info("Opened shadow account", "account", name, "dir", dir, "mailboxes", len(u.mailboxes))
+	return u, nil
+}
+
+func (u *user) Username() string {
+	return u.name
+}
+
+// ListMailboxes lists all mailboxes of the account (they are all considered subscribed), along with their missing
+// ancestors as non-selectable mailboxes (e.g. "[Gmail]").
+func (u *user) ListMailboxes(bool) ([]backend.Mailbox, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var mailboxes []backend.Mailbox
+	parents := make(map[string]bool)
+	for name, m := range u.mailboxes {
+		mailboxes = append(mailboxes, m)
+		for i := strings.Index(name, Delimiter); i > 0; i = indexFrom(name, Delimiter, i+len(Delimiter)) {
+			if parent := name[:i]; u.mailboxes[parent] == nil && !parents[parent] {
+				parents[parent] = true
+				mailboxes = append(mailboxes, &mailbox{u: u, name: parent, noSelect: true})
+			}
+		}
+	}
+	slices.SortFunc(mailboxes, func(a, b backend.Mailbox) int { return strings.Compare(a.Name(), b.Name()) })
+	return mailboxes, nil
+}
+
+// indexFrom returns the index of the given substring in s, starting at the given index, or -1 if not found.
+func indexFrom(s, substr string, from int) int {
+	if i := strings.Index(s[from:], substr); i >= 0 {
+		return from + i
+	}
+	return -1
+}
+
+// canonicalName returns the canonical name of the given mailbox name: INBOX is case-insensitive.
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if m, ok := u.mailboxes[canonicalName(name)]; ok {
+		return m, nil
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *user) CreateMailbox(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	name = canonicalName(name)
+	if !strings.HasPrefix(name, u.namespace) && name != "INBOX" {
+		return fmt.Errorf("mailbox '%s' is outside the personal namespace '%s'", name, u.namespace)
+	}
+	return u.createMailbox(name)
+}
+
+// createMailbox creates a new, empty mailbox of the given name. Must be called with the mutex held.
+func (u *user) createMailbox(name string) error {
+	if name == "" || strings.HasSuffix(name, Delimiter) {
+		return fmt.Errorf("invalid mailbox name '%s'", name)
+	} else if _, ok := u.mailboxes[name]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+	m, err := openMailbox(u, name, filepath.Join(u.dir, escapeName(name)))
+	if err != nil {
+		return err
+	}
+	u.mailboxes[name] = m
+	return nil
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	name = canonicalName(name)
+	m, ok := u.mailboxes[name]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	} else if _, ok := defaultMailboxes[name]; ok {
+		return errors.New("cannot delete system mailbox")
+	}
+	if err := os.RemoveAll(m.dir); err != nil {
+		return fmt.Errorf("failed to delete mailbox '%s': %w", name, err)
+	}
+	delete(u.mailboxes, name)
+	return nil
+}
+
+// RenameMailbox renames the given mailbox, along with its descendants (like Gmail does for nested labels).
+func (u *user) RenameMailbox(existingName, newName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	existingName, newName = canonicalName(existingName), canonicalName(newName)
+	if _, ok := u.mailboxes[existingName]; !ok {
+		return backend.ErrNoSuchMailbox
+	} else if _, ok := defaultMailboxes[existingName]; ok {
+		return errors.New("cannot rename system mailbox")
+	} else if _, ok := u.mailboxes[newName]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+	for name, m := range u.mailboxes {
+		if name != existingName && !strings.HasPrefix(name, existingName+Delimiter) {
+			continue
+		}
+		renamed := newName + strings.TrimPrefix(name, existingName)
+		dir := filepath.Join(u.dir, escapeName(renamed))
+		if err := os.Rename(m.dir, dir); err != nil {
+			return fmt.Errorf("failed to rename mailbox '%s' to '%s': %w", name, renamed, err)
+		}
+		delete(u.mailboxes, name)
+		m.name, m.dir = renamed, dir
+		u.mailboxes[renamed] = m
+	}
+	return nil
+}
+
+func (u *user) Logout() error {
+	return nil
+}
@@ -0,0 +1,175 @@
+package spool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/compress"
+)
+
+const fileExtension = ".eml.zst"
+
+// Spool keeps the bodies of messages fetched from the source account, but not yet appended to the target account,
+// zstd-compressed on local disk. Bodies are spooled before appending them and removed once appended, so bodies of
+// messages that failed to append (e.g. during a target-side outage) need not be downloaded again by later attempts,
+// or by later runs. The total (compressed) size of the spool is capped; bodies that don't fit are not spooled. A nil
+// Spool is valid; it holds nothing, and discards all bodies.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+	size     int64
+}
+
+// Open opens the spool in the given directory, creating it if necessary, and keeping bodies spooled by previous runs.
+// If the directory is empty, nil is returned.
+func Open(dir string, maxBytes int64) (*Spool, error) {
+	if dir == "" {
+		return nil, nil
+	} else if maxBytes <= 0 {
+		return nil, fmt.Errorf("spool size must be positive")
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory '%s': %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory '%s': %w", dir, err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+	bodies := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		} else if strings.HasSuffix(entry.Name(), ".tmp") {
+			// Leftover of a crash while spooling
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+		} else if info, err := entry.Info(); err == nil && strings.HasSuffix(entry.Name(), fileExtension) {
+			s.size += info.Size()
+			bodies++
+		}
+	}
+	if bodies > 0 {
+		slog.Info("Found message bodies spooled by a previous run", "dir", dir, "bodies", bodies, "bytes", s.size)
+	}
+	return s, nil
+}
+
+// path returns the path of the spooled body of the message with the given key (e.g. its Message-ID).
+func (s *Spool) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+fileExtension)
+}
+
+// Has returns true if the body of the message with the given key is spooled.
+func (s *Spool) Has(key string) bool {
+	if s == nil {
+		return false
+	}
+	_, err := os.Stat(s.path(key))
+	return err == nil
+}
+
+// Put spools the body read from the given reader for the message with the given key, replacing any previously
+// spooled body. Returns false (and no error) if the spool has no room for it.
+func (s *Spool) Put(key string, r io.Reader) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+
+	f, err := os.CreateTemp(s.dir, "body-*.tmp")
+	if err != nil {
+		return false, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	w, err := compress.NewWriter(f, compress.Zstd)
+	if err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = f.Close()
+		return false, fmt.Errorf("failed to spool body: %w", err)
+	} else if err := w.Close(); err != nil {
+		_ = f.Close()
+		return false, fmt.Errorf("failed to spool body: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return false, fmt.Errorf("failed to stat spool file: %w", err)
+	} else if err := f.Close(); err != nil {
+		return false, fmt.Errorf("failed to spool body: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(key)
+	var replaced int64
+	if existing, err := os.Stat(path); err == nil {
+		replaced = existing.Size()
+	}
+	if s.size-replaced+info.Size() > s.maxBytes {
+		return false, nil
+	} else if err := os.Rename(f.Name(), path); err != nil {
+		return false, fmt.Errorf("failed to spool body: %w", err)
+	}
+	s.size += info.Size() - replaced
+	return true, nil
+}
+
+// Open returns a reader of the (decompressed) spooled body of the message with the given key.
+func (s *Spool) Open(key string) (io.ReadCloser, error) {
+	if s == nil {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spooled body: %w", err)
+	}
+	r, err := compress.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &spooledBody{ReadCloser: r, file: f}, nil
+}
+
+// Remove removes the spooled body of the message with the given key, if any.
+func (s *Spool) Remove(key string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(key)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat spooled body: %w", err)
+	} else if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove spooled body: %w", err)
+	}
+	s.size -= info.Size()
+	return nil
+}
+
+// spooledBody is a decompressing reader of a spool file, closing the file when closed.
+type spooledBody struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b *spooledBody) Close() error {
+	_ = b.ReadCloser.Close()
+	return b.file.Close()
+}
@@ -0,0 +1,235 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Label is the state of a single source label as of the run that recorded it.
+type Label struct {
+	Messages uint32 `json:"messages"`
+	// Fingerprint identifies the set of messages in the label (regardless of its name), so a label whose messages did
+	// not change can be recognized after it was renamed.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ruleHistoryLimit is the number of most recent runs kept in the history of each organization rule.
+const ruleHistoryLimit = 100
+
+// Rule is the state of a single organization rule, across the runs that applied it.
+type Rule struct {
+	// ActedRuns is the number of runs in which the rule's actions were applied to any messages.
+	ActedRuns int `json:"actedRuns"`
+	// History are the most recent runs of the rule, oldest first.
+	History []RuleRun `json:"history,omitempty"`
+}
+
+// RuleRun is the outcome of a single run of an organization rule.
+type RuleRun struct {
+	Time time.Time `json:"time"`
+	// Matched is the number of messages matching the rule.
+	Matched int `json:"matched"`
+	// Acted is the number of messages the rule's actions were applied to (fewer than matched while ramping up).
+	Acted int `json:"acted"`
+}
+
+// AddRun adds the given run to the rule's history, forgetting the oldest runs beyond the history limit.
+func (r *Rule) AddRun(run RuleRun) {
+	if run.Acted > 0 {
+		r.ActedRuns++
+	}
+	r.History = append(r.History, run)
+	if len(r.History) > ruleHistoryLimit {
+		r.History = slices.Clone(r.History[len(r.History)-ruleHistoryLimit:])
+	}
+}
+
+// data is the persisted content of a store.
+type data struct {
+	Updated time.Time        `json:"updated"`
+	Labels  map[string]Label `json:"labels"`
+	// TargetUIDs are the UIDs of migrated messages in the target account's default mailbox, keyed by their source
+	// Gmail message ID (X-GM-MSGID), as of the mailbox's TargetUIDValidity.
+	TargetUIDs        map[string]uint32 `json:"targetUids,omitempty"`
+	TargetUIDValidity uint32            `json:"targetUidValidity,omitempty"`
+	// Rules are the states of organization rules, keyed by their names.
+	Rules map[string]Rule `json:"rules,omitempty"`
+}
+
+// Store persists state across runs in a JSON file, e.g. the labels seen by the previous run. A nil Store is valid; it
+// holds no state, and silently discards updates.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	data  data
+	dirty bool // whether target UIDs changed since the store was last saved
+}
+
+// Open opens the store persisted in the given file path, which need not exist yet. If the path is empty, nil is
+// returned.
+func Open(path string) (*Store, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s := &Store{path: path, data: data{Labels: make(map[string]Label), TargetUIDs: make(map[string]uint32), Rules: make(map[string]Rule)}}
+	if content, err := os.ReadFile(path); errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file '%s': %w", path, err)
+	} else if err := json.Unmarshal(content, &s.data); err != nil {
+		return nil, fmt.Errorf("failed to parse state file '%s': %w", path, err)
+	}
+	if s.data.Labels == nil {
+		s.data.Labels = make(map[string]Label)
+	}
+	if s.data.TargetUIDs == nil {
+		s.data.TargetUIDs = make(map[string]uint32)
+	}
+	if s.data.Rules == nil {
+		s.data.Rules = make(map[string]Rule)
+	}
+	return s, nil
+}
+
+// Labels returns the labels recorded by the previous run, by name.
+func (s *Store) Labels() map[string]Label {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.data.Labels)
+}
+
+// SetLabels replaces the recorded labels with the given ones, and persists the store.
+func (s *Store) SetLabels(labels map[string]Label) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Labels = maps.Clone(labels)
+	return s.save()
+}
+
+// Rule returns the recorded state of the organization rule of the given name (zero if none was recorded).
+func (s *Store) Rule(name string) Rule {
+	if s == nil {
+		return Rule{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Rules[name]
+}
+
+// Rules returns the recorded states of all organization rules, by name.
+func (s *Store) Rules() map[string]Rule {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.data.Rules)
+}
+
+// SetRule records the state of the organization rule of the given name, and persists the store.
+func (s *Store) SetRule(name string, rule Rule) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Rules[name] = rule
+	return s.save()
+}
+
+// ValidateTargetUIDs forgets all recorded target UIDs if the given UIDVALIDITY of the target mailbox differs from the
+// one they were recorded under (UIDs of different UIDVALIDITY values identify different messages). Returns the number
+// of forgotten UIDs.
+func (s *Store) ValidateTargetUIDs(uidValidity uint32) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.TargetUIDValidity == uidValidity {
+		return 0
+	}
+	forgotten := len(s.data.TargetUIDs)
+	s.data.TargetUIDs = make(map[string]uint32)
+	s.data.TargetUIDValidity = uidValidity
+	s.dirty = true
+	return forgotten
+}
+
+// TargetUID returns the recorded target UID of the message with the given source Gmail message ID, or 0 if unknown.
+func (s *Store) TargetUID(gmailMessageID uint64) uint32 {
+	if s == nil || gmailMessageID == 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.TargetUIDs[strconv.FormatUint(gmailMessageID, 10)]
+}
+
+// SetTargetUID records the target UID of the message with the given source Gmail message ID; a zero UID forgets it.
+// Unlike labels, target UIDs are only persisted by Save, since they change with every migrated message.
+func (s *Store) SetTargetUID(gmailMessageID uint64, uid uint32) {
+	if s == nil || gmailMessageID == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatUint(gmailMessageID, 10)
+	if uid == 0 {
+		delete(s.data.TargetUIDs, key)
+	} else {
+		s.data.TargetUIDs[key] = uid
+	}
+	s.dirty = true
+}
+
+// Save persists the store, if target UIDs changed since it was last saved.
+func (s *Store) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the store to its file, replacing it atomically so a crash never leaves a partially written file.
+func (s *Store) save() error {
+	s.data.Updated = time.Now().UTC()
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	} else if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	} else if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file '%s': %w", s.path, err)
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package sync plans the synchronization of account structure (e.g. labels) from a source account to a target
+// account.
+package sync
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/arikkfir-org/gmail-organizer/internal/gcp"
+)
+
+// MailboxPlanner plans the creation of the mailboxes (labels) of a source account that are missing in a target
+// account. Mailbox names are label paths, delimited by gcp.LabelDelimiter.
+type MailboxPlanner struct {
+	// Exclude, if set, excludes source mailboxes from the plan (e.g. labels internal to this application). Parents
+	// of planned mailboxes are never excluded.
+	Exclude func(name string) bool
+}
+
+// MailboxPlan is the set of mailboxes to create in a target account.
+type MailboxPlan struct {
+	// Create are the mailboxes to create, with parents before their children.
+	Create []string
+	// Parents are the mailboxes in Create that are missing parents of other mailboxes, rather than source mailboxes.
+	Parents []string
+	// Existing is the number of source mailboxes already present in the target account.
+	Existing int
+}
+
+// Plan diffs the given source mailboxes against the given target mailboxes, and returns the mailboxes to create in
+// the target: source mailboxes missing in the target, along with any of their missing parents (which not all servers
+// create implicitly, and which may be absent from the source list, e.g. when it only lists selectable mailboxes).
+func (p *MailboxPlanner) Plan(source, target []string) *MailboxPlan {
+	existing := make(map[string]bool, len(target))
+	for _, name := range target {
+		existing[name] = true
+	}
+
+	plan := &MailboxPlan{}
+	planned := make(map[string]bool)
+	sourceNames := make(map[string]bool, len(source))
+	for _, name := range source {
+		sourceNames[name] = true
+	}
+	for _, name := range source {
+		if p.Exclude != nil && p.Exclude(name) {
+			continue
+		} else if existing[name] {
+			plan.Existing++
+			continue
+		}
+		for _, mailbox := range append(parents(name), name) {
+			if !existing[mailbox] && !planned[mailbox] {
+				planned[mailbox] = true
+				plan.Create = append(plan.Create, mailbox)
+				if !sourceNames[mailbox] {
+					plan.Parents = append(plan.Parents, mailbox)
+				}
+			}
+		}
+	}
+
+	// Parents before children, and otherwise alphabetically for a stable plan
+	slices.SortFunc(plan.Create, func(a, b string) int {
+		return cmp.Or(cmp.Compare(depth(a), depth(b)), cmp.Compare(a, b))
+	})
+	slices.Sort(plan.Parents)
+	return plan
+}
+
+// parents returns the ancestors of the given label path, from the top-most down.
+func parents(name string) []string {
+	var result []string
+	for i, c := range name {
+		if string(c) == gcp.LabelDelimiter && i > 0 {
+			result = append(result, name[:i])
+		}
+	}
+	return result
+}
+
+// depth returns the number of ancestors of the given label path.
+func depth(name string) int {
+	return strings.Count(strings.Trim(name, gcp.LabelDelimiter), gcp.LabelDelimiter)
+}
@@ -0,0 +1,122 @@
+package version
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// LatestReleaseURL is the GitHub API endpoint describing the latest release.
+	LatestReleaseURL = "https://api.github.com/repos/arikkfir-org/gmail-organizer/releases/latest"
+
+	// KnownBadVersionsURL points at the list of versions that must not be used (e.g. due to duplicate-append bugs),
+	// maintained in the repository's main branch so that it applies to already-released binaries as well.
+	KnownBadVersionsURL = "https://raw.githubusercontent.com/arikkfir-org/gmail-organizer/main/known-bad-versions.json"
+)
+
+// KnownBadVersion is a released version that should not be used, along with the reason.
+type KnownBadVersion struct {
+	Version string `json:"version"`
+	Reason  string `json:"reason"`
+}
+
+// CheckResult is the outcome of checking the running version against the published releases.
+type CheckResult struct {
+	Current         string `json:"current"`
+	Latest          string `json:"latest"`
+	UpdateAvailable bool   `json:"updateAvailable"`
+	KnownBad        bool   `json:"knownBad"`
+	KnownBadReason  string `json:"knownBadReason,omitempty"`
+}
+
+// Check queries the release endpoints for the latest release and the list of known-bad versions, and compares them
+// with the running version.
+func Check(ctx context.Context, client *http.Client) (*CheckResult, error) {
+	result := &CheckResult{Current: Version}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := getJSON(ctx, client, LatestReleaseURL, &release); err != nil {
+		return nil, fmt.Errorf("failed to query latest release: %w", err)
+	}
+	result.Latest = release.TagName
+	result.UpdateAvailable = Version != "dev" && release.TagName != "" && compareVersions(release.TagName, Version) > 0
+
+	var knownBad []KnownBadVersion
+	if err := getJSON(ctx, client, KnownBadVersionsURL, &knownBad); err != nil {
+		return nil, fmt.Errorf("failed to query known-bad versions: %w", err)
+	}
+	for _, v := range knownBad {
+		if compareVersions(v.Version, Version) == 0 {
+			result.KnownBad = true
+			result.KnownBadReason = v.Reason
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "gmail-organizer/"+Version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status from '%s': %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response from '%s': %w", url, err)
+	}
+	return nil
+}
+
+// compareVersions compares two "vMAJOR.MINOR.PATCH" versions (the "v" prefix and pre-release suffixes are ignored),
+// returning -1, 0 or 1. Versions that are not in this form (e.g. commit SHAs) are only considered equal or not.
+func compareVersions(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		if strings.TrimPrefix(a, "v") == strings.TrimPrefix(b, "v") {
+			return 0
+		}
+		return 1
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] > pb[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	fields := strings.Split(v, ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}